@@ -10,6 +10,9 @@ import { StdioServerTransport } from '@modelcontextprotocol/sdk/server/stdio.js'
 import { ErrorCode, McpError } from '@modelcontextprotocol/sdk/types.js';
 import { InMemoryTaskStore, InMemoryTaskMessageQueue } from '@modelcontextprotocol/sdk/experimental/tasks/stores/in-memory.js';
 import { createRequire } from 'node:module';
+import { AsyncLocalStorage } from 'node:async_hooks';
+import { createHash, randomBytes } from 'node:crypto';
+import readline from 'node:readline';
 
 const require = createRequire(import.meta.url);
 const PKG_META: { version: string; name: string; repoUrl?: string } = (() => {
@@ -46,7 +49,7 @@ type TmuxWindow = {
   flags: string;
 };
 
-type TmuxPane = {
+export type TmuxPane = {
   session: string;
   window: string;
   id: string;
@@ -61,22 +64,52 @@ const tmuxBinary = process.env.TMUX_BIN || 'tmux';
 const tmuxFallbackPaths = ['/opt/homebrew/bin', '/usr/local/bin', '/usr/bin'];
 const extraPath = tmuxFallbackPaths.join(':');
 const tmuxCommandTimeoutMs = Number(process.env.MCP_TMUX_TIMEOUT_MS ?? '15000');
+const hostConcurrency = Number(process.env.MCP_TMUX_HOST_CONCURRENCY ?? '8');
+// Run local targeted commands over one persistent control-mode client (tmux -C) instead of a process per call.
+const controlModeEnabled = /^(1|true|yes)$/i.test(process.env.MCP_TMUX_CONTROL_MODE ?? '');
+// Start the tmux server and retry once when a call fails with "no server running" (fresh hosts, after reboots).
+const autoStartServer = /^(1|true|yes)$/i.test(process.env.MCP_TMUX_AUTO_START_SERVER ?? '');
+// Upper bound on any background task's lifetime, however it was configured (0 = unbounded).
+const maxTaskDurationMs = Number(process.env.MCP_TMUX_MAX_TASK_DURATION_MS ?? '0');
+// Highest history-limit tmux_history_limit may raise the global option to (every new pane keeps that many lines).
+const maxHistoryLimit = Number(process.env.MCP_TMUX_MAX_HISTORY_LIMIT ?? '100000');
+// Monitoring-only deployments: refuse every tool that changes tmux or server state; reads keep working.
+const readOnlyMode = /^(1|true|yes)$/i.test(process.env.MCP_TMUX_READ_ONLY ?? '');
+// Which pane a session- or window-only target means (first, active, or last pane); unset leaves it to tmux.
+const defaultPaneStrategy = parsePaneStrategy(process.env.MCP_TMUX_PANE_STRATEGY);
+// Whether tmux_capture_pane strips colour escapes when a call does not say (set 0 to keep colour by default).
+const stripAnsiDefault = !/^(0|false|no)$/i.test(process.env.MCP_TMUX_STRIP_ANSI ?? '');
+// Backoff suggested to clients in the Eof line of a task the server ended (0 = no hint).
+const taskRetryAfterMs = Number(process.env.MCP_TMUX_TASK_RETRY_AFTER_MS ?? '1000');
+// How long tasks keep retrying a capture that fails transiently before giving up (0 = retry once).
+const taskRetryGraceMs = Number(process.env.MCP_TMUX_TASK_RETRY_GRACE_MS ?? '0');
+// ssh keepalives so dropped connections fail fast instead of stalling long-running polls (0 disables).
+const sshAliveIntervalSec = Number(process.env.MCP_TMUX_SSH_ALIVE_INTERVAL ?? '15');
+const sshAliveCountMax = Number(process.env.MCP_TMUX_SSH_ALIVE_COUNT ?? '3');
 const hostProfilePath =
   process.env.MCP_TMUX_HOSTS_FILE ||
   path.join(process.env.HOME || process.cwd(), '.config', 'mcp-tmux', 'hosts.json');
 const logBaseDir =
   process.env.MCP_TMUX_LOG_DIR || path.join(process.env.HOME || process.cwd(), '.config', 'mcp-tmux', 'logs');
 const layoutProfilePath = path.join(process.env.HOME || process.cwd(), '.config', 'mcp-tmux', 'layouts.json');
+const macroPath = path.join(process.env.HOME || process.cwd(), '.config', 'mcp-tmux', 'macros.json');
+const hostDefaultsPath = path.join(process.env.HOME || process.cwd(), '.config', 'mcp-tmux', 'defaults.json');
+// Size-based rotation for log files (0 = unbounded). Rotated files are kept as .1 (newest) .. .N.
+const logMaxBytes = Number(process.env.MCP_TMUX_LOG_MAX_MB ?? '0') * 1024 * 1024;
+const logKeepFiles = Number(process.env.MCP_TMUX_LOG_KEEP ?? '3');
 const defaultCapturePageSizes = [20, 100, 400]; // incremental paging budget
 const defaultMaxPages = 3;
-let hostProfiles: Record<
-  string,
-  {
-    pathAdd?: string[];
-    tmuxBin?: string;
-    defaultSession?: string;
-  }
-> = {};
+type HostProfile = {
+  pathAdd?: string[];
+  tmuxBin?: string;
+  defaultSession?: string;
+  sockets?: string[];
+  socketPolicy?: SocketPolicy;
+  commandWrapper?: string;
+};
+let hostProfiles: Record<string, HostProfile> = {};
+let macros = new Map<string, MacroDefinition>();
+let hostDefaults: Record<string, HostDefaults> = {};
 let layoutProfiles: Record<
   string,
   {
@@ -95,6 +128,205 @@ const defaultTargetNote = () =>
   }`;
 const isoTimestamp = () => new Date().toISOString();
 
+type SpanAttributes = Record<string, string | number | boolean>;
+
+export type FinishedSpan = {
+  traceId: string;
+  spanId: string;
+  parentSpanId?: string;
+  name: string;
+  kind: 'server' | 'client' | 'internal';
+  startMs: number;
+  endMs: number;
+  attributes: SpanAttributes;
+  error?: string;
+};
+
+export type SpanExporter = { export: (spans: FinishedSpan[]) => void };
+
+// Per-call context carried across awaits (the active span, so tmux invocations nest under their tool call).
+type RequestContext = {
+  traceId?: string;
+  spanId?: string;
+  requestId?: string;
+  serverStarts?: string[];
+  hostOverride?: HostOverride;
+  // Probes that must not have side effects, even with MCP_TMUX_AUTO_START_SERVER.
+  noServerStart?: boolean;
+};
+const requestContext = new AsyncLocalStorage<RequestContext>();
+
+// Opt-in tracing: spans are exported as OTLP/HTTP JSON when MCP_TMUX_OTLP_ENDPOINT is set
+// (e.g. http://localhost:4318/v1/traces).
+function createOtlpExporter(endpoint: string): SpanExporter {
+  let pending: FinishedSpan[] = [];
+  let timer: NodeJS.Timeout | undefined;
+  let warned = false;
+  const attr = (attributes: SpanAttributes) =>
+    Object.entries(attributes).map(([key, v]) => ({
+      key,
+      value: typeof v === 'number' ? { doubleValue: v } : typeof v === 'boolean' ? { boolValue: v } : { stringValue: v },
+    }));
+  const flush = async () => {
+    timer = undefined;
+    const spans = pending;
+    pending = [];
+    const body = {
+      resourceSpans: [
+        {
+          resource: { attributes: attr({ 'service.name': 'mcp-tmux', 'service.version': VERSION }) },
+          scopeSpans: [
+            {
+              scope: { name: PACKAGE_NAME, version: VERSION },
+              spans: spans.map((sp) => ({
+                traceId: sp.traceId,
+                spanId: sp.spanId,
+                parentSpanId: sp.parentSpanId,
+                name: sp.name,
+                kind: sp.kind === 'server' ? 2 : sp.kind === 'client' ? 3 : 1,
+                startTimeUnixNano: `${sp.startMs}000000`,
+                endTimeUnixNano: `${sp.endMs}000000`,
+                attributes: attr(sp.attributes),
+                status: sp.error ? { code: 2, message: sp.error } : { code: 1 },
+              })),
+            },
+          ],
+        },
+      ],
+    };
+    try {
+      await fetch(endpoint, { method: 'POST', headers: { 'content-type': 'application/json' }, body: JSON.stringify(body) });
+    } catch (error) {
+      if (!warned) console.warn(`Failed to export spans to ${endpoint}:`, error);
+      warned = true;
+    }
+  };
+  return {
+    export(spans) {
+      pending.push(...spans);
+      if (pending.length >= 100) {
+        void flush();
+      } else if (!timer) {
+        timer = setTimeout(() => void flush(), 2000);
+        timer.unref();
+      }
+    },
+  };
+}
+
+let spanExporter: SpanExporter | undefined = process.env.MCP_TMUX_OTLP_ENDPOINT
+  ? createOtlpExporter(process.env.MCP_TMUX_OTLP_ENDPOINT)
+  : undefined;
+
+export function setSpanExporter(exporter: SpanExporter | undefined) {
+  spanExporter = exporter;
+}
+
+export function createInMemorySpanExporter() {
+  const spans: FinishedSpan[] = [];
+  return { spans, export: (finished: FinishedSpan[]) => void spans.push(...finished) };
+}
+
+export async function withSpan<T>(
+  name: string,
+  kind: FinishedSpan['kind'],
+  attributes: SpanAttributes,
+  fn: () => Promise<T>,
+): Promise<T> {
+  const exporter = spanExporter;
+  if (!exporter) return fn();
+  const parent = requestContext.getStore();
+  const span: FinishedSpan = {
+    traceId: parent?.traceId ?? randomBytes(16).toString('hex'),
+    spanId: randomBytes(8).toString('hex'),
+    parentSpanId: parent?.spanId,
+    name,
+    kind,
+    startMs: Date.now(),
+    endMs: 0,
+    attributes,
+  };
+  try {
+    return await requestContext.run({ ...parent, traceId: span.traceId, spanId: span.spanId }, fn);
+  } catch (error) {
+    span.error = error instanceof Error ? error.message : String(error);
+    throw error;
+  } finally {
+    span.endMs = Date.now();
+    exporter.export([span]);
+  }
+}
+
+type ToolHandler = (...args: any[]) => unknown;
+
+// Clients correlate their own logs by sending `x-request-id` in the request `_meta`; otherwise we mint one.
+export function requestIdFromMeta(meta: Record<string, unknown> | undefined) {
+  const supplied = meta?.['x-request-id'];
+  if (typeof supplied === 'string' && supplied.trim()) return supplied.trim().slice(0, 128);
+  return randomBytes(8).toString('hex');
+}
+
+export function currentRequestId() {
+  return requestContext.getStore()?.requestId;
+}
+
+export type StatCounter = 'toolCalls' | 'toolErrors' | 'tmuxSpawns' | 'controlCommands' | 'cacheHits' | 'cacheMisses';
+
+export type ServerStats = Record<StatCounter, number> & { activeTasks: number; uptimeMs: number };
+
+// In-process counters for tmux_stats, for clients with no metrics pipeline. Counts reset when the server restarts.
+export function createStats(now = Date.now) {
+  const startedAt = now();
+  const counts: Record<StatCounter, number> = {
+    toolCalls: 0,
+    toolErrors: 0,
+    tmuxSpawns: 0,
+    controlCommands: 0,
+    cacheHits: 0,
+    cacheMisses: 0,
+  };
+  return {
+    bump(counter: StatCounter) {
+      counts[counter]++;
+    },
+    snapshot(activeTasks = 0): ServerStats {
+      return { ...counts, activeTasks, uptimeMs: now() - startedAt };
+    },
+  };
+}
+
+export const serverStats = createStats();
+
+// Wraps every registered tool handler; this is the single place for cross-cutting per-call behavior.
+export function instrumentTool(name: string, handler: ToolHandler): ToolHandler {
+  return (...args: any[]) => {
+    const input = args[0] as { host?: unknown } | undefined;
+    // Handlers receive (input, extra), or just (extra) when the tool has no input schema.
+    const extra = args[args.length - 1] as { _meta?: Record<string, unknown> } | undefined;
+    const host = typeof input?.host === 'string' ? input.host : defaultHost ?? 'local';
+    const requestId = requestIdFromMeta(extra?._meta);
+    const hostOverride = hostOverrideFromMeta(extra?._meta);
+    const serverStarts: string[] = [];
+    return requestContext.run({ ...requestContext.getStore(), requestId, serverStarts, hostOverride }, () =>
+      withSpan(
+        `tool ${name}`,
+        'server',
+        { 'mcp.tool': name, 'mcp.request_id': requestId, 'tmux.host': host },
+        async () => {
+          serverStats.bump('toolCalls');
+          try {
+            assertToolAllowed(name, args.length > 1 ? (input as Record<string, unknown>) : undefined);
+            return withServerStartNote((await handler(...args)) as { content?: unknown[] }, serverStarts);
+          } catch (error) {
+            serverStats.bump('toolErrors');
+            throw error;
+          }
+        },
+      ),
+    );
+  };
+}
+
 const instructions = `
 You are connected to a tmux MCP server. Use these tools to collaborate with a human inside tmux.
 
@@ -129,40 +361,518 @@ function shQuote(arg: string) {
   return `'${arg.replace(/'/g, `'\\''`)}'`;
 }
 
+export function buildSshArgs(host: string, remoteArgs: string[], aliveInterval = sshAliveIntervalSec, aliveCount = sshAliveCountMax) {
+  const args = ['-T'];
+  if (aliveInterval > 0) {
+    args.push('-o', `ServerAliveInterval=${aliveInterval}`, '-o', `ServerAliveCountMax=${aliveCount}`);
+  }
+  return [...args, host, ...remoteArgs];
+}
+
+// Resolve the process to spawn for a tmux invocation (local binary, or ssh to a host with the tmux command
+// base64-wrapped so the remote shell does not mangle it).
+export function tmuxInvocation(args: string[], host?: string) {
+  assertValidHost(host);
+  const hostConfig = getHostProfile(host);
+  const bin = hostConfig?.tmuxBin || tmuxBinary;
+  const pathAdd = hostConfig?.pathAdd ?? [];
+  const basePath = buildPath(process.env.PATH, [...tmuxFallbackPaths, ...pathAdd]);
+
+  if (host) {
+    // Build a single remote command string and base64-encode it to avoid shell comment parsing (#).
+    const commandStr = `PATH=${shQuote(basePath)} exec ${[bin, ...args].map(shQuote).join(' ')}`;
+    const b64 = Buffer.from(commandStr, 'utf8').toString('base64');
+    const remoteCmd = `printf %s ${shQuote(b64)} | base64 -d | sh`;
+    return { file: 'ssh', args: buildSshArgs(host, [remoteCmd]), env: undefined };
+  }
+  return { file: bin, args, env: { ...process.env, PATH: basePath } };
+}
+
+// Limits concurrent calls per key, queueing the rest in FIFO order. A limit of 0 disables limiting.
+export function createKeyedLimiter(limit: number) {
+  const active = new Map<string, number>();
+  const waiting = new Map<string, (() => void)[]>();
+  const release = (key: string) => {
+    const next = waiting.get(key)?.shift();
+    if (next) return next(); // hand the slot straight to the next waiter
+    const count = (active.get(key) ?? 1) - 1;
+    if (count > 0) active.set(key, count);
+    else active.delete(key);
+    waiting.delete(key);
+  };
+  return async function run<T>(key: string, fn: () => Promise<T>): Promise<T> {
+    if (limit <= 0) return fn();
+    if ((active.get(key) ?? 0) < limit) {
+      active.set(key, (active.get(key) ?? 0) + 1);
+    } else {
+      await new Promise<void>((resolve) => {
+        const queue = waiting.get(key) ?? [];
+        queue.push(resolve);
+        waiting.set(key, queue);
+      });
+    }
+    try {
+      return await fn();
+    } finally {
+      release(key);
+    }
+  };
+}
+
+// Protects remote hosts (and local fds) from bursts of ssh connections; local tmux calls are not limited.
+const hostLimiter = createKeyedLimiter(hostConcurrency);
+
+function limitHost<T>(host: string | undefined, fn: () => Promise<T>) {
+  return host ? hostLimiter(host, fn) : fn();
+}
+
+// Serializes writes per pane so concurrent clients sharing a pane cannot interleave keystrokes. Targets are keyed
+// by the pane id they resolve to, so `%3` and `dev:0.1` naming the same pane share one queue; a target that cannot
+// be resolved keeps its own string (its write will fail anyway). Reads are unaffected.
+export function createPaneWriteQueue(
+  resolvePaneId: (target: string, host?: string) => Promise<string> = (target, host) =>
+    runTmux(['display-message', '-p', '-t', target, '#{pane_id}'], host),
+) {
+  const limiter = createKeyedLimiter(1);
+  return async <T>(target: string, host: string | undefined, fn: () => Promise<T>) => {
+    const id = target.startsWith('%')
+      ? target
+      : (await resolvePaneId(target, host).then((out) => out.trim(), () => '')) || target;
+    return limiter(`${host ?? 'local'}\u0000${id}`, fn);
+  };
+}
+
+const paneWriteQueue = createPaneWriteQueue();
+
+function sendKeysQueued(target: string, keys: string, enter?: boolean, host?: string) {
+  return paneWriteQueue(target, host, () => sendKeys(target, keys, enter, host));
+}
+
 async function runTmux(args: string[], host?: string) {
+  return withSpan(`tmux ${args[0] ?? ''}`.trim(), 'client', tmuxSpanAttributes(args, host), () =>
+    limitHost(host, () => execWithServerStart(args, host, (socket) => execTmux(args, host, socket))),
+  );
+}
+
+// exit-empty off keeps the freshly started server alive until a session is created.
+const startServerArgs = ['start-server', ';', 'set-option', '-s', 'exit-empty', 'off'];
+
+export function isNoServerError(error: unknown) {
+  const detail = (error as { data?: TmuxErrorDetail }).data;
+  const text = `${detail?.stderr ?? ''}\n${error instanceof Error ? error.message : String(error)}`;
+  return /no server running|error connecting to .*\(No such file or directory\)/i.test(text);
+}
+
+// Runs `run`; if it fails because no tmux server is running and `enabled`, runs `start` and retries once.
+export async function retryWithServerStart<T>(
+  run: () => Promise<T>,
+  start: () => Promise<unknown>,
+  enabled: boolean,
+): Promise<{ value: T; started: boolean }> {
   try {
-    assertValidHost(host);
-    const hostConfig = getHostProfile(host);
-    const bin = hostConfig?.tmuxBin || tmuxBinary;
-    const pathAdd = hostConfig?.pathAdd ?? [];
-    const basePath = buildPath(process.env.PATH, [...tmuxFallbackPaths, ...pathAdd]);
-    let stdout: string;
-
-    if (host) {
-      // Build a single remote command string and base64-encode it to avoid shell comment parsing (#).
-      const commandStr = `PATH=${basePath} exec ${[bin, ...args].map(shQuote).join(' ')}`;
-      const b64 = Buffer.from(commandStr, 'utf8').toString('base64');
-      const remoteCmd = `printf %s ${shQuote(b64)} | base64 -d | sh`;
-      const sshArgs = ['-T', host, remoteCmd];
-      ({ stdout } = await execa('ssh', sshArgs, { timeout: tmuxCommandTimeoutMs }));
-    } else {
-      ({ stdout } = await execa(bin, args, {
-        env: { ...process.env, PATH: basePath },
-        timeout: tmuxCommandTimeoutMs,
-      }));
+    return { value: await run(), started: false };
+  } catch (error) {
+    if (!enabled || !isNoServerError(error)) throw error;
+    await start();
+    return { value: await run(), started: true };
+  }
+}
+
+async function execWithServerStart<T>(
+  args: string[],
+  host: string | undefined,
+  run: (socket?: string) => Promise<T>,
+) {
+  const enabled =
+    autoStartServer &&
+    args[0] !== 'kill-server' &&
+    args[0] !== 'start-server' &&
+    !requestContext.getStore()?.noServerStart;
+  const socket = await routeSocket(host, enabled);
+  const { value, started } = await retryWithServerStart(
+    () => run(socket),
+    () => execTmux(startServerArgs, host, socket),
+    enabled,
+  );
+  if (started) requestContext.getStore()?.serverStarts?.push(host ?? 'local');
+  return value;
+}
+
+// Tells the client when a call only succeeded because the server was auto-started.
+export function withServerStartNote<T extends { content?: unknown[] }>(result: T, hosts: string[]): T {
+  if (!hosts.length || !result || !Array.isArray(result.content)) return result;
+  const where = [...new Set(hosts)].join(', ');
+  const note = `Note: tmux server was not running on ${where}; started it (MCP_TMUX_AUTO_START_SERVER).`;
+  return { ...result, content: [...result.content, { type: 'text', text: note }] };
+}
+
+export type SocketPolicy = 'failover' | 'round-robin';
+export type SocketHealth = { socket: string; ok: boolean; error?: string };
+
+// -L takes a socket name under tmux's socket directory; anything with a slash is a path for -S.
+export function socketArgs(socket: string) {
+  return socket.includes('/') ? ['-S', socket] : ['-L', socket];
+}
+
+// Routes calls for hosts with several tmux servers (profile `sockets`) to a healthy one. failover always prefers
+// the first healthy socket in list order, so sessions stay on one server; round-robin rotates the starting
+// socket per call. Probe results are cached for ttlMs, and a call that finds its server gone marks it down.
+export function createSocketRouter({ ttlMs = 10_000, now = Date.now }: { ttlMs?: number; now?: () => number } = {}) {
+  const health = new Map<string, { ok: boolean; at: number; error?: string }>();
+  const cursors = new Map<string, number>();
+  const key = (host: string, socket: string) => `${host}\u0000${socket}`;
+  const check = async (host: string, socket: string, probe: (socket: string) => Promise<unknown>) => {
+    const cached = health.get(key(host, socket));
+    if (cached && now() - cached.at < ttlMs) {
+      serverStats.bump('cacheHits');
+      return cached;
+    }
+    serverStats.bump('cacheMisses');
+    let entry: { ok: boolean; at: number; error?: string };
+    try {
+      await probe(socket);
+      entry = { ok: true, at: now() };
+    } catch (error) {
+      entry = { ok: false, at: now(), error: (error as Error).message };
+    }
+    health.set(key(host, socket), entry);
+    return entry;
+  };
+  return {
+    async pick(
+      host: string,
+      sockets: string[],
+      probe: (socket: string) => Promise<unknown>,
+      policy: SocketPolicy = 'failover',
+    ) {
+      const start = policy === 'round-robin' ? (cursors.get(host) ?? 0) % sockets.length : 0;
+      if (policy === 'round-robin') cursors.set(host, start + 1);
+      const failures: string[] = [];
+      for (let i = 0; i < sockets.length; i++) {
+        const socket = sockets[(start + i) % sockets.length];
+        const result = await check(host, socket, probe);
+        if (result.ok) return socket;
+        failures.push(`${socket} (${result.error})`);
+      }
+      throw new McpError(ErrorCode.InternalError, `No healthy tmux socket on ${host}: ${failures.join(', ')}`);
+    },
+    async checkAll(host: string, sockets: string[], probe: (socket: string) => Promise<unknown>) {
+      sockets.forEach((socket) => health.delete(key(host, socket)));
+      const results: SocketHealth[] = [];
+      for (const socket of sockets) {
+        const { ok, error } = await check(host, socket, probe);
+        results.push({ socket, ok, ...(error ? { error } : {}) });
+      }
+      return results;
+    },
+    markDown(host: string, socket: string, error: string) {
+      health.set(key(host, socket), { ok: false, at: now(), error });
+    },
+  };
+}
+
+const socketRouter = createSocketRouter();
+
+const socketProbeArgs = ['display-message', '-p', '#{pid}'];
+
+// With `fallback`, a host whose sockets are all down routes to its first socket instead of failing, so the
+// caller's server auto-start can bring that server up.
+async function routeSocket(host: string | undefined, fallback = false) {
+  // A per-request override replaces the whole profile, sockets included.
+  const profile = getHostProfile(host) as HostProfile | undefined;
+  if (!profile?.sockets?.length) return undefined;
+  const probe = (socket: string) => execTmux(socketProbeArgs, host, socket);
+  try {
+    return await socketRouter.pick(host ?? 'local', profile.sockets, probe, profile.socketPolicy);
+  } catch (error) {
+    if (!fallback) throw error;
+    return profile.sockets[0];
+  }
+}
+
+// execTmux on the socket runTmux would route to, for side calls such as watch hooks (no server auto-start).
+async function execRoutedTmux(args: string[], host?: string) {
+  return execTmux(args, host, await routeSocket(host));
+}
+
+function tmuxSpanAttributes(args: string[], host?: string): SpanAttributes {
+  return { 'tmux.command': args.join(' '), 'tmux.host': host ?? 'local' };
+}
+
+// One command line for a control client: every argument single-quoted so formats, quotes, ~ and $ reach the
+// command untouched. Commands are newline-terminated, so arguments containing newlines cannot be sent, and
+// chained commands (a bare ";") are refused: tmux answers each with its own block and drops the rest of the
+// chain after an error, so the replies could not be matched back to callers.
+export function controlCommandLine(args: string[]) {
+  if (args.some((arg) => arg === ';' || /[\r\n]/.test(arg))) return undefined;
+  return args.map((arg) => `'${arg.replace(/'/g, `'\\''`)}'`).join(' ');
+}
+
+export type ControlBackend = {
+  write(line: string): void;
+  onLine(listener: (line: string) => void): void;
+  onClose(listener: () => void): void;
+  close(): void;
+};
+
+// Raised when the control client went away; `controlSent` says whether tmux may already have run the command.
+function controlClosedError(sent: boolean) {
+  const message = sent ? 'tmux control client exited before replying' : 'tmux control client is not available';
+  return Object.assign(new Error(message), { controlSent: sent });
+}
+
+// A command the control client never sent is safe to run again by spawning tmux.
+export function isControlUnsent(error: unknown) {
+  return (error as { controlSent?: boolean })?.controlSent === false;
+}
+
+// Multiplexes commands over a control-mode connection. tmux answers each command, in order, with a
+// %begin/%end (or %error) block whose flags have bit 1 set; the attach itself (flags 0) marks the client as
+// ready, and notifications such as %output or %window-add between blocks are ignored. Commands issued before
+// the client is ready are held back, so a failed attach never runs any of them.
+export function createControlClient(backend: ControlBackend, timeoutMs = tmuxCommandTimeoutMs) {
+  type Pending = { line: string; resolve: (output: string) => void; reject: (error: Error) => void };
+  const queued: Pending[] = [];
+  const inFlight: Pending[] = [];
+  let ready = false;
+  let closed = false;
+  let block: { ours: boolean; lines: string[] } | undefined;
+  const flush = () => {
+    for (const pending of queued.splice(0)) {
+      inFlight.push(pending);
+      backend.write(`${pending.line}\n`);
+    }
+  };
+  backend.onLine((line) => {
+    if (!block) {
+      const begin = /^%begin \d+ \d+ (\d+)/.exec(line);
+      if (begin) block = { ours: (Number(begin[1]) & 1) === 1, lines: [] };
+      else if (line === '%exit') backend.close();
+      return;
+    }
+    const end = /^%(end|error) \d+ \d+ \d+/.exec(line);
+    if (!end) {
+      block.lines.push(line);
+      return;
     }
+    const { ours, lines } = block;
+    block = undefined;
+    if (!ours) {
+      if (!ready && end[1] === 'end') {
+        ready = true;
+        flush();
+      } else if (!ready) backend.close();
+      return;
+    }
+    const pending = inFlight.shift();
+    if (!pending) return;
+    if (end[1] === 'end') pending.resolve(lines.join('\n'));
+    else pending.reject(new Error(lines.join('\n') || 'tmux command failed'));
+  });
+  backend.onClose(() => {
+    closed = true;
+    for (const pending of inFlight.splice(0)) pending.reject(controlClosedError(true));
+    for (const pending of queued.splice(0)) pending.reject(controlClosedError(false));
+  });
+  return {
+    get closed() {
+      return closed;
+    },
+    run(args: string[]) {
+      const line = controlCommandLine(args);
+      if (closed || line === undefined) return Promise.reject(controlClosedError(false));
+      return new Promise<string>((resolve, reject) => {
+        // A reply that never comes would shift every later reply onto the wrong command; drop the client.
+        const timer = setTimeout(() => {
+          reject(new Error(`Command timed out after ${timeoutMs} milliseconds`));
+          backend.close();
+        }, timeoutMs);
+        const settle =
+          <T>(fn: (value: T) => void) =>
+          (value: T) => {
+            clearTimeout(timer);
+            fn(value);
+          };
+        queued.push({ line, resolve: settle(resolve), reject: settle(reject) });
+        if (ready) flush();
+      });
+    },
+    close() {
+      backend.close();
+    },
+  };
+}
+
+export type ControlClient = ReturnType<typeof createControlClient>;
+
+function spawnControlBackend(): ControlBackend {
+  const invocation = tmuxInvocation(['-C', 'attach-session'], undefined);
+  const child = execa(invocation.file, invocation.args, {
+    env: invocation.env,
+    stdin: 'pipe',
+    buffer: false,
+    reject: false,
+  });
+  const closeListeners: (() => void)[] = [];
+  let closed = false;
+  const close = () => {
+    if (closed) return;
+    closed = true;
+    child.kill();
+    for (const listener of closeListeners) listener();
+  };
+  void child.then(close, close);
+  child.stdin?.on('error', close);
+  const lines = readline.createInterface({ input: child.stdout! });
+  return {
+    write: (line) => child.stdin?.write(line),
+    onLine: (listener) => lines.on('line', listener),
+    onClose: (listener) => closeListeners.push(listener),
+    close,
+  };
+}
+
+// Commands sent over the control client: local, on the default socket, and with an explicit target (or
+// list-sessions), since anything else would resolve against the control client's own session. Chained
+// commands always spawn tmux (see controlCommandLine).
+export function isControlEligible(args: string[], host?: string, socket?: string) {
+  if (host || socket || args.includes(';')) return false;
+  return args.includes('-t') || args[0] === 'list-sessions';
+}
+
+const controlRetryMs = 5000;
+let controlClient: ControlClient | undefined;
+let controlRetryAt = 0;
+// tmux's name for our control client, so attached-client counts can leave it out.
+let controlClientName: string | undefined;
+
+function localControlClient(now = Date.now()) {
+  if (controlClient && !controlClient.closed) return controlClient;
+  if (now < controlRetryAt) return undefined;
+  controlRetryAt = now + controlRetryMs;
+  controlClient = createControlClient(spawnControlBackend());
+  // Pane output would otherwise stream into the pipe as %output notifications (tmux 3.2+; ignored if older).
+  controlClient.run(['refresh-client', '-f', 'no-output']).catch(() => undefined);
+  // A command run over the control connection evaluates against that client, so this names it.
+  controlClient.run(['display-message', '-p', '#{client_name}']).then(
+    (name) => (controlClientName = name.trim() || undefined),
+    () => undefined,
+  );
+  return controlClient;
+}
 
+async function execTmux(args: string[], host?: string, socket?: string) {
+  const fullArgs = socket ? [...socketArgs(socket), ...args] : args;
+  const control = controlModeEnabled && isControlEligible(args, host, socket) ? localControlClient() : undefined;
+  if (control) {
+    try {
+      const output = await control.run(args);
+      serverStats.bump('controlCommands');
+      return output.trim();
+    } catch (error) {
+      // Not sent (attach failed or client gone): fall back to spawning tmux for this call, counted as a spawn only.
+      if (!isControlUnsent(error)) {
+        serverStats.bump('controlCommands');
+        throw tmuxError(fullArgs, host, { message: (error as Error).message, stderr: (error as Error).message });
+      }
+    }
+  }
+  try {
+    const invocation = tmuxInvocation(fullArgs, host);
+    serverStats.bump('tmuxSpawns');
+    const { stdout } = await execa(invocation.file, invocation.args, {
+      env: invocation.env,
+      timeout: tmuxCommandTimeoutMs,
+    });
     return stdout.trim();
   } catch (error) {
-    const err = error as { stderr?: string; stdout?: string; message: string };
-    const detail = err.stderr || err.stdout || err.message;
-    throw new McpError(
-      ErrorCode.InternalError,
-      `${host ? `ssh ${host} ` : ''}tmux ${args.join(' ')} failed: ${detail}`.trim(),
-    );
+    throw socketFailure(tmuxError(fullArgs, host, error), host, socket);
+  }
+}
+
+function socketFailure(error: McpError, host: string | undefined, socket?: string) {
+  if (socket && isNoServerError(error)) socketRouter.markDown(host ?? 'local', socket, error.message);
+  return error;
+}
+
+// Like runTmux, but returns stdout undecoded so callers can validate or transcode it.
+async function runTmuxBytes(args: string[], host?: string) {
+  return withSpan(`tmux ${args[0] ?? ''}`.trim(), 'client', tmuxSpanAttributes(args, host), () =>
+    limitHost(host, () => execWithServerStart(args, host, (socket) => execTmuxBytes(args, host, socket))),
+  );
+}
+
+async function execTmuxBytes(args: string[], host?: string, socket?: string) {
+  const fullArgs = socket ? [...socketArgs(socket), ...args] : args;
+  try {
+    const invocation = tmuxInvocation(fullArgs, host);
+    serverStats.bump('tmuxSpawns');
+    const { stdout } = await execa(invocation.file, invocation.args, {
+      env: invocation.env,
+      timeout: tmuxCommandTimeoutMs,
+      encoding: 'buffer',
+    });
+    return stdout;
+  } catch (error) {
+    throw socketFailure(tmuxError(fullArgs, host, error), host, socket);
+  }
+}
+
+// Decode captured bytes as UTF-8, replacing invalid sequences with U+FFFD and reporting whether any were found.
+export function decodeUtf8(bytes: Uint8Array) {
+  try {
+    return { text: new TextDecoder('utf-8', { fatal: true }).decode(bytes), hadInvalidUtf8: false };
+  } catch {
+    return { text: new TextDecoder('utf-8').decode(bytes), hadInvalidUtf8: true };
+  }
+}
+
+// Canonical WHATWG name for a source-encoding label (latin1 -> windows-1252), or InvalidParams for unknown ones.
+export function resolveSourceEncoding(label: string) {
+  try {
+    return new TextDecoder(label).encoding;
+  } catch {
+    throw new McpError(ErrorCode.InvalidParams, `Unsupported sourceEncoding: ${label}`);
   }
 }
 
+// UTF-8 passes through decodeUtf8; any other encoding is transcoded from the pane's legacy locale.
+export function decodeCapture(bytes: Uint8Array, encoding?: string) {
+  const resolved = encoding ? resolveSourceEncoding(encoding) : 'utf-8';
+  if (resolved === 'utf-8') return decodeUtf8(bytes);
+  return { text: new TextDecoder(resolved).decode(bytes), hadInvalidUtf8: false };
+}
+
+function outputText(value: unknown) {
+  if (typeof value === 'string') return value || undefined;
+  if (value instanceof Uint8Array) return decodeUtf8(value).text || undefined;
+  return undefined;
+}
+
+export type TmuxErrorDetail = {
+  command: string;
+  args: string[];
+  host?: string;
+  stderr?: string;
+  stdout?: string;
+  exitCode?: number;
+};
+
+// Wrap a failed tmux/ssh invocation so clients can inspect the failure via McpError.data instead of parsing text.
+export function tmuxError(args: string[], host: string | undefined, error: unknown) {
+  const err = error as { stderr?: unknown; stdout?: unknown; exitCode?: number; message: string };
+  const detail: TmuxErrorDetail = {
+    command: `${host ? `ssh ${host} ` : ''}tmux ${args.join(' ')}`,
+    args,
+    host,
+    stderr: outputText(err.stderr),
+    stdout: outputText(err.stdout),
+    exitCode: typeof err.exitCode === 'number' ? err.exitCode : undefined,
+  };
+  const reason = detail.stderr || detail.stdout || err.message;
+  return new McpError(ErrorCode.InternalError, `${detail.command} failed: ${reason}`.trim(), detail);
+}
+
 async function capturePaged(target: string, host: string | undefined, pageSizes = defaultCapturePageSizes) {
   // Try progressively larger captures until we either cover history or exhaust sizes.
   const historySizeRaw = await runTmux(['display-message', '-p', '#{history_size}'], host).catch(() => '0');
@@ -198,59 +908,327 @@ function resolveHost(host?: string) {
   return host ?? defaultHost;
 }
 
-function resolveSession(session?: string) {
-  return session ?? defaultSession;
+// Saved per-host defaults (tmux_set_defaults) fill in what the current defaults lack, e.g. after a restart, and
+// take over when a call names another host than the default one.
+export function pickDefault(
+  saved: Record<string, HostDefaults>,
+  key: 'session' | 'pane',
+  current: string | undefined,
+  host: string | undefined,
+  currentHost: string | undefined,
+) {
+  const fromSaved = saved[host ?? 'local']?.[key];
+  return host === currentHost ? current ?? fromSaved : fromSaved ?? current;
 }
 
-function resolvePaneTarget(target?: string) {
-  return target ?? defaultPane;
+function defaultFor(key: 'session' | 'pane', current: string | undefined, host?: string) {
+  return pickDefault(hostDefaults, key, current, resolveHost(host), defaultHost);
 }
 
-function requirePaneTarget(target?: string) {
-  const resolved = resolvePaneTarget(target);
-  if (!resolved) {
+function resolveSession(session?: string, host?: string) {
+  return session ?? defaultFor('session', defaultSession, host);
+}
+
+function resolvePaneTarget(target?: string, host?: string) {
+  return target ?? defaultFor('pane', defaultPane, host);
+}
+
+// Which pane of a window-only target to use: the active one, else the configured strategy, else the first pane.
+// The first pane is resolved from the pane list (see applyPaneStrategy), not `.0`, so pane-base-index 1 works.
+export function windowPaneStrategy(activePane: boolean, fallback?: PaneStrategy): PaneStrategy {
+  return activePane ? 'active' : fallback ?? 'first';
+}
+
+export type PaneStrategy = 'first' | 'active' | 'last';
+
+export function parsePaneStrategy(raw?: string): PaneStrategy | undefined {
+  if (!raw) return undefined;
+  const value = raw.trim().toLowerCase();
+  if (value === 'first' || value === 'active' || value === 'last') return value;
+  console.warn('Ignoring invalid MCP_TMUX_PANE_STRATEGY (expected first, active, or last):', raw);
+  return undefined;
+}
+
+// Pane ids and session:window.pane targets already name one pane; anything else is a session or window.
+// Only a pane spec after the last '.' (an index, %id, !, +/-offset or {token}) counts, so window names such as
+// "api.v2" stay windows.
+export function namesPane(target: string) {
+  return target.startsWith('%') || /:[^:]*\.(\d+|%\d+|!|[+-]\d*|\{[\w-]+\})$/.test(target);
+}
+
+// tmux splits a target at its last '.', so "dev:api.v2" would look for pane "v2" of window "api". A trailing '.'
+// leaves an empty (ignored) pane part and keeps the dotted window name whole.
+export function escapeWindowTarget(target: string) {
+  const colon = target.indexOf(':');
+  return colon >= 0 && target.includes('.', colon) && !target.endsWith('.') ? `${target}.` : target;
+}
+
+// Resolves a session- or window-only target to a pane id using the panes of that window (its session's current
+// window for a bare session), by index order rather than `.0` so pane-base-index does not matter.
+export async function applyPaneStrategy(
+  target: string,
+  strategy: PaneStrategy | undefined,
+  list: (target: string) => Promise<{ id: string; index: number; active: boolean }[]>,
+) {
+  if (namesPane(target)) return target;
+  if (!strategy) return escapeWindowTarget(target);
+  const panes = [...(await list(escapeWindowTarget(target)))].sort((a, b) => a.index - b.index);
+  if (!panes.length) throw new McpError(ErrorCode.InvalidParams, `No panes found for ${target}`);
+  if (strategy === 'first') return panes[0].id;
+  if (strategy === 'last') return panes[panes.length - 1].id;
+  return (panes.find((p) => p.active) ?? panes[0]).id;
+}
+
+function strategyPaneTarget(target: string, host: string | undefined, strategy = defaultPaneStrategy) {
+  return applyPaneStrategy(target, strategy, (t) => listPanes(t, host));
+}
+
+const paneStrategySchema = z
+  .enum(['first', 'active', 'last'])
+  .describe('Which pane a session- or window-only target resolves to (default MCP_TMUX_PANE_STRATEGY, else tmux).')
+  .optional();
+
+// Writes with skipIfAttached refuse to type into a session a human currently has attached.
+export function assertSessionDetached(attached: string, target: string) {
+  const clients = Number(attached) || 0;
+  if (clients > 0) {
     throw new McpError(
-      ErrorCode.InvalidParams,
-      'target is required (provide target or set default pane via tmux_set_default or tmux_select_pane)',
+      ErrorCode.InvalidRequest,
+      `Session of ${target} has ${clients} attached client${clients === 1 ? '' : 's'}; refusing to write (skipIfAttached=true)`,
     );
   }
-  return resolved;
 }
 
-function isDestructiveTmuxArgs(args: string[]) {
-  if (!args.length) return false;
-  const verbs = new Set(['kill-session', 'kill-window', 'kill-pane', 'kill-server', 'unlink-window', 'unlink-pane']);
-  const first = args[0];
-  if (verbs.has(first) || first.startsWith('kill-')) return true;
-  if (first === 'attach' && args.includes('-k')) return true;
-  return false;
+async function guardAttached(target: string, host: string | undefined, skipIfAttached: boolean) {
+  if (!skipIfAttached) return;
+  const { attached, session } = await fetchPaneFields(
+    target,
+    { attached: '#{session_attached}', session: '#{session_name}' },
+    host,
+  );
+  const counts = await attachedWithoutControl(host);
+  assertSessionDetached(counts ? String(counts.get(session) ?? 0) : attached, target);
 }
 
-function requireHost(host?: string) {
-  const resolved = resolveHost(host);
-  if (!resolved) {
-    throw new McpError(ErrorCode.InvalidParams, 'host is required (set host param or MCP_TMUX_HOST)');
-  }
-  return resolved;
+export type BroadcastResult = { pane: string; ok: boolean; error?: string };
+
+// Explicit, scoped alternative to synchronize-panes: send the same keys to every pane in one window.
+export async function broadcastKeys(
+  window: string,
+  keys: string,
+  enter: boolean,
+  host: string | undefined,
+  io: {
+    list: (target: string, host?: string) => Promise<TmuxPane[]>;
+    send: (target: string, keys: string, enter: boolean, host?: string) => Promise<void>;
+  } = { list: listPanes, send: sendKeysQueued },
+): Promise<BroadcastResult[]> {
+  const panes = await io.list(window, host);
+  if (!panes.length) throw new McpError(ErrorCode.InvalidParams, `No panes found in window ${window}`);
+  const results = await Promise.allSettled(panes.map((p) => io.send(p.id, keys, enter, host)));
+  return results.map((r, i): BroadcastResult =>
+    r.status === 'fulfilled'
+      ? { pane: panes[i].id, ok: true }
+      : { pane: panes[i].id, ok: false, error: r.reason instanceof Error ? r.reason.message : String(r.reason) },
+  );
 }
 
-function requireSession(session?: string) {
-  const resolved = resolveSession(session);
+function requirePaneTarget(target?: string, host?: string) {
+  const resolved = resolvePaneTarget(target, host);
   if (!resolved) {
     throw new McpError(
       ErrorCode.InvalidParams,
-      'session is required (set session param, MCP_TMUX_SESSION, or use tmux_open_session)',
+      'target is required (provide target or set default pane via tmux_set_default or tmux_select_pane)',
     );
   }
   return resolved;
 }
 
-async function ensureLocalTmuxAvailable() {
+export type TargetCheck = {
+  target?: string;
+  pane?: string;
+  session?: string;
+  window?: string;
+  sessionExists: boolean;
+  paneExists: boolean;
+  error?: string;
+};
+
+// Preflight for a target: resolve it the way the other tools would (default pane, pane strategy) and ask tmux
+// whether it exists. Only read commands run, and failures are reported rather than thrown.
+export async function validateTarget(
+  target: string | undefined,
+  strategy: PaneStrategy | undefined,
+  run: (args: string[]) => Promise<string>,
+  host?: string,
+): Promise<TargetCheck> {
+  const resolved = resolvePaneTarget(target, host);
+  if (!resolved) {
+    return { sessionExists: false, paneExists: false, error: 'no target given and no default pane is set' };
+  }
+  const message = (error: unknown) => (error instanceof Error ? error.message : String(error));
+  const session = resolved.startsWith('%') || resolved.startsWith('@') ? undefined : getSessionFromTarget(resolved);
+  if (session) {
+    // `=` asks for an exact name; a bare name would also match a session it is a prefix of (dev -> dev2).
+    const error = await run(['has-session', '-t', `=${session}`]).then(
+      () => undefined,
+      (e: unknown) => message(e),
+    );
+    if (error) return { target: resolved, session, sessionExists: false, paneExists: false, error };
+  }
   try {
-    await runTmux(['-V']);
+    const pane = await applyPaneStrategy(resolved, strategy, async (t) =>
+      (await run(['list-panes', '-t', t, '-F', '#{pane_id}\t#{pane_index}\t#{pane_active}']))
+        .split('\n')
+        .filter(Boolean)
+        .map((line) => {
+          const [id, index, active] = line.split('\t');
+          return { id, index: Number(index), active: active === '1' };
+        }),
+    );
+    const raw = await run(['display-message', '-p', '-t', pane, '#{session_name}\t#{window_id}\t#{pane_id}']);
+    const [sessionName, window, paneId] = raw.split('\t');
+    return { target: resolved, pane: paneId, session: sessionName, window, sessionExists: true, paneExists: true };
   } catch (error) {
-    // Keep server running even if local tmux missing; remote hosts may still be usable.
-    console.warn(`Warning: local tmux unavailable (${tmuxBinary} -V failed). Remote hosts may still work.`, error);
+    return { target: resolved, session, sessionExists: session !== undefined, paneExists: false, error: message(error) };
+  }
+}
+
+function isDestructiveTmuxArgs(args: string[]) {
+  if (!args.length) return false;
+  const verbs = new Set(['kill-session', 'kill-window', 'kill-pane', 'kill-server', 'unlink-window', 'unlink-pane']);
+  const first = args[0];
+  if (verbs.has(first) || first.startsWith('kill-')) return true;
+  if (first === 'attach' && args.includes('-k')) return true;
+  return false;
+}
+
+// Tools that change panes, sessions, layouts, or saved server state.
+const writeTools = new Set([
+  'tmux_set_default',
+  'tmux_set_defaults',
+  'tmux_open_session',
+  'tmux_set_audit_logging',
+  'tmux_restore_layout',
+  'tmux_restore_layouts',
+  'tmux_multi_run',
+  'tmux_select_window',
+  'tmux_select_pane',
+  'tmux_set_sync_panes',
+  'tmux_set_pane_title',
+  'tmux_set_pane_border_status',
+  'tmux_broadcast_keys',
+  'tmux_save_layout_profile',
+  'tmux_restore_session',
+  'tmux_setup_session',
+  'tmux_apply_layout_profile',
+  'tmux_send_keys',
+  'tmux_send_keys_sequence',
+  'tmux_define_macro',
+  'tmux_run_macro',
+  'tmux_reset_pane',
+  'tmux_run_batch',
+  'tmux_set_prompt_sentinel',
+  'tmux_new_session',
+  'tmux_new_window',
+  'tmux_split_pane',
+  'tmux_kill_session',
+  'tmux_kill_idle_sessions',
+  'tmux_kill_server',
+  'tmux_kill_window',
+  'tmux_kill_pane',
+  'tmux_rename_session',
+  'tmux_rename_window',
+  'tmux_refresh_client',
+  'tmux_run_shell',
+]);
+
+// Raw tmux verbs (and their aliases) that only read state.
+const readOnlyTmuxVerbs = new Set([
+  'capture-pane',
+  'capturep',
+  'has-session',
+  'has',
+  'info',
+  'server-info',
+  'ls',
+  'lsb',
+  'lsc',
+  'lscm',
+  'lsk',
+  'lsp',
+  'lsw',
+  'show',
+  'showb',
+  'showw',
+  'showmsgs',
+]);
+
+export function isReadOnlyTmuxArgs(args: string[]) {
+  const first = args[0] ?? '';
+  if (first === 'display-message' || first === 'display') return args.includes('-p');
+  return first.startsWith('list-') || first.startsWith('show-') || readOnlyTmuxVerbs.has(first);
+}
+
+// In read-only mode, raw-argument tools are allowed only for read verbs and tmux_build_layout only without a
+// target to apply to.
+// tmux runs #(...) in a format as a shell command, and an argument ending in `;` (also `\;`) starts another
+// command in the same call, so neither may come from a caller in read-only mode.
+export function unsafeTmuxArg(values: string[]) {
+  return values.find((value) => value.endsWith(';') || value.includes('#('));
+}
+
+// Tools that pass a caller-supplied `format` straight to tmux.
+const formatTools = new Set(['tmux_display_message', 'tmux_list_sessions', 'tmux_list_windows', 'tmux_list_panes']);
+
+export function assertToolAllowed(name: string, input: Record<string, unknown> | undefined, readOnly = readOnlyMode) {
+  if (!readOnly) return;
+  const args = Array.isArray(input?.args) ? input.args.map(String) : [];
+  const format = formatTools.has(name) && typeof input?.format === 'string' ? [input.format] : [];
+  const unsafe = unsafeTmuxArg([...args, ...format]);
+  if (unsafe !== undefined) {
+    throw new McpError(
+      ErrorCode.InvalidRequest,
+      `${name} is not allowed to pass ${JSON.stringify(unsafe)}: #(...) and ; are blocked while the server is ` +
+        'read-only (MCP_TMUX_READ_ONLY)',
+    );
+  }
+  const write =
+    writeTools.has(name) ||
+    (name === 'tmux_command' && (Boolean(input?.asShell) || !isReadOnlyTmuxArgs(args))) ||
+    (name === 'tmux_debug_raw' && !isReadOnlyTmuxArgs(args)) ||
+    (name === 'tmux_build_layout' && Boolean(input?.target)) ||
+    (name === 'tmux_history_limit' && Boolean(input?.raise));
+  if (write) {
+    throw new McpError(ErrorCode.InvalidRequest, `${name} is not allowed: the server is read-only (MCP_TMUX_READ_ONLY)`);
+  }
+}
+
+function requireHost(host?: string) {
+  const resolved = resolveHost(host);
+  if (!resolved) {
+    throw new McpError(ErrorCode.InvalidParams, 'host is required (set host param or MCP_TMUX_HOST)');
+  }
+  return resolved;
+}
+
+function requireSession(session?: string, host?: string) {
+  const resolved = resolveSession(session, host);
+  if (!resolved) {
+    throw new McpError(
+      ErrorCode.InvalidParams,
+      'session is required (set session param, MCP_TMUX_SESSION, or use tmux_open_session)',
+    );
+  }
+  return resolved;
+}
+
+async function ensureLocalTmuxAvailable() {
+  try {
+    await runTmux(['-V']);
+  } catch (error) {
+    // Keep server running even if local tmux missing; remote hosts may still be usable.
+    console.warn(`Warning: local tmux unavailable (${tmuxBinary} -V failed). Remote hosts may still work.`, error);
   }
 }
 
@@ -273,7 +1251,7 @@ async function detectDefaultSession(): Promise<string | undefined> {
 
 async function listSessions(host?: string): Promise<TmuxSession[]> {
   const fmt = '#{session_id}\t#{session_name}\t#{session_windows}\t#{session_attached}\t#{session_created}';
-  const raw = await runTmux(['list-sessions', '-F', fmt], host);
+  const raw = await runTmux(buildListArgs('list-sessions', fmt), host);
   if (!raw) return [];
 
   return raw
@@ -289,13 +1267,134 @@ async function listSessions(host?: string): Promise<TmuxSession[]> {
     }));
 }
 
-async function listWindows(target?: string, host?: string): Promise<TmuxWindow[]> {
-  const fmt =
-    '#{session_name}\t#{window_id}\t#{window_index}\t#{window_name}\t#{window_active}\t#{window_panes}\t#{window_flags}';
-  const args = ['list-windows', '-F', fmt];
+export type SessionActivity = { name: string; activity: number; lastAttached?: number; attached: number };
+
+const sessionActivityFormat = '#{session_name}\t#{session_activity}\t#{session_last_attached}\t#{session_attached}';
+
+// Timestamps are unix seconds; session_last_attached is empty for sessions nobody ever attached to.
+export function parseSessionActivity(raw: string): SessionActivity[] {
+  if (!raw) return [];
+  return raw
+    .split('\n')
+    .map((line) => line.split('\t'))
+    .filter((parts) => parts.length >= 4 && parts[0] && !Number.isNaN(Number(parts[1])))
+    .map(([name, activity, lastAttached, attached]) => ({
+      name,
+      activity: Number(activity),
+      lastAttached: lastAttached && lastAttached !== '0' ? Number(lastAttached) : undefined,
+      attached: Number(attached) || 0,
+    }));
+}
+
+const clientSessionFormat = '#{client_name}\t#{client_session}';
+
+// Attached clients per session from list-clients, leaving out our own control-mode client (which tmux counts in
+// #{session_attached}). Other control clients, such as iTerm2's tmux integration, are people and still count.
+export function countAttachedClients(raw: string, exclude?: string) {
+  const counts = new Map<string, number>();
+  for (const line of raw.split('\n')) {
+    const [name, session] = line.split('\t');
+    if (!name || !session || name === exclude) continue;
+    counts.set(session, (counts.get(session) ?? 0) + 1);
+  }
+  return counts;
+}
+
+// Our control client's name when it is attached to this host's server (only ever the local default one).
+function ownControlClient(host?: string) {
+  return host || !controlClient || controlClient.closed ? undefined : controlClientName;
+}
+
+// Per-session attached counts without our control client, or undefined when it is not attached here.
+async function attachedWithoutControl(host?: string) {
+  const own = ownControlClient(host);
+  if (!own) return undefined;
+  return countAttachedClients(await runTmux(['list-clients', '-F', clientSessionFormat], host), own);
+}
+
+async function sessionActivity(host?: string) {
+  const sessions = parseSessionActivity(await runTmux(['list-sessions', '-F', sessionActivityFormat], host));
+  const counts = await attachedWithoutControl(host);
+  return counts ? sessions.map((s) => ({ ...s, attached: counts.get(s.name) ?? 0 })) : sessions;
+}
+
+export type IdleSessionPlan = { idle: SessionActivity[]; skippedAttached: string[] };
+
+// Sessions with no activity for at least idleSeconds; attached ones are only included when asked for.
+export function selectIdleSessions(
+  sessions: SessionActivity[],
+  idleSeconds: number,
+  includeAttached = false,
+  nowSec = Math.floor(Date.now() / 1000),
+): IdleSessionPlan {
+  const stale = sessions.filter((s) => nowSec - s.activity >= idleSeconds);
+  return {
+    idle: stale.filter((s) => includeAttached || !s.attached),
+    skippedAttached: includeAttached ? [] : stale.filter((s) => s.attached).map((s) => s.name),
+  };
+}
+
+// Lists sessions in one call and kills the idle ones by exact name (=name, so "dev" never matches "dev2");
+// dryRun only reports them. A failed kill (e.g. the session already exited) is reported, not thrown. With
+// excludeClient (our control client), attached counts come from list-clients without it.
+export async function killIdleSessions(
+  run: (args: string[]) => Promise<string>,
+  idleSeconds: number,
+  opts: { includeAttached?: boolean; dryRun?: boolean; nowSec?: number; excludeClient?: string } = {},
+) {
+  let sessions = parseSessionActivity(await run(['list-sessions', '-F', sessionActivityFormat]));
+  if (opts.excludeClient) {
+    const counts = countAttachedClients(await run(['list-clients', '-F', clientSessionFormat]), opts.excludeClient);
+    sessions = sessions.map((s) => ({ ...s, attached: counts.get(s.name) ?? 0 }));
+  }
+  const plan = selectIdleSessions(sessions, idleSeconds, opts.includeAttached, opts.nowSec);
+  const killed: string[] = [];
+  const failed: { name: string; error: string }[] = [];
+  if (!opts.dryRun) {
+    for (const s of plan.idle) {
+      await run(['kill-session', '-t', `=${s.name}`]).then(
+        () => killed.push(s.name),
+        (err) => failed.push({ name: s.name, error: (err as Error).message }),
+      );
+    }
+  }
+  return { ...plan, killed, failed };
+}
+
+function formatSessionActivity(sessions: SessionActivity[], nowSec = Math.floor(Date.now() / 1000)) {
+  if (!sessions.length) return 'No tmux sessions found.';
+  const iso = (sec: number) => new Date(sec * 1000).toISOString();
+  return sessions
+    .map((s) =>
+      [
+        `${s.name}: ${s.attached ? `attached (${s.attached} client${s.attached === 1 ? '' : 's'})` : 'detached'}`,
+        `last activity ${iso(s.activity)} (idle ${Math.max(0, nowSec - s.activity)}s)`,
+        `last attached ${s.lastAttached ? iso(s.lastAttached) : 'never'}`,
+      ].join(' | '),
+    )
+    .join('\n');
+}
+
+// The format is one argv entry, so it reaches tmux verbatim (remotely, inside tmuxInvocation's base64 wrapping).
+export function buildListArgs(
+  verb: 'list-sessions' | 'list-windows' | 'list-panes',
+  format: string,
+  target?: string,
+  all = false,
+) {
+  const args = [verb, '-F', format];
   if (target) {
     args.push('-t', target);
+  } else if (all) {
+    args.push('-a');
   }
+  return args;
+}
+
+async function listWindows(target?: string, host?: string): Promise<TmuxWindow[]> {
+  const fmt =
+    '#{session_name}\t#{window_id}\t#{window_index}\t#{window_name}\t#{window_active}\t#{window_panes}\t#{window_flags}';
+  const args = buildListArgs('list-windows', fmt, target);
 
   const raw = await runTmux(args, host);
   if (!raw) return [];
@@ -315,13 +1414,10 @@ async function listWindows(target?: string, host?: string): Promise<TmuxWindow[]
     }));
 }
 
-async function listPanes(target?: string, host?: string): Promise<TmuxPane[]> {
+async function listPanes(target?: string, host?: string, all = false): Promise<TmuxPane[]> {
   const fmt =
     '#{session_name}\t#{window_id}\t#{pane_id}\t#{pane_index}\t#{pane_active}\t#{pane_tty}\t#{pane_current_command}\t#{pane_title}';
-  const args = ['list-panes', '-F', fmt];
-  if (target) {
-    args.push('-t', target);
-  }
+  const args = buildListArgs('list-panes', fmt, target, all);
 
   const raw = await runTmux(args, host);
   if (!raw) return [];
@@ -329,8 +1425,9 @@ async function listPanes(target?: string, host?: string): Promise<TmuxPane[]> {
   return raw
     .split('\n')
     .map((line) => line.split('\t'))
-    .filter((parts) => parts.length >= 8 && parts.every(Boolean))
-    .map(([session, window, id, index, active, tty, command, title]) => ({
+    .filter((parts) => parts.length >= 8 && parts.slice(0, 7).every(Boolean))
+    // #{pane_title} is last because titles may contain tabs (or be empty); it takes the rest of the line.
+    .map(([session, window, id, index, active, tty, command, ...title]) => ({
       session,
       window,
       id,
@@ -338,12 +1435,495 @@ async function listPanes(target?: string, host?: string): Promise<TmuxPane[]> {
       active: active === '1',
       tty,
       command,
-      title,
+      title: title.join('\t'),
     }));
 }
 
-async function capturePane(target: string, start?: number, end?: number, host?: string) {
+// Resolve "the pane running <command>" when exactly one pane matches #{pane_current_command}.
+export function findPaneByCommand(panes: TmuxPane[], command: string) {
+  const matches = panes.filter((p) => commandName(p.command) === commandName(command));
+  if (matches.length === 1) return matches[0];
+  if (!matches.length) {
+    const running = [...new Set(panes.map((p) => p.command))].join(', ') || 'none';
+    throw new McpError(ErrorCode.InvalidParams, `No pane is running "${command}" (running: ${running})`);
+  }
+  const candidates = matches.map((p) => `${p.id} (${p.session}:${p.window}.${p.index})`).join(', ');
+  throw new McpError(ErrorCode.InvalidParams, `Several panes are running "${command}": ${candidates}; pass target instead`);
+}
+
+export type LineChange = { line: number; text: string };
+
+// Line diff (0-based positions: removed lines index `before`, added lines index `after`). Common prefix and
+// suffix are trimmed first so the LCS only runs over the changed middle, e.g. scrolled-off and new lines.
+export function diffLines(before: string, after: string) {
+  const a = before ? before.split('\n') : [];
+  const b = after ? after.split('\n') : [];
+  let pre = 0;
+  while (pre < a.length && pre < b.length && a[pre] === b[pre]) pre++;
+  let suf = 0;
+  while (suf < a.length - pre && suf < b.length - pre && a[a.length - 1 - suf] === b[b.length - 1 - suf]) suf++;
+  const am = a.slice(pre, a.length - suf);
+  const bm = b.slice(pre, b.length - suf);
+  const removed: LineChange[] = [];
+  const added: LineChange[] = [];
+  if (am.length * bm.length > 4_000_000) {
+    am.forEach((text, i) => removed.push({ line: pre + i, text }));
+    bm.forEach((text, j) => added.push({ line: pre + j, text }));
+    return { added, removed };
+  }
+  const dp = Array.from({ length: am.length + 1 }, () => new Uint32Array(bm.length + 1));
+  for (let i = am.length - 1; i >= 0; i--) {
+    for (let j = bm.length - 1; j >= 0; j--) {
+      dp[i][j] = am[i] === bm[j] ? dp[i + 1][j + 1] + 1 : Math.max(dp[i + 1][j], dp[i][j + 1]);
+    }
+  }
+  let i = 0;
+  let j = 0;
+  while (i < am.length || j < bm.length) {
+    if (i < am.length && j < bm.length && am[i] === bm[j]) {
+      i++;
+      j++;
+    } else if (j >= bm.length || (i < am.length && dp[i + 1][j] >= dp[i][j + 1])) {
+      removed.push({ line: pre + i, text: am[i++] });
+    } else {
+      added.push({ line: pre + j, text: bm[j++] });
+    }
+  }
+  return { added, removed };
+}
+
+export function contentHash(text: string) {
+  return createHash('sha256').update(text).digest('hex').slice(0, 16);
+}
+
+// Recent capture bodies by hash, so clients can ask for a diff by hash without sending the old text back.
+const recentCaptures = new Map<string, string>();
+
+function rememberCapture(text: string) {
+  const hash = contentHash(text);
+  recentCaptures.delete(hash);
+  recentCaptures.set(hash, text);
+  while (recentCaptures.size > 32) recentCaptures.delete(recentCaptures.keys().next().value as string);
+  return hash;
+}
+
+function formatLineDiff(diff: { added: LineChange[]; removed: LineChange[] }) {
+  return [
+    ...diff.removed.map((c) => `- ${c.line}: ${c.text}`),
+    ...diff.added.map((c) => `+ ${c.line}: ${c.text}`),
+  ].join('\n');
+}
+
+export type CaptureTransforms = {
+  collapseBlankLines?: boolean;
+  collapseProgress?: boolean;
+  expandTabs?: number;
+};
+
+// Bar and spinner glyphs (block elements, braille, pip's ━╸╺), with the bar's padding, and bracketed
+// [====>   ] / [###   ] bars.
+const progressBarPattern =
+  /[▀-▟⠀-⣿━╸╺][▀-▟⠀-⣿━╸╺ ]*|\[[=#>. -]*[=#>][=#>. -]*\]/g;
+
+// Numbers that only progress output carries: percentages, sizes and rates (12.0 MB, 3.1MB/s, 18.2it/s), counts
+// and size pairs (45/100, 6.6/12.0 MB), and eta/elapsed times (eta 0:00:02, tqdm's [00:02<00:03]). Bare numbers
+// (line 12, HTTP 200, step 1) and timestamps are left alone, so distinct log lines never collapse.
+const progressTokenPattern = new RegExp(
+  [
+    String.raw`\d+(?:[.,]\d+)?\s*(?:%|(?:[kKMGTP]i?)?B\b(?:\/s)?|it\/s|s\/it)`,
+    String.raw`(?<![\/\d])\d+(?:[.,]\d+)?\/\d+(?:[.,]\d+)?(?:\s*(?:[kKMGTP]i?)?B\b)?(?![\/\d])`,
+    String.raw`(?:eta|ETA)\s+\d+(?::\d{2}){1,2}`,
+    String.raw`\d+(?::\d{2}){1,2}(?=<)`,
+    String.raw`(?<=<)\d+(?::\d{2}){1,2}`,
+  ]
+    .map((alt) => ` *(?:${alt})`)
+    .join('|'),
+  'g',
+);
+
+// A line with its progress tokens and bar/spinner glyphs masked, or undefined when it has none. Right-aligned
+// numbers keep one space, so " 10%" and "100%" mask alike. Consecutive lines with the same key are updates of
+// one progress line.
+export function progressKey(line: string) {
+  let found = false;
+  const mask = (token: string) => (found = true) && (token.startsWith(' ') ? ' #' : '#');
+  const key = line.replace(progressBarPattern, () => (found = true) && '*').replace(progressTokenPattern, mask);
+  return found ? key : undefined;
+}
+
+// Collapses each run of consecutive progress updates (pip/npm/docker bars, spinners) to its last line.
+export function collapseProgressLines(text: string) {
+  const kept: string[] = [];
+  let prevKey: string | undefined;
+  let collapsed = 0;
+  for (const line of text.split('\n')) {
+    const key = progressKey(line);
+    if (key !== undefined && key === prevKey) {
+      kept[kept.length - 1] = line;
+      collapsed++;
+      continue;
+    }
+    kept.push(line);
+    prevKey = key;
+  }
+  return { text: kept.join('\n'), collapsed };
+}
+
+// Escape sequences capture-pane -e keeps (CSI such as SGR colours, OSC such as hyperlinks); they take no columns.
+// eslint-disable-next-line no-control-regex
+const escapeSequencePattern = /(\x1b\[[0-9;?]*[ -/]*[@-~]|\x1b\][^\x07\x1b]*(?:\x07|\x1b\\)|\x1b[()][0-9A-Za-z]|\x1b.)/;
+
+// Replaces tabs with spaces up to the next multiple of `width` display columns, counting wide glyphs as two and
+// escape sequences as none.
+export function expandTabs(text: string, width: number) {
+  let expanded = 0;
+  const lines = text.split('\n').map((line) => {
+    if (!line.includes('\t')) return line;
+    let col = 0;
+    let out = '';
+    // split() with a capturing pattern puts the escape sequences at the odd indexes.
+    for (const [i, part] of line.split(escapeSequencePattern).entries()) {
+      if (i % 2 === 1) {
+        out += part;
+        continue;
+      }
+      for (const { segment } of graphemes.segment(part)) {
+        if (segment === '\t') {
+          const pad = width - (col % width);
+          out += ' '.repeat(pad);
+          col += pad;
+          expanded++;
+        } else {
+          out += segment;
+          col += graphemeWidth(segment);
+        }
+      }
+    }
+    return out;
+  });
+  return { text: lines.join('\n'), expanded };
+}
+
+// Text clean-ups applied to decoded captures (capture-pane already drops escape sequences unless -e is used).
+export function transformCapture(
+  text: string,
+  transforms: CaptureTransforms = {},
+): { text: string; collapsedLines: number; expandedTabs?: number; collapsedProgress?: number } {
+  let out = text;
+  let collapsedLines = 0;
+  let expandedTabs: number | undefined;
+  let collapsedProgress: number | undefined;
+  if (transforms.expandTabs) {
+    ({ text: out, expanded: expandedTabs } = expandTabs(out, transforms.expandTabs));
+  }
+  if (transforms.collapseProgress) {
+    ({ text: out, collapsed: collapsedProgress } = collapseProgressLines(out));
+  }
+  if (transforms.collapseBlankLines) {
+    const kept: string[] = [];
+    for (const line of out.split('\n')) {
+      const blank = !line.trim();
+      if (blank && kept.length && !kept[kept.length - 1].trim()) {
+        collapsedLines++;
+        continue;
+      }
+      kept.push(line);
+    }
+    out = kept.join('\n');
+  }
+  return {
+    text: out,
+    collapsedLines,
+    ...(expandedTabs !== undefined ? { expandedTabs } : {}),
+    ...(collapsedProgress !== undefined ? { collapsedProgress } : {}),
+  };
+}
+
+// Re-runs `fetch` up to `retries` more times (delayMs apart) while `isEmpty` holds, e.g. a capture taken before a
+// new session's shell has drawn its prompt. Returns the last result and how many retries were used.
+export async function retryWhileEmpty<T>(
+  fetch: () => Promise<T>,
+  isEmpty: (value: T) => boolean,
+  { retries, delayMs }: { retries: number; delayMs: number },
+) {
+  let value = await fetch();
+  let used = 0;
+  while (used < retries && isEmpty(value)) {
+    await new Promise((r) => setTimeout(r, delayMs));
+    value = await fetch();
+    used++;
+  }
+  return { value, retries: used };
+}
+
+// Keeps the first `head` and last `tail` lines, replacing the middle with a marker; useful when only the command
+// line and the outcome of a long run matter. Text short enough to fit is returned whole.
+export function headTailLines(text: string, head = 0, tail = 0, marker?: string) {
+  const lines = text.split('\n');
+  const elidedLines = Math.max(0, lines.length - head - tail);
+  if (!elidedLines) return { text, elidedLines };
+  const cut = marker ?? `... ${elidedLines} lines elided ...`;
+  const kept = [...lines.slice(0, head), cut, ...(tail ? lines.slice(-tail) : [])];
+  return { text: kept.join('\n'), elidedLines };
+}
+
+// Keeps the last maxBytes bytes of UTF-8 text (the newest output), starting on a character boundary. The marker,
+// when given, goes on its own line at the cut.
+export function keepLastBytes(text: string, maxBytes: number, marker?: string) {
+  const total = Buffer.byteLength(text);
+  if (total <= maxBytes) return { text, droppedBytes: 0 };
+  // Cut on a grapheme boundary so neither a multi-byte character nor an emoji/combining sequence is split.
+  let start = 0;
+  let index = 0;
+  for (const { segment } of graphemes.segment(text)) {
+    if (start >= total - maxBytes) break;
+    start += Buffer.byteLength(segment);
+    index += segment.length;
+  }
+  const kept = text.slice(index);
+  return { text: marker !== undefined ? `${marker}\n${kept}` : kept, droppedBytes: start };
+}
+
+// Size of returned capture text, so agents can budget context before asking for more. A trailing newline does
+// not start another line.
+export function captureSize(text: string) {
+  return { byteLength: Buffer.byteLength(text), lineCount: captureLines(text).length };
+}
+
+// The capture split into lines, one trailing newline ignored, so clients need not guess about it.
+export function captureLines(text: string) {
+  return text ? text.replace(/\n$/, '').split('\n') : [];
+}
+
+const graphemes = new Intl.Segmenter(undefined, { granularity: 'grapheme' });
+
+// East Asian wide/fullwidth blocks and emoji, which terminals (and tmux) draw two cells wide.
+const wideRanges: [number, number][] = [
+  [0x1100, 0x115f], [0x231a, 0x231b], [0x2329, 0x232a], [0x23e9, 0x23ec], [0x23f0, 0x23f0], [0x23f3, 0x23f3],
+  [0x25fd, 0x25fe], [0x2614, 0x2615], [0x2648, 0x2653], [0x267f, 0x267f], [0x2693, 0x2693], [0x26a1, 0x26a1],
+  [0x26aa, 0x26ab], [0x26bd, 0x26be], [0x26c4, 0x26c5], [0x26ce, 0x26ce], [0x26d4, 0x26d4], [0x26ea, 0x26ea],
+  [0x26f2, 0x26f5], [0x26fa, 0x26fa], [0x26fd, 0x26fd], [0x2705, 0x2705], [0x270a, 0x270b], [0x2728, 0x2728],
+  [0x274c, 0x274c], [0x274e, 0x274e], [0x2753, 0x2755], [0x2757, 0x2757], [0x2795, 0x2797], [0x27b0, 0x27b0],
+  [0x27bf, 0x27bf], [0x2b1b, 0x2b1c], [0x2b50, 0x2b50], [0x2b55, 0x2b55], [0x2e80, 0x303e], [0x3041, 0x33ff],
+  [0x3400, 0x4dbf], [0x4e00, 0x9fff], [0xa000, 0xa4cf], [0xa960, 0xa97f], [0xac00, 0xd7a3], [0xf900, 0xfaff],
+  [0xfe10, 0xfe19], [0xfe30, 0xfe6f], [0xff00, 0xff60], [0xffe0, 0xffe6], [0x16fe0, 0x16fe4], [0x17000, 0x18cff],
+  [0x1b000, 0x1b2ff], [0x1f004, 0x1f004], [0x1f0cf, 0x1f0cf], [0x1f18e, 0x1f18e], [0x1f191, 0x1f19a],
+  [0x1f1e6, 0x1f1ff], [0x1f200, 0x1f251], [0x1f300, 0x1f64f], [0x1f680, 0x1f6ff], [0x1f7e0, 0x1f7eb],
+  [0x1f90c, 0x1f9ff], [0x1fa70, 0x1faff], [0x20000, 0x2fffd], [0x30000, 0x3fffd],
+];
+
+function isWideCodePoint(cp: number) {
+  let lo = 0;
+  let hi = wideRanges.length - 1;
+  while (lo <= hi) {
+    const mid = (lo + hi) >> 1;
+    if (cp < wideRanges[mid][0]) hi = mid - 1;
+    else if (cp > wideRanges[mid][1]) lo = mid + 1;
+    else return true;
+  }
+  return false;
+}
+
+// Display cells for one grapheme: 0 for lone combining marks and zero-width characters, 2 for wide glyphs,
+// emoji sequences, and anything forced to emoji presentation (U+FE0F), otherwise 1.
+export function graphemeWidth(grapheme: string) {
+  const first = grapheme.codePointAt(0) ?? 0;
+  if (first < 0x20 || (first >= 0x7f && first < 0xa0)) return 0;
+  if (/^[\p{Mn}\p{Me}\u200b-\u200f\u2060\ufeff]+$/u.test(grapheme)) return 0;
+  if (grapheme.includes('\ufe0f')) return 2;
+  for (const ch of grapheme) {
+    if (isWideCodePoint(ch.codePointAt(0)!)) return 2;
+  }
+  return 1;
+}
+
+export function displayWidth(text: string) {
+  let width = 0;
+  for (const { segment } of graphemes.segment(text)) width += graphemeWidth(segment);
+  return width;
+}
+
+// Cuts a line to display cells [start, end). A wide glyph straddling either edge is replaced by spaces for the
+// cells that fall inside the range, so the slice keeps its width and later columns still line up.
+export function sliceColumns(line: string, start: number, end = Infinity) {
+  let col = 0;
+  let out = '';
+  for (const { segment } of graphemes.segment(line)) {
+    if (col >= end) break;
+    const width = graphemeWidth(segment);
+    const next = col + width;
+    if (col >= start && next <= end) {
+      out += segment;
+    } else if (next > start && width > 0) {
+      out += ' '.repeat(Math.min(next, end) - Math.max(col, start));
+    }
+    col = next;
+  }
+  return out;
+}
+
+export function sliceColumnRange(text: string, start = 0, end?: number) {
+  return text
+    .split('\n')
+    .map((line) => sliceColumns(line, start, end))
+    .join('\n');
+}
+
+export type CaptureOptions = {
+  joinWrapped?: boolean;
+  escapes?: boolean;
+};
+
+const ansiPalette = [
+  '#000000', '#cd0000', '#00cd00', '#cdcd00', '#0000ee', '#cd00cd', '#00cdcd', '#e5e5e5',
+  '#7f7f7f', '#ff0000', '#00ff00', '#ffff00', '#5c5cff', '#ff00ff', '#00ffff', '#ffffff',
+];
+
+function ansi256(n: number) {
+  if (n < 16) return ansiPalette[n];
+  if (n >= 232) {
+    const v = (8 + (n - 232) * 10).toString(16).padStart(2, '0');
+    return `#${v}${v}${v}`;
+  }
+  const c = n - 16;
+  const level = (x: number) => (x ? 55 + x * 40 : 0).toString(16).padStart(2, '0');
+  return `#${level(Math.floor(c / 36))}${level(Math.floor(c / 6) % 6)}${level(c % 6)}`;
+}
+
+function escapeHtml(text: string) {
+  return text.replace(/&/g, '&amp;').replace(/</g, '&lt;').replace(/>/g, '&gt;').replace(/"/g, '&quot;');
+}
+
+type SgrState = {
+  fg?: string;
+  bg?: string;
+  bold?: boolean;
+  dim?: boolean;
+  italic?: boolean;
+  underline?: boolean;
+  inverse?: boolean;
+};
+
+function applySgr(state: SgrState, params: number[]): SgrState {
+  const next = { ...state };
+  for (let i = 0; i < params.length; i++) {
+    const p = params[i];
+    if (p === 0) Object.keys(next).forEach((k) => delete next[k as keyof SgrState]);
+    else if (p === 1) next.bold = true;
+    else if (p === 2) next.dim = true;
+    else if (p === 3) next.italic = true;
+    else if (p === 4) next.underline = true;
+    else if (p === 7) next.inverse = true;
+    else if (p === 22) next.bold = next.dim = undefined;
+    else if (p === 23) next.italic = undefined;
+    else if (p === 24) next.underline = undefined;
+    else if (p === 27) next.inverse = undefined;
+    else if (p >= 30 && p <= 37) next.fg = ansiPalette[p - 30];
+    else if (p >= 90 && p <= 97) next.fg = ansiPalette[p - 90 + 8];
+    else if (p === 39) next.fg = undefined;
+    else if (p >= 40 && p <= 47) next.bg = ansiPalette[p - 40];
+    else if (p >= 100 && p <= 107) next.bg = ansiPalette[p - 100 + 8];
+    else if (p === 49) next.bg = undefined;
+    else if (p === 38 || p === 48) {
+      let color: string | undefined;
+      if (params[i + 1] === 5) {
+        color = ansi256(params[i + 2] ?? 0);
+        i += 2;
+      } else if (params[i + 1] === 2) {
+        const [r, g, b] = params.slice(i + 2, i + 5).map((v) => Math.min(255, v ?? 0).toString(16).padStart(2, '0'));
+        color = `#${r}${g}${b}`;
+        i += 4;
+      }
+      if (p === 38) next.fg = color;
+      else next.bg = color;
+    }
+  }
+  return next;
+}
+
+function sgrStyle(state: SgrState) {
+  const fg = state.inverse ? state.bg ?? '#ffffff' : state.fg;
+  const bg = state.inverse ? state.fg ?? '#000000' : state.bg;
+  const css: string[] = [];
+  if (fg) css.push(`color:${fg}`);
+  if (bg) css.push(`background-color:${bg}`);
+  if (state.bold) css.push('font-weight:bold');
+  if (state.dim) css.push('opacity:0.7');
+  if (state.italic) css.push('font-style:italic');
+  if (state.underline) css.push('text-decoration:underline');
+  return css.join(';');
+}
+
+// Minimal SGR-to-CSS conversion for captures taken with -e; other escape sequences are dropped.
+export function ansiToHtml(text: string) {
+  let state: SgrState = {};
+  let html = '';
+  // eslint-disable-next-line no-control-regex
+  const re = /\x1b\[([0-9;]*)m|\x1b\[[0-9;?]*[A-Za-ln-z]|\x1b\][^\x07\x1b]*(?:\x07|\x1b\\)|\x1b[()][0-9A-Za-z]|\x1b./g;
+  let last = 0;
+  const emit = (chunk: string) => {
+    if (!chunk) return;
+    const style = sgrStyle(state);
+    html += style ? `<span style="${style}">${escapeHtml(chunk)}</span>` : escapeHtml(chunk);
+  };
+  for (let m = re.exec(text); m; m = re.exec(text)) {
+    emit(text.slice(last, m.index));
+    last = re.lastIndex;
+    if (m[1] !== undefined) {
+      const params = m[1] === '' ? [0] : m[1].split(';').map((v) => (v === '' ? 0 : Number(v)));
+      state = applySgr(state, params);
+    }
+  }
+  emit(text.slice(last));
+  return `<pre class="tmux-pane">${html}</pre>`;
+}
+
+// With splitVisible, section says which part of the capture the link is in and line counts from that part's start.
+export type Hyperlink = { text: string; url: string; line: number; section?: 'visible' | 'scrollback' };
+
+// Strip escape sequences from a -e capture, keeping OSC 8 hyperlinks (ESC ] 8 ; params ; url ST) as a parallel
+// list of their visible text, target and 0-based line. An empty url closes the open link.
+export function extractHyperlinks(text: string) {
+  // eslint-disable-next-line no-control-regex
+  const re = /\x1b\]8;[^;\x07\x1b]*;([^\x07\x1b]*)(?:\x07|\x1b\\)|\x1b\[[0-9;?]*[ -/]*[@-~]|\x1b\][^\x07\x1b]*(?:\x07|\x1b\\)|\x1b[()][0-9A-Za-z]|\x1b./g;
+  const links: Hyperlink[] = [];
+  let plain = '';
+  let open: Hyperlink | undefined;
+  let last = 0;
+  const emit = (chunk: string) => {
+    plain += chunk;
+    if (open) open.text += chunk;
+  };
+  const close = () => {
+    if (open?.text) links.push(open);
+    open = undefined;
+  };
+  for (let m = re.exec(text); m; m = re.exec(text)) {
+    emit(text.slice(last, m.index));
+    last = re.lastIndex;
+    if (m[1] === undefined) continue;
+    close();
+    if (m[1]) open = { text: '', url: m[1], line: plain.split('\n').length - 1 };
+  }
+  emit(text.slice(last));
+  close();
+  return { text: plain, links };
+}
+
+// An explicit keepColor wins over the server default; column slicing and tab expansion measure display columns,
+// so they always get plain text.
+export function resolveKeepColor(keepColor: boolean | undefined, columns = false, stripDefault = stripAnsiDefault) {
+  return !columns && (keepColor ?? !stripDefault);
+}
+
+export function buildCaptureArgs(target: string, start?: number, end?: number, opts: CaptureOptions = {}) {
   const args = ['capture-pane', '-p', '-t', target];
+  if (opts.joinWrapped) {
+    args.push('-J'); // join wrapped lines instead of returning the on-screen wrapping
+  }
+  if (opts.escapes) {
+    args.push('-e'); // keep colour/attribute escape sequences
+  }
   if (typeof start === 'number') {
     args.push('-S', start.toString());
   } else {
@@ -352,8 +1932,130 @@ async function capturePane(target: string, start?: number, end?: number, host?:
   if (typeof end === 'number') {
     args.push('-E', end.toString());
   }
+  return args;
+}
+
+// Visible screen is lines 0.. of the viewport; scrollback is the history above it (negative lines, ending at -1).
+export function splitCaptureRanges(historyStart = -200) {
+  return {
+    visible: { start: 0, end: undefined },
+    scrollback: { start: Math.min(historyStart, -1), end: -1 },
+  };
+}
+
+async function capturePane(target: string, start?: number, end?: number, host?: string, opts: CaptureOptions = {}) {
+  return runTmux(buildCaptureArgs(target, start, end, opts), host);
+}
+
+// Capture with explicit UTF-8 validation (or transcoding from opts.encoding); `bytes` keeps the raw output for
+// callers that want it untouched.
+async function capturePaneChecked(
+  target: string,
+  start?: number,
+  end?: number,
+  host?: string,
+  opts: CaptureOptions & { encoding?: string } = {},
+) {
+  const bytes = await runTmuxBytes(buildCaptureArgs(target, start, end, opts), host);
+  const { text, hadInvalidUtf8 } = decodeCapture(bytes, opts.encoding);
+  return { text: text.trim(), hadInvalidUtf8, bytes };
+}
+
+// Fetch several pane format fields with a single display-message call. The output is bracketed so that
+// empty leading/trailing fields survive runTmux's trim.
+async function fetchPaneFields<K extends string>(target: string, fields: Record<K, string>, host?: string) {
+  const keys = Object.keys(fields) as K[];
+  const fmt = `[${keys.map((k) => fields[k]).join('\t')}]`;
+  const raw = await runTmux(['display-message', '-p', '-t', target, fmt], host);
+  return parsePaneFields(keys, raw.replace(/^\[/, '').replace(/\]$/, ''));
+}
+
+export function historyFields(meta: Record<string, string>): {
+  historySize: number;
+  historyLimit: number;
+  scrollPosition?: number;
+} {
+  return {
+    historySize: Number(meta.historySize) || 0,
+    historyLimit: Number(meta.historyLimit) || 0,
+    ...(meta.scrollPosition ? { scrollPosition: Number(meta.scrollPosition) } : {}),
+  };
+}
+
+export type HistoryLimitCheck = {
+  globalLimit: number;
+  paneLimit?: number;
+  minLines?: number;
+  short: boolean;
+  raised: boolean;
+};
+
+// Reads the global history-limit (and, with a target, the limit the pane was created with) and, when minLines is
+// more than the global limit and raise is set, raises it. tmux only applies history-limit to new panes, so a
+// raise never lengthens an existing pane's scrollback; `short` says whether the pane (else new panes) would keep
+// fewer than minLines. Raising past maxLines is refused before anything runs.
+export async function checkHistoryLimit(
+  run: (args: string[]) => Promise<string>,
+  {
+    target,
+    minLines,
+    raise = false,
+    maxLines = maxHistoryLimit,
+  }: { target?: string; minLines?: number; raise?: boolean; maxLines?: number } = {},
+): Promise<HistoryLimitCheck> {
+  if (raise && minLines !== undefined && minLines > maxLines) {
+    throw new McpError(
+      ErrorCode.InvalidParams,
+      `minLines ${minLines} is above the most tmux_history_limit may raise history-limit to (${maxLines}, ` +
+        'MCP_TMUX_MAX_HISTORY_LIMIT)',
+    );
+  }
+  const globalLimit = Number(await run(['show-options', '-gv', 'history-limit'])) || 0;
+  const paneLimit = target
+    ? Number(await run(['display-message', '-p', '-t', target, '#{history_limit}'])) || 0
+    : undefined;
+  const raised = raise && minLines !== undefined && minLines > globalLimit;
+  if (raised) await run(['set-option', '-g', 'history-limit', String(minLines)]);
+  const short = minLines !== undefined && (paneLimit ?? (raised ? minLines : globalLimit)) < minLines;
+  return { globalLimit, ...(paneLimit !== undefined ? { paneLimit } : {}), minLines, short, raised };
+}
+
+// Pane metadata capture_pane can report; fetched together in a single display-message call.
+export function captureMetaFields({
+  title = false,
+  dimensions = false,
+  cursor = false,
+  history = false,
+}: {
+  title?: boolean;
+  dimensions?: boolean;
+  cursor?: boolean;
+  history?: boolean;
+}) {
+  const fields: Record<string, string> = {};
+  if (dimensions) Object.assign(fields, { width: '#{pane_width}', height: '#{pane_height}' });
+  if (cursor) Object.assign(fields, { cursorX: '#{cursor_x}', cursorY: '#{cursor_y}' });
+  // scroll_position is only set while the pane is in copy mode.
+  if (history) {
+    Object.assign(fields, {
+      historySize: '#{history_size}',
+      historyLimit: '#{history_limit}',
+      scrollPosition: '#{scroll_position}',
+    });
+  }
+  // Titles are free text and may contain tabs, so the title goes last where parsePaneFields keeps the remainder.
+  if (title) fields.title = '#{pane_title}';
+  return fields;
+}
 
-  return runTmux(args, host);
+// The last key takes the rest of the line, tabs included, so a free-text field must be requested last.
+export function parsePaneFields<K extends string>(keys: K[], raw: string) {
+  const values = raw.split('\t');
+  const result = {} as Record<K, string>;
+  keys.forEach((k, i) => {
+    result[k] = (i === keys.length - 1 ? values.slice(i).join('\t') : values[i]) ?? '';
+  });
+  return result;
 }
 
 async function sendKeys(target: string, keys: string, enter?: boolean, host?: string) {
@@ -391,6 +2093,66 @@ async function sendKeys(target: string, keys: string, enter?: boolean, host?: st
   await runTmux(args, host);
 }
 
+// Moves to the end of the line and kills back to its start, which clears the whole input line whatever the cursor
+// position (C-u alone only clears what is left of the cursor). `keys` replaces the sequence, e.g. adding C-k for
+// readline setups where C-u stops at the cursor.
+export const defaultClearLineKeys = ['C-e', 'C-u'];
+
+// Named keys send-keys understands (matched case-insensitively, as tmux does), besides F1-F12 and single characters.
+const tmuxNamedKeys = new Set(
+  [
+    ...['Enter', 'Escape', 'Tab', 'BTab', 'Space', 'BSpace', 'Up', 'Down', 'Left', 'Right', 'Home', 'End'],
+    ...['IC', 'Insert', 'DC', 'Delete', 'NPage', 'PageDown', 'PgDn', 'PPage', 'PageUp', 'PgUp'],
+    ...['KP/', 'KP*', 'KP-', 'KP+', 'KP.', 'KPEnter', ...'0123456789'.split('').map((d) => `KP${d}`)],
+  ].map((k) => k.toLowerCase()),
+);
+
+// One tmux key: optional C-/M-/S- modifiers (or ^x) on a named key, a function key, or a single character.
+// Anything else would reach send-keys without `--` and be typed as literal text.
+export function isTmuxKeyName(key: string) {
+  let base = key;
+  while (/^[CMS]-./i.test(base)) base = base.slice(2);
+  if (/^\^\S$/.test(base) || /^F([1-9]|1[0-2])$/i.test(base)) return true;
+  return [...base].length === 1 ? /\S/u.test(base) : tmuxNamedKeys.has(base.toLowerCase());
+}
+
+export const tmuxKeyNameSchema = z
+  .string()
+  .refine(isTmuxKeyName, { message: 'Expected a tmux key name such as C-u, Escape, or BSpace' });
+
+export function buildClearLineArgs(target: string, keys: string[] = defaultClearLineKeys) {
+  if (!keys.length) throw new McpError(ErrorCode.InvalidParams, 'clearLineKeys must list at least one key');
+  const bad = keys.filter((k) => !isTmuxKeyName(k));
+  if (bad.length) {
+    throw new McpError(ErrorCode.InvalidParams, `clearLineKeys must be tmux key names, got ${JSON.stringify(bad)}`);
+  }
+  return ['send-keys', '-t', target, ...keys];
+}
+
+// Recovery sequence for a pane stuck in copy-mode or a pager: leave the mode, quit the pager, interrupt, and
+// optionally drop the scrollback.
+export function buildResetPaneCommands(target: string, inMode: boolean, clearHistory = false) {
+  const commands: string[][] = [];
+  if (inMode) {
+    commands.push(['send-keys', '-t', target, '-X', 'cancel']);
+  }
+  commands.push(['send-keys', '-t', target, 'q']);
+  commands.push(['send-keys', '-t', target, 'C-c']);
+  if (clearHistory) {
+    commands.push(['clear-history', '-t', target]);
+  }
+  return commands;
+}
+
+async function resetPane(target: string, clearHistory: boolean, host?: string) {
+  const { inMode } = await fetchPaneFields(target, { inMode: '#{pane_in_mode}' }, host);
+  const commands = buildResetPaneCommands(target, inMode === '1', clearHistory);
+  for (const args of commands) {
+    await runTmux(args, host);
+  }
+  return { wasInMode: inMode === '1', commands };
+}
+
 async function createSession(name: string, command?: string, host?: string) {
   if (!name || !name.trim()) {
     throw new McpError(ErrorCode.InvalidParams, 'session name is required');
@@ -430,6 +2192,26 @@ async function splitPane(target: string, orientation: 'horizontal' | 'vertical',
   await runTmux(args, host);
 }
 
+// kill-server takes every session on the host with it, so it needs confirm=true plus the host name typed back.
+export function assertKillServerConfirmed(host: string | undefined, confirm: boolean, hostConfirmation?: string) {
+  if (!confirm) {
+    throw new McpError(ErrorCode.InvalidParams, 'confirm=true is required to kill the tmux server');
+  }
+  const expected = host ?? 'local';
+  if (hostConfirmation !== expected) {
+    throw new McpError(
+      ErrorCode.InvalidParams,
+      `hostConfirmation must equal the target host "${expected}" to kill its tmux server`,
+    );
+  }
+}
+
+async function killServer(host?: string) {
+  const sessions = await listSessions(host).catch(() => [] as TmuxSession[]);
+  await runTmux(['kill-server'], host);
+  return sessions;
+}
+
 async function killSession(target: string, host?: string) {
   await runTmux(['kill-session', '-t', target], host);
 }
@@ -453,7 +2235,7 @@ async function renameWindow(target: string, name: string, host?: string) {
 async function ensureSession(host: string | undefined, session: string, command?: string) {
   let existed = true;
   try {
-    await runTmux(['has-session', '-t', session], host);
+    await runTmux(['has-session', '-t', `=${session}`], host);
   } catch {
     existed = false;
     const args = ['new-session', '-d', '-s', session];
@@ -465,20 +2247,204 @@ async function ensureSession(host: string | undefined, session: string, command?
   return existed;
 }
 
+// select-pane -T only retitles; it does not change the active pane.
+export function buildPaneTitleArgs(target: string | undefined, title: string) {
+  return ['select-pane', ...(target ? ['-t', target] : []), '-T', title];
+}
+
 async function setPaneTitle(target: string | undefined, title: string, host?: string) {
-  const args = ['select-pane', '-T', title];
-  if (target) {
-    args.push('-t', target);
-  }
-  await runTmux(args, host);
+  await runTmux(buildPaneTitleArgs(target, title), host);
+}
+
+// With MCP_TMUX_LOCK_DEFAULT=1 a default, once set (including from MCP_TMUX_HOST/MCP_TMUX_SESSION),
+// can only be replaced via tmux_set_default with force=true, so agents sharing a server don't stomp each other.
+const lockDefault = /^(1|true|yes)$/i.test(process.env.MCP_TMUX_LOCK_DEFAULT ?? '');
+
+export function assertDefaultWritable(
+  locked: boolean,
+  current: Record<string, string | undefined>,
+  force = false,
+) {
+  if (!locked || force) return;
+  const set = Object.entries(current).filter(([, value]) => value !== undefined);
+  if (!set.length) return;
+  throw new McpError(
+    ErrorCode.InvalidRequest,
+    `Defaults are locked (${set.map(([key, value]) => `${key}: ${value}`).join(', ')}); pass force=true to overwrite.`,
+  );
+}
+
+export type TargetDefaults = { host?: string; session?: string; window?: string; pane?: string };
+
+// Every default assignment goes through here. With the lock on and a default already set, explicit updates
+// (tmux_set_default, tmux_set_defaults activate) are refused unless forced, while tools that only set defaults
+// as a convenience (open_session, new_session, new_window, select_pane) leave them as they are.
+export function nextDefaults(
+  locked: boolean,
+  current: TargetDefaults,
+  update: TargetDefaults,
+  { force = false, implicit = false }: { force?: boolean; implicit?: boolean } = {},
+): TargetDefaults {
+  const isSet = Object.values(current).some((value) => value !== undefined);
+  if (locked && !force && isSet && implicit) return current;
+  assertDefaultWritable(locked, current, force);
+  return { ...current, ...update };
+}
+
+// Applies an update to the module defaults; false when the lock kept them unchanged.
+function setDefaults(update: TargetDefaults, opts: { force?: boolean; implicit?: boolean } = {}) {
+  const current = { host: defaultHost, session: defaultSession, window: defaultWindow, pane: defaultPane };
+  const next = nextDefaults(lockDefault, current, update, opts);
+  ({ host: defaultHost, session: defaultSession, window: defaultWindow, pane: defaultPane } = next);
+  return next !== current;
 }
 
+const defaultsLockedNote = ' Defaults are locked (MCP_TMUX_LOCK_DEFAULT) and were left unchanged.';
+
 function summarizeDefaults() {
+  const saved = Object.entries(hostDefaults).map(
+    ([host, d]) =>
+      `  ${host}: session=${d.session ?? '(unset)'} window=${d.window ?? '(unset)'} pane=${d.pane ?? '(unset)'}`,
+  );
   return [
     `host: ${defaultHost ?? '(unset)'}`,
     `session: ${defaultSession ?? '(unset)'}`,
     `window: ${defaultWindow ?? '(unset)'}`,
     `pane: ${defaultPane ?? '(unset)'}`,
+    ...(saved.length ? ['saved per-host defaults:', ...saved] : []),
+  ].join('\n');
+}
+
+export type HostDefaults = { session?: string; window?: string; pane?: string };
+
+// Folds a batch of per-host defaults into the saved set. Omitted fields keep their saved value, an empty string
+// clears one, and a host left with nothing is dropped. The host "local" stands for the local tmux server.
+export function mergeHostDefaults(
+  saved: Record<string, HostDefaults>,
+  entries: ({ host: string } & HostDefaults)[],
+): Record<string, HostDefaults> {
+  const seen = new Set<string>();
+  const next = { ...saved };
+  for (const { host, ...fields } of entries) {
+    if (!host?.trim()) throw new McpError(ErrorCode.InvalidParams, 'every defaults entry needs a host');
+    if (seen.has(host)) throw new McpError(ErrorCode.InvalidParams, `host ${host} is listed more than once`);
+    seen.add(host);
+    const merged: HostDefaults = { ...next[host] };
+    for (const key of ['session', 'window', 'pane'] as const) {
+      if (fields[key] === undefined) continue;
+      if (fields[key]) merged[key] = fields[key];
+      else delete merged[key];
+    }
+    if (Object.keys(merged).length) next[host] = merged;
+    else delete next[host];
+  }
+  return next;
+}
+
+// activate must name a host with saved defaults (or local); anything else would silently clear the defaults.
+export function assertKnownDefaultsHost(saved: Record<string, HostDefaults>, host: string) {
+  if (host === 'local' || saved[host]) return;
+  const known = [...new Set(['local', ...Object.keys(saved)])].join(', ');
+  throw new McpError(ErrorCode.InvalidParams, `No saved defaults for host ${host} (known: ${known})`);
+}
+
+export async function readHostDefaults(file = hostDefaultsPath): Promise<Record<string, HostDefaults>> {
+  try {
+    return JSON.parse(await fs.readFile(file, 'utf8')) as Record<string, HostDefaults>;
+  } catch (error) {
+    if ((error as NodeJS.ErrnoException).code !== 'ENOENT') {
+      console.warn(`Failed to read defaults file at ${file}:`, error);
+    }
+    return {};
+  }
+}
+
+export async function writeHostDefaults(saved: Record<string, HostDefaults>, file = hostDefaultsPath) {
+  try {
+    await fs.mkdir(path.dirname(file), { recursive: true });
+    await fs.writeFile(file, JSON.stringify(saved, null, 2), 'utf8');
+  } catch (error) {
+    console.warn(`Failed to persist defaults to ${file}:`, error);
+  }
+}
+
+async function loadHostDefaults() {
+  hostDefaults = await readHostDefaults();
+}
+
+export type ServerDescription = {
+  package: string;
+  version: string;
+  repository: string;
+  auth: string;
+  hosts: { host: string; profile: boolean; tmuxVersion?: string; error?: string }[];
+  defaults: Record<string, string | undefined>;
+  features: Record<string, boolean>;
+};
+
+// One-shot introspection for clients that would otherwise call server_info, get_default and health per host.
+export async function describeServer(
+  probe: (host: string | undefined) => Promise<string> = (host) => runTmux(['-V'], host),
+): Promise<ServerDescription> {
+  const names = [...new Set(['local', ...(defaultHost ? [defaultHost] : []), ...Object.keys(hostProfiles)])];
+  const versions = await Promise.allSettled(names.map((host) => probe(host === 'local' ? undefined : host)));
+  return {
+    package: PACKAGE_NAME,
+    version: VERSION,
+    repository: REPO_URL,
+    auth: 'none (stdio)',
+    hosts: names.map((host, i) => {
+      const result = versions[i];
+      const profile = Boolean(hostProfiles[host]);
+      return result.status === 'fulfilled'
+        ? { host, profile, tmuxVersion: result.value.trim() }
+        : { host, profile, error: (result.reason as Error)?.message ?? String(result.reason) };
+    }),
+    defaults: { host: defaultHost, session: defaultSession, window: defaultWindow, pane: defaultPane },
+    features: {
+      tracing: Boolean(spanExporter),
+      lockDefault,
+      readOnly: readOnlyMode,
+      controlMode: controlModeEnabled,
+      logRotation: logMaxBytes > 0,
+      auditSampling: Object.keys(auditSampleRates).length > 0,
+      sshKeepalive: sshAliveIntervalSec > 0,
+    },
+  };
+}
+
+export type PingResult = { serverTime: string; host: string; tmuxRoundTripMs?: number; reply?: string };
+
+// Side-effect-free latency probe: server time plus, optionally, a display-message round trip through tmux/ssh.
+export async function ping(
+  host: string | undefined,
+  throughTmux = true,
+  probe: (host: string | undefined) => Promise<string> = (h) => runTmux(['display-message', '-p', 'pong'], h),
+): Promise<PingResult> {
+  const result: PingResult = { serverTime: isoTimestamp(), host: host ?? 'local' };
+  if (!throughTmux) return result;
+  const started = performance.now();
+  result.reply = await probe(host);
+  result.tmuxRoundTripMs = Math.round(performance.now() - started);
+  return result;
+}
+
+function formatServerDescription(desc: ServerDescription) {
+  return [
+    `Package: ${desc.package}`,
+    `Version: ${desc.version}`,
+    `Repository: ${desc.repository}`,
+    `Auth: ${desc.auth}`,
+    'Hosts:',
+    ...desc.hosts.map(
+      (h) => `  ${h.host}${h.profile ? ' (profile)' : ''}: ${h.tmuxVersion ?? `unreachable (${h.error})`}`,
+    ),
+    `Defaults -> ${Object.entries(desc.defaults)
+      .map(([key, value]) => `${key}: ${value ?? '(unset)'}`)
+      .join(', ')}`,
+    `Features: ${Object.entries(desc.features)
+      .map(([key, on]) => `${key}=${on ? 'on' : 'off'}`)
+      .join(', ')}`,
   ].join('\n');
 }
 
@@ -514,9 +2480,71 @@ function formatPanes(panes: TmuxPane[]) {
     .join('\n');
 }
 
-function getHostProfile(host?: string) {
+export type HostOverride = { tmuxBin?: string; pathAdd?: string[] };
+
+// Absolute directory made only of characters that are inert in a POSIX shell word and in PATH.
+const safePathEntry = /^\/[A-Za-z0-9_.\/+@-]*$/;
+
+// Per-request host settings from _meta: `x-tmux-host-override: { tmuxBin?, pathAdd? }` replaces the host's profile
+// for that call, and `x-tmux-ignore-profile: true` runs with built-in defaults. Handy for one-off hosts and tests.
+// tmuxBin must be a binary some profile (or TMUX_BIN) already declares, pathAdd entries must be plain absolute paths,
+// and read-only servers refuse overrides outright since they would otherwise change what runs remotely.
+export function hostOverrideFromMeta(
+  meta: Record<string, unknown> | undefined,
+  profiles = hostProfiles,
+  readOnly = readOnlyMode,
+): HostOverride | undefined {
+  const supplied = meta?.['x-tmux-host-override'];
+  const ignoreProfile = meta?.['x-tmux-ignore-profile'] === true;
+  if (readOnly && (supplied !== undefined || ignoreProfile)) {
+    throw new McpError(
+      ErrorCode.InvalidRequest,
+      'x-tmux-host-override and x-tmux-ignore-profile are not allowed: the server is read-only (MCP_TMUX_READ_ONLY)',
+    );
+  }
+  if (supplied !== undefined) {
+    const { tmuxBin, pathAdd } = (supplied ?? {}) as Record<string, unknown>;
+    const validBin = tmuxBin === undefined || (typeof tmuxBin === 'string' && tmuxBin.length > 0);
+    const validPath = pathAdd === undefined || (Array.isArray(pathAdd) && pathAdd.every((p) => typeof p === 'string'));
+    if (typeof supplied !== 'object' || supplied === null || !validBin || !validPath) {
+      throw new McpError(
+        ErrorCode.InvalidParams,
+        'x-tmux-host-override must be an object with optional tmuxBin (string) and pathAdd (string[])',
+      );
+    }
+    const knownBins = new Set([tmuxBinary, ...Object.values(profiles).flatMap((p) => (p.tmuxBin ? [p.tmuxBin] : []))]);
+    if (tmuxBin !== undefined && !knownBins.has(tmuxBin as string)) {
+      throw new McpError(
+        ErrorCode.InvalidParams,
+        `x-tmux-host-override tmuxBin must be TMUX_BIN or a tmuxBin declared in ${hostProfilePath}`,
+      );
+    }
+    const badEntry = ((pathAdd ?? []) as string[]).find((entry) => !safePathEntry.test(entry));
+    if (badEntry !== undefined) {
+      throw new McpError(
+        ErrorCode.InvalidParams,
+        `x-tmux-host-override pathAdd entries must be absolute paths without shell metacharacters (got ${JSON.stringify(
+          badEntry,
+        )})`,
+      );
+    }
+    return { tmuxBin: tmuxBin as string | undefined, pathAdd: pathAdd as string[] | undefined };
+  }
+  return ignoreProfile ? {} : undefined;
+}
+
+export function resolveHostProfile(
+  host: string | undefined,
+  profiles = hostProfiles,
+  override = requestContext.getStore()?.hostOverride,
+) {
+  if (override) return override;
   if (!host) return undefined;
-  return hostProfiles[host];
+  return profiles[host];
+}
+
+function getHostProfile(host?: string) {
+  return resolveHostProfile(host);
 }
 
 export function buildPath(current: string | undefined, additions: string[]) {
@@ -556,6 +2584,30 @@ async function loadLayoutProfiles() {
   }
 }
 
+async function loadMacros() {
+  try {
+    const parsed = parseMacroFile(await fs.readFile(macroPath, 'utf8'));
+    for (const problem of parsed.problems) console.warn(`Skipping macro in ${macroPath}: ${problem}`);
+    macros = parsed.macros;
+  } catch (error) {
+    if ((error as NodeJS.ErrnoException).code !== 'ENOENT') {
+      console.warn(`Failed to read macro file at ${macroPath}:`, error);
+    }
+    macros = new Map();
+  }
+}
+
+// Only macros defined with persist=true are written; the rest live for the lifetime of the server.
+async function persistMacros() {
+  const saved = Object.fromEntries([...macros].filter(([, m]) => m.persist));
+  try {
+    await fs.mkdir(path.dirname(macroPath), { recursive: true });
+    await fs.writeFile(macroPath, JSON.stringify(saved, null, 2), 'utf8');
+  } catch (error) {
+    console.warn(`Failed to persist macros to ${macroPath}:`, error);
+  }
+}
+
 async function persistLayouts() {
   try {
     await fs.mkdir(path.dirname(layoutProfilePath), { recursive: true });
@@ -565,17 +2617,79 @@ async function persistLayouts() {
   }
 }
 
-async function buildStateSnapshot({
-  host,
-  session,
-  captureLines = 200,
-}: {
-  host?: string;
-  session?: string;
-  captureLines?: number;
-}) {
+// Marks where state snapshots cut a capture to fit maxTotalBytes.
+const defaultTruncationMarker = '...[truncated]...';
+
+export type CappedCapture = { target: string; text: string; droppedBytes: number; omitted: boolean };
+
+// Shares one byte budget across captures in order: each is kept whole while it fits, the one that crosses the
+// budget keeps its newest bytes behind the marker line, and the rest are omitted. The marker line counts against
+// the budget, so the returned texts never add up to more than maxTotalBytes; a capture with no room left after
+// the marker is omitted.
+export function capTotalBytes(
+  captures: { target: string; text: string }[],
+  maxTotalBytes: number,
+  marker = defaultTruncationMarker,
+): CappedCapture[] {
+  let remaining = maxTotalBytes;
+  return captures.map(({ target, text }) => {
+    const bytes = Buffer.byteLength(text);
+    if (bytes <= remaining) {
+      remaining -= bytes;
+      return { target, text, droppedBytes: 0, omitted: false };
+    }
+    const room = remaining - Buffer.byteLength(`${marker}\n`);
+    remaining = 0;
+    if (room <= 0) return { target, text: '', droppedBytes: bytes, omitted: true };
+    const cut = keepLastBytes(text, room, marker);
+    return { target, text: cut.text, droppedBytes: cut.droppedBytes, omitted: false };
+  });
+}
+
+// One blob for reading several captures at a glance: each pane under a `=== pane %id ===` header, in order.
+export function mergeCaptures(captures: CappedCapture[]) {
+  return captures
+    .map((c) => {
+      if (c.omitted) return `=== pane ${c.target} (omitted: maxTotalBytes reached) ===`;
+      const note = c.droppedBytes ? ` (truncated: dropped the first ${c.droppedBytes} bytes)` : '';
+      return `=== pane ${c.target}${note} ===\n${c.text || '(empty)'}`;
+    })
+    .join('\n\n');
+}
+
+// metadataOnly skips capture-pane entirely, for clients polling topology that do not need pane content.
+// captureTargets captures several panes instead of the default/active one (allPanes: every listed pane, merged
+// into one blob); maxTotalBytes bounds their pane text together. The merged blob's headers, truncation notes and
+// separators come on top of that budget.
+export async function buildStateSnapshot(
+  {
+    host,
+    session,
+    captureLines = 200,
+    metadataOnly = false,
+    captureTargets,
+    maxTotalBytes,
+    allPanes = false,
+  }: {
+    host?: string;
+    session?: string;
+    captureLines?: number;
+    metadataOnly?: boolean;
+    captureTargets?: string[];
+    maxTotalBytes?: number;
+    allPanes?: boolean;
+  },
+  io: {
+    listSessions: typeof listSessions;
+    listWindows: typeof listWindows;
+    listPanes: typeof listPanes;
+    capture: typeof capturePane;
+    // The host's default pane, from the same per-host saved defaults the session comes from.
+    paneDefault?: (host?: string) => string | undefined;
+  } = { listSessions, listWindows, listPanes, capture: capturePane },
+) {
   const resolvedHost = resolveHost(host);
-  const resolvedSession = resolveSession(session);
+  const resolvedSession = resolveSession(session, host);
   if (!resolvedSession) {
     throw new McpError(
       ErrorCode.InvalidParams,
@@ -583,15 +2697,32 @@ async function buildStateSnapshot({
     );
   }
 
-  const sessions = await listSessions(resolvedHost);
-  const windows = await listWindows(resolvedSession, resolvedHost);
-  const panes = await listPanes(resolvedSession, resolvedHost);
+  const sessions = await io.listSessions(resolvedHost);
+  const windows = await io.listWindows(resolvedSession, resolvedHost);
+  const panes = await io.listPanes(resolvedSession, resolvedHost);
   const activeWindow = windows.find((w) => w.active);
-  const activePane = panes.find((p) => p.active && (!defaultPane || p.id === defaultPane)) || panes.find((p) => p.active);
-  const targetPane = defaultPane ?? activePane?.id;
-  let capture = '(no capture target)';
-  if (targetPane) {
-    capture = await capturePane(targetPane, -captureLines, undefined, resolvedHost);
+  const hostPane = (io.paneDefault ?? ((h?: string) => resolvePaneTarget(undefined, h)))(host);
+  const activePane = panes.find((p) => p.active && (!hostPane || p.id === hostPane)) || panes.find((p) => p.active);
+  const targetPane = hostPane ?? activePane?.id;
+  let capture: string | undefined = '(no capture target)';
+  let captures: CappedCapture[] | undefined;
+  let merged: string | undefined;
+  const targets = captureTargets?.length ? captureTargets : allPanes ? panes.map((p) => p.id) : undefined;
+  if (metadataOnly) {
+    capture = undefined;
+  } else if (targets?.length) {
+    capture = undefined;
+    const raw: { target: string; text: string }[] = [];
+    for (const target of targets) {
+      raw.push({ target, text: await io.capture(target, -captureLines, undefined, resolvedHost) });
+    }
+    captures = capTotalBytes(raw, maxTotalBytes ?? Infinity);
+    if (allPanes) merged = mergeCaptures(captures);
+  } else if (targetPane) {
+    capture = await io.capture(targetPane, -captureLines, undefined, resolvedHost);
+    if (maxTotalBytes !== undefined) {
+      capture = capTotalBytes([{ target: targetPane, text: capture }], maxTotalBytes)[0].text;
+    }
   }
 
   return {
@@ -601,12 +2732,43 @@ async function buildStateSnapshot({
     panes,
     captureTarget: targetPane,
     capture,
+    captures,
+    merged,
     sessionsText: formatSessions(sessions),
     windowsText: formatWindows(windows),
     panesText: formatPanes(panes),
   };
 }
 
+function formatStateSnapshot(snapshot: Awaited<ReturnType<typeof buildStateSnapshot>>, captureLines: number) {
+  const captures =
+    snapshot.merged !== undefined
+      ? [`Captures (last ${captureLines} lines each):`, snapshot.merged, '']
+      : (snapshot.captures ?? []).flatMap((c) => {
+          if (c.omitted) return [`Capture ${c.target}: (omitted: maxTotalBytes reached)`, ''];
+          const note = c.droppedBytes ? ` (truncated: dropped the first ${c.droppedBytes} bytes)` : '';
+          return [`Capture ${c.target} (last ${captureLines} lines)${note}:`, c.text, ''];
+        });
+  const target = snapshot.captures
+    ? snapshot.captures.map((c) => c.target).join(', ')
+    : (snapshot.captureTarget ?? '(none)');
+  return [
+    `Host: ${snapshot.host}`,
+    `Session: ${snapshot.session}`,
+    `Capture target: ${target}`,
+    '',
+    snapshot.sessionsText,
+    '',
+    snapshot.windowsText,
+    '',
+    snapshot.panesText,
+    '',
+    ...(snapshot.capture !== undefined ? [`Capture (last ${captureLines} lines):`, snapshot.capture, ''] : []),
+    ...captures,
+    defaultTargetNote(),
+  ].join('\n');
+}
+
 async function captureLayouts(session: string, host?: string) {
   const fmt = '#{window_id}\t#{window_layout}\t#{window_name}\t#{window_index}';
   const output = await runTmux(['list-windows', '-t', session, '-F', fmt], host);
@@ -623,155 +2785,1405 @@ async function applyLayout(target: string, layout: string, host?: string) {
   await runTmux(['select-layout', '-t', target, layout], host);
 }
 
-async function tailPane({
-  host,
-  target,
-  lines,
-  iterations,
-  intervalMs,
-}: {
-  host?: string;
-  target: string;
-  lines: number;
-  iterations: number;
-  intervalMs: number;
-}) {
-  const resolvedHost = resolveHost(host);
-  let lastCapture = '';
-  for (let i = 0; i < iterations; i++) {
-    lastCapture += `\n--- tail iteration ${i + 1}/${iterations} ---\n`;
-    lastCapture += await capturePane(target, -lines, undefined, resolvedHost);
-    if (i < iterations - 1) {
-      await new Promise((r) => setTimeout(r, intervalMs));
+// A window layout as a tree: leaves are panes, inner cells split their area left-right ({...}) or
+// top-bottom ([...]).
+export type LayoutCell = {
+  width: number;
+  height: number;
+  x: number;
+  y: number;
+  paneId?: number;
+  split?: 'left-right' | 'top-bottom';
+  children?: LayoutCell[];
+};
+
+// tmux's layout checksum (layout_checksum in layout-custom.c): a 16-bit rotate-and-add over the layout body.
+export function layoutChecksum(body: string) {
+  let csum = 0;
+  for (let i = 0; i < body.length; i++) {
+    csum = (csum >> 1) + ((csum & 1) << 15);
+    csum = (csum + body.charCodeAt(i)) & 0xffff;
+  }
+  return csum.toString(16).padStart(4, '0');
+}
+
+export function parseLayout(layout: string): { checksum: string; root: LayoutCell } {
+  const prefix = /^([0-9a-f]{4}),/.exec(layout);
+  if (!prefix) throw new McpError(ErrorCode.InvalidParams, 'layout must start with a 4-digit hex checksum');
+  const body = layout.slice(prefix[0].length);
+  if (layoutChecksum(body) !== prefix[1]) {
+    throw new McpError(ErrorCode.InvalidParams, `layout checksum mismatch (expected ${layoutChecksum(body)})`);
+  }
+  let pos = 0;
+  const fail = (what: string): never => {
+    throw new McpError(ErrorCode.InvalidParams, `invalid layout at offset ${pos}: expected ${what}`);
+  };
+  const number = () => {
+    const m = /^\d+/.exec(body.slice(pos));
+    if (!m) fail('a number');
+    pos += m![0].length;
+    return Number(m![0]);
+  };
+  const expect = (ch: string) => {
+    if (body[pos] !== ch) fail(`"${ch}"`);
+    pos++;
+  };
+  const cell = (): LayoutCell => {
+    const width = number();
+    expect('x');
+    const height = number();
+    expect(',');
+    const x = number();
+    expect(',');
+    const y = number();
+    const open = body[pos];
+    if (open === '{' || open === '[') {
+      pos++;
+      const close = open === '{' ? '}' : ']';
+      const children = [cell()];
+      while (body[pos] === ',') {
+        pos++;
+        children.push(cell());
+      }
+      expect(close);
+      return { width, height, x, y, split: open === '{' ? 'left-right' : 'top-bottom', children };
     }
+    expect(',');
+    return { width, height, x, y, paneId: number() };
+  };
+  const root = cell();
+  if (pos !== body.length) fail('end of layout');
+  return { checksum: prefix[1], root };
+}
+
+// Checks a layout string with the same parser select-layout input goes through (checksum included).
+// Returns the reason when the layout is malformed, undefined otherwise.
+export function validateLayoutString(layout: string) {
+  try {
+    parseLayout(layout);
+    return undefined;
+  } catch (error) {
+    return (error as McpError).message;
   }
-  return lastCapture.trim();
 }
 
-function extractRecentCommands(text: string, max = 15) {
-  const cmds: string[] = [];
-  const lines = text.split('\n');
-  const promptPattern = /[$#>] ([^\s].*)$/;
-  for (let i = lines.length - 1; i >= 0 && cmds.length < max; i--) {
-    const line = lines[i];
-    const match = line.match(promptPattern);
-    if (match && match[1]) {
-      cmds.push(match[1]);
+function layoutBody(cell: LayoutCell): string {
+  const head = `${cell.width}x${cell.height},${cell.x},${cell.y}`;
+  if (cell.children?.length) {
+    const [open, close] = cell.split === 'top-bottom' ? ['[', ']'] : ['{', '}'];
+    return `${head}${open}${cell.children.map(layoutBody).join(',')}${close}`;
+  }
+  if (cell.paneId === undefined) {
+    throw new McpError(ErrorCode.InvalidParams, `layout cell ${head} needs either paneId or children`);
+  }
+  return `${head},${cell.paneId}`;
+}
+
+// Serializes a layout tree back into the string select-layout accepts, with a freshly computed checksum.
+export function buildLayout(root: LayoutCell) {
+  const body = layoutBody(root);
+  return `${layoutChecksum(body)},${body}`;
+}
+
+const layoutCellSchema: z.ZodType<LayoutCell> = z.lazy(() =>
+  z.object({
+    width: z.number().int().min(1),
+    height: z.number().int().min(1),
+    x: z.number().int().min(0),
+    y: z.number().int().min(0),
+    paneId: z.number().int().min(0).describe('Pane number (the digits of %N) for leaf cells.').optional(),
+    split: z.enum(['left-right', 'top-bottom']).describe('How children divide this cell.').optional(),
+    children: z.array(layoutCellSchema).optional(),
+  }),
+);
+
+export type LayoutApplyResult = {
+  target: string;
+  status: 'applied' | 'invalid' | 'failed' | 'skipped';
+  error?: string;
+};
+
+export async function applyLayouts(
+  entries: { target: string; layout: string }[],
+  { host, atomic = false }: { host?: string; atomic?: boolean },
+  apply: (target: string, layout: string, host?: string) => Promise<void> = applyLayout,
+) {
+  const results = entries.map((e): LayoutApplyResult => {
+    const error = validateLayoutString(e.layout);
+    return error ? { target: e.target, status: 'invalid', error } : { target: e.target, status: 'skipped' };
+  });
+  // Atomic mode refuses to touch anything if any layout is malformed.
+  if (atomic && results.some((r) => r.status === 'invalid')) {
+    return results;
+  }
+  for (let i = 0; i < entries.length; i++) {
+    if (results[i].status === 'invalid') continue;
+    try {
+      await apply(entries[i].target, entries[i].layout, host);
+      results[i] = { target: entries[i].target, status: 'applied' };
+    } catch (error) {
+      results[i] = { target: entries[i].target, status: 'failed', error: (error as Error).message };
+      if (atomic) break;
     }
   }
-  return cmds.reverse();
+  return results;
 }
 
-const auditFlags: Record<string, boolean> = {};
+export type LayoutPlanResult = {
+  target: string;
+  status: 'will-change' | 'no-op' | 'invalid' | 'failed';
+  current?: string;
+  error?: string;
+};
 
-function auditKey(host?: string, session?: string) {
-  return `${host ?? defaultHost ?? 'local'}:${session ?? defaultSession ?? 'unknown'}`;
+async function readWindowLayout(target: string, host?: string) {
+  return runTmux(['display-message', '-p', '-t', target, '#{window_layout}'], host);
 }
 
-function isAuditEnabled(host?: string, session?: string) {
-  return Boolean(auditFlags[auditKey(host, session)]);
+// Dry run for applyLayouts: compares each requested layout with the window's current one without applying.
+export async function planLayouts(
+  entries: { target: string; layout: string }[],
+  host?: string,
+  read: (target: string, host?: string) => Promise<string> = readWindowLayout,
+): Promise<LayoutPlanResult[]> {
+  return Promise.all(
+    entries.map(async ({ target, layout }): Promise<LayoutPlanResult> => {
+      const error = validateLayoutString(layout);
+      if (error) return { target, status: 'invalid', error };
+      try {
+        const current = await read(target, host);
+        return { target, status: current === layout ? 'no-op' : 'will-change', current };
+      } catch (err) {
+        return { target, status: 'failed', error: (err as Error).message };
+      }
+    }),
+  );
 }
 
-function setAuditEnabled(host: string | undefined, session: string | undefined, enabled: boolean) {
-  auditFlags[auditKey(host, session)] = enabled;
+// Lines of `next` that were appended after `prev`, where both are tail captures of the same pane. Matches the
+// longest suffix of prev that is also a prefix of next; with no overlap at all, everything in next is new.
+export function appendedLines(prev: string, next: string) {
+  const a = prev ? prev.split('\n') : [];
+  const b = next ? next.split('\n') : [];
+  for (let k = Math.min(a.length, b.length); k > 0; k--) {
+    let match = true;
+    for (let i = 0; i < k; i++) {
+      if (a[a.length - k + i] !== b[i]) {
+        match = false;
+        break;
+      }
+    }
+    if (match) return b.slice(k);
+  }
+  return b;
 }
 
-async function auditLog(host: string | undefined, session: string | undefined, event: string, meta?: unknown) {
-  if (!isAuditEnabled(host, session)) return;
-  const h = sanitizePathSegment(host ?? defaultHost, 'local');
-  const s = sanitizePathSegment(session ?? defaultSession, 'unknown');
-  const dir = path.join(logBaseDir, h, s);
-  const file = path.join(dir, `audit-${isoTimestamp().slice(0, 10)}.log`);
-  await fs.mkdir(dir, { recursive: true });
-  const line = `[${isoTimestamp()}] ${event}${meta !== undefined ? ` ${JSON.stringify(meta)}` : ''}\n`;
-  await fs.appendFile(file, line);
+export type MatchPosition = { line: number; byteOffset: number; text: string; groups: (string | null)[] };
+
+// Every match of regex with its 0-based line index, UTF-8 byte offset within that line, and capture groups.
+export function findMatches(text: string, regex: RegExp): MatchPosition[] {
+  const global = new RegExp(regex.source, regex.flags.includes('g') ? regex.flags : `${regex.flags}g`);
+  const out: MatchPosition[] = [];
+  text.split('\n').forEach((line, index) => {
+    global.lastIndex = 0;
+    for (let m = global.exec(line); m; m = global.exec(line)) {
+      out.push({
+        line: index,
+        byteOffset: Buffer.byteLength(line.slice(0, m.index)),
+        text: m[0],
+        groups: m.slice(1).map((g) => g ?? null),
+      });
+      if (m[0] === '') global.lastIndex++;
+    }
+  });
+  return out;
 }
 
-function getSessionFromTarget(target: string | undefined) {
-  if (!target) return defaultSession;
-  const parts = target.split(':');
-  return parts[0] || defaultSession;
+// grep -C style filtering: keeps matching lines plus `context` lines around them, merging overlapping windows
+// and separating the rest with `--`. maxMatches keeps only the last N matches (the most recent output).
+export function grepLines(
+  text: string,
+  regex: RegExp,
+  { context = 0, maxMatches }: { context?: number; maxMatches?: number } = {},
+) {
+  const lines = text.split('\n');
+  let hits = lines.flatMap((line, i) => (regex.test(line) ? [i] : []));
+  const total = hits.length;
+  if (maxMatches !== undefined && maxMatches > 0 && hits.length > maxMatches) hits = hits.slice(-maxMatches);
+  const out: string[] = [];
+  let lastEnd = -1;
+  for (const i of hits) {
+    const from = Math.max(0, i - context, lastEnd + 1);
+    const to = Math.min(lines.length - 1, i + context);
+    if (from > to) continue;
+    if (lastEnd >= 0 && from > lastEnd + 1) out.push('--');
+    out.push(...lines.slice(from, to + 1));
+    lastEnd = to;
+  }
+  return { text: out.join('\n'), total, shown: hits.length };
 }
 
-async function appendSessionLog(host: string | undefined, session: string | undefined, message: string) {
-  const h = sanitizePathSegment(host ?? defaultHost, 'local');
-  const s = sanitizePathSegment(session ?? defaultSession, 'unknown');
-  const dir = path.join(logBaseDir, h, s);
-  const file = path.join(dir, `${isoTimestamp().slice(0, 10)}.log`);
-  await fs.mkdir(dir, { recursive: true });
-  await fs.appendFile(file, `[${isoTimestamp()}] ${message}\n`);
+// The cursor line may have been edited since the baseline (typed input), so only earlier lines anchor the
+// overlap; text already on the cursor line (e.g. the prompt itself) is dropped so it cannot match again.
+export function newOutputSince(baseline: string, current: string) {
+  const lines = baseline.split('\n');
+  const cursorLine = lines.pop() ?? '';
+  const added = appendedLines(lines.join('\n'), current);
+  if (cursorLine && added[0]?.startsWith(cursorLine)) added[0] = added[0].slice(cursorLine.length);
+  return added.join('\n');
 }
 
-async function captureHistory({
-  host,
-  session,
-  target,
-  lines = 800,
-  allPanes = false,
-}: {
-  host?: string;
-  session?: string;
-  target?: string;
-  lines?: number;
-  allPanes?: boolean;
-}) {
-  const resolvedHost = resolveHost(host);
-  if (target) {
-    const capture = await capturePane(target, -lines, undefined, resolvedHost);
-    return { captures: [{ target, text: capture }], commands: extractRecentCommands(capture) };
+export async function waitForPattern(
+  capture: () => Promise<string>,
+  regex: RegExp,
+  { timeoutMs, intervalMs, baseline }: { timeoutMs: number; intervalMs: number; baseline?: string },
+) {
+  const started = Date.now();
+  for (;;) {
+    const current = await capture();
+    const text = baseline === undefined ? current : newOutputSince(baseline, current);
+    const match = regex.exec(text);
+    const elapsedMs = Date.now() - started;
+    if (match) return { matched: true, match: match[0], text, elapsedMs };
+    if (elapsedMs + intervalMs > timeoutMs) return { matched: false, text, elapsedMs };
+    await new Promise((r) => setTimeout(r, intervalMs));
   }
-  const resolvedSession = requireSession(session);
-  const panes = await listPanes(resolvedSession, resolvedHost);
-  const targets = allPanes ? panes : panes.filter((p) => p.active);
-  const captures = await Promise.all(
-    targets.map(async (p) => ({
-      target: `${p.session}:${p.window}.${p.index}`,
-      text: await capturePane(p.id, -lines, undefined, resolvedHost),
-    })),
-  );
-  const combinedText = captures.map((c) => c.text).join('\n');
-  return { captures, commands: extractRecentCommands(combinedText) };
 }
 
-async function listDirSimple(dir: string, host?: string) {
-  if (host) {
-    assertValidHost(host);
-    const { stdout } = await execa('ssh', ['-T', host, 'ls', '-1', dir], { timeout: tmuxCommandTimeoutMs });
-    return stdout.split('\n').filter(Boolean);
+export const defaultPromptSentinel = '[mcp-ready]';
+const promptSentinelOption = '@mcp_prompt_sentinel';
+
+// Sentinels end up inside PS1 and a regex, so keep them to characters neither bash nor zsh prompt expansion touches.
+export function assertPromptSentinel(sentinel: string) {
+  if (!/^[\w.:@+=[\]-]{3,32}$/.test(sentinel)) {
+    throw new McpError(ErrorCode.InvalidParams, 'sentinel must be 3-32 characters of [A-Za-z0-9_.:@+=[]-]');
   }
-  const entries = await fs.readdir(dir);
-  return entries.sort();
 }
 
-export function diffNewFiles(prev: string[], next: string[]) {
-  const prevSet = new Set(prev);
-  return next.filter((f) => !prevSet.has(f));
+// Appends the sentinel to PS1 (bash/zsh/sh). The sentinel is quoted apart from ${PS1} so zsh cannot read it as a
+// subscript, and the leading space keeps the line out of history under HISTCONTROL=ignorespace.
+export function buildPromptSentinelCommand(sentinel: string) {
+  assertPromptSentinel(sentinel);
+  return ` PS1="\${PS1}"'${sentinel} '`;
 }
 
-async function fanoutSendCapture({
-  targets,
-  keys,
-  enter,
-  capture = true,
-  captureLines = 200,
-  delayMs = 0,
-  mode = 'send_capture',
-  pattern,
-  patternFlags,
-  tailIterations = 3,
-  tailIntervalMs = 1000,
-}: {
-  targets: { host?: string; target?: string; captureLines?: number; delayMs?: number }[];
-  keys: string;
-  enter: boolean;
-  capture?: boolean;
-  captureLines?: number;
-  delayMs?: number;
-  mode?: 'send_capture' | 'tail' | 'pattern';
-  pattern?: string;
-  patternFlags?: string;
-  tailIterations?: number;
-  tailIntervalMs?: number;
+// The pane is at its prompt when the (trimmed) capture ends with the sentinel; a typed or echoed command follows
+// it on the same line, so a running command never matches.
+export function promptSentinelPattern(sentinel: string) {
+  return new RegExp(`${sentinel.replace(/[.+[\]]/g, '\\$&')}\\s*$`);
+}
+
+const posixShells = new Set(['bash', 'zsh', 'sh', 'dash', 'ksh', 'mksh', 'ash']);
+
+// Login shells report argv[0] with a leading '-' (e.g. -bash, -zsh); drop it before comparing by name.
+export function commandName(command: string) {
+  return command.trim().replace(/^-/, '');
+}
+
+export function isPosixShell(command: string) {
+  return posixShells.has(commandName(command));
+}
+
+// Injects the sentinel once per pane (remembered in the @mcp_prompt_sentinel pane option) and waits for the new
+// prompt to show it, so callers learn straight away when the shell does not honour PS1 (e.g. fish).
+export async function configurePromptSentinel(
+  target: string,
+  sentinel: string,
+  { force = false, timeoutMs = 5000, intervalMs = 200 }: { force?: boolean; timeoutMs?: number; intervalMs?: number },
+  io: {
+    run: (args: string[]) => Promise<string>;
+    send: (keys: string) => Promise<void>;
+    capture: () => Promise<string>;
+  },
+) {
+  const command = buildPromptSentinelCommand(sentinel);
+  const current = await io.run(['show-options', '-pqv', '-t', target, promptSentinelOption]).catch(() => '');
+  if (current.trim() === sentinel && !force) return { injected: false, ready: true, elapsedMs: 0 };
+  // The PS1 assignment is typed into the pane, so anything but a POSIX shell would run (or choke on) it.
+  const shell = await io.run(['display-message', '-p', '-t', target, '#{pane_current_command}']);
+  if (!isPosixShell(shell)) {
+    throw new McpError(
+      ErrorCode.InvalidRequest,
+      `Pane ${target} is running ${JSON.stringify(shell.trim())}, not a POSIX shell (bash/zsh/sh/dash/ksh); ` +
+        'refusing to type a PS1 assignment',
+    );
+  }
+  const baseline = await io.capture();
+  await io.send(command);
+  const wait = await waitForPattern(io.capture, promptSentinelPattern(sentinel), { timeoutMs, intervalMs, baseline });
+  if (wait.matched) await io.run(['set-option', '-p', '-t', target, promptSentinelOption, sentinel]);
+  return { injected: true, ready: wait.matched, elapsedMs: wait.elapsedMs };
+}
+
+// The sentinel configured on a pane, for waitForPrompt callers; InvalidParams if none was set up.
+export async function paneSentinel(target: string, run: (args: string[]) => Promise<string>) {
+  const sentinel = (await run(['show-options', '-pqv', '-t', target, promptSentinelOption]).catch(() => '')).trim();
+  if (!sentinel) {
+    throw new McpError(ErrorCode.InvalidParams, 'No prompt sentinel on this pane; run tmux_set_prompt_sentinel first');
+  }
+  return sentinel;
+}
+
+export type MacroStep = {
+  action: 'send' | 'wait' | 'sleep' | 'capture';
+  keys?: string;
+  enter?: boolean;
+  pattern?: string;
+  flags?: string;
+  timeoutMs?: number;
+  ms?: number;
+  lines?: number;
+};
+export type MacroDefinition = { description?: string; steps: MacroStep[]; persist?: boolean };
+export type MacroStepResult = {
+  step: number;
+  action: MacroStep['action'];
+  status: 'ok' | 'timeout' | 'failed' | 'skipped';
+  elapsedMs: number;
+  detail?: string;
+  output?: string;
+};
+
+const macroStepSchema = z.object({
+  action: z.enum(['send', 'wait', 'sleep', 'capture']).describe('Step type.'),
+  keys: z.string().describe('send: keys to send (same syntax as tmux_send_keys).').optional(),
+  enter: z.boolean().describe('send: append Enter (default true).').optional(),
+  pattern: z.string().describe('wait: regex that must appear in output since the last send.').optional(),
+  flags: z.string().describe('wait: regex flags (e.g., i).').optional(),
+  timeoutMs: z.number().describe('wait: how long to wait (default 10000).').optional(),
+  ms: z.number().describe('sleep: milliseconds to pause.').optional(),
+  lines: z.number().describe('wait/capture: lines of scrollback to read (default 200).').optional(),
+});
+
+const macroDefinitionSchema = z.object({
+  description: z.string().optional(),
+  steps: z.array(macroStepSchema).min(1),
+  persist: z.boolean().optional(),
+});
+
+// Macros are keyed by user-chosen names, so they live in a Map: names like toString or __proto__ must not
+// resolve to Object.prototype members. Entries that fail the schema or compileMacroSteps are left out and
+// reported in problems, so a hand-edited file surfaces its mistakes at load time rather than mid-macro.
+export function parseMacroFile(raw: string) {
+  const parsed = JSON.parse(raw) as unknown;
+  const macros = new Map<string, MacroDefinition>();
+  const problems: string[] = [];
+  if (parsed === null || typeof parsed !== 'object' || Array.isArray(parsed)) {
+    return { macros, problems: ['expected an object mapping macro names to definitions'] };
+  }
+  for (const [name, entry] of Object.entries(parsed)) {
+    const result = macroDefinitionSchema.safeParse(entry);
+    if (!result.success) {
+      const issues = result.error.issues.map((i) => `${i.path.join('.') || '(root)'}: ${i.message}`).join('; ');
+      problems.push(`${name}: ${issues}`);
+      continue;
+    }
+    try {
+      compileMacroSteps(result.data.steps);
+    } catch (error) {
+      problems.push(`${name}: ${(error as Error).message}`);
+      continue;
+    }
+    macros.set(name, result.data);
+  }
+  return { macros, problems };
+}
+
+// Checks a macro up front (at define time and again before running) so a typo fails before any keys are sent.
+export function compileMacroSteps(steps: MacroStep[]) {
+  return steps.map((step, i) => {
+    const where = `step ${i + 1} (${step.action})`;
+    if (step.action === 'send' && step.keys === undefined && !step.enter) {
+      throw new McpError(ErrorCode.InvalidParams, `${where}: keys or enter=true is required`);
+    }
+    if (step.action === 'sleep' && !(typeof step.ms === 'number' && step.ms >= 0)) {
+      throw new McpError(ErrorCode.InvalidParams, `${where}: ms is required`);
+    }
+    if (step.action !== 'wait') return undefined;
+    if (!step.pattern) throw new McpError(ErrorCode.InvalidParams, `${where}: pattern is required`);
+    try {
+      return new RegExp(step.pattern, (step.flags ?? '').replace(/[gy]/g, ''));
+    } catch (error) {
+      throw new McpError(ErrorCode.InvalidParams, `${where}: invalid pattern: ${(error as Error).message}`);
+    }
+  });
+}
+
+// Runs macro steps in order. A wait step looks for its pattern in output produced since the preceding send;
+// the first timeout or failure stops the macro and the remaining steps are reported as skipped.
+export async function runMacro(
+  steps: MacroStep[],
+  io: {
+    send: (keys: string, enter: boolean) => Promise<void>;
+    capture: (lines?: number) => Promise<string>;
+    sleep?: (ms: number) => Promise<void>;
+  },
+  { intervalMs = 250, defaultTimeoutMs = 10000 }: { intervalMs?: number; defaultTimeoutMs?: number } = {},
+): Promise<MacroStepResult[]> {
+  const patterns = compileMacroSteps(steps);
+  const sleep = io.sleep ?? ((ms: number) => new Promise<void>((r) => setTimeout(r, ms)));
+  const results: MacroStepResult[] = [];
+  let baseline: string | undefined;
+  let stopped = false;
+  for (const [i, step] of steps.entries()) {
+    const base = { step: i + 1, action: step.action };
+    if (stopped) {
+      results.push({ ...base, status: 'skipped', elapsedMs: 0 });
+      continue;
+    }
+    const started = Date.now();
+    const elapsed = () => Date.now() - started;
+    try {
+      if (step.action === 'send') {
+        if (patterns.slice(i + 1).some(Boolean)) baseline = await io.capture();
+        await io.send(step.keys ?? '', step.enter ?? true);
+        results.push({ ...base, status: 'ok', elapsedMs: elapsed() });
+      } else if (step.action === 'sleep') {
+        await sleep(step.ms ?? 0);
+        results.push({ ...base, status: 'ok', elapsedMs: elapsed() });
+      } else if (step.action === 'capture') {
+        results.push({ ...base, status: 'ok', elapsedMs: elapsed(), output: await io.capture(step.lines) });
+      } else {
+        const timeoutMs = step.timeoutMs ?? defaultTimeoutMs;
+        const capture = () => io.capture(step.lines);
+        const wait = await waitForPattern(capture, patterns[i]!, { timeoutMs, intervalMs, baseline });
+        if (!wait.matched) stopped = true;
+        results.push({
+          ...base,
+          status: wait.matched ? 'ok' : 'timeout',
+          elapsedMs: elapsed(),
+          detail: wait.matched ? `matched "${wait.match}"` : `no match for /${step.pattern}/ within ${timeoutMs}ms`,
+        });
+      }
+    } catch (error) {
+      stopped = true;
+      results.push({
+        ...base,
+        status: 'failed',
+        elapsedMs: elapsed(),
+        detail: error instanceof Error ? error.message : String(error),
+      });
+    }
+  }
+  return results;
+}
+
+export type KeyStep = { keys: string; enter?: boolean; waitFor?: string; flags?: string; timeoutMs?: number };
+export type KeyStepResult = {
+  step: number;
+  status: 'ok' | 'timeout' | 'failed' | 'skipped';
+  elapsedMs: number;
+  detail?: string;
+};
+
+// Sends each step's keys and, when waitFor is set, waits for it to appear in output produced after the send.
+// The first timeout or failure stops the sequence; remaining steps are reported as skipped.
+export async function runKeySequence(
+  steps: KeyStep[],
+  io: { send: (keys: string, enter: boolean) => Promise<void>; capture: () => Promise<string> },
+  { intervalMs = 250, defaultTimeoutMs = 10000 }: { intervalMs?: number; defaultTimeoutMs?: number } = {},
+): Promise<KeyStepResult[]> {
+  const patterns = steps.map((step, i) => {
+    if (!step.waitFor) return undefined;
+    try {
+      return new RegExp(step.waitFor, (step.flags ?? '').replace(/[gy]/g, ''));
+    } catch (error) {
+      throw new McpError(ErrorCode.InvalidParams, `step ${i + 1}: invalid waitFor regex: ${(error as Error).message}`);
+    }
+  });
+  const results: KeyStepResult[] = [];
+  let stopped = false;
+  for (const [i, step] of steps.entries()) {
+    if (stopped) {
+      results.push({ step: i + 1, status: 'skipped', elapsedMs: 0 });
+      continue;
+    }
+    const started = Date.now();
+    const regex = patterns[i];
+    try {
+      const baseline = regex ? await io.capture() : undefined;
+      await io.send(step.keys, step.enter ?? true);
+      if (!regex) {
+        results.push({ step: i + 1, status: 'ok', elapsedMs: Date.now() - started });
+        continue;
+      }
+      const timeoutMs = step.timeoutMs ?? defaultTimeoutMs;
+      const wait = await waitForPattern(io.capture, regex, { timeoutMs, intervalMs, baseline });
+      if (wait.matched) {
+        results.push({ step: i + 1, status: 'ok', elapsedMs: Date.now() - started, detail: `matched "${wait.match}"` });
+      } else {
+        stopped = true;
+        results.push({
+          step: i + 1,
+          status: 'timeout',
+          elapsedMs: Date.now() - started,
+          detail: `no match for /${step.waitFor}/ within ${timeoutMs}ms`,
+        });
+      }
+    } catch (error) {
+      stopped = true;
+      results.push({
+        step: i + 1,
+        status: 'failed',
+        elapsedMs: Date.now() - started,
+        detail: error instanceof Error ? error.message : String(error),
+      });
+    }
+  }
+  return results;
+}
+
+// Line mode treats the capture's last line (where the cursor is) as possibly incomplete: it is held back
+// until later output follows it, so followers never see a line split mid-write.
+function splitPartialLine(capture: string) {
+  const lines = capture.split('\n');
+  const partial = lines.pop() ?? '';
+  return { complete: lines.join('\n'), partial };
+}
+
+export function followStep(previous: string, capture: string, lineMode = false) {
+  const { complete, partial } = lineMode ? splitPartialLine(capture) : { complete: capture, partial: '' };
+  return { added: appendedLines(previous, complete), previous: complete, partial };
+}
+
+// Remembers, per pane, how many lines it had produced (history_size + cursor row) at each tail call so a later
+// call can size its first capture to what was written in the last N seconds. Without a sample old enough the
+// oldest one stands in (a shorter window), and without any sample the caller falls back to its fixed budget.
+export function createActivityTracker(keep = 16) {
+  const samples = new Map<string, { at: number; total: number }[]>();
+  return {
+    record(key: string, total: number, at: number) {
+      const list = samples.get(key) ?? [];
+      // A cleared history makes the count go backwards; older samples no longer mean anything.
+      if (list.length && total < list[list.length - 1].total) list.length = 0;
+      list.push({ at, total });
+      if (list.length > keep) list.splice(0, list.length - keep);
+      samples.set(key, list);
+    },
+    linesSince(key: string, windowMs: number, total: number, now: number) {
+      const list = samples.get(key);
+      if (!list?.length) return undefined;
+      const cutoff = now - windowMs;
+      const baseline = [...list].reverse().find((sample) => sample.at <= cutoff) ?? list[0];
+      return total >= baseline.total ? total - baseline.total : undefined;
+    },
+  };
+}
+
+// Initial tail window for `written` recent lines: the new lines plus the line the cursor is on, kept between
+// the smallest paging budget and the caller's line limit.
+export function activityWindowLines(written: number | undefined, max: number, min = defaultCapturePageSizes[0]) {
+  if (written === undefined) return max;
+  return Math.max(Math.min(min, max), Math.min(max, written + 1));
+}
+
+const paneActivity = createActivityTracker();
+
+async function paneLinePosition(target: string, host?: string) {
+  const { history, cursorY } = await fetchPaneFields(
+    target,
+    { history: '#{history_size}', cursorY: '#{cursor_y}' },
+    host,
+  );
+  return { historySize: Number(history) || 0, cursorY: Number(cursorY) || 0 };
+}
+
+async function paneLineTotal(target: string, host?: string) {
+  const { historySize, cursorY } = await paneLinePosition(target, host);
+  return historySize + cursorY;
+}
+
+export type ResumePoint = { start: number; skipped: number; reset: boolean };
+
+// Absolute line L (0 = oldest history line, history_size + cursor_y = the cursor line) is capture-pane line
+// L - history_size. Resuming more than `lines` back keeps only the newest `lines` and reports the gap; a fromLine
+// past the cursor means the history was cleared, so the tail restarts at the cursor line. Once history-limit
+// drops old lines, indexes shift down by what was dropped.
+export function resumePoint(fromLine: number, historySize: number, cursorY: number, lines: number): ResumePoint {
+  const total = historySize + cursorY;
+  if (fromLine > total) return { start: cursorY, skipped: 0, reset: true };
+  const first = Math.max(fromLine, total - Math.max(1, lines) + 1);
+  return { start: first - historySize, skipped: first - fromLine, reset: false };
+}
+
+export type PaneSize = { width: number; height: number };
+
+// Reports a new size whenever it differs from the previous one seen (the first call only records it). A resize
+// reflows the pane, so line-delta followers must take a fresh baseline instead of diffing across it.
+export function createResizeDetector() {
+  let last: PaneSize | undefined;
+  return (size: PaneSize) => {
+    const changed = last !== undefined && (last.width !== size.width || last.height !== size.height);
+    last = size;
+    return changed ? size : undefined;
+  };
+}
+
+export function resizeNotice(size: PaneSize) {
+  return `Resized: ${size.width}x${size.height} (content reflowed; reset any buffered output)`;
+}
+
+async function paneSize(target: string, host?: string): Promise<PaneSize> {
+  const { width, height } = await fetchPaneFields(target, { width: '#{pane_width}', height: '#{pane_height}' }, host);
+  return { width: Number(width), height: Number(height) };
+}
+
+export type WatchHooks = { start?: string[]; end?: string[] };
+
+// tmux commands run when a tail starts and ends, from MCP_TMUX_WATCH_HOOKS (JSON object of argv arrays, e.g.
+// {"start": ["display-message", "-t", "{target}", "agent watching"]}); "{target}" becomes the tailed pane.
+export function parseWatchHooks(spec: string | undefined): WatchHooks {
+  if (!spec) return {};
+  try {
+    const parsed = JSON.parse(spec) as Record<string, unknown>;
+    const hooks: WatchHooks = {};
+    for (const phase of ['start', 'end'] as const) {
+      const argv = parsed?.[phase];
+      if (argv === undefined) continue;
+      if (!Array.isArray(argv) || !argv.length) throw new Error(`${phase} must be a non-empty array of arguments`);
+      hooks[phase] = argv.map(String);
+    }
+    return hooks;
+  } catch (error) {
+    console.warn('Ignoring invalid MCP_TMUX_WATCH_HOOKS:', error);
+    return {};
+  }
+}
+
+const watchHooks = parseWatchHooks(process.env.MCP_TMUX_WATCH_HOOKS);
+
+// Hooks are a courtesy to humans sharing the pane: a failing one is logged and never fails the tail.
+export async function runWatchHook(
+  argv: string[] | undefined,
+  target: string,
+  host?: string,
+  exec: (args: string[], host?: string) => Promise<unknown> = execRoutedTmux,
+) {
+  if (!argv) return;
+  try {
+    await exec(argv.map((arg) => arg.split('{target}').join(target)), host);
+  } catch (error) {
+    console.warn(`Watch hook failed for ${target}:`, error);
+  }
+}
+
+export async function withWatchHooks<T>(
+  target: string,
+  host: string | undefined,
+  fn: () => Promise<T>,
+  hooks: WatchHooks = watchHooks,
+  exec?: (args: string[], host?: string) => Promise<unknown>,
+) {
+  await runWatchHook(hooks.start, target, host, exec);
+  try {
+    return await fn();
+  } finally {
+    await runWatchHook(hooks.end, target, host, exec);
+  }
+}
+
+async function tailPane({
+  host,
+  target,
+  lines,
+  iterations,
+  intervalMs,
+  followOnly = false,
+  lineMode = false,
+  initialLines = lines,
+  fromStart,
+  detectResize = followOnly || lineMode,
+}: {
+  host?: string;
+  target: string;
+  lines: number;
+  iterations: number;
+  intervalMs: number;
+  followOnly?: boolean;
+  lineMode?: boolean;
+  initialLines?: number;
+  // capture-pane -S of a resume point; follow modes emit from there before following.
+  fromStart?: number;
+  detectResize?: boolean;
+}) {
+  const resolvedHost = resolveHost(host);
+  let lastCapture = '';
+  const resized = createResizeDetector();
+  if (detectResize) resized(await paneSize(target, resolvedHost));
+  if (followOnly || lineMode) {
+    // tail -f semantics: the current tail is only a baseline; emit what gets appended after it.
+    let step = followStep('', await capturePane(target, -lines, undefined, resolvedHost), lineMode);
+    let baselinePartial = step.partial;
+    if (fromStart !== undefined) {
+      // Taken after the baseline, so a line written in between is repeated rather than lost.
+      const resumed = await capturePane(target, fromStart, undefined, resolvedHost);
+      const missed = lineMode ? splitPartialLine(resumed).complete : resumed;
+      if (missed) lastCapture += `\n--- resumed (+${missed.split('\n').length} lines) ---\n${missed}`;
+    }
+    for (let i = 0; i < iterations; i++) {
+      await new Promise((r) => setTimeout(r, intervalMs));
+      const size = detectResize ? resized(await paneSize(target, resolvedHost)) : undefined;
+      if (size) {
+        // Reflowed lines would all look new; start over from the current screen.
+        lastCapture += `\n--- ${resizeNotice(size)} ---`;
+        step = followStep('', await capturePane(target, -lines, undefined, resolvedHost), lineMode);
+        baselinePartial = step.partial;
+        continue;
+      }
+      step = followStep(step.previous, await capturePane(target, -lines, undefined, resolvedHost), lineMode);
+      if (step.added.length) {
+        lastCapture += `\n--- tail iteration ${i + 1}/${iterations} (+${step.added.length} lines) ---\n`;
+        lastCapture += step.added.join('\n');
+      }
+    }
+    if (lineMode && step.partial && step.partial !== baselinePartial) {
+      lastCapture += `\n--- partial line at end ---\n${step.partial}`;
+    }
+    return lastCapture.trim();
+  }
+  for (let i = 0; i < iterations; i++) {
+    const size = detectResize && i > 0 ? resized(await paneSize(target, resolvedHost)) : undefined;
+    if (size) lastCapture += `\n--- ${resizeNotice(size)} ---`;
+    lastCapture += `\n--- tail iteration ${i + 1}/${iterations} ---\n`;
+    const start = i === 0 ? fromStart ?? -initialLines : -lines;
+    lastCapture += await capturePane(target, start, undefined, resolvedHost);
+    if (i < iterations - 1) {
+      await new Promise((r) => setTimeout(r, intervalMs));
+    }
+  }
+  return lastCapture.trim();
+}
+
+// Coalesces rapid pane changes: a changed capture is emitted only once the pane has been quiet for
+// debounceMs, or once maxLatencyMs has passed since the first unemitted change. Callers take a final capture
+// at the end, so nothing needs flushing.
+export function createChangeDebouncer({
+  debounceMs,
+  maxLatencyMs = debounceMs * 10,
+}: {
+  debounceMs: number;
+  maxLatencyMs?: number;
+}) {
+  let last: string | undefined;
+  let pending: string | undefined;
+  let firstChangeAt = 0;
+  let lastChangeAt = 0;
+  return {
+    offer(value: string, now: number): string | undefined {
+      if (value !== last) {
+        last = value;
+        if (pending === undefined) firstChangeAt = now;
+        pending = value;
+        lastChangeAt = now;
+      }
+      if (pending === undefined) return undefined;
+      if (now - lastChangeAt < debounceMs && now - firstChangeAt < maxLatencyMs) return undefined;
+      const out = pending;
+      pending = undefined;
+      return out;
+    },
+  };
+}
+
+// ssh exits 255 when the connection itself fails (refused, dropped, keepalive timeout), as opposed to the
+// remote tmux command failing.
+export function isTransportLost(error: unknown) {
+  const detail = (error as { data?: TmuxErrorDetail }).data;
+  return Boolean(detail?.host) && detail?.exitCode === 255;
+}
+
+const transientErrorPattern = /EINTR|EAGAIN|Interrupted system call|Resource temporarily unavailable|timed out/i;
+
+// Failures worth retrying: a dropped ssh connection, or an interrupted/timed-out call that may succeed next time.
+export function isTransientError(error: unknown) {
+  if (isTransportLost(error)) return true;
+  const detail = (error as { data?: TmuxErrorDetail }).data;
+  const text = `${detail?.stderr ?? ''} ${error instanceof Error ? error.message : String(error)}`;
+  return transientErrorPattern.test(text);
+}
+
+// Retry fn on transient errors every delayMs until graceMs has passed since the first failure (graceMs 0 retries
+// once), then rethrow the last error. Other errors are thrown straight away.
+export async function retryTransient<T>(
+  fn: () => Promise<T>,
+  {
+    graceMs = taskRetryGraceMs,
+    delayMs,
+    now = Date.now,
+    sleep = (ms: number) => new Promise<void>((r) => setTimeout(r, ms)),
+  }: { graceMs?: number; delayMs: number; now?: () => number; sleep?: (ms: number) => Promise<void> },
+) {
+  let failedAt: number | undefined;
+  for (let attempt = 0; ; attempt++) {
+    try {
+      return await fn();
+    } catch (error) {
+      if (!isTransientError(error)) throw error;
+      failedAt ??= now();
+      const elapsed = now() - failedAt;
+      if (graceMs > 0 ? elapsed >= graceMs : attempt > 0) throw error;
+      await sleep(graceMs > 0 ? Math.min(delayMs, graceMs - elapsed) : delayMs);
+    }
+  }
+}
+
+// Capture for long-running tasks: every capture spawns a fresh ssh, so retrying after a dropped connection
+// is effectively a reconnect.
+async function captureForTask(target: string, lines: number, host: string | undefined, retryDelayMs: number) {
+  return retryTransient(() => capturePane(target, -lines, undefined, host), { delayMs: retryDelayMs });
+}
+
+// Appended to server-initiated Eof lines so clients wait before starting the replacement task.
+export function retryAfterHint(retryAfterMs = taskRetryAfterMs) {
+  return retryAfterMs > 0 ? ` retryAfterMs=${retryAfterMs}` : '';
+}
+
+export function taskFailureNotice(error: unknown, retryAfterMs = taskRetryAfterMs) {
+  if (isTransportLost(error)) {
+    const host = (error as { data?: TmuxErrorDetail }).data?.host;
+    const hint = retryAfterHint(retryAfterMs);
+    return `Eof: transport-lost (ssh connection to ${host} dropped; start a new task to reconnect)${hint}`;
+  }
+  return `Error: ${error instanceof Error ? error.message : String(error)}`;
+}
+
+export type TaskStatus = 'working' | 'completed' | 'failed';
+export type TaskEntry = {
+  taskId: string;
+  tool: string;
+  label?: string;
+  host?: string;
+  target?: string;
+  startedAt: number;
+  status: TaskStatus;
+  finishedAt?: number;
+};
+
+// Background tasks this server started, so clients (and operators reading audit logs) can tell them apart by label.
+// Finished entries beyond `keepFinished` are dropped oldest-first.
+export function createTaskRegistry(keepFinished = 50, now = Date.now) {
+  const entries = new Map<string, TaskEntry>();
+  return {
+    start(entry: Omit<TaskEntry, 'startedAt' | 'status'>) {
+      const record: TaskEntry = { ...entry, startedAt: now(), status: 'working' };
+      entries.set(entry.taskId, record);
+      return record;
+    },
+    finish(taskId: string, status: Exclude<TaskStatus, 'working'>) {
+      const record = entries.get(taskId);
+      if (!record) return undefined;
+      record.status = status;
+      record.finishedAt = now();
+      const finished = [...entries.values()].filter((e) => e.status !== 'working');
+      for (const old of finished.slice(0, Math.max(0, finished.length - keepFinished))) entries.delete(old.taskId);
+      return record;
+    },
+    list() {
+      return [...entries.values()];
+    },
+  };
+}
+
+const taskRegistry = createTaskRegistry();
+
+async function startTask(taskStore: any, entry: Omit<TaskEntry, 'taskId' | 'startedAt' | 'status'>) {
+  const task = await taskStore.createTask({});
+  taskRegistry.start({ ...entry, taskId: task.taskId });
+  await auditLog(entry.host, getSessionFromTarget(entry.target), 'task_start', { taskId: task.taskId, ...entry });
+  return task;
+}
+
+async function storeTaskResult(taskStore: any, taskId: string, status: 'completed' | 'failed', result: unknown) {
+  const record = taskRegistry.finish(taskId, status);
+  if (record) {
+    await auditLog(record.host, getSessionFromTarget(record.target), 'task_end', {
+      taskId,
+      tool: record.tool,
+      label: record.label,
+      status,
+    });
+  }
+  await taskStore.storeTaskResult(taskId, status, result);
+}
+
+export function formatTaskList(entries: TaskEntry[], now = Date.now()) {
+  if (!entries.length) return '(no tasks)';
+  return entries
+    .map((e) => {
+      const age = Math.round(((e.finishedAt ?? now) - e.startedAt) / 1000);
+      const where = [e.host, e.target].filter(Boolean).join(' ');
+      return `${e.taskId} ${e.status} ${e.tool}${where ? ` ${where}` : ''} ${age}s${e.label ? ` "${e.label}"` : ''}`;
+    })
+    .join('\n');
+}
+
+// Returns a check that reports true once `maxMs` has elapsed; never expires when maxMs is 0.
+export function createDeadline(maxMs: number, now = Date.now) {
+  const end = now() + maxMs;
+  return () => maxMs > 0 && now() >= end;
+}
+
+export function maxDurationNotice(maxMs: number, retryAfterMs = taskRetryAfterMs) {
+  const hint = retryAfterHint(retryAfterMs);
+  return `Eof: max-duration (task lifetime capped at ${maxMs}ms; start a new task to continue)${hint}`;
+}
+
+export type PaneProcessSample = { dead: boolean; deadStatus?: number; command: string };
+export type PaneExitResult = { status: 'exited' | 'idle' | 'timeout'; detail: string; elapsedMs: number };
+
+const shellCommands = new Set(['bash', 'zsh', 'sh', 'fish', 'dash', 'ksh', 'tcsh', 'csh', 'nu', 'pwsh']);
+
+function isShellCommand(command: string) {
+  return shellCommands.has(commandName(command));
+}
+
+// Foreground commands that swallow typed input until quit with `q`. man itself is listed because its pager
+// runs in man's process group, so the pane reports man rather than less.
+const pagerCommands = new Set(['less', 'more', 'most', 'man', 'pg', 'bat', 'delta']);
+
+export function isPagerCommand(command: string) {
+  return pagerCommands.has(command.trim());
+}
+
+// Sends `q` while the pane's foreground command is a pager, re-checking until it is gone (or attempts run
+// out), so keys sent next reach the shell instead of the pager.
+export async function exitPager(
+  io: { command: () => Promise<string>; quit: () => Promise<void>; sleep?: (ms: number) => Promise<void> },
+  { attempts = 3, settleMs = 150 }: { attempts?: number; settleMs?: number } = {},
+) {
+  const sleep = io.sleep ?? ((ms: number) => new Promise<void>((r) => setTimeout(r, ms)));
+  const pager = await io.command();
+  if (!isPagerCommand(pager)) return { pager: undefined, exited: false };
+  for (let i = 0; i < attempts; i++) {
+    await io.quit();
+    await sleep(settleMs);
+    if (!isPagerCommand(await io.command())) return { pager, exited: true };
+  }
+  return { pager, exited: false };
+}
+
+export function isPaneGone(error: unknown) {
+  const detail = (error as { data?: TmuxErrorDetail }).data;
+  return /can't find pane|no such pane/i.test(`${detail?.stderr ?? ''} ${(error as Error)?.message ?? ''}`);
+}
+
+// Polls the pane's process state until it exits: the pane dies (remain-on-exit keeps the status), the pane
+// disappears, or the foreground command hands control back to the shell.
+export async function watchPaneExit(
+  sample: () => Promise<PaneProcessSample>,
+  { intervalMs, timeoutMs }: { intervalMs: number; timeoutMs: number },
+): Promise<PaneExitResult> {
+  const started = Date.now();
+  let initial: string | undefined;
+  for (;;) {
+    let current: PaneProcessSample;
+    try {
+      current = await sample();
+    } catch (error) {
+      if (!isPaneGone(error)) throw error;
+      const elapsedMs = Date.now() - started;
+      return { status: 'exited', detail: 'Pane closed (process exited; exit status unavailable).', elapsedMs };
+    }
+    const elapsedMs = Date.now() - started;
+    if (current.dead) {
+      const status = current.deadStatus !== undefined ? ` with status ${current.deadStatus}` : '';
+      return { status: 'exited', detail: `Process exited${status}.`, elapsedMs };
+    }
+    if (initial === undefined) {
+      initial = current.command;
+      if (isShellCommand(initial)) {
+        return { status: 'idle', detail: `No foreground process (shell ${initial} is at the prompt).`, elapsedMs };
+      }
+    } else if (isShellCommand(current.command)) {
+      return { status: 'exited', detail: `${initial} finished; prompt returned (exit status unknown).`, elapsedMs };
+    }
+    if (elapsedMs + intervalMs > timeoutMs) {
+      return { status: 'timeout', detail: `${initial} still running after ${timeoutMs}ms.`, elapsedMs };
+    }
+    await new Promise((r) => setTimeout(r, intervalMs));
+  }
+}
+
+export type CommandWaitResult = { matched: boolean; command: string; elapsedMs: number };
+
+// Polls the pane's foreground command until it equals `command` (or, with `until: 'not'`, until it is anything
+// else), returning the last command seen either way.
+export async function waitForCommand(
+  current: () => Promise<string>,
+  {
+    command,
+    until = 'is',
+    intervalMs,
+    timeoutMs,
+  }: { command: string; until?: 'is' | 'not'; intervalMs: number; timeoutMs: number },
+): Promise<CommandWaitResult> {
+  const started = Date.now();
+  for (;;) {
+    const seen = commandName(await current());
+    const elapsedMs = Date.now() - started;
+    if ((seen === command) === (until === 'is')) return { matched: true, command: seen, elapsedMs };
+    if (elapsedMs + intervalMs > timeoutMs) return { matched: false, command: seen, elapsedMs };
+    await new Promise((r) => setTimeout(r, intervalMs));
+  }
+}
+
+async function samplePaneProcess(target: string, host?: string): Promise<PaneProcessSample> {
+  const fields = await fetchPaneFields(
+    target,
+    { dead: '#{pane_dead}', status: '#{pane_dead_status}', command: '#{pane_current_command}' },
+    host,
+  );
+  return {
+    dead: fields.dead === '1',
+    deadStatus: fields.status === '' ? undefined : Number(fields.status),
+    command: fields.command,
+  };
+}
+
+// Commands typed at recognized prompts (see promptPattern), oldest first.
+function extractRecentCommands(text: string, max = 15) {
+  const cmds: string[] = [];
+  const lines = text.split('\n');
+  for (let i = lines.length - 1; i >= 0 && cmds.length < max; i--) {
+    const command = promptPattern.exec(lines[i])?.[2]?.trim();
+    if (command) {
+      cmds.push(command);
+    }
+  }
+  return cmds.reverse();
+}
+
+// Drop the shell's echo of a command we just sent (and everything above it) from a capture. With `baseline` (the
+// pane captured just before the command was typed, ending at its prompt line), the echo is the first line after
+// that point containing the command's first line; without one (or when the baseline has scrolled away), it is the
+// last prompt line (promptPattern) containing it, then the last line containing it at all. Output that repeats
+// the command (`echo`, `history`, `set -x`) therefore stays. Continuation lines of multi-line sends are dropped
+// when they echo the matching command line.
+export function stripEchoedCommand(capture: string, command: string, baseline?: string) {
+  const commandLines = command.split('\n').map((l) => l.trim());
+  const first = commandLines[0];
+  if (!first) return { text: capture, stripped: false };
+  const lines = capture.split('\n');
+  const from = baseline === undefined ? -1 : baselineEnd(lines, baseline.split('\n'));
+  let idx = from === -1 ? -1 : lines.findIndex((line, i) => i >= from && line.includes(first));
+  for (let i = lines.length - 1; from === -1 && i >= 0 && idx === -1; i--) {
+    if (promptPattern.exec(lines[i])?.[2]?.includes(first)) idx = i;
+  }
+  for (let i = lines.length - 1; from === -1 && i >= 0 && idx === -1; i--) {
+    if (lines[i].includes(first)) idx = i;
+  }
+  if (idx === -1) return { text: capture, stripped: false };
+  let end = idx + 1;
+  for (let j = 1; j < commandLines.length && end < lines.length; j++) {
+    if (!commandLines[j] || !lines[end].includes(commandLines[j])) break;
+    end++;
+  }
+  return { text: lines.slice(end).join('\n'), stripped: true };
+}
+
+// Index of the baseline's last line (the prompt the command was typed at) within a later capture, found by
+// matching the few lines above it; -1 when they are not in the capture.
+function baselineEnd(lines: string[], baseline: string[]) {
+  const context = baseline.slice(0, -1).slice(-5);
+  if (!context.length) return -1;
+  for (let p = lines.length - 1; p >= context.length; p--) {
+    if (context.every((line, k) => lines[p - context.length + k] === line)) return p;
+  }
+  return -1;
+}
+
+export type PromptSegment = { prompt: string; command: string; output: string };
+
+// Primary prompt: `user@host:dir$`, `(venv) user@host ~ %`, a cwd prompt such as `~/app $`, or a bare `$`/`#`/`%`
+// alone on its line (an idle shell). A bare prompt followed by text is not recognized, since output lines such as
+// Markdown headings, comments and heredoc bodies look the same. Group 1 is the prompt and group 2 the command;
+// override with MCP_TMUX_PROMPT_PATTERN using the same two groups.
+const defaultPromptPattern =
+  /^((?:\([^)]*\) )?(?:[\w.-]+@[\w.-]+\S*(?: \S+)? ?[$#%>]|[~/]\S* ?[$#%>]|[$#%](?= ?$)))(?: (.*))?$/;
+
+export function parsePromptPattern(spec: string | undefined) {
+  if (!spec) return defaultPromptPattern;
+  try {
+    return new RegExp(spec);
+  } catch (error) {
+    console.warn('Ignoring invalid MCP_TMUX_PROMPT_PATTERN:', error);
+    return defaultPromptPattern;
+  }
+}
+
+const promptPattern = parsePromptPattern(process.env.MCP_TMUX_PROMPT_PATTERN);
+
+// A command continues on PS2 (`> `) lines after a trailing backslash, a heredoc, or an unclosed quote.
+function commandContinues(command: string) {
+  const quotes = (command.match(/'/g)?.length ?? 0) % 2 === 1 || (command.match(/"/g)?.length ?? 0) % 2 === 1;
+  return /\\$/.test(command) || /<<-?\s*['"]?[\w-]+/.test(command) || quotes;
+}
+
+// Split a capture into (prompt, command, output) triples. Text before the first prompt becomes a segment
+// with an empty prompt and command; a trailing bare prompt is the shell waiting for input.
+export function segmentByPrompt(text: string, pattern: RegExp = promptPattern): PromptSegment[] {
+  const segments: PromptSegment[] = [];
+  let current: PromptSegment | undefined;
+  let output: string[] = [];
+  let continuing = false;
+  const flush = () => {
+    if (current) segments.push({ ...current, output: output.join('\n') });
+  };
+  for (const line of text.split('\n')) {
+    const match = pattern.exec(line);
+    if (match) {
+      flush();
+      current = { prompt: match[1] ?? '', command: (match[2] ?? '').trimEnd(), output: '' };
+      output = [];
+      continuing = commandContinues(current.command);
+      continue;
+    }
+    if (current && continuing && /^> ?/.test(line)) {
+      current.command += `\n${line.replace(/^> ?/, '')}`;
+      continue;
+    }
+    continuing = false;
+    if (!current) current = { prompt: '', command: '', output: '' };
+    output.push(line);
+  }
+  flush();
+  return segments;
+}
+
+function formatSegments(segments: PromptSegment[]) {
+  return segments
+    .map((seg, i) => {
+      const head = `== [${i + 1}] ${seg.prompt ? [seg.prompt, seg.command].filter(Boolean).join(' ') : '(no prompt)'} ==`;
+      return seg.output ? `${head}\n${seg.output}` : head;
+    })
+    .join('\n');
+}
+
+const auditFlags: Record<string, boolean> = {};
+
+function auditKey(host?: string, session?: string) {
+  return `${host ?? defaultHost ?? 'local'}:${session ?? defaultSession ?? 'unknown'}`;
+}
+
+function isAuditEnabled(host?: string, session?: string) {
+  return Boolean(auditFlags[auditKey(host, session)]);
+}
+
+function setAuditEnabled(host: string | undefined, session: string | undefined, enabled: boolean) {
+  auditFlags[auditKey(host, session)] = enabled;
+}
+
+// One append at a time per file, so the size check, renames and append of one write cannot interleave with
+// another's (two writers could otherwise both rotate, or append to a file that was just renamed away).
+const logWriteQueue = createKeyedLimiter(1);
+
+export function appendWithRotation(file: string, data: string, maxBytes = logMaxBytes, keep = logKeepFiles) {
+  return logWriteQueue(path.resolve(file), () => rotateAndAppend(file, data, maxBytes, keep));
+}
+
+async function rotateAndAppend(file: string, data: string, maxBytes: number, keep: number) {
+  if (maxBytes > 0) {
+    const size = await fs
+      .stat(file)
+      .then((st) => st.size)
+      .catch(() => 0);
+    if (size > 0 && size + Buffer.byteLength(data) > maxBytes) {
+      const ignoreMissing = (error: NodeJS.ErrnoException) => {
+        if (error.code !== 'ENOENT') throw error;
+      };
+      if (keep > 0) {
+        for (let i = keep - 1; i >= 1; i--) {
+          await fs.rename(`${file}.${i}`, `${file}.${i + 1}`).catch(ignoreMissing);
+        }
+        await fs.rename(file, `${file}.1`);
+      } else {
+        await fs.unlink(file).catch(ignoreMissing);
+      }
+    }
+  }
+  await fs.appendFile(file, data);
+}
+
+// Secrets that must not land in log files: flag values, KEY=value env prefixes, and long token-like strings.
+// Token-like strings are matched as whole words, and git SHAs (40 or 64 hex digits) and UUIDs are left alone so
+// logged `git log` or container ids stay useful.
+const defaultRedactPatterns: { pattern: RegExp; keep: boolean }[] = [
+  { pattern: /(--?(?:password|passwd|pass|token|secret|api[-_]?key)(?:=|\s+))[^\s'"]+/gi, keep: true },
+  { pattern: /(\b[A-Za-z0-9_]*(?:TOKEN|SECRET|PASSWORD|PASSWD|API_KEY|APIKEY)=)[^\s'"]+/g, keep: true },
+  {
+    pattern:
+      /(?<![A-Za-z0-9+_-])(?!(?:[0-9a-fA-F]{40}|[0-9a-fA-F]{64}|[0-9a-fA-F]{8}(?:-[0-9a-fA-F]{4}){3}-[0-9a-fA-F]{12})(?![A-Za-z0-9+_=-]))(?=[A-Za-z0-9+_-]*\d)(?=[A-Za-z0-9+_-]*[A-Za-z])[A-Za-z0-9+_-]{32,}={0,2}/g,
+    keep: false,
+  },
+];
+
+// Extra patterns from MCP_TMUX_REDACT_PATTERNS (JSON array of regex sources); whole matches are masked.
+export function parseRedactPatterns(spec: string | undefined) {
+  if (!spec) return [];
+  try {
+    const sources = JSON.parse(spec) as unknown;
+    if (!Array.isArray(sources)) throw new Error('expected a JSON array');
+    return sources.map((src) => ({ pattern: new RegExp(String(src), 'g'), keep: false }));
+  } catch (error) {
+    console.warn('Ignoring invalid MCP_TMUX_REDACT_PATTERNS:', error);
+    return [];
+  }
+}
+
+const redactPatterns = [...defaultRedactPatterns, ...parseRedactPatterns(process.env.MCP_TMUX_REDACT_PATTERNS)];
+
+export function redactSecrets(text: string, patterns = redactPatterns) {
+  let out = text;
+  for (const { pattern, keep } of patterns) {
+    out = out.replace(pattern, (match: string, prefix: unknown) =>
+      keep && typeof prefix === 'string' ? `${prefix}***` : '***',
+    );
+  }
+  return out;
+}
+
+// Redact every string inside a log metadata value, keeping its shape so it still serializes as valid JSON.
+export function redactValue(value: unknown, patterns = redactPatterns): unknown {
+  if (typeof value === 'string') return redactSecrets(value, patterns);
+  if (Array.isArray(value)) return value.map((v) => redactValue(v, patterns));
+  if (value && typeof value === 'object') {
+    return Object.fromEntries(Object.entries(value).map(([k, v]) => [k, redactValue(v, patterns)]));
+  }
+  return value;
+}
+
+// Read-heavy events that may be sampled; writes and `*.error` events are always logged.
+const sampledAuditEvents = new Set(['capture_pane', 'context_history', 'multi_run.capture']);
+
+// Parse "event=N,event2=0": log 1 in N occurrences of the event, 0 suppresses it.
+export function parseAuditSampling(spec: string | undefined) {
+  const rates: Record<string, number> = {};
+  for (const part of (spec ?? '').split(',')) {
+    const [event, rate] = part.split('=').map((p) => p.trim());
+    if (!event || !sampledAuditEvents.has(event)) continue;
+    const n = Number(rate);
+    if (Number.isInteger(n) && n >= 0) rates[event] = n;
+  }
+  return rates;
+}
+
+const auditSampleRates = parseAuditSampling(process.env.MCP_TMUX_AUDIT_SAMPLE);
+const auditSampleCounters: Record<string, number> = {};
+
+export function shouldAuditEvent(
+  event: string,
+  rates: Record<string, number> = auditSampleRates,
+  counters: Record<string, number> = auditSampleCounters,
+) {
+  const rate = rates[event];
+  if (rate === undefined || event.endsWith('.error')) return true;
+  if (rate === 0) return false;
+  const seen = counters[event] ?? 0;
+  counters[event] = seen + 1;
+  return seen % rate === 0;
+}
+
+async function auditLog(host: string | undefined, session: string | undefined, event: string, meta?: unknown) {
+  if (!isAuditEnabled(host, session)) return;
+  if (!shouldAuditEvent(event)) return;
+  const h = sanitizePathSegment(host ?? defaultHost, 'local');
+  const s = sanitizePathSegment(session ?? defaultSession, 'unknown');
+  const dir = path.join(logBaseDir, h, s);
+  const file = path.join(dir, `audit-${isoTimestamp().slice(0, 10)}.log`);
+  await fs.mkdir(dir, { recursive: true });
+  await appendWithRotation(file, formatAuditLine(event, meta));
+}
+
+export function formatAuditLine(event: string, meta?: unknown, timestamp = isoTimestamp(), requestId = currentRequestId()) {
+  const req = requestId ? ` req=${requestId}` : '';
+  return `[${timestamp}] ${event}${req}${meta !== undefined ? ` ${JSON.stringify(redactValue(meta))}` : ''}\n`;
+}
+
+function getSessionFromTarget(target: string | undefined) {
+  if (!target) return defaultSession;
+  const parts = target.split(':');
+  return parts[0] || defaultSession;
+}
+
+async function appendSessionLog(host: string | undefined, session: string | undefined, message: string) {
+  const h = sanitizePathSegment(host ?? defaultHost, 'local');
+  const s = sanitizePathSegment(session ?? defaultSession, 'unknown');
+  const dir = path.join(logBaseDir, h, s);
+  const file = path.join(dir, `${isoTimestamp().slice(0, 10)}.log`);
+  await fs.mkdir(dir, { recursive: true });
+  await appendWithRotation(file, `[${isoTimestamp()}] ${redactSecrets(message)}\n`);
+}
+
+async function captureHistory({
+  host,
+  session,
+  target,
+  lines = 800,
+  allPanes = false,
+}: {
+  host?: string;
+  session?: string;
+  target?: string;
+  lines?: number;
+  allPanes?: boolean;
+}) {
+  const resolvedHost = resolveHost(host);
+  if (target) {
+    const capture = await capturePane(target, -lines, undefined, resolvedHost);
+    return { captures: [{ target, text: capture }], commands: extractRecentCommands(capture) };
+  }
+  const resolvedSession = requireSession(session, host);
+  const panes = await listPanes(resolvedSession, resolvedHost);
+  const targets = allPanes ? panes : panes.filter((p) => p.active);
+  const captures = await Promise.all(
+    targets.map(async (p) => ({
+      target: `${p.session}:${p.window}.${p.index}`,
+      text: await capturePane(p.id, -lines, undefined, resolvedHost),
+    })),
+  );
+  const combinedText = captures.map((c) => c.text).join('\n');
+  return { captures, commands: extractRecentCommands(combinedText) };
+}
+
+async function listDirSimple(dir: string, host?: string) {
+  if (host) {
+    assertValidHost(host);
+    const { stdout } = await execa('ssh', buildSshArgs(host, ['ls', '-1', dir]), { timeout: tmuxCommandTimeoutMs });
+    return stdout.split('\n').filter(Boolean);
+  }
+  const entries = await fs.readdir(dir);
+  return entries.sort();
+}
+
+export function diffNewFiles(prev: string[], next: string[]) {
+  const prevSet = new Set(prev);
+  return next.filter((f) => !prevSet.has(f));
+}
+
+async function fanoutSendCapture({
+  targets,
+  keys,
+  enter,
+  capture = true,
+  captureLines = 200,
+  delayMs = 0,
+  mode = 'send_capture',
+  pattern,
+  patternFlags,
+  tailIterations = 3,
+  tailIntervalMs = 1000,
+}: {
+  targets: { host?: string; target?: string; captureLines?: number; delayMs?: number }[];
+  keys: string;
+  enter: boolean;
+  capture?: boolean;
+  captureLines?: number;
+  delayMs?: number;
+  mode?: 'send_capture' | 'tail' | 'pattern';
+  pattern?: string;
+  patternFlags?: string;
+  tailIterations?: number;
+  tailIntervalMs?: number;
 }) {
   const results = await Promise.allSettled(
     targets.map(async (t) => {
@@ -781,7 +4193,7 @@ async function fanoutSendCapture({
         throw new McpError(ErrorCode.InvalidParams, 'target is required (or set default pane)');
       }
       const sessionForLog = getSessionFromTarget(paneTarget);
-      await sendKeys(paneTarget, keys, enter, resolvedHost);
+      await sendKeysQueued(paneTarget, keys, enter, resolvedHost);
       await auditLog(resolvedHost, sessionForLog, 'multi_run.send_keys', {
         target: paneTarget,
         keys,
@@ -819,70 +4231,494 @@ async function fanoutSendCapture({
     }),
   );
 
-  const lines: string[] = [];
-  let ok = 0;
-  let fail = 0;
-  for (const r of results) {
-    if (r.status === 'fulfilled') {
-      ok++;
-      lines.push(`== ${r.value.host} ${r.value.target} ==`);
-      if (capture) {
-        lines.push(r.value.output || '(no output)');
-      } else {
-        lines.push('(capture disabled)');
-      }
-    } else {
-      fail++;
-      const msg = r.reason instanceof Error ? r.reason.message : String(r.reason);
-      lines.push(`== error ==`);
-      lines.push(msg);
-    }
+  const lines: string[] = [];
+  let ok = 0;
+  let fail = 0;
+  for (const r of results) {
+    if (r.status === 'fulfilled') {
+      ok++;
+      lines.push(`== ${r.value.host} ${r.value.target} ==`);
+      if (capture) {
+        lines.push(r.value.output || '(no output)');
+      } else {
+        lines.push('(capture disabled)');
+      }
+    } else {
+      fail++;
+      const msg = r.reason instanceof Error ? r.reason.message : String(r.reason);
+      lines.push(`== error ==`);
+      lines.push(msg);
+    }
+  }
+  lines.push('');
+  lines.push(`Summary: ${ok} succeeded, ${fail} failed`);
+  return lines.join('\n');
+}
+
+async function saveLayoutProfile(name: string, session: string, host?: string) {
+  const windows = await captureLayouts(session, host);
+  layoutProfiles[name] = {
+    host,
+    session,
+    windows,
+  };
+  await persistLayouts();
+}
+
+async function applyLayoutProfile(name: string, targetSession?: string, host?: string) {
+  const profile = layoutProfiles[name];
+  if (!profile) {
+    throw new McpError(ErrorCode.InvalidParams, `No layout profile named '${name}' found.`);
+  }
+  const resolvedHost = resolveHost(host) ?? profile.host;
+  const session = targetSession ?? profile.session;
+  for (const w of profile.windows) {
+    const windowTarget = `${session}:${w.index}`;
+    try {
+      await applyLayout(windowTarget, w.layout, resolvedHost);
+    } catch (error) {
+      throw new McpError(
+        ErrorCode.InternalError,
+        `Failed to apply layout to ${windowTarget}: ${(error as Error).message}`,
+      );
+    }
+  }
+}
+
+export type SessionSnapshot = {
+  version: 1;
+  session: string;
+  windows: { index: number; name: string; layout: string; panes: { index: number; cwd: string; command: string }[] }[];
+};
+
+const sessionSnapshotSchema: z.ZodType<SessionSnapshot> = z.object({
+  version: z.literal(1),
+  session: z.string().min(1),
+  windows: z
+    .array(
+      z.object({
+        index: z.number().int().min(0),
+        name: z.string(),
+        layout: z.string(),
+        panes: z
+          .array(z.object({ index: z.number().int().min(0), cwd: z.string(), command: z.string() }))
+          .min(1),
+      }),
+    )
+    .min(1),
+});
+
+// Checks an untrusted snapshot (e.g. parsed from tool input) before any tmux command is built from it.
+export function validateSessionSnapshot(value: unknown): SessionSnapshot {
+  const result = sessionSnapshotSchema.safeParse(value);
+  if (result.success) return result.data;
+  const issues = result.error.issues.map((i) => `${i.path.join('.') || '(root)'}: ${i.message}`).join('; ');
+  throw new McpError(ErrorCode.InvalidParams, `snapshot must be a version 1 session snapshot with windows (${issues})`);
+}
+
+export const sessionSnapshotFormat = [
+  '#{window_index}',
+  '#{window_name}',
+  '#{window_layout}',
+  '#{pane_index}',
+  '#{pane_current_path}',
+  '#{pane_current_command}',
+].join('\t');
+
+export function parseSessionSnapshot(session: string, raw: string): SessionSnapshot {
+  const windows = new Map<number, SessionSnapshot['windows'][number]>();
+  for (const line of raw.split('\n').filter(Boolean)) {
+    const [windowIndex, name, layout, paneIndex, cwd, command] = line.split('\t');
+    const index = Number(windowIndex);
+    if (!windows.has(index)) windows.set(index, { index, name, layout, panes: [] });
+    windows.get(index)!.panes.push({ index: Number(paneIndex), cwd: cwd ?? '', command: command ?? '' });
+  }
+  const sorted = [...windows.values()].sort((a, b) => a.index - b.index);
+  for (const w of sorted) w.panes.sort((a, b) => a.index - b.index);
+  return { version: 1, session, windows: sorted };
+}
+
+async function saveSession(session: string, host?: string) {
+  const raw = await runTmux(['list-panes', '-s', '-t', session, '-F', sessionSnapshotFormat], host);
+  return parseSessionSnapshot(session, raw);
+}
+
+async function missingDirs(dirs: string[], host?: string) {
+  if (!dirs.length) return [];
+  if (host) {
+    assertValidHost(host);
+    const script = `for d in ${dirs.map(shQuote).join(' ')}; do [ -d "$d" ] || printf '%s\\n' "$d"; done`;
+    const { stdout } = await execa('ssh', buildSshArgs(host, [script]), { timeout: tmuxCommandTimeoutMs });
+    return stdout.split('\n').filter(Boolean);
+  }
+  const checks = await Promise.all(dirs.map((d) => fs.stat(d).then((st) => st.isDirectory(), () => false)));
+  return dirs.filter((_, i) => !checks[i]);
+}
+
+// Recreates a saved session: its windows (names, pane cwds, layouts) and, with restoreCommands, the programs
+// that were running (by name; shells are skipped). Panes whose cwd no longer exists start in tmux's default
+// directory and are reported in the notes instead of failing the restore.
+export async function restoreSession(
+  snapshot: SessionSnapshot,
+  { session = snapshot.session, restoreCommands = false }: { session?: string; restoreCommands?: boolean },
+  io: { run: (args: string[]) => Promise<string>; missingDirs: (dirs: string[]) => Promise<string[]> },
+) {
+  snapshot = validateSessionSnapshot(snapshot);
+  const cwds = [...new Set(snapshot.windows.flatMap((w) => w.panes.map((p) => p.cwd)).filter(Boolean))];
+  const missing = new Set(await io.missingDirs(cwds));
+  const notes: string[] = [];
+  const cwdArgs = (window: string, pane: { index: number; cwd: string }) => {
+    if (!pane.cwd) return [];
+    if (!missing.has(pane.cwd)) return ['-c', pane.cwd];
+    notes.push(`${window}.${pane.index}: cwd ${pane.cwd} is missing; started in the default directory`);
+    return [];
+  };
+  for (const [i, w] of snapshot.windows.entries()) {
+    const label = `${session}:${w.name}`;
+    const [first, ...rest] = w.panes;
+    const create =
+      i === 0
+        ? ['new-session', '-d', '-s', session, '-n', w.name, '-P', '-F', '#{window_id}\t#{pane_id}']
+        : ['new-window', '-d', '-t', `${session}:`, '-n', w.name, '-P', '-F', '#{window_id}\t#{pane_id}'];
+    const created = await io.run([...create, ...(first ? cwdArgs(label, first) : [])]);
+    const [windowId, firstPane] = created.trim().split('\t');
+    const paneIds = [firstPane, ...(await splitTiled(windowId, rest.map((pane) => cwdArgs(label, pane)), io.run))];
+    try {
+      await io.run(['select-layout', '-t', windowId, w.layout]);
+    } catch (error) {
+      notes.push(`${label}: layout not applied (${(error as Error).message})`);
+    }
+    if (restoreCommands) {
+      for (const [p, pane] of w.panes.entries()) {
+        if (!pane.command || isShellCommand(pane.command)) continue;
+        await io.run(['send-keys', '-t', paneIds[p], '--', pane.command, 'Enter']);
+      }
+    }
+  }
+  return { session, windows: snapshot.windows.length, notes };
+}
+
+// Splits a window once per entry of `splits` (extra split-window arguments), rebalancing with the tiled layout
+// between splits so many-pane windows do not run out of room before their final layout lands. Returns the new
+// pane ids in order.
+async function splitTiled(windowId: string, splits: string[][], run: (args: string[]) => Promise<string>) {
+  const paneIds: string[] = [];
+  for (const extra of splits) {
+    paneIds.push((await run(['split-window', '-d', '-t', windowId, '-P', '-F', '#{pane_id}', ...extra])).trim());
+    if (splits.length > 1) await run(['select-layout', '-t', windowId, 'tiled']);
+  }
+  return paneIds;
+}
+
+export type SetupWindow = { name: string; command?: string; cwd?: string; panes?: number; layout?: string };
+
+// Bootstraps a session in one call: creates it if missing, then adds each named window that is not there yet
+// (existing windows are left alone so the call can be repeated). Extra panes are split off the first one and the
+// window layout (a preset like tiled or a saved layout string) is applied once all panes exist.
+export async function setupSession(
+  session: string,
+  windows: SetupWindow[],
+  io: { run: (args: string[]) => Promise<string> },
+) {
+  if (!session.trim()) throw new McpError(ErrorCode.InvalidParams, 'session name is required');
+  if (!windows.length) throw new McpError(ErrorCode.InvalidParams, 'windows must list at least one window');
+  for (const w of windows) {
+    if (!w.name?.trim()) throw new McpError(ErrorCode.InvalidParams, 'every window needs a name');
+    if (w.panes !== undefined && (!Number.isInteger(w.panes) || w.panes < 1)) {
+      throw new McpError(ErrorCode.InvalidParams, `window ${w.name}: panes must be a positive integer`);
+    }
+  }
+  const sessionExisted = await io.run(['has-session', '-t', `=${session}`]).then(
+    () => true,
+    () => false,
+  );
+  const existing = new Map<string, string>();
+  if (sessionExisted) {
+    const raw = await io.run(['list-windows', '-t', `=${session}:`, '-F', '#{window_name}\t#{window_id}']);
+    for (const line of raw.split('\n').filter(Boolean)) {
+      const [name, id] = line.split('\t');
+      if (!existing.has(name)) existing.set(name, id);
+    }
+  }
+  let sessionCreated = !sessionExisted;
+  const results: { name: string; windowId: string; created: boolean }[] = [];
+  for (const w of windows) {
+    const found = existing.get(w.name);
+    if (found) {
+      results.push({ name: w.name, windowId: found, created: false });
+      continue;
+    }
+    const dir = w.cwd ? ['-c', w.cwd] : [];
+    const create = sessionCreated
+      ? ['new-session', '-d', '-s', session, '-n', w.name, '-P', '-F', '#{window_id}', ...dir]
+      : ['new-window', '-d', '-t', `=${session}:`, '-n', w.name, '-P', '-F', '#{window_id}', ...dir];
+    sessionCreated = false;
+    const windowId = (await io.run(w.command ? [...create, w.command] : create)).trim();
+    const split = w.command ? [...dir, w.command] : dir;
+    await splitTiled(windowId, Array.from({ length: (w.panes ?? 1) - 1 }, () => split), io.run);
+    if (w.layout) await io.run(['select-layout', '-t', windowId, w.layout]);
+    existing.set(w.name, windowId);
+    results.push({ name: w.name, windowId, created: true });
+  }
+  return { session, sessionCreated: !sessionExisted, windows: results };
+}
+
+async function selectWindow(target: string, host?: string) {
+  await runTmux(['select-window', '-t', target], host);
+}
+
+async function selectPane(target: string, host?: string) {
+  await runTmux(['select-pane', '-t', target], host);
+}
+
+// tmux may expand #{...} in run-shell commands itself; either way display -p prints the pane's path.
+export function paneCwdPrefix(target: string, tmuxBin = tmuxBinary) {
+  return `cd "$(${tmuxBin} display -p -t ${shQuote(target)} '#{pane_current_path}')" && `;
+}
+
+export function buildRunShellArgs(
+  command: string,
+  { target, usePaneCwd = false, tmuxBin = tmuxBinary }: { target?: string; usePaneCwd?: boolean; tmuxBin?: string } = {},
+) {
+  const args = ['run-shell'];
+  if (target) args.push('-t', target);
+  args.push(usePaneCwd && target ? `${paneCwdPrefix(target, tmuxBin)}${command}` : command);
+  return args;
+}
+
+const stderrMarker = '__mcp_tmux_stderr__';
+
+// run-shell merges the command's stdout and stderr, so stderr goes to a temp file that is printed (and removed)
+// after a marker line carrying the exit status. The command runs in a subshell so an `exit` still reaches the
+// marker, and the status is reported rather than returned so a failing command does not become a tmux error.
+export function wrapStderrCapture(command: string) {
+  return [
+    '__mcp_err=$(mktemp) || exit 1',
+    `( ${command}\n) 2>"$__mcp_err"`,
+    '__mcp_rc=$?',
+    `printf '\\n${stderrMarker} %s\\n' "$__mcp_rc"`,
+    'cat "$__mcp_err"',
+    'rm -f "$__mcp_err"',
+  ].join('; ');
+}
+
+export function splitStderrCapture(output: string) {
+  const at = output.lastIndexOf(`${stderrMarker} `);
+  if (at === -1 || (at > 0 && output[at - 1] !== '\n')) return { stdout: output, stderr: '', exitCode: undefined };
+  const rest = output.slice(at + stderrMarker.length + 1);
+  const newline = rest.indexOf('\n');
+  const code = Number(newline === -1 ? rest : rest.slice(0, newline));
+  return {
+    stdout: output.slice(0, Math.max(0, at - 1)),
+    stderr: newline === -1 ? '' : rest.slice(newline + 1),
+    exitCode: Number.isInteger(code) ? code : undefined,
+  };
+}
+
+// A host profile's commandWrapper (e.g. `sudo -n`) runs run-shell commands as another user. It is plain words
+// only, so a typo cannot smuggle shell syntax into every command; the command itself goes to `sh -c` intact.
+export function wrapHostCommand(command: string, wrapper?: string) {
+  if (!wrapper) return command;
+  if (!/^[\w./=@:-]+( [\w./=@:-]+)*$/.test(wrapper.trim())) {
+    throw new McpError(
+      ErrorCode.InvalidRequest,
+      `host profile commandWrapper must be plain words (e.g. "sudo -n"), got ${JSON.stringify(wrapper)}`,
+    );
   }
-  lines.push('');
-  lines.push(`Summary: ${ok} succeeded, ${fail} failed`);
-  return lines.join('\n');
+  return `${wrapper.trim()} sh -c ${shQuote(command)}`;
 }
 
-async function saveLayoutProfile(name: string, session: string, host?: string) {
-  const windows = await captureLayouts(session, host);
-  layoutProfiles[name] = {
+// Runs a shell command on the host via the tmux server (not inside the pane), optionally from the pane's cwd.
+async function runShell(
+  command: string,
+  {
     host,
-    session,
-    windows,
+    target,
+    usePaneCwd = false,
+    separateStderr = false,
+  }: { host?: string; target?: string; usePaneCwd?: boolean; separateStderr?: boolean },
+) {
+  const profile = getHostProfile(host) as HostProfile | undefined;
+  const tmuxBin = profile?.tmuxBin || tmuxBinary;
+  // The cwd prefix stays outside the wrapper: it asks tmux for the pane path, which must run as the socket owner.
+  const wrapped = wrapHostCommand(command, profile?.commandWrapper);
+  const line = separateStderr ? wrapStderrCapture(wrapped) : wrapped;
+  return runTmux(buildRunShellArgs(line, { target, usePaneCwd, tmuxBin }), host);
+}
+
+// asShell joins the args into one run-shell command line, through the host's commandWrapper like runShell. It
+// stays a single argv entry, so quoting is left to the shell that runs it (and, remotely, to tmuxInvocation's
+// base64 wrapping).
+export function buildCommandArgs(args: string[], asShell = false, wrapper?: string) {
+  return asShell ? ['run-shell', wrapHostCommand(args.join(' '), wrapper)] : args;
+}
+
+export type PaneStats = { pid: number; cpuPercent: number; memPercent: number; rssKb: number; elapsed: string };
+
+// ps reports etime as [[dd-]hh:]mm:ss.
+export function parseElapsed(etime: string) {
+  const m = /^(?:(\d+)-)?(?:(\d+):)?(\d+):(\d+)$/.exec(etime.trim());
+  if (!m) return undefined;
+  const [, d = '0', h = '0', min, sec] = m;
+  return ((Number(d) * 24 + Number(h)) * 60 + Number(min)) * 60 + Number(sec);
+}
+
+const psGoneMarker = '__mcp_tmux_pid_gone__';
+
+// Parses `ps -o %cpu=,%mem=,rss=,etime= -p <pid>`; undefined means the process is gone.
+export function parsePsStats(pid: number, raw: string): PaneStats | undefined {
+  const line = raw.split('\n').find((l) => l.trim() && !l.includes(psGoneMarker));
+  if (!line) return undefined;
+  const [cpu, mem, rss, elapsed] = line.trim().split(/\s+/);
+  if ([cpu, mem, rss].some((v) => v === undefined || Number.isNaN(Number(v))) || !elapsed) return undefined;
+  return { pid, cpuPercent: Number(cpu), memPercent: Number(mem), rssKb: Number(rss), elapsed };
+}
+
+export function buildPsCommand(pid: number) {
+  if (!Number.isInteger(pid) || pid <= 0) throw new McpError(ErrorCode.InvalidParams, `invalid pane pid: ${pid}`);
+  return `ps -o %cpu=,%mem=,rss=,etime= -p ${pid} || echo ${psGoneMarker}`;
+}
+
+async function paneStats(target: string, host?: string) {
+  const fields = await fetchPaneFields(target, { pid: '#{pane_pid}', dead: '#{pane_dead}' }, host);
+  const pid = Number(fields.pid);
+  if (fields.dead === '1' || !pid) return { pid, stats: undefined };
+  return { pid, stats: parsePsStats(pid, await runShell(buildPsCommand(pid), { host })) };
+}
+
+export type TmuxBuffer = { name: string; size: number; created: number; sample: string };
+
+export const bufferListFormat = '#{buffer_name}\t#{buffer_size}\t#{buffer_created}\t#{buffer_sample}';
+
+// Buffers come newest first; the sample is tmux's escaped preview (newlines shown as \n), not the content.
+export function parseBufferList(raw: string): TmuxBuffer[] {
+  return raw
+    .split('\n')
+    .filter(Boolean)
+    .map((line) => {
+      const [name, size, created, ...sample] = line.split('\t');
+      return { name, size: Number(size) || 0, created: Number(created) || 0, sample: sample.join('\t') };
+    });
+}
+
+// Without a name tmux shows the most recent buffer (the last copy-mode yank).
+export function buildShowBufferArgs(name?: string) {
+  return name ? ['show-buffer', '-b', name] : ['show-buffer'];
+}
+
+// The format is passed as a single argv entry; for remote hosts tmuxInvocation base64-wraps the whole command
+// so `#{...}`, `$`, and quotes reach tmux unmangled.
+// client (-c) picks which attached client's view formats like #{client_width} are evaluated from.
+export function buildDisplayMessageArgs(format: string, target?: string, client?: string) {
+  return ['display-message', '-p', ...(client ? ['-c', client] : []), ...(target ? ['-t', target] : []), format];
+}
+
+// The unexpanded option values behind statusLineFormat (every window's formats, via #{W:}).
+const statusFormatSources =
+  '#{status-left} #{status-right} #{W:#{window-status-format} #{window-status-current-format} }';
+
+// The status line as a client draws it: #{T:...} expands the option's formats and strftime escapes, and the
+// window list renders each window with its (current-)window-status-format.
+export const statusLineFormat = [
+  '#{T:status-left}',
+  '#{W:#{T:window-status-format}#{window-status-separator},#{T:window-status-current-format}#{window-status-separator}}',
+  '#{T:status-right}',
+].join('\t');
+
+export type StatusLine = { left: string; windows: string; right: string; text: string };
+
+const statusStylePattern = /#\[[^\]]*\]/g;
+
+// Split the rendered status; #[fg=...] style directives are dropped unless keepStyles is set.
+export function parseStatusLine(raw: string, keepStyles = false): StatusLine {
+  const [left = '', windows = '', right = ''] = raw.replace(/\r?\n$/, '').split('\t');
+  const clean = (part: string) => (keepStyles ? part : part.replace(statusStylePattern, ''));
+  const line = { left: clean(left), windows: clean(windows).trimEnd(), right: clean(right) };
+  return { ...line, text: [line.left, line.windows, line.right].filter((part) => part.trim()).join(' ') };
+}
+
+// -C sets the size tmux uses for that client (control-mode clients, e.g. tmux -CC, report no terminal size
+// of their own), so captures of its session come back at the intended dimensions.
+export function buildRefreshClientArgs(client: string, size?: { width: number; height: number }) {
+  const args = ['refresh-client', '-t', client];
+  if (size) {
+    if (![size.width, size.height].every((n) => Number.isInteger(n) && n > 0)) {
+      throw new McpError(ErrorCode.InvalidParams, 'width and height must be positive integers');
+    }
+    args.push('-C', `${size.width}x${size.height}`);
+  }
+  return args;
+}
+
+// Successful tmux commands often print nothing; report that explicitly instead of a placeholder string.
+// legacyEmptyText restores the old "(no output)" text for clients that matched on it.
+export function commandOutputResult(output: string, legacyEmptyText = false) {
+  const hadOutput = output.length > 0;
+  return {
+    content: [{ type: 'text' as const, text: hadOutput || !legacyEmptyText ? output : '(no output)' }],
+    structuredContent: { output, hadOutput },
   };
-  await persistLayouts();
 }
 
-async function applyLayoutProfile(name: string, targetSession?: string, host?: string) {
-  const profile = layoutProfiles[name];
-  if (!profile) {
-    throw new McpError(ErrorCode.InvalidParams, `No layout profile named '${name}' found.`);
+// Raw output of a list command run with a caller-supplied format.
+export function rawListResult(output: string) {
+  return {
+    content: [{ type: 'text' as const, text: output || '(none)' }],
+    structuredContent: { lines: captureLines(output) },
+  };
+}
+
+// Window options set through a pane target silently apply to the whole window, so insist on a window.
+// Returns the target escaped for tmux (see escapeWindowTarget).
+function assertWindowTarget(target: string) {
+  if (!target || namesPane(target)) {
+    throw new McpError(ErrorCode.InvalidParams, `Expected a window target (session:window or @id), got "${target}"`);
   }
-  const resolvedHost = resolveHost(host) ?? profile.host;
-  const session = targetSession ?? profile.session;
-  for (const w of profile.windows) {
-    const windowTarget = `${session}:${w.index}`;
-    try {
-      await applyLayout(windowTarget, w.layout, resolvedHost);
-    } catch (error) {
-      throw new McpError(
-        ErrorCode.InternalError,
-        `Failed to apply layout to ${windowTarget}: ${(error as Error).message}`,
-      );
-    }
+  return escapeWindowTarget(target);
+}
+
+export function buildSyncPanesArgs(target: string, on: boolean) {
+  return ['set-window-option', '-t', assertWindowTarget(target), 'synchronize-panes', on ? 'on' : 'off'];
+}
+
+export const paneBorderStatuses = ['off', 'top', 'bottom'] as const;
+export type PaneBorderStatus = (typeof paneBorderStatuses)[number];
+
+// Both options are set in one tmux call, chained with ";".
+export function buildPaneBorderArgs(window: string, status: PaneBorderStatus, format?: string) {
+  const target = assertWindowTarget(window);
+  if (!paneBorderStatuses.includes(status)) {
+    throw new McpError(ErrorCode.InvalidParams, `pane-border-status must be off, top, or bottom, got "${status}"`);
   }
+  const args = ['set-window-option', '-t', target, 'pane-border-status', status];
+  if (format !== undefined) args.push(';', 'set-window-option', '-t', target, 'pane-border-format', format);
+  return args;
 }
 
-async function selectWindow(target: string, host?: string) {
-  await runTmux(['select-window', '-t', target], host);
+// Titles are only drawn when the window shows pane borders with a status line.
+export function buildPaneBorderStatusArgs(target: string, current: string) {
+  return current === 'off' ? ['set-window-option', '-t', target, 'pane-border-status', 'top'] : undefined;
 }
 
-async function selectPane(target: string, host?: string) {
-  await runTmux(['select-pane', '-t', target], host);
+// Returns the pane's previous title.
+async function retitlePane(target: string, title: string, showBorder: boolean, host?: string) {
+  const { previous, border } = await fetchPaneFields(
+    target,
+    { border: '#{pane-border-status}', previous: '#{pane_title}' },
+    host,
+  );
+  const borderArgs = showBorder ? buildPaneBorderStatusArgs(target, border) : undefined;
+  if (borderArgs) await runTmux(borderArgs, host);
+  await setPaneTitle(target, title, host);
+  return { previous, borderEnabled: Boolean(borderArgs) };
 }
 
+// Returns the option value tmux reports after the change.
 async function setSyncPanes(target: string, on: boolean, host?: string) {
-  await runTmux(['set-window-option', '-t', target, 'synchronize-panes', on ? 'on' : 'off'], host);
+  const args = buildSyncPanesArgs(target, on);
+  await runTmux(args, host);
+  const state = await runTmux(['show-window-options', '-v', '-t', args[2], 'synchronize-panes'], host);
+  return state === 'on';
 }
 
 async function main() {
@@ -900,6 +4736,8 @@ async function main() {
 
   await loadHostProfiles();
   await loadLayoutProfiles();
+  await loadMacros();
+  await loadHostDefaults();
   await ensureLocalTmuxAvailable();
 
   const server = new McpServer(
@@ -928,6 +4766,18 @@ async function main() {
     },
   );
 
+  // Route every tool registration through instrumentTool.
+  const registerTool: (...args: any[]) => unknown = server.registerTool.bind(server);
+  (server as any).registerTool = (name: string, config: unknown, handler: ToolHandler) =>
+    registerTool(name, config, instrumentTool(name, handler));
+  // Task tools too: createTask is the tool call; getTask/getTaskResult only poll the task store.
+  const registerToolTask = (name: string, config: unknown, handler: { createTask: ToolHandler }) =>
+    server.experimental.tasks.registerToolTask(
+      name,
+      config as any,
+      { ...handler, createTask: instrumentTool(name, handler.createTask) } as any,
+    );
+
   server.registerResource(
     'tmux_state_resource',
     'tmux://state/default',
@@ -980,17 +4830,81 @@ async function main() {
         session: z.string().describe('Session name to remember.').optional(),
         window: z.string().describe('Window target to remember.').optional(),
         pane: z.string().describe('Pane target to remember.').optional(),
+        force: z
+          .boolean()
+          .describe('Overwrite defaults even when MCP_TMUX_LOCK_DEFAULT is enabled.')
+          .default(false),
       },
     },
-    async ({ host, session, window, pane }) => {
-      if (host !== undefined) defaultHost = host || undefined;
-      if (session !== undefined) defaultSession = session || undefined;
-      if (window !== undefined) defaultWindow = window || undefined;
-      if (pane !== undefined) defaultPane = pane || undefined;
+    async ({ host, session, window, pane, force }) => {
+      const update: TargetDefaults = {};
+      if (host !== undefined) update.host = host || undefined;
+      if (session !== undefined) update.session = session || undefined;
+      if (window !== undefined) update.window = window || undefined;
+      if (pane !== undefined) update.pane = pane || undefined;
+      setDefaults(update, { force });
       return { content: [{ type: 'text', text: `Defaults updated:\n${summarizeDefaults()}` }] };
     },
   );
 
+  server.registerTool(
+    'tmux_set_defaults',
+    {
+      title: 'Save defaults for several hosts',
+      description:
+        'Save session/window/pane defaults for many hosts in one call (persisted across restarts); optionally switch to one of them.',
+      inputSchema: {
+        defaults: z
+          .array(
+            z.object({
+              host: z.string().describe('SSH host alias, or "local" for the local tmux server.'),
+              session: z.string().describe('Session to default to on this host ("" clears).').optional(),
+              window: z.string().describe('Window target to default to on this host ("" clears).').optional(),
+              pane: z.string().describe('Pane target to default to on this host ("" clears).').optional(),
+            }),
+          )
+          .min(1)
+          .describe('Per-host defaults; omitted fields keep their saved value.'),
+        activate: z
+          .string()
+          .describe('Host (from the saved defaults, or "local") to make the current default host right away.')
+          .optional(),
+        force: z
+          .boolean()
+          .describe('Overwrite current defaults on activate even when MCP_TMUX_LOCK_DEFAULT is enabled.')
+          .default(false)
+          .optional(),
+      },
+    },
+    async ({ defaults, activate, force = false }) => {
+      const next = mergeHostDefaults(hostDefaults, defaults);
+      if (activate !== undefined) assertKnownDefaultsHost(next, activate);
+      if (activate !== undefined) {
+        assertDefaultWritable(
+          lockDefault,
+          { host: defaultHost, session: defaultSession, window: defaultWindow, pane: defaultPane },
+          force,
+        );
+      }
+      hostDefaults = next;
+      await writeHostDefaults(hostDefaults);
+      if (activate !== undefined) {
+        const saved = hostDefaults[activate] ?? {};
+        setDefaults(
+          {
+            host: activate === 'local' ? undefined : activate,
+            session: saved.session,
+            window: saved.window,
+            pane: saved.pane,
+          },
+          { force },
+        );
+      }
+      const text = `Saved defaults for ${defaults.map((d) => d.host).join(', ')}.\n${summarizeDefaults()}`;
+      return { content: [{ type: 'text', text }] };
+    },
+  );
+
   server.registerTool(
     'tmux_get_default',
     {
@@ -1017,15 +4931,14 @@ async function main() {
     },
     async ({ host, session, command }) => {
       const existed = await ensureSession(host, session, command);
-      defaultHost = host;
-      defaultSession = session;
-      defaultWindow = undefined;
-      defaultPane = undefined;
+      const applied = setDefaults({ host, session, window: undefined, pane: undefined }, { implicit: true });
       await log('info', `${existed ? 'reconnected' : 'created'} session ${session} on ${host}`);
       const attachHint = `ssh -t ${host} ${tmuxBinary} attach -t ${session}`;
-      const text = existed
-        ? `Reconnected to remote session ${session} on ${host}. Attach with: ${attachHint}`
-        : `Created remote session ${session} on ${host}. Attach with: ${attachHint}`;
+      const text =
+        (existed
+          ? `Reconnected to remote session ${session} on ${host}. Attach with: ${attachHint}`
+          : `Created remote session ${session} on ${host}. Attach with: ${attachHint}`) +
+        (applied ? '' : defaultsLockedNote);
       await appendSessionLog(host, session, `mcp-tmux ${VERSION} ${existed ? 'reconnected' : 'created'} session`);
       return { content: [{ type: 'text', text }] };
     },
@@ -1070,31 +4983,44 @@ async function main() {
           .number()
           .describe('How many lines of scrollback to include from the capture target (default 200).')
           .optional(),
+        metadataOnly: z
+          .boolean()
+          .describe('Return only sessions/windows/panes, skipping the pane capture.')
+          .default(false)
+          .optional(),
+        captureTargets: z
+          .array(z.string())
+          .describe('Capture these panes instead of the active/default pane.')
+          .optional(),
+        maxTotalBytes: z
+          .number()
+          .int()
+          .min(0)
+          .describe(
+            'Cap the combined size of the pane text; later captures are truncated or omitted and marked. allPanes headers and separators are not counted.',
+          )
+          .optional(),
+        allPanes: z
+          .boolean()
+          .describe('Capture every listed pane, merged into one text under "=== pane %id ===" headers.')
+          .default(false)
+          .optional(),
       },
     },
-    async ({ host, session, captureLines }) => {
+    async ({ host, session, captureLines, metadataOnly = false, captureTargets, maxTotalBytes, allPanes = false }) => {
       const snapshot = await buildStateSnapshot({
         host,
         session,
         captureLines: captureLines ?? 200,
+        metadataOnly,
+        captureTargets,
+        maxTotalBytes,
+        allPanes,
       });
-      const text = [
-        `Host: ${snapshot.host}`,
-        `Session: ${snapshot.session}`,
-        `Capture target: ${snapshot.captureTarget ?? '(none)'}`,
-        '',
-        snapshot.sessionsText,
-        '',
-        snapshot.windowsText,
-        '',
-        snapshot.panesText,
-        '',
-        `Capture (last ${captureLines ?? 200} lines):`,
-        snapshot.capture,
-        '',
-        defaultTargetNote(),
-      ].join('\n');
-      return { content: [{ type: 'text', text }] };
+      const text = formatStateSnapshot(snapshot, captureLines ?? 200);
+      if (snapshot.merged === undefined) return { content: [{ type: 'text', text }] };
+      const captures = Object.fromEntries((snapshot.captures ?? []).map((c) => [c.target, c.text]));
+      return { content: [{ type: 'text', text }], structuredContent: { captures, merged: snapshot.merged } };
     },
   );
 
@@ -1113,31 +5039,44 @@ async function main() {
           .number()
           .describe('How many lines of scrollback to include from the capture target (default 200).')
           .optional(),
+        metadataOnly: z
+          .boolean()
+          .describe('Return only sessions/windows/panes, skipping the pane capture.')
+          .default(false)
+          .optional(),
+        captureTargets: z
+          .array(z.string())
+          .describe('Capture these panes instead of the active/default pane.')
+          .optional(),
+        maxTotalBytes: z
+          .number()
+          .int()
+          .min(0)
+          .describe(
+            'Cap the combined size of the pane text; later captures are truncated or omitted and marked. allPanes headers and separators are not counted.',
+          )
+          .optional(),
+        allPanes: z
+          .boolean()
+          .describe('Capture every listed pane, merged into one text under "=== pane %id ===" headers.')
+          .default(false)
+          .optional(),
       },
     },
-    async ({ host, session, captureLines }) => {
+    async ({ host, session, captureLines, metadataOnly = false, captureTargets, maxTotalBytes, allPanes = false }) => {
       const snapshot = await buildStateSnapshot({
         host,
         session,
         captureLines: captureLines ?? 200,
+        metadataOnly,
+        captureTargets,
+        maxTotalBytes,
+        allPanes,
       });
-      const text = [
-        `Host: ${snapshot.host}`,
-        `Session: ${snapshot.session}`,
-        `Capture target: ${snapshot.captureTarget ?? '(none)'}`,
-        '',
-        snapshot.sessionsText,
-        '',
-        snapshot.windowsText,
-        '',
-        snapshot.panesText,
-        '',
-        `Capture (last ${captureLines ?? 200} lines):`,
-        snapshot.capture,
-        '',
-        defaultTargetNote(),
-      ].join('\n');
-      return { content: [{ type: 'text', text }] };
+      const text = formatStateSnapshot(snapshot, captureLines ?? 200);
+      if (snapshot.merged === undefined) return { content: [{ type: 'text', text }] };
+      const captures = Object.fromEntries((snapshot.captures ?? []).map((c) => [c.target, c.text]));
+      return { content: [{ type: 'text', text }], structuredContent: { captures, merged: snapshot.merged } };
     },
   );
 
@@ -1220,6 +5159,53 @@ async function main() {
     },
   );
 
+  server.registerTool(
+    'tmux_describe_server',
+    {
+      title: 'Describe server',
+      description:
+        'One-shot summary: package/version, tmux version per known host, current defaults, enabled features, and auth mode.',
+    },
+    async () => ({ content: [{ type: 'text', text: formatServerDescription(await describeServer()) }] }),
+  );
+
+  server.registerTool(
+    'tmux_stats',
+    {
+      title: 'Server stats',
+      description:
+        'In-process counters since start: tool calls and errors, running background tasks, tmux spawns, control-mode commands, and cache hits/misses.',
+    },
+    async () => {
+      const stats = serverStats.snapshot(taskRegistry.list().filter((t) => t.status === 'working').length);
+      const text = Object.entries(stats)
+        .map(([k, v]) => `${k}: ${v}`)
+        .join('\n');
+      return { content: [{ type: 'text', text }], structuredContent: stats };
+    },
+  );
+
+  server.registerTool(
+    'tmux_ping',
+    {
+      title: 'Ping the server (and tmux)',
+      description:
+        'Measure latency without side effects: returns the server time and, unless tmux=false, the round trip of display-message -p pong on the host.',
+      inputSchema: {
+        host: z.string().describe('SSH host alias (optional). Uses default host if set.').optional(),
+        tmux: z.boolean().describe('Also time a tmux round trip to the host.').default(true).optional(),
+      },
+    },
+    async ({ host, tmux = true }) => {
+      const result = await ping(resolveHost(host), tmux);
+      const lines = [`Server time: ${result.serverTime}`, `Host: ${result.host}`];
+      if (result.tmuxRoundTripMs !== undefined) {
+        lines.push(`tmux round trip: ${result.tmuxRoundTripMs}ms (reply: ${result.reply})`);
+      }
+      return { content: [{ type: 'text', text: lines.join('\n') }] };
+    },
+  );
+
   server.registerTool(
     'tmux_set_audit_logging',
     {
@@ -1262,7 +5248,7 @@ async function main() {
       },
     },
     async ({ host, session }) => {
-      const resolvedSession = requireSession(session);
+      const resolvedSession = requireSession(session, host);
       const layouts = await captureLayouts(resolvedSession, resolveHost(host));
       const text = layouts
         .map((l) => `${resolvedSession}:${l.index} (${l.id}) ${l.name} layout=${l.layout}`)
@@ -1282,10 +5268,108 @@ async function main() {
         layout: z.string().describe('Layout string obtained from tmux_capture_layout.'),
       },
     },
-    async ({ host, target, layout }) => {
-      await applyLayout(target, layout, resolveHost(host));
-      await log('info', `restored layout on ${target}${host ? ` on ${host}` : ''}`);
-      return { content: [{ type: 'text', text: `Restored layout on ${target}.` }] };
+    async ({ host, target, layout }) => {
+      await applyLayout(target, layout, resolveHost(host));
+      await log('info', `restored layout on ${target}${host ? ` on ${host}` : ''}`);
+      return { content: [{ type: 'text', text: `Restored layout on ${target}.` }] };
+    },
+  );
+
+  server.registerTool(
+    'tmux_parse_layout',
+    {
+      title: 'Parse a window layout',
+      description:
+        'Decompose a tmux layout string (or a window\'s current layout) into a tree of cells with sizes, offsets, and pane ids.',
+      inputSchema: {
+        host: z.string().describe('SSH host alias (optional). Uses default host if set.').optional(),
+        layout: z.string().describe('Layout string to parse. If omitted, reads the layout of target.').optional(),
+        target: z.string().describe('Window target to read the current layout from (when layout is omitted).').optional(),
+      },
+    },
+    async ({ host, layout, target }) => {
+      if (!layout && !target) throw new McpError(ErrorCode.InvalidParams, 'layout or target is required');
+      const source =
+        layout ?? (await runTmux(['display-message', '-p', '-t', target!, '#{window_layout}'], resolveHost(host)));
+      const parsed = parseLayout(source);
+      return {
+        content: [{ type: 'text', text: JSON.stringify(parsed, null, 2) }],
+        structuredContent: parsed,
+      };
+    },
+  );
+
+  server.registerTool(
+    'tmux_build_layout',
+    {
+      title: 'Build a window layout',
+      description:
+        'Serialize a layout tree (as returned by tmux_parse_layout) into a layout string with a valid checksum, optionally applying it to a window.',
+      inputSchema: {
+        host: z.string().describe('SSH host alias (optional). Uses default host if set.').optional(),
+        root: layoutCellSchema.describe('Root cell covering the whole window.'),
+        target: z.string().describe('Window target to apply the layout to (optional).').optional(),
+      },
+    },
+    async ({ host, root, target }) => {
+      const layout = buildLayout(root);
+      if (target) {
+        await applyLayout(target, layout, resolveHost(host));
+        return { content: [{ type: 'text', text: `Applied layout ${layout} to ${target}.` }] };
+      }
+      return { content: [{ type: 'text', text: layout }] };
+    },
+  );
+
+  server.registerTool(
+    'tmux_restore_layouts',
+    {
+      title: 'Restore layouts across windows',
+      description:
+        'Validate and apply layout strings to several windows in one call, reporting per-window errors instead of skipping them. atomic=true aborts on the first invalid layout or failure.',
+      inputSchema: {
+        host: z.string().describe('SSH host alias (optional). Uses default host if set.').optional(),
+        layouts: z
+          .array(
+            z.object({
+              target: z.string().describe('Window target (e.g., session:window or window id).'),
+              layout: z.string().describe('Layout string obtained from tmux_capture_layout.'),
+            }),
+          )
+          .nonempty()
+          .describe('Windows and the layouts to apply to them.'),
+        atomic: z
+          .boolean()
+          .describe('Apply nothing if any layout is invalid, and stop at the first apply failure.')
+          .default(false)
+          .optional(),
+        dryRun: z
+          .boolean()
+          .describe('Only report which windows would change (will-change/no-op/invalid); apply nothing.')
+          .default(false)
+          .optional(),
+      },
+    },
+    async ({ host, layouts, atomic = false, dryRun = false }) => {
+      const resolvedHost = resolveHost(host);
+      if (dryRun) {
+        const plan = await planLayouts(layouts, resolvedHost);
+        const lines = plan.map((r) => {
+          const detail = r.error ? ` (${r.error})` : r.status === 'will-change' ? ` (current ${r.current})` : '';
+          return `${r.target}: ${r.status}${detail}`;
+        });
+        const changing = plan.filter((r) => r.status === 'will-change').length;
+        lines.push('', `Dry run: ${changing} of ${plan.length} windows would change; nothing applied`);
+        return { content: [{ type: 'text', text: lines.join('\n') }] };
+      }
+      const results = await applyLayouts(layouts, { host: resolvedHost, atomic });
+      const applied = results.filter((r) => r.status === 'applied').length;
+      const failed = results.filter((r) => r.status === 'invalid' || r.status === 'failed').length;
+      const lines = results.map((r) => `${r.target}: ${r.status}${r.error ? ` (${r.error})` : ''}`);
+      lines.push('');
+      lines.push(`Summary: ${applied} applied, ${failed} failed, ${results.length - applied - failed} skipped`);
+      await log(failed ? 'warning' : 'info', `restored ${applied}/${results.length} layouts${host ? ` on ${host}` : ''}`);
+      return { content: [{ type: 'text', text: lines.join('\n') }] };
     },
   );
 
@@ -1303,21 +5387,113 @@ async function main() {
         lines: z.number().describe('How many lines per fetch.').default(200).optional(),
         iterations: z.number().describe('How many polling iterations.').default(3).optional(),
         intervalMs: z.number().describe('Delay between polls in milliseconds.').default(1000).optional(),
+        followOnly: z
+          .boolean()
+          .describe('Only return output appended after the first poll (tail -f style); the baseline is not returned.')
+          .default(false)
+          .optional(),
+        lineMode: z
+          .boolean()
+          .describe('Follow like followOnly but only emit complete lines; a trailing partial line is flushed at the end.')
+          .default(false)
+          .optional(),
+        activityWindowSec: z
+          .number()
+          .positive()
+          .describe(
+            'Size the first fetch to the lines written in the last N seconds (as seen by earlier tails of this pane), ' +
+              'capped at lines. The first tail of a pane uses lines.',
+          )
+          .optional(),
+        detectResize: z
+          .boolean()
+          .describe('Mark pane resizes; follow modes then take a fresh baseline (default on when following).')
+          .optional(),
+        fromLine: z
+          .number()
+          .int()
+          .min(0)
+          .describe(
+            'Resume from this absolute line (0 = oldest history line), e.g. the nextLine of an earlier tail, ' +
+              'instead of the usual first window. At most lines lines are returned.',
+          )
+          .optional(),
       },
     },
-    async ({ host, target, lines = 200, iterations = 3, intervalMs = 1000 }) => {
-      const resolvedTarget = requirePaneTarget(target);
-      const tailText = await tailPane({ host, target: resolvedTarget, lines, iterations, intervalMs });
+    async ({
+      host,
+      target,
+      lines = 200,
+      iterations = 3,
+      intervalMs = 1000,
+      followOnly = false,
+      lineMode = false,
+      activityWindowSec,
+      detectResize,
+      fromLine,
+    }) => {
+      const resolvedTarget = requirePaneTarget(target, host);
+      const resolvedHost = resolveHost(host);
+      if (fromLine !== undefined && activityWindowSec !== undefined) {
+        throw new McpError(ErrorCode.InvalidParams, 'fromLine cannot be combined with activityWindowSec');
+      }
+      let resume: ResumePoint | undefined;
+      if (fromLine !== undefined) {
+        const { historySize, cursorY } = await paneLinePosition(resolvedTarget, resolvedHost);
+        resume = resumePoint(fromLine, historySize, cursorY, lines);
+      }
+      const activityKey = `${resolvedHost ?? ''}\u0000${resolvedTarget}`;
+      let initialLines = lines;
+      if (activityWindowSec !== undefined) {
+        const total = await paneLineTotal(resolvedTarget, resolvedHost);
+        const now = Date.now();
+        initialLines = activityWindowLines(
+          paneActivity.linesSince(activityKey, activityWindowSec * 1000, total, now),
+          lines,
+        );
+        paneActivity.record(activityKey, total, now);
+      }
+      const tailText = await withWatchHooks(resolvedTarget, resolvedHost, () =>
+        tailPane({
+          host,
+          target: resolvedTarget,
+          lines,
+          iterations,
+          intervalMs,
+          followOnly,
+          lineMode,
+          initialLines,
+          fromStart: resume?.start,
+          detectResize,
+        }),
+      );
+      const nextLine = await paneLineTotal(resolvedTarget, resolvedHost);
+      if (activityWindowSec !== undefined) {
+        paneActivity.record(activityKey, nextLine, Date.now());
+      }
       await appendSessionLog(
-        resolveHost(host),
+        resolvedHost,
         getSessionFromTarget(resolvedTarget),
         `tail_pane ${resolvedTarget} lines=${lines}`,
       );
-      return { content: [{ type: 'text', text: tailText || '(no output)' }] };
+      const text = tailText || (followOnly || lineMode ? '(no new output)' : '(no output)');
+      let header =
+        activityWindowSec !== undefined && !followOnly && !lineMode
+          ? `Initial window: ${initialLines} lines (activity in the last ${activityWindowSec}s)\n`
+          : '';
+      if (resume) {
+        header += resume.reset
+          ? `Resume: line ${fromLine} is past the cursor (history cleared); restarted at the cursor line\n`
+          : `Resumed from line ${fromLine}${resume.skipped ? ` (skipped ${resume.skipped} lines beyond lines)` : ''}\n`;
+      }
+      return {
+        content: [{ type: 'text', text: `${header}${text}\nNext line: ${nextLine}` }],
+        structuredContent: { nextLine, ...(resume ? { skipped: resume.skipped, reset: resume.reset } : {}) },
+      };
     },
   );
 
-  server.experimental.tasks.registerToolTask(
+  registerToolTask(
     'tmux_tail_task',
     {
       title: 'Tail a pane (task)',
@@ -1331,34 +5507,99 @@ async function main() {
         lines: z.number().describe('How many lines per fetch.').default(200).optional(),
         intervalMs: z.number().describe('Delay between polls in milliseconds.').default(1500).optional(),
         iterations: z.number().describe('How many polling iterations before auto-complete.').default(5).optional(),
+        debounceMs: z
+          .number()
+          .describe('Only record a change once the pane has been quiet this long (coalesces chatty output).')
+          .optional(),
+        maxLatencyMs: z
+          .number()
+          .describe('With debounceMs: record a pending change after at most this long (default 10x debounceMs).')
+          .optional(),
+        detectResize: z
+          .boolean()
+          .describe('Record a "Resized: WxH" entry when the pane size changes, so clients reset buffered output.')
+          .default(false)
+          .optional(),
+        label: z.string().describe('Free-form name shown in tmux_list_tasks and audit logs (e.g. "build output").').optional(),
       },
       outputSchema: undefined,
     } as any,
     {
       async createTask(
-        { host, target, lines = 200, intervalMs = 1500, iterations = 5 }: any,
+        {
+          host,
+          target,
+          lines = 200,
+          intervalMs = 1500,
+          iterations = 5,
+          debounceMs,
+          maxLatencyMs,
+          detectResize = false,
+          label,
+        }: any,
         { taskStore }: any,
       ) {
-        const resolvedTarget = requirePaneTarget(target);
-        const task = await taskStore.createTask({});
-        (async () => {
-          const resolvedHost = resolveHost(host);
-          const parts: string[] = [];
-          for (let i = 0; i < iterations; i++) {
-            const capture = await capturePane(resolvedTarget, -lines, undefined, resolvedHost);
-            parts.push(`Iteration ${i + 1}/${iterations}`);
-            parts.push(capture || '(empty)');
-            if (i < iterations - 1) {
-              await new Promise((r) => setTimeout(r, intervalMs));
+        const resolvedTarget = requirePaneTarget(target, host);
+        const task = await startTask(taskStore, {
+          tool: 'tmux_tail_task',
+          label,
+          host: resolveHost(host),
+          target: resolvedTarget,
+        });
+        // The task span covers the task's whole lifetime.
+        void withSpan(
+          'task tmux_tail_task',
+          'server',
+          { 'mcp.tool': 'tmux_tail_task', 'tmux.target': resolvedTarget },
+          async () => {
+            const resolvedHost = resolveHost(host);
+            const parts: string[] = [];
+            const debouncer = debounceMs ? createChangeDebouncer({ debounceMs, maxLatencyMs }) : undefined;
+            const expired = createDeadline(maxTaskDurationMs);
+            const resized = createResizeDetector();
+            try {
+              await runWatchHook(watchHooks.start, resolvedTarget, resolvedHost);
+              for (let i = 0; i < iterations; i++) {
+                if (expired()) {
+                  parts.push(maxDurationNotice(maxTaskDurationMs));
+                  break;
+                }
+                const size = detectResize ? resized(await paneSize(resolvedTarget, resolvedHost)) : undefined;
+                if (size) parts.push(resizeNotice(size));
+                const capture = await captureForTask(resolvedTarget, lines, resolvedHost, intervalMs);
+                if (!debouncer) {
+                  parts.push(`Iteration ${i + 1}/${iterations}`);
+                  parts.push(capture || '(empty)');
+                } else {
+                  const settled = debouncer.offer(capture, Date.now());
+                  if (settled !== undefined) {
+                    parts.push(`Change (settled by iteration ${i + 1}/${iterations})`);
+                    parts.push(settled || '(empty)');
+                  }
+                }
+                if (i < iterations - 1) {
+                  await new Promise((r) => setTimeout(r, intervalMs));
+                }
+              }
+              if (!expired()) {
+                const finalCapture = await captureForTask(resolvedTarget, lines, resolvedHost, intervalMs);
+                parts.push('Final:');
+                parts.push(finalCapture || '(empty)');
+              }
+              await storeTaskResult(taskStore, task.taskId, 'completed', {
+                content: [{ type: 'text', text: parts.join('\n') }],
+              });
+            } catch (error) {
+              parts.push(taskFailureNotice(error));
+              await storeTaskResult(taskStore, task.taskId, 'failed', {
+                content: [{ type: 'text', text: parts.join('\n') }],
+                isError: true,
+              });
+            } finally {
+              await runWatchHook(watchHooks.end, resolvedTarget, resolvedHost);
             }
-          }
-          const finalCapture = await capturePane(resolvedTarget, -lines, undefined, resolvedHost);
-          parts.push('Final:');
-          parts.push(finalCapture || '(empty)');
-          await taskStore.storeTaskResult(task.taskId, 'completed', {
-            content: [{ type: 'text', text: parts.join('\n') }],
-          });
-        })();
+          },
+        );
         return { task };
       },
       async getTask(_args: any, { taskId, taskStore }: any) {
@@ -1432,7 +5673,7 @@ async function main() {
     },
   );
 
-  server.experimental.tasks.registerToolTask(
+  registerToolTask(
     'tmux_watch_dir_task',
     {
       title: 'Watch a directory for new files',
@@ -1442,40 +5683,55 @@ async function main() {
         path: z.string().describe('Directory to watch.').default('.').optional(),
         intervalMs: z.number().describe('Polling interval ms.').default(2000).optional(),
         iterations: z.number().describe('Max polling iterations.').default(10).optional(),
+        label: z.string().describe('Free-form name shown in tmux_list_tasks and audit logs (e.g. "build output").').optional(),
       },
       outputSchema: undefined,
     } as any,
     {
-      async createTask({ host, path = '.', intervalMs = 2000, iterations = 10 }: any, { taskStore }: any) {
-        const task = await taskStore.createTask({});
-        (async () => {
-          let prev = await listDirSimple(path, host);
-          for (let i = 0; i < iterations; i++) {
-            await new Promise((r) => setTimeout(r, intervalMs));
-            const curr = await listDirSimple(path, host);
-            const added = diffNewFiles(prev, curr);
-            prev = curr;
-            if (added.length) {
-              await taskStore.storeTaskResult(task.taskId, 'completed', {
-                content: [
-                  {
-                    type: 'text',
-                    text: `New files detected in ${path}${host ? ` on ${host}` : ''}:\n${added.join('\n')}`,
-                  },
-                ],
+      async createTask({ host, path = '.', intervalMs = 2000, iterations = 10, label }: any, { taskStore }: any) {
+        const resolvedHost = resolveHost(host);
+        const task = await startTask(taskStore, { tool: 'tmux_watch_dir_task', label, host: resolvedHost });
+        const where = `${path}${resolvedHost ? ` on ${resolvedHost}` : ''}`;
+        // The task span covers the task's whole lifetime.
+        void withSpan(
+          'task tmux_watch_dir_task',
+          'server',
+          { 'mcp.tool': 'tmux_watch_dir_task', 'watch.path': path },
+          async () => {
+            const expired = createDeadline(maxTaskDurationMs);
+            try {
+              let prev = await listDirSimple(path, resolvedHost);
+              for (let i = 0; i < iterations; i++) {
+                await new Promise((r) => setTimeout(r, intervalMs));
+                if (expired()) {
+                  await storeTaskResult(taskStore, task.taskId, 'completed', {
+                    content: [
+                      { type: 'text', text: `No new files detected in ${path}.\n${maxDurationNotice(maxTaskDurationMs)}` },
+                    ],
+                  });
+                  return;
+                }
+                const curr = await listDirSimple(path, resolvedHost);
+                const added = diffNewFiles(prev, curr);
+                prev = curr;
+                if (added.length) {
+                  await storeTaskResult(taskStore, task.taskId, 'completed', {
+                    content: [{ type: 'text', text: `New files detected in ${where}:\n${added.join('\n')}` }],
+                  });
+                  return;
+                }
+              }
+              await storeTaskResult(taskStore, task.taskId, 'completed', {
+                content: [{ type: 'text', text: `No new files detected in ${where} after ${iterations} checks.` }],
+              });
+            } catch (error) {
+              await storeTaskResult(taskStore, task.taskId, 'failed', {
+                content: [{ type: 'text', text: taskFailureNotice(error) }],
+                isError: true,
               });
-              return;
             }
-          }
-          await taskStore.storeTaskResult(task.taskId, 'completed', {
-            content: [
-              {
-                type: 'text',
-                text: `No new files detected in ${path}${host ? ` on ${host}` : ''} after ${iterations} checks.`,
-              },
-            ],
-          });
-        })();
+          },
+        );
         return { task };
       },
       async getTask(_args: any, { taskId, taskStore }: any) {
@@ -1487,7 +5743,7 @@ async function main() {
     } as any,
   );
 
-  server.experimental.tasks.registerToolTask(
+  registerToolTask(
     'tmux_wait_for_pattern_task',
     {
       title: 'Wait for output pattern',
@@ -1503,41 +5759,138 @@ async function main() {
         lines: z.number().describe('Lines per fetch.').default(400).optional(),
         intervalMs: z.number().describe('Delay between polls in milliseconds.').default(1500).optional(),
         iterations: z.number().describe('Max polling iterations.').default(8).optional(),
+        label: z.string().describe('Free-form name shown in tmux_list_tasks and audit logs (e.g. "build output").').optional(),
       },
       outputSchema: undefined,
     } as any,
     {
       async createTask(
-        { host, target, pattern, flags, lines = 400, intervalMs = 1500, iterations = 8 }: any,
+        { host, target, pattern, flags, lines = 400, intervalMs = 1500, iterations = 8, label }: any,
         { taskStore }: any,
       ) {
-        const resolvedTarget = requirePaneTarget(target);
-        const task = await taskStore.createTask({});
-        (async () => {
-          const resolvedHost = resolveHost(host);
-          const regex = new RegExp(pattern, flags);
-          for (let i = 0; i < iterations; i++) {
-            const capture = await capturePane(resolvedTarget, -lines, undefined, resolvedHost);
-            if (regex.test(capture)) {
-              await taskStore.storeTaskResult(task.taskId, 'completed', {
-                content: [{ type: 'text', text: `Pattern matched on iteration ${i + 1}.\n${capture}` }],
+        const resolvedTarget = requirePaneTarget(target, host);
+        // Compiled before the task is registered, so a bad pattern is a plain error rather than a task stuck working.
+        let regex: RegExp;
+        try {
+          regex = new RegExp(pattern, flags);
+        } catch (error) {
+          throw new McpError(ErrorCode.InvalidParams, `invalid pattern: ${(error as Error).message}`);
+        }
+        const task = await startTask(taskStore, {
+          tool: 'tmux_wait_for_pattern_task',
+          label,
+          host: resolveHost(host),
+          target: resolvedTarget,
+        });
+        // The task span covers the task's whole lifetime.
+        void withSpan(
+          'task tmux_wait_for_pattern_task',
+          'server',
+          { 'mcp.tool': 'tmux_wait_for_pattern_task', 'tmux.target': resolvedTarget },
+          async () => {
+            const resolvedHost = resolveHost(host);
+            const expired = createDeadline(maxTaskDurationMs);
+            try {
+              for (let i = 0; i < iterations; i++) {
+                if (expired()) {
+                  await storeTaskResult(taskStore, task.taskId, 'completed', {
+                    content: [
+                      { type: 'text', text: `Pattern not found after ${i} checks.\n${maxDurationNotice(maxTaskDurationMs)}` },
+                    ],
+                  });
+                  return;
+                }
+                const capture = await captureForTask(resolvedTarget, lines, resolvedHost, intervalMs);
+                if (regex.test(capture)) {
+                  await storeTaskResult(taskStore, task.taskId, 'completed', {
+                    content: [{ type: 'text', text: `Pattern matched on iteration ${i + 1}.\n${capture}` }],
+                  });
+                  return;
+                }
+                if (i < iterations - 1) {
+                  await new Promise((r) => setTimeout(r, intervalMs));
+                }
+              }
+              const finalCapture = await captureForTask(resolvedTarget, lines, resolvedHost, intervalMs);
+              await storeTaskResult(taskStore, task.taskId, 'completed', {
+                content: [
+                  {
+                    type: 'text',
+                    text: `Pattern not found after ${iterations} checks.\nLast capture:\n${finalCapture}`,
+                  },
+                ],
+              });
+            } catch (error) {
+              await storeTaskResult(taskStore, task.taskId, 'failed', {
+                content: [{ type: 'text', text: taskFailureNotice(error) }],
+                isError: true,
               });
-              return;
             }
-            if (i < iterations - 1) {
-              await new Promise((r) => setTimeout(r, intervalMs));
+          },
+        );
+        return { task };
+      },
+      async getTask(_args: any, { taskId, taskStore }: any) {
+        return taskStore.getTask(taskId);
+      },
+      async getTaskResult(_args: any, { taskId, taskStore }: any) {
+        return taskStore.getTaskResult(taskId);
+      },
+    } as any,
+  );
+
+  registerToolTask(
+    'tmux_wait_for_exit_task',
+    {
+      title: 'Wait for the pane process to exit',
+      description:
+        'Complete once the command running in a pane exits (pane dies or the prompt returns), instead of polling for output.',
+      inputSchema: {
+        host: z.string().describe('SSH host alias (optional). Uses default host if set.').optional(),
+        target: z
+          .string()
+          .describe('Pane target to watch (pane id or session:window.pane). If omitted, uses default pane if set.')
+          .optional(),
+        intervalMs: z.number().describe('Delay between checks in milliseconds.').default(1000).optional(),
+        timeoutMs: z.number().describe('Give up after this many milliseconds.').default(600000).optional(),
+        label: z.string().describe('Free-form name shown in tmux_list_tasks and audit logs (e.g. "build output").').optional(),
+      },
+      outputSchema: undefined,
+    } as any,
+    {
+      async createTask({ host, target, intervalMs = 1000, timeoutMs = 600000, label }: any, { taskStore }: any) {
+        const resolvedTarget = requirePaneTarget(target, host);
+        const task = await startTask(taskStore, {
+          tool: 'tmux_wait_for_exit_task',
+          label,
+          host: resolveHost(host),
+          target: resolvedTarget,
+        });
+        void withSpan(
+          'task tmux_wait_for_exit_task',
+          'server',
+          { 'mcp.tool': 'tmux_wait_for_exit_task', 'tmux.target': resolvedTarget },
+          async () => {
+            const resolvedHost = resolveHost(host);
+            try {
+              const capped = maxTaskDurationMs > 0 && maxTaskDurationMs < timeoutMs;
+              const result = await watchPaneExit(() => samplePaneProcess(resolvedTarget, resolvedHost), {
+                intervalMs,
+                timeoutMs: capped ? maxTaskDurationMs : timeoutMs,
+              });
+              const lines = [`Status: ${result.status}`, result.detail, `Elapsed: ${result.elapsedMs}ms`];
+              if (capped && result.status === 'timeout') lines.push(maxDurationNotice(maxTaskDurationMs));
+              await storeTaskResult(taskStore, task.taskId, 'completed', {
+                content: [{ type: 'text', text: lines.join('\n') }],
+              });
+            } catch (error) {
+              await storeTaskResult(taskStore, task.taskId, 'failed', {
+                content: [{ type: 'text', text: taskFailureNotice(error) }],
+                isError: true,
+              });
             }
-          }
-          const finalCapture = await capturePane(resolvedTarget, -lines, undefined, resolvedHost);
-          await taskStore.storeTaskResult(task.taskId, 'completed', {
-            content: [
-              {
-                type: 'text',
-                text: `Pattern not found after ${iterations} checks.\nLast capture:\n${finalCapture}`,
-              },
-            ],
-          });
-        })();
+          },
+        );
         return { task };
       },
       async getTask(_args: any, { taskId, taskStore }: any) {
@@ -1549,75 +5902,371 @@ async function main() {
     } as any,
   );
 
-
   server.registerTool(
-    'tmux_select_window',
+    'tmux_set_prompt_sentinel',
+    {
+      title: 'Set a prompt sentinel',
+      description:
+        "Append a known marker to the pane shell's PS1 (bash/zsh/sh) so tmux_run_batch waitForPrompt=true can tell deterministically when a command has finished. Done once per pane unless force=true.",
+      inputSchema: {
+        host: z.string().describe('SSH host alias (optional). Uses default host if set.').optional(),
+        target: z
+          .string()
+          .describe('Pane target (pane id or session:window.pane). If omitted, uses default pane if set.')
+          .optional(),
+        sentinel: z.string().describe(`Marker to append to PS1 (default ${defaultPromptSentinel}).`).optional(),
+        force: z
+          .boolean()
+          .describe('Inject again even if the pane already has this sentinel.')
+          .default(false)
+          .optional(),
+      },
+    },
+    async ({ host, target, sentinel = defaultPromptSentinel, force = false }) => {
+      const resolvedHost = resolveHost(host);
+      const resolvedTarget = requirePaneTarget(target, host);
+      assertPromptSentinel(sentinel);
+      const result = await configurePromptSentinel(
+        resolvedTarget,
+        sentinel,
+        { force },
+        {
+          run: (args) => runTmux(args, resolvedHost),
+          send: (keys) => sendKeysQueued(resolvedTarget, keys, true, resolvedHost),
+          capture: () => capturePane(resolvedTarget, -50, undefined, resolvedHost),
+        },
+      );
+      const text = !result.injected
+        ? `Pane ${resolvedTarget} already uses prompt sentinel ${sentinel}.`
+        : result.ready
+          ? `Prompt sentinel ${sentinel} set on ${resolvedTarget} (prompt seen after ${result.elapsedMs}ms).`
+          : `Sent the PS1 change to ${resolvedTarget}, but no prompt ending in ${sentinel} appeared within ` +
+            `${result.elapsedMs}ms; the shell may not use PS1 (e.g. fish) or is busy.`;
+      return { content: [{ type: 'text', text }], structuredContent: { sentinel, ...result }, isError: !result.ready };
+    },
+  );
+
+  server.registerTool(
+    'tmux_wait_for_command',
+    {
+      title: 'Wait for a pane command',
+      description:
+        'Poll #{pane_current_command} until it equals a command (e.g. node started) or, with until=not, until it changes away (e.g. vim closed).',
+      inputSchema: {
+        host: z.string().describe('SSH host alias (optional). Uses default host if set.').optional(),
+        target: z
+          .string()
+          .describe('Pane target to watch (pane id or session:window.pane). If omitted, uses default pane if set.')
+          .optional(),
+        command: z.string().min(1).describe('Command name as tmux reports it (e.g. bash, vim, node).'),
+        until: z
+          .enum(['is', 'not'])
+          .describe('is: wait until the pane runs command; not: wait until it no longer does.')
+          .default('is')
+          .optional(),
+        intervalMs: z.number().describe('Delay between checks in milliseconds.').default(500).optional(),
+        timeoutMs: z.number().describe('Give up after this many milliseconds.').default(30000).optional(),
+      },
+    },
+    async ({ host, target, command, until = 'is', intervalMs = 500, timeoutMs = 30000 }) => {
+      const resolvedHost = resolveHost(host);
+      const resolvedTarget = requirePaneTarget(target, host);
+      const result = await waitForCommand(
+        async () =>
+          (await fetchPaneFields(resolvedTarget, { command: '#{pane_current_command}' }, resolvedHost)).command,
+        { command, until, intervalMs, timeoutMs },
+      );
+      const goal = until === 'is' ? `running ${command}` : `no longer running ${command}`;
+      const text = result.matched
+        ? `Pane ${resolvedTarget} is ${goal} (current: ${result.command}, after ${result.elapsedMs}ms).`
+        : `Timed out after ${result.elapsedMs}ms waiting for ${resolvedTarget} to be ${goal} ` +
+          `(current: ${result.command}).`;
+      return { content: [{ type: 'text', text }], structuredContent: result, isError: !result.matched };
+    },
+  );
+
+  server.registerTool(
+    'tmux_list_tasks',
+    {
+      title: 'List background tasks',
+      description: 'List tail/wait/watch tasks started by this server with their labels, targets, and status.',
+      inputSchema: {
+        status: z.enum(['working', 'completed', 'failed']).describe('Only list tasks in this state.').optional(),
+      },
+    },
+    async ({ status }) => {
+      const entries = taskRegistry.list().filter((e) => !status || e.status === status);
+      return { content: [{ type: 'text', text: formatTaskList(entries) }] };
+    },
+  );
+
+  server.registerTool(
+    'tmux_select_window',
+    {
+      title: 'Focus a window',
+      description: 'Select a window so subsequent commands target it.',
+      inputSchema: {
+        host: z.string().describe('SSH host alias (optional). Uses default host if set.').optional(),
+        target: z.string().describe('Window target (session:window or window id).'),
+      },
+    },
+    async ({ host, target }) => {
+      await selectWindow(target, resolveHost(host));
+      await log('info', `selected window ${target}${host ? ` on ${host}` : ''}`);
+      return { content: [{ type: 'text', text: `Selected window ${target}.` }] };
+    },
+  );
+
+  server.registerTool(
+    'tmux_select_pane',
+    {
+      title: 'Focus a pane',
+      description: 'Select a pane so subsequent commands target it.',
+      inputSchema: {
+        host: z.string().describe('SSH host alias (optional). Uses default host if set.').optional(),
+        target: z.string().describe('Pane target (pane id or session:window.pane).'),
+      },
+    },
+    async ({ host, target }) => {
+      await selectPane(target, resolveHost(host));
+      await log('info', `selected pane ${target}${host ? ` on ${host}` : ''}`);
+      const applied = setDefaults({ pane: target }, { implicit: true });
+      return { content: [{ type: 'text', text: `Selected pane ${target}.${applied ? '' : defaultsLockedNote}` }] };
+    },
+  );
+
+  server.registerTool(
+    'tmux_set_pane_title',
+    {
+      title: 'Set a pane title',
+      description:
+        'Label a pane for humans (select-pane -T), turning on pane-border-status for its window if it is off. Returns the previous title.',
+      inputSchema: {
+        host: z.string().describe('SSH host alias (optional). Uses default host if set.').optional(),
+        target: z
+          .string()
+          .describe('Pane target (pane id or session:window.pane). If omitted, uses default pane if set.')
+          .optional(),
+        title: z.string().describe('New pane title.'),
+        showBorder: z
+          .boolean()
+          .describe('Set pane-border-status to top when it is off so the title is visible.')
+          .default(true)
+          .optional(),
+      },
+    },
+    async ({ host, target, title, showBorder = true }) => {
+      const resolvedTarget = requirePaneTarget(target, host);
+      const resolvedHost = resolveHost(host);
+      const { previous, borderEnabled } = await retitlePane(resolvedTarget, title, showBorder, resolvedHost);
+      await log('info', `pane title ${resolvedTarget}: ${title}${host ? ` on ${host}` : ''}`);
+      const text = [
+        `Set title of ${resolvedTarget} to ${JSON.stringify(title)} (was ${JSON.stringify(previous)}).`,
+        ...(borderEnabled ? ['Enabled pane-border-status (top) for its window.'] : []),
+      ].join('\n');
+      return { content: [{ type: 'text', text }], structuredContent: { previous, borderEnabled } };
+    },
+  );
+
+  server.registerTool(
+    'tmux_set_pane_border_status',
+    {
+      title: 'Show or hide pane borders',
+      description:
+        'Set pane-border-status (off, top, bottom) for a window, and optionally pane-border-format, so humans can see pane titles.',
+      inputSchema: {
+        host: z.string().describe('SSH host alias (optional). Uses default host if set.').optional(),
+        target: z.string().describe('Window target (session:window or window id).'),
+        status: z.enum(paneBorderStatuses).describe('Where to draw the pane status line, or off.'),
+        format: z
+          .string()
+          .describe('pane-border-format to use (e.g. "#{pane_index}: #{pane_title}"). Leaves the current one if omitted.')
+          .optional(),
+      },
+    },
+    async ({ host, target, status, format }) => {
+      await runTmux(buildPaneBorderArgs(target, status, format), resolveHost(host));
+      await log('info', `pane-border-status ${status} for ${target}${host ? ` on ${host}` : ''}`);
+      const formatNote = format !== undefined ? ` with format ${JSON.stringify(format)}` : '';
+      return { content: [{ type: 'text', text: `pane-border-status ${status} on ${target}${formatNote}.` }] };
+    },
+  );
+
+  server.registerTool(
+    'tmux_set_sync_panes',
+    {
+      title: 'Toggle synchronize-panes',
+      description: 'Enable or disable synchronize-panes for a window.',
+      inputSchema: {
+        host: z.string().describe('SSH host alias (optional). Uses default host if set.').optional(),
+        target: z.string().describe('Window target (session:window or window id).'),
+        on: z.boolean().describe('Whether to enable synchronize-panes.'),
+      },
+    },
+    async ({ host, target, on }) => {
+      const enabled = await setSyncPanes(target, on, resolveHost(host));
+      await log('info', `sync-panes ${enabled ? 'on' : 'off'} for ${target}${host ? ` on ${host}` : ''}`);
+      return {
+        content: [
+          {
+            type: 'text',
+            text: `sync-panes ${enabled ? 'enabled' : 'disabled'} on ${target}.\nState: ${enabled ? 'on' : 'off'}`,
+          },
+        ],
+      };
+    },
+  );
+
+  server.registerTool(
+    'tmux_broadcast_keys',
+    {
+      title: 'Send keys to every pane in a window',
+      description:
+        'List the panes of one window and send the same keys to each, reporting per-pane results (scoped alternative to synchronize-panes).',
+      inputSchema: {
+        host: z.string().describe('SSH host alias (optional). Uses default host if set.').optional(),
+        target: z.string().describe('Window target (session:window or window id).'),
+        keys: z
+          .string()
+          .describe('The text/keys to send. Supports <SPACE>/<ENTER>/<TAB>/<ESC>. Empty + enter=true sends Enter.'),
+        enter: z.boolean().describe('Append Enter after the keys.').default(true).optional(),
+      },
+    },
+    async ({ host, target, keys, enter = true }) => {
+      const resolvedHost = resolveHost(host);
+      const results = await broadcastKeys(target, keys, enter, resolvedHost);
+      const session = getSessionFromTarget(target);
+      await auditLog(resolvedHost, session, 'broadcast_keys', { target, keys, enter, panes: results.map((r) => r.pane) });
+      await appendSessionLog(resolvedHost, session, `broadcast-keys "${keys}" enter=${enter} to ${target}`);
+      const ok = results.filter((r) => r.ok).length;
+      const text = [
+        ...results.map((r) => `${r.pane}: ${r.ok ? 'sent' : `failed (${r.error})`}`),
+        '',
+        `Summary: ${ok}/${results.length} panes`,
+      ].join('\n');
+      return { content: [{ type: 'text', text }], isError: ok < results.length };
+    },
+  );
+
+  server.registerTool(
+    'tmux_save_layout_profile',
     {
-      title: 'Focus a window',
-      description: 'Select a window so subsequent commands target it.',
+      title: 'Save a layout profile',
+      description: 'Capture layouts for all windows in a session and store them under a profile name.',
       inputSchema: {
         host: z.string().describe('SSH host alias (optional). Uses default host if set.').optional(),
-        target: z.string().describe('Window target (session:window or window id).'),
+        session: z.string().describe('Session to capture (optional, uses default session).').optional(),
+        name: z.string().describe('Profile name to store.'),
       },
     },
-    async ({ host, target }) => {
-      await selectWindow(target, resolveHost(host));
-      await log('info', `selected window ${target}${host ? ` on ${host}` : ''}`);
-      return { content: [{ type: 'text', text: `Selected window ${target}.` }] };
+    async ({ host, session, name }) => {
+      const resolvedSession = requireSession(session, host);
+      await saveLayoutProfile(name, resolvedSession, resolveHost(host));
+      return { content: [{ type: 'text', text: `Saved layout profile '${name}' for session ${resolvedSession}.` }] };
     },
   );
 
   server.registerTool(
-    'tmux_select_pane',
+    'tmux_save_session',
     {
-      title: 'Focus a pane',
-      description: 'Select a pane so subsequent commands target it.',
+      title: 'Save a session snapshot',
+      description:
+        'Serialize a session (windows, names, layouts, pane cwds and running commands) into a JSON snapshot for tmux_restore_session.',
       inputSchema: {
         host: z.string().describe('SSH host alias (optional). Uses default host if set.').optional(),
-        target: z.string().describe('Pane target (pane id or session:window.pane).'),
+        session: z.string().describe('Session to save (optional, uses default session).').optional(),
       },
     },
-    async ({ host, target }) => {
-      await selectPane(target, resolveHost(host));
-      await log('info', `selected pane ${target}${host ? ` on ${host}` : ''}`);
-      defaultPane = target;
-      return { content: [{ type: 'text', text: `Selected pane ${target}.` }] };
+    async ({ host, session }) => {
+      const snapshot = await saveSession(requireSession(session, host), resolveHost(host));
+      return {
+        content: [{ type: 'text', text: JSON.stringify(snapshot) }],
+        structuredContent: snapshot,
+      };
     },
   );
 
   server.registerTool(
-    'tmux_set_sync_panes',
+    'tmux_restore_session',
     {
-      title: 'Toggle synchronize-panes',
-      description: 'Enable or disable synchronize-panes for a window.',
+      title: 'Restore a session snapshot',
+      description:
+        'Recreate a session from a tmux_save_session snapshot: windows, pane cwds, and layouts (optionally restarting commands).',
       inputSchema: {
         host: z.string().describe('SSH host alias (optional). Uses default host if set.').optional(),
-        target: z.string().describe('Window target (session:window or window id).'),
-        on: z.boolean().describe('Whether to enable synchronize-panes.'),
+        snapshot: z.string().describe('Snapshot JSON returned by tmux_save_session.'),
+        session: z.string().describe('Name for the restored session (defaults to the saved name).').optional(),
+        restoreCommands: z
+          .boolean()
+          .describe('Re-run the saved non-shell commands (by name only) in their panes.')
+          .default(false)
+          .optional(),
       },
     },
-    async ({ host, target, on }) => {
-      await setSyncPanes(target, on, resolveHost(host));
-      await log('info', `sync-panes ${on ? 'on' : 'off'} for ${target}${host ? ` on ${host}` : ''}`);
-      return { content: [{ type: 'text', text: `sync-panes ${on ? 'enabled' : 'disabled'} on ${target}.` }] };
+    async ({ host, snapshot, session, restoreCommands = false }) => {
+      const resolvedHost = resolveHost(host);
+      let json: unknown;
+      try {
+        json = JSON.parse(snapshot);
+      } catch (error) {
+        throw new McpError(ErrorCode.InvalidParams, `snapshot is not valid JSON: ${(error as Error).message}`);
+      }
+      const parsed = validateSessionSnapshot(json);
+      const name = session ?? parsed.session;
+      const exists = await runTmux(['has-session', '-t', `=${name}`], resolvedHost).then(
+        () => true,
+        () => false,
+      );
+      if (exists) throw new McpError(ErrorCode.InvalidRequest, `Session ${name} already exists; pick another name.`);
+      const result = await restoreSession(
+        parsed,
+        { session: name, restoreCommands },
+        { run: (args) => runTmux(args, resolvedHost), missingDirs: (dirs) => missingDirs(dirs, resolvedHost) },
+      );
+      await auditLog(resolvedHost, name, 'restore_session', { windows: result.windows, notes: result.notes });
+      const text = [`Restored session ${name} with ${result.windows} windows.`, ...result.notes].join('\n');
+      return { content: [{ type: 'text', text }] };
     },
   );
 
   server.registerTool(
-    'tmux_save_layout_profile',
+    'tmux_setup_session',
     {
-      title: 'Save a layout profile',
-      description: 'Capture layouts for all windows in a session and store them under a profile name.',
+      title: 'Set up a session and its windows',
+      description:
+        'Create (or ensure) a session and a list of named windows with optional commands, cwds, pane counts and layouts in one call.',
       inputSchema: {
         host: z.string().describe('SSH host alias (optional). Uses default host if set.').optional(),
-        session: z.string().describe('Session to capture (optional, uses default session).').optional(),
-        name: z.string().describe('Profile name to store.'),
+        session: z.string().describe('Session to create or reuse.'),
+        windows: z
+          .array(
+            z.object({
+              name: z.string().describe('Window name; windows that already exist are left untouched.'),
+              command: z.string().describe('Command to start in each pane of the window.').optional(),
+              cwd: z.string().describe('Starting directory for the window panes.').optional(),
+              panes: z.number().int().min(1).max(16).describe('Number of panes (default 1).').optional(),
+              layout: z
+                .string()
+                .describe('Layout preset (tiled, even-horizontal, main-vertical, ...) or saved layout string.')
+                .optional(),
+            }),
+          )
+          .min(1)
+          .describe('Windows to ensure, in order.'),
       },
     },
-    async ({ host, session, name }) => {
-      const resolvedSession = requireSession(session);
-      await saveLayoutProfile(name, resolvedSession, resolveHost(host));
-      return { content: [{ type: 'text', text: `Saved layout profile '${name}' for session ${resolvedSession}.` }] };
+    async ({ host, session, windows }) => {
+      const resolvedHost = resolveHost(host);
+      const result = await setupSession(session, windows, { run: (args) => runTmux(args, resolvedHost) });
+      await auditLog(resolvedHost, session, 'setup_session', {
+        sessionCreated: result.sessionCreated,
+        windows: result.windows,
+      });
+      const lines = [
+        `Session ${session} ${result.sessionCreated ? 'created' : 'already existed'}.`,
+        ...result.windows.map((w) => `${w.name}\t${w.windowId}\t${w.created ? 'created' : 'existing'}`),
+      ];
+      return { content: [{ type: 'text', text: lines.join('\n') }], structuredContent: result };
     },
   );
 
@@ -1652,116 +6301,633 @@ async function main() {
         host: z.string().describe('SSH host alias (optional). Uses default host if set.').optional(),
       },
     },
-    async ({ host }) => {
+    async ({ host }) => {
+      const resolvedHost = resolveHost(host);
+      const results: string[] = [];
+      try {
+        await runTmux(['-V'], resolvedHost);
+        results.push('tmux -V: ok');
+      } catch (error) {
+        throw new McpError(
+          ErrorCode.InternalError,
+          `tmux not reachable on ${resolvedHost ?? 'local'}: ${(error as Error).message}`,
+        );
+      }
+      try {
+        const sessions = await listSessions(resolvedHost);
+        results.push(`sessions: ${sessions.length}`);
+      } catch (error) {
+        results.push(`sessions: failed (${(error as Error).message})`);
+      }
+      const hostCfg = getHostProfile(resolvedHost);
+      results.push(`host profile: ${hostCfg ? JSON.stringify(hostCfg) : 'none'}`);
+      const sockets = (hostCfg as HostProfile | undefined)?.sockets;
+      if (sockets?.length) {
+        const health = await socketRouter.checkAll(resolvedHost ?? 'local', sockets, (socket) =>
+          execTmux(socketProbeArgs, resolvedHost, socket),
+        );
+        results.push(...health.map((h) => `socket ${h.socket}: ${h.ok ? 'ok' : `down (${h.error})`}`));
+      }
+      return { content: [{ type: 'text', text: results.join('\n') }] };
+    },
+  );
+
+  server.registerTool(
+    'tmux_validate_target',
+    {
+      title: 'Check that a target exists',
+      description:
+        'Preflight before a sequence: resolve a target (default pane, paneStrategy) and report whether its session and pane exist, with the concrete pane id. Read-only.',
+      inputSchema: {
+        host: z.string().describe('SSH host alias (optional). Uses default host if set.').optional(),
+        target: z
+          .string()
+          .describe('Target to check (pane id, session, session:window[.pane]). Defaults to the default pane.')
+          .optional(),
+        paneStrategy: paneStrategySchema,
+      },
+    },
+    async ({ host, target, paneStrategy }) => {
+      const resolvedHost = resolveHost(host);
+      const check = await requestContext.run({ ...requestContext.getStore(), noServerStart: true }, () =>
+        validateTarget(target, paneStrategy ?? defaultPaneStrategy, (args) => runTmux(args, resolvedHost), host),
+      );
+      const text = check.paneExists
+        ? `${check.target} resolves to pane ${check.pane} (session ${check.session}, window ${check.window}).`
+        : `${check.target ?? '(no target)'} is not usable: ${check.error}`;
+      return { content: [{ type: 'text', text }], structuredContent: check };
+    },
+  );
+
+  server.registerTool(
+    'tmux_list_sessions',
+    {
+      title: 'List tmux sessions',
+      description: 'Enumerate sessions with attachment counts and window totals.',
+      inputSchema: {
+        host: z.string().describe('SSH host alias (optional). If omitted, uses default host or local.').optional(),
+        format: z
+          .string()
+          .min(1)
+          .describe('Custom tmux -F format (e.g. "#{pane_id} #{pane_pid}"); returns the raw rendered lines instead.')
+          .optional(),
+      },
+    },
+    async ({ host, format }) => {
+      if (format) return rawListResult(await runTmux(buildListArgs('list-sessions', format), resolveHost(host)));
+      const sessions = await listSessions(resolveHost(host));
+      return {
+        content: [{ type: 'text', text: formatSessions(sessions) }],
+      };
+    },
+  );
+
+  server.registerTool(
+    'tmux_session_activity',
+    {
+      title: 'Session activity',
+      description:
+        'Report per-session last activity, last attach time, and whether a client is attached, so agents can avoid disturbing a human.',
+      inputSchema: {
+        host: z.string().describe('SSH host alias (optional). Uses default host if set.').optional(),
+      },
+    },
+    async ({ host }) => {
+      const sessions = await sessionActivity(resolveHost(host));
+      return { content: [{ type: 'text', text: formatSessionActivity(sessions) }] };
+    },
+  );
+
+  server.registerTool(
+    'tmux_list_windows',
+    {
+      title: 'List windows',
+      description: 'List windows within a session (or all sessions if no target provided).',
+      inputSchema: {
+        host: z.string().describe('SSH host alias (optional). Uses default host if set.').optional(),
+        target: z.string().describe('Session name or id to list (optional). If omitted, lists all.').optional(),
+        format: z
+          .string()
+          .min(1)
+          .describe('Custom tmux -F format (e.g. "#{pane_id} #{pane_pid}"); returns the raw rendered lines instead.')
+          .optional(),
+      },
+    },
+    async ({ target, host, format }) => {
+      if (format) return rawListResult(await runTmux(buildListArgs('list-windows', format, target), resolveHost(host)));
+      const windows = await listWindows(target, resolveHost(host));
+      return {
+        content: [{ type: 'text', text: formatWindows(windows) }],
+      };
+    },
+  );
+
+  server.registerTool(
+    'tmux_list_panes',
+    {
+      title: 'List panes',
+      description: 'List panes across windows or inside a specific target.',
+      inputSchema: {
+        host: z.string().describe('SSH host alias (optional). Uses default host if set.').optional(),
+        target: z
+          .string()
+          .describe('Target (session, window, or pane) to narrow the list. Optional.')
+          .optional(),
+        format: z
+          .string()
+          .min(1)
+          .describe('Custom tmux -F format (e.g. "#{pane_id} #{pane_pid}"); returns the raw rendered lines instead.')
+          .optional(),
+      },
+    },
+    async ({ target, host, format }) => {
+      if (format) return rawListResult(await runTmux(buildListArgs('list-panes', format, target), resolveHost(host)));
+      const panes = await listPanes(target, resolveHost(host));
+      return {
+        content: [{ type: 'text', text: formatPanes(panes) }],
+      };
+    },
+  );
+
+  server.registerTool(
+    'tmux_capture_pane',
+    {
+      title: 'Capture pane output',
+      description: 'Read the scrollback of a pane to observe command results.',
+      inputSchema: {
+        host: z.string().describe('SSH host alias (optional). Uses default host if set.').optional(),
+        target: z
+          .string()
+          .describe('Pane target (pane id or session:window.pane). If omitted, uses default pane if set.')
+          .optional(),
+        start: z
+          .number()
+          .describe('Optional start line offset (e.g. -200 for last 200 lines). Defaults to -200.')
+          .optional(),
+        end: z.number().describe('Optional end line offset.').optional(),
+        includeTitle: z
+          .boolean()
+          .describe('Also report the pane title (#{pane_title}) above the capture.')
+          .default(false)
+          .optional(),
+        joinWrapped: z
+          .boolean()
+          .describe('Join lines the terminal wrapped (capture-pane -J). Default false keeps the on-screen wrapping.')
+          .default(false)
+          .optional(),
+        base64: z
+          .boolean()
+          .describe('Return the raw capture bytes base64-encoded instead of decoded text (no UTF-8 replacement).')
+          .default(false)
+          .optional(),
+        sourceEncoding: z
+          .string()
+          .min(1)
+          .describe('Encoding of the pane output (e.g. latin1, shift_jis) to transcode to UTF-8. Default: UTF-8.')
+          .optional(),
+        collapseBlankLines: z
+          .boolean()
+          .describe('Reduce runs of blank lines to a single blank line (reports how many were dropped).')
+          .default(false)
+          .optional(),
+        collapseProgress: z
+          .boolean()
+          .describe('Collapse runs of progress-bar/spinner updates to their latest line (reports how many were dropped).')
+          .default(false)
+          .optional(),
+        expandTabs: z
+          .number()
+          .int()
+          .min(1)
+          .max(16)
+          .describe('Expand tab characters to spaces at this tab width so the capture renders the same everywhere.')
+          .optional(),
+        findByCommand: z
+          .string()
+          .describe('Capture the single pane whose current command matches (e.g. node) instead of passing target.')
+          .optional(),
+        splitVisible: z
+          .boolean()
+          .describe('Return the visible screen and the scrollback above it as separate sections (start bounds the scrollback; end is rejected).')
+          .default(false)
+          .optional(),
+        segmentByPrompt: z
+          .boolean()
+          .describe('Split the capture into prompt/command/output segments using the prompt detector.')
+          .default(false)
+          .optional(),
+        grep: z.string().describe('Only return lines matching this regex (plus context).').optional(),
+        grepFlags: z.string().describe('Regex flags for grep (e.g., i).').optional(),
+        context: z.number().int().min(0).describe('Lines of context around each grep match (like grep -C).').optional(),
+        maxMatches: z.number().int().min(1).describe('Keep only the last N grep matches.').optional(),
+        includeHash: z
+          .boolean()
+          .describe('Report a content hash of the returned text, usable later as previousHash.')
+          .default(false)
+          .optional(),
+        metadataOnly: z
+          .boolean()
+          .describe('Return only the headers and size (byteLength/lineCount) of the capture, not the text itself.')
+          .default(false)
+          .optional(),
+        previousHash: z
+          .string()
+          .describe('Return only a line diff against the earlier capture with this content hash.')
+          .optional(),
+        maxBytes: z
+          .number()
+          .int()
+          .min(1)
+          .describe('Keep only the last N bytes of the returned text (newest output).')
+          .optional(),
+        truncationMarker: z
+          .string()
+          .describe(`Text inserted where maxBytes/headLines/tailLines cut content, e.g. "${defaultTruncationMarker}".`)
+          .optional(),
+        retryEmpty: z
+          .number()
+          .int()
+          .min(0)
+          .max(10)
+          .describe('Retry up to N times (200ms apart) while the capture is empty, e.g. right after new-session.')
+          .optional(),
+        includeDimensions: z
+          .boolean()
+          .describe('Report the pane width/height (header and structured content) for wrapping captured text.')
+          .default(false)
+          .optional(),
+        includeCursor: z
+          .boolean()
+          .describe('Report the cursor column/row within the visible pane (0-based; header and structured content).')
+          .default(false)
+          .optional(),
+        includeHistory: z
+          .boolean()
+          .describe('Report history size/limit and the copy-mode scroll position, for paging with start/end.')
+          .default(false)
+          .optional(),
+        keepColor: z
+          .boolean()
+          .describe('Keep colour/attribute escape sequences (-e). Defaults to MCP_TMUX_STRIP_ANSI (stripped unless 0).')
+          .optional(),
+        extractLinks: z
+          .boolean()
+          .describe(
+            'Return plain text plus the OSC 8 hyperlinks in it as structured `links` ({text, url, line, section}).',
+          )
+          .default(false)
+          .optional(),
+        asLines: z
+          .boolean()
+          .describe('Also return the returned text as structured `lines` (after all transforms; no trailing empty line).')
+          .default(false)
+          .optional(),
+        previousText: z.string().describe('Return only a line diff against this earlier capture text.').optional(),
+        headLines: z
+          .number()
+          .int()
+          .min(0)
+          .describe('Keep only the first N lines (combine with tailLines for head + tail).')
+          .optional(),
+        tailLines: z
+          .number()
+          .int()
+          .min(0)
+          .describe('Keep only the last N lines; lines in between are elided and counted.')
+          .optional(),
+        matchPositions: z
+          .boolean()
+          .describe('With grep: also report each match with its line index, byte offset, and capture groups.')
+          .default(false)
+          .optional(),
+        startColumn: z
+          .number()
+          .int()
+          .min(0)
+          .describe('Keep display columns from here (0-based). Wide CJK/emoji glyphs count as two columns.')
+          .optional(),
+        endColumn: z
+          .number()
+          .int()
+          .min(1)
+          .describe('Keep display columns before this one (exclusive); a glyph cut in half becomes a space.')
+          .optional(),
+        paneStrategy: paneStrategySchema,
+      },
+    },
+    async ({
+      target,
+      start,
+      end,
+      host,
+      includeTitle = false,
+      joinWrapped = false,
+      base64 = false,
+      collapseBlankLines = false,
+      collapseProgress = false,
+      sourceEncoding,
+      expandTabs: tabWidth,
+      findByCommand,
+      splitVisible = false,
+      segmentByPrompt: segment = false,
+      grep,
+      grepFlags,
+      context,
+      maxMatches,
+      matchPositions = false,
+      headLines,
+      tailLines,
+      includeHash = false,
+      metadataOnly = false,
+      previousHash,
+      previousText,
+      includeDimensions = false,
+      includeCursor = false,
+      includeHistory = false,
+      asLines = false,
+      extractLinks = false,
+      keepColor,
+      retryEmpty = 0,
+      maxBytes,
+      truncationMarker,
+      startColumn,
+      endColumn,
+      paneStrategy,
+    }) => {
       const resolvedHost = resolveHost(host);
-      const results: string[] = [];
-      try {
-        await runTmux(['-V'], resolvedHost);
-        results.push('tmux -V: ok');
-      } catch (error) {
+      const found =
+        !target && findByCommand
+          ? findPaneByCommand(await listPanes(undefined, resolvedHost, true), findByCommand)
+          : undefined;
+      const resolvedTarget = found
+        ? found.id
+        : await strategyPaneTarget(requirePaneTarget(target, host), resolvedHost, paneStrategy);
+      let grepRegex: RegExp | undefined;
+      if (grep !== undefined) {
+        if (base64) throw new McpError(ErrorCode.InvalidParams, 'grep cannot be combined with base64');
+        try {
+          grepRegex = new RegExp(grep, (grepFlags ?? '').replace(/[gy]/g, ''));
+        } catch (error) {
+          throw new McpError(ErrorCode.InvalidParams, `invalid grep regex: ${(error as Error).message}`);
+        }
+      }
+      if (matchPositions && !grepRegex) {
+        throw new McpError(ErrorCode.InvalidParams, 'matchPositions requires grep');
+      }
+      if (splitVisible && (base64 || grepRegex)) {
+        throw new McpError(ErrorCode.InvalidParams, 'splitVisible cannot be combined with base64 or grep');
+      }
+      // The visible section always runs to the bottom of the screen, so an end offset has nothing to cut.
+      if (splitVisible && end !== undefined) {
         throw new McpError(
-          ErrorCode.InternalError,
-          `tmux not reachable on ${resolvedHost ?? 'local'}: ${(error as Error).message}`,
+          ErrorCode.InvalidParams,
+          'splitVisible cannot be combined with end; use start to bound the scrollback',
         );
       }
-      try {
-        const sessions = await listSessions(resolvedHost);
-        results.push(`sessions: ${sessions.length}`);
-      } catch (error) {
-        results.push(`sessions: failed (${(error as Error).message})`);
+      if (segment && (base64 || grepRegex || splitVisible)) {
+        throw new McpError(ErrorCode.InvalidParams, 'segmentByPrompt cannot be combined with base64, grep, or splitVisible');
       }
-      const hostCfg = getHostProfile(resolvedHost);
-      results.push(`host profile: ${hostCfg ? JSON.stringify(hostCfg) : 'none'}`);
-      return { content: [{ type: 'text', text: results.join('\n') }] };
-    },
-  );
-
-  server.registerTool(
-    'tmux_list_sessions',
-    {
-      title: 'List tmux sessions',
-      description: 'Enumerate sessions with attachment counts and window totals.',
-      inputSchema: {
-        host: z.string().describe('SSH host alias (optional). If omitted, uses default host or local.').optional(),
-      },
-    },
-    async ({ host }) => {
-      const sessions = await listSessions(resolveHost(host));
-      return {
-        content: [{ type: 'text', text: formatSessions(sessions) }],
-      };
-    },
-  );
-
-  server.registerTool(
-    'tmux_list_windows',
-    {
-      title: 'List windows',
-      description: 'List windows within a session (or all sessions if no target provided).',
-      inputSchema: {
-        host: z.string().describe('SSH host alias (optional). Uses default host if set.').optional(),
-        target: z.string().describe('Session name or id to list (optional). If omitted, lists all.').optional(),
-      },
-    },
-    async ({ target, host }) => {
-      const windows = await listWindows(target, resolveHost(host));
-      return {
-        content: [{ type: 'text', text: formatWindows(windows) }],
+      const headTail = headLines !== undefined || tailLines !== undefined;
+      if (maxBytes !== undefined && base64) {
+        throw new McpError(ErrorCode.InvalidParams, 'maxBytes cannot be combined with base64');
+      }
+      const columns = startColumn !== undefined || endColumn !== undefined;
+      if (columns && base64) {
+        throw new McpError(ErrorCode.InvalidParams, 'startColumn/endColumn cannot be combined with base64');
+      }
+      if (asLines && base64) throw new McpError(ErrorCode.InvalidParams, 'asLines cannot be combined with base64');
+      if (keepColor && (columns || tabWidth)) {
+        throw new McpError(ErrorCode.InvalidParams, 'keepColor cannot be combined with startColumn/endColumn or expandTabs');
+      }
+      if (extractLinks && (keepColor || base64)) {
+        throw new McpError(ErrorCode.InvalidParams, 'extractLinks cannot be combined with keepColor or base64');
+      }
+      // Link lines index the capture as tmux returned it, so transforms that drop or cut lines would make them lie.
+      if (
+        extractLinks &&
+        (collapseBlankLines || collapseProgress || columns || headTail || grepRegex || maxBytes !== undefined || segment)
+      ) {
+        throw new McpError(
+          ErrorCode.InvalidParams,
+          'extractLinks cannot be combined with collapseBlankLines, collapseProgress, startColumn/endColumn, ' +
+            'headLines/tailLines, grep, maxBytes, or segmentByPrompt',
+        );
+      }
+      if (columns && endColumn !== undefined && endColumn <= (startColumn ?? 0)) {
+        throw new McpError(ErrorCode.InvalidParams, 'endColumn must be greater than startColumn');
+      }
+      const encoding = sourceEncoding ? resolveSourceEncoding(sourceEncoding) : undefined;
+      if (encoding && base64) {
+        throw new McpError(ErrorCode.InvalidParams, 'sourceEncoding cannot be combined with base64');
+      }
+      if (headTail && (base64 || splitVisible || segment)) {
+        throw new McpError(
+          ErrorCode.InvalidParams,
+          'headLines/tailLines cannot be combined with base64, splitVisible, or segmentByPrompt',
+        );
+      }
+      const capture = (from?: number, to?: number) =>
+        capturePaneChecked(resolvedTarget, from, to, resolvedHost, {
+          joinWrapped,
+          escapes: extractLinks || resolveKeepColor(keepColor, columns || Boolean(tabWidth)),
+          encoding,
+        })
+          .then((c) => (extractLinks ? { ...c, ...extractHyperlinks(c.text) } : { ...c, links: undefined }))
+          .then((c) => ({
+            ...c,
+            ...transformCapture(c.text, { collapseBlankLines, collapseProgress, expandTabs: tabWidth }),
+          }))
+          .then((c) => (columns ? { ...c, text: sliceColumnRange(c.text, startColumn, endColumn) } : c))
+          .catch(async (error: unknown) => {
+            await auditLog(resolvedHost, getSessionFromTarget(resolvedTarget), 'capture_pane.error', {
+              target: resolvedTarget,
+              error: (error as Error).message,
+            });
+            throw error;
+          });
+      const ranges = splitVisible ? splitCaptureRanges(start) : undefined;
+      const { value: captured, retries } = await retryWhileEmpty(
+        () => (ranges ? capture(ranges.visible.start, ranges.visible.end) : capture(start, end)),
+        (c) => !c.text.trim(),
+        { retries: retryEmpty, delayMs: 200 },
+      );
+      const history = ranges ? await capture(ranges.scrollback.start, ranges.scrollback.end) : undefined;
+      let output = base64 ? Buffer.from(captured.bytes).toString('base64') : captured.text;
+      if (history) {
+        output = ['Visible:', captured.text || '(empty)', '', 'Scrollback:', history.text || '(empty)'].join('\n');
+      }
+      const header: string[] = [];
+      if (retries) header.push(`Empty capture retries: ${retries}`);
+      if (found) {
+        header.push(`Pane: ${found.id} (${found.session}:${found.window}.${found.index}, running ${found.command})`);
+      }
+      if (base64) {
+        header.push('Encoding: base64 (raw bytes)');
+      } else if (encoding && encoding !== 'utf-8') {
+        header.push(`Encoding: transcoded from ${encoding}`);
+      } else if (captured.hadInvalidUtf8 || history?.hadInvalidUtf8) {
+        header.push('UTF-8: invalid byte sequences replaced with U+FFFD');
+      }
+      const collapsedLines = captured.collapsedLines + (history?.collapsedLines ?? 0);
+      const expandedTabs = (captured.expandedTabs ?? 0) + (history?.expandedTabs ?? 0);
+      if (tabWidth && !base64 && expandedTabs) {
+        header.push(`Tabs expanded: ${expandedTabs} (width ${tabWidth})`);
+      }
+      if (collapseBlankLines && !base64) {
+        header.push(`Collapsed blank lines: ${collapsedLines}`);
+      }
+      if (collapseProgress && !base64) {
+        const collapsedProgress = (captured.collapsedProgress ?? 0) + (history?.collapsedProgress ?? 0);
+        header.push(`Collapsed progress lines: ${collapsedProgress}`);
+      }
+      const links = !extractLinks
+        ? undefined
+        : history
+          ? [
+              ...(captured.links ?? []).map((l) => ({ ...l, section: 'visible' as const })),
+              ...(history.links ?? []).map((l) => ({ ...l, section: 'scrollback' as const })),
+            ]
+          : (captured.links ?? []);
+      if (links) {
+        header.push(
+          `Links: ${links.length}`,
+          ...links.map((l) => {
+            const where = l.section ? `${l.section} ${l.line}` : `${l.line}`;
+            return `  ${where}: ${JSON.stringify(l.text)} -> ${l.url}`;
+          }),
+        );
+      }
+      let matches: MatchPosition[] | undefined;
+      if (grepRegex && matchPositions) {
+        matches = findMatches(output, grepRegex);
+        if (maxMatches && matches.length > maxMatches) matches = matches.slice(-maxMatches);
+      }
+      if (grepRegex) {
+        const filtered = grepLines(output, grepRegex, { context, maxMatches });
+        output = filtered.text;
+        header.push(`Grep: /${grep}/ ${filtered.shown} of ${filtered.total} matches shown`);
+      }
+      if (headTail) {
+        const trimmed = headTailLines(output, headLines, tailLines, truncationMarker);
+        output = trimmed.text;
+        header.push(`Elided lines: ${trimmed.elidedLines}`);
+      }
+      if (maxBytes !== undefined) {
+        const cut = keepLastBytes(output, maxBytes, truncationMarker);
+        output = cut.text;
+        if (cut.droppedBytes) header.push(`Truncated: dropped the first ${cut.droppedBytes} bytes`);
+      }
+      const segments = segment ? segmentByPrompt(output) : undefined;
+      if (segments) {
+        header.push(`Segments: ${segments.length}`);
+        output = formatSegments(segments);
+      }
+      const metaFields = captureMetaFields({
+        title: includeTitle,
+        dimensions: includeDimensions,
+        cursor: includeCursor,
+        history: includeHistory,
+      });
+      let dimensions: { width: number; height: number } | undefined;
+      let cursor: { cursorX: number; cursorY: number } | undefined;
+      let historyInfo: ReturnType<typeof historyFields> | undefined;
+      if (Object.keys(metaFields).length) {
+        const meta = await fetchPaneFields(resolvedTarget, metaFields, resolvedHost);
+        if (includeTitle) header.push(`Title: ${meta.title || '(none)'}`);
+        if (includeDimensions) {
+          dimensions = { width: Number(meta.width), height: Number(meta.height) };
+          header.push(`Dimensions: ${dimensions.width}x${dimensions.height}`);
+        }
+        if (includeCursor) {
+          cursor = { cursorX: Number(meta.cursorX), cursorY: Number(meta.cursorY) };
+          header.push(`Cursor: ${cursor.cursorX},${cursor.cursorY}`);
+        }
+        if (includeHistory) {
+          historyInfo = historyFields(meta);
+          const { historySize, historyLimit, scrollPosition } = historyInfo;
+          const scroll = scrollPosition !== undefined ? `, scrolled ${scrollPosition} up` : '';
+          header.push(`History: ${historySize}/${historyLimit} lines${scroll}`);
+        }
+      }
+      await auditLog(resolvedHost, getSessionFromTarget(resolvedTarget), 'capture_pane', {
+        target: resolvedTarget,
+        start,
+        end,
+        length: output.length,
+      });
+      if (matches) {
+        header.push(
+          `Match positions (line:byte):`,
+          ...matches.map((m) => {
+            const groups = m.groups.length ? ` groups=${JSON.stringify(m.groups)}` : '';
+            return `  ${m.line}:${m.byteOffset} ${JSON.stringify(m.text)}${groups}`;
+          }),
+        );
+      }
+      if (includeHash || previousHash !== undefined || previousText !== undefined) {
+        header.push(`Content hash: ${rememberCapture(output)}`);
+      }
+      const previous = previousText ?? (previousHash !== undefined ? recentCaptures.get(previousHash) : undefined);
+      if (previousText === undefined && previousHash !== undefined) {
+        serverStats.bump(previous === undefined ? 'cacheMisses' : 'cacheHits');
+      }
+      if (previousHash !== undefined && previous === undefined) {
+        header.push('Diff: previous hash unknown (expired or from another server); returning the full capture');
+      } else if (previous !== undefined) {
+        const diff = diffLines(previous, output);
+        header.push(`Diff: +${diff.added.length} -${diff.removed.length} lines`);
+        output = diff.added.length || diff.removed.length ? formatLineDiff(diff) : '(unchanged)';
+      }
+      const size = captureSize(output);
+      const structured = {
+        ...(segments ? { segments } : {}),
+        ...(matches ? { matches } : {}),
+        ...dimensions,
+        ...cursor,
+        ...historyInfo,
+        ...size,
+        ...(asLines && !metadataOnly ? { lines: captureLines(output) } : {}),
+        ...(links ? { links } : {}),
       };
-    },
-  );
-
-  server.registerTool(
-    'tmux_list_panes',
-    {
-      title: 'List panes',
-      description: 'List panes across windows or inside a specific target.',
-      inputSchema: {
-        host: z.string().describe('SSH host alias (optional). Uses default host if set.').optional(),
-        target: z
-          .string()
-          .describe('Target (session, window, or pane) to narrow the list. Optional.')
-          .optional(),
-      },
-    },
-    async ({ target, host }) => {
-      const panes = await listPanes(target, resolveHost(host));
+      if (metadataOnly) {
+        header.push(`Size: ${size.byteLength} bytes, ${size.lineCount} lines`);
+        return { content: [{ type: 'text', text: header.join('\n') }], structuredContent: structured };
+      }
+      const body = output || (grepRegex ? '(no matches)' : '(empty pane)');
       return {
-        content: [{ type: 'text', text: formatPanes(panes) }],
+        content: [{ type: 'text', text: header.length ? [...header, '', body].join('\n') : body }],
+        structuredContent: structured,
       };
     },
   );
 
   server.registerTool(
-    'tmux_capture_pane',
+    'tmux_capture_html',
     {
-      title: 'Capture pane output',
-      description: 'Read the scrollback of a pane to observe command results.',
+      title: 'Capture pane as HTML',
+      description: 'Capture a pane with colours preserved (capture-pane -e) and return it as an HTML <pre> with inline styles.',
       inputSchema: {
         host: z.string().describe('SSH host alias (optional). Uses default host if set.').optional(),
         target: z
           .string()
           .describe('Pane target (pane id or session:window.pane). If omitted, uses default pane if set.')
           .optional(),
-        start: z
-          .number()
-          .describe('Optional start line offset (e.g. -200 for last 200 lines). Defaults to -200.')
-          .optional(),
+        start: z.number().describe('Optional start line offset (e.g. -200). Defaults to -200.').optional(),
         end: z.number().describe('Optional end line offset.').optional(),
       },
     },
-    async ({ target, start, end, host }) => {
-      const resolvedTarget = requirePaneTarget(target);
-      const output = await capturePane(resolvedTarget, start, end, resolveHost(host));
-      await auditLog(resolveHost(host), getSessionFromTarget(resolvedTarget), 'capture_pane', {
+    async ({ host, target, start, end }) => {
+      const resolvedHost = resolveHost(host);
+      const resolvedTarget = requirePaneTarget(target, host);
+      const captured = await capturePaneChecked(resolvedTarget, start, end, resolvedHost, { escapes: true });
+      await auditLog(resolvedHost, getSessionFromTarget(resolvedTarget), 'capture_pane', {
         target: resolvedTarget,
         start,
         end,
-        length: output.length,
+        length: captured.text.length,
+        format: 'html',
       });
-      return {
-        content: [{ type: 'text', text: output || '(empty pane)' }],
-      };
+      return { content: [{ type: 'text', text: ansiToHtml(captured.text) }] };
     },
   );
 
@@ -1815,40 +6981,290 @@ async function main() {
   );
 
   server.registerTool(
-    'tmux_send_keys',
+    'tmux_send_keys',
+    {
+      title: 'Send keys to pane',
+      description: 'Send keystrokes to a tmux target, optionally appending Enter.',
+      inputSchema: {
+        host: z.string().describe('SSH host alias (optional). Uses default host if set.').optional(),
+        target: z
+          .string()
+          .describe('Pane target (pane id or session:window.pane). If omitted, uses default pane if set.')
+          .optional(),
+        window: z
+          .string()
+          .describe('Window target (session:window) to send to instead of a pane. Used only when target is omitted.')
+          .optional(),
+        activePane: z
+          .boolean()
+          .describe("With window: send to the window's active pane instead of its first pane.")
+          .default(false)
+          .optional(),
+        keys: z
+          .string()
+          .describe('The text/keys to send. Supports <SPACE>/<ENTER>/<TAB>/<ESC>. Empty + enter=true sends Enter.'),
+        enter: z.boolean().describe('Append Enter after the keys.').default(true).optional(),
+        skipIfAttached: z
+          .boolean()
+          .describe('Refuse to write if a client (e.g. a human) is attached to the target session.')
+          .default(false)
+          .optional(),
+        exitPagerFirst: z
+          .boolean()
+          .describe('If the pane is in a pager (less, man, more, ...), send q to leave it before sending the keys.')
+          .default(false)
+          .optional(),
+        clearLine: z
+          .boolean()
+          .describe('Clear the current input line first (C-e C-u: end of line, then kill to its start).')
+          .default(false)
+          .optional(),
+        clearLineKeys: z
+          .array(tmuxKeyNameSchema)
+          .describe('Key names to send for clearLine instead of C-e C-u, e.g. ["C-e", "C-u", "C-k"].')
+          .optional(),
+        paneStrategy: paneStrategySchema,
+      },
+    },
+    async ({
+      target,
+      window,
+      activePane = false,
+      keys,
+      enter = true,
+      host,
+      skipIfAttached = false,
+      exitPagerFirst = false,
+      clearLine = false,
+      clearLineKeys,
+      paneStrategy,
+    }) => {
+      const resolvedHost = resolveHost(host);
+      const base = !target && window ? window : requirePaneTarget(target, host);
+      // An explicit paneStrategy wins, then activePane (window only), then MCP_TMUX_PANE_STRATEGY, as for any target.
+      const strategy =
+        paneStrategy ?? (!target && window ? windowPaneStrategy(activePane, defaultPaneStrategy) : defaultPaneStrategy);
+      const resolvedTarget = await strategyPaneTarget(base, resolvedHost, strategy);
+      await guardAttached(resolvedTarget, resolvedHost, skipIfAttached);
+      let pagerNote = '';
+      await paneWriteQueue(resolvedTarget, resolvedHost, async () => {
+        if (exitPagerFirst) {
+          const { pager, exited } = await exitPager({
+            command: async () =>
+              (await fetchPaneFields(resolvedTarget, { command: '#{pane_current_command}' }, resolvedHost)).command,
+            quit: () => sendKeys(resolvedTarget, 'q', false, resolvedHost),
+          });
+          if (pager) {
+            pagerNote = exited ? ` Exited pager ${pager} first.` : ` Pager ${pager} did not exit after q.`;
+          }
+        }
+        if (clearLine) await runTmux(buildClearLineArgs(resolvedTarget, clearLineKeys), resolvedHost);
+        await sendKeys(resolvedTarget, keys, enter, resolvedHost);
+      });
+      await log('debug', `send-keys to ${resolvedTarget}${resolvedHost ? ` on ${resolvedHost}` : ''}: "${keys}"`);
+      await auditLog(resolvedHost, getSessionFromTarget(resolvedTarget), 'send_keys', {
+        target: resolvedTarget,
+        keys,
+        enter,
+      });
+      await appendSessionLog(
+        resolvedHost,
+        getSessionFromTarget(resolvedTarget),
+        `send-keys "${keys}" enter=${enter}`,
+      );
+      return {
+        content: [
+          { type: 'text', text: `Sent keys to ${resolvedTarget}${enter ? ' (with Enter)' : ''}.${pagerNote}` },
+        ],
+      };
+    },
+  );
+
+  server.registerTool(
+    'tmux_send_keys_sequence',
+    {
+      title: 'Send a scripted key sequence',
+      description:
+        'Drive interactive prompts: for each step send keys, then (optionally) wait for a regex in the new output before the next step.',
+      inputSchema: {
+        host: z.string().describe('SSH host alias (optional). Uses default host if set.').optional(),
+        target: z
+          .string()
+          .describe('Pane target (pane id or session:window.pane). If omitted, uses default pane if set.')
+          .optional(),
+        steps: z
+          .array(
+            z.object({
+              keys: z.string().describe('Keys to send (same syntax as tmux_send_keys).'),
+              enter: z.boolean().describe('Append Enter after the keys (default true).').optional(),
+              waitFor: z.string().describe('Regex that must appear in new output before the next step.').optional(),
+              flags: z.string().describe('Regex flags (e.g., i).').optional(),
+              timeoutMs: z.number().describe('How long to wait for waitFor (default 10000).').optional(),
+            }),
+          )
+          .min(1)
+          .describe('Steps to run in order; the first timeout or failure stops the sequence.'),
+        lines: z.number().describe('Lines of scrollback to watch for each waitFor.').default(200).optional(),
+        intervalMs: z.number().describe('Poll interval while waiting.').default(250).optional(),
+      },
+    },
+    async ({ host, target, steps, lines = 200, intervalMs = 250 }) => {
+      const resolvedHost = resolveHost(host);
+      const resolvedTarget = requirePaneTarget(target, host);
+      const session = getSessionFromTarget(resolvedTarget);
+      const results = await runKeySequence(
+        steps,
+        {
+          send: async (keys, enter) => {
+            await sendKeysQueued(resolvedTarget, keys, enter, resolvedHost);
+            await auditLog(resolvedHost, session, 'send_keys_sequence.step', { target: resolvedTarget, keys, enter });
+            await appendSessionLog(resolvedHost, session, `send-keys "${keys}" enter=${enter} (sequence)`);
+          },
+          capture: () => capturePane(resolvedTarget, -lines, undefined, resolvedHost),
+        },
+        { intervalMs },
+      );
+      const ok = results.filter((r) => r.status === 'ok').length;
+      const text = [
+        ...results.map((r) => `Step ${r.step}: ${r.status} (${r.elapsedMs}ms)${r.detail ? ` ${r.detail}` : ''}`),
+        '',
+        `Summary: ${ok}/${results.length} steps succeeded`,
+      ].join('\n');
+      return { content: [{ type: 'text', text }], isError: ok < results.length };
+    },
+  );
+
+  server.registerTool(
+    'tmux_define_macro',
+    {
+      title: 'Define a macro',
+      description:
+        'Store a named sequence of send/wait/sleep/capture steps so a repeated interaction can be replayed with tmux_run_macro.',
+      inputSchema: {
+        name: z
+          .string()
+          .regex(/^[\w.-]+$/)
+          .describe('Macro name (letters, digits, _ . -).'),
+        description: z.string().describe('What the macro does (shown by tmux_list_macros).').optional(),
+        steps: z
+          .array(macroStepSchema)
+          .min(1)
+          .describe('Steps to run in order.'),
+        persist: z
+          .boolean()
+          .describe('Also save to ~/.config/mcp-tmux/macros.json so it survives restarts.')
+          .default(false)
+          .optional(),
+      },
+    },
+    async ({ name, description, steps, persist = false }) => {
+      compileMacroSteps(steps);
+      const replaced = macros.has(name);
+      macros.set(name, { description, steps, persist });
+      await persistMacros();
+      const text = `${replaced ? 'Replaced' : 'Defined'} macro '${name}' (${steps.length} steps${persist ? ', persisted' : ''}).`;
+      return { content: [{ type: 'text', text }] };
+    },
+  );
+
+  server.registerTool(
+    'tmux_list_macros',
+    {
+      title: 'List macros',
+      description: 'List macros defined with tmux_define_macro.',
+    },
+    async () => {
+      const text = [...macros]
+        .map(([name, m]) => {
+          const about = m.description ? `: ${m.description}` : '';
+          return `${name} (${m.steps.length} steps${m.persist ? ', persisted' : ''})${about}`;
+        })
+        .join('\n');
+      return { content: [{ type: 'text', text: text || '(no macros)' }] };
+    },
+  );
+
+  server.registerTool(
+    'tmux_run_macro',
+    {
+      title: 'Run a macro',
+      description: 'Replay a macro defined with tmux_define_macro against a pane and report per-step results and captures.',
+      inputSchema: {
+        host: z.string().describe('SSH host alias (optional). Uses default host if set.').optional(),
+        target: z
+          .string()
+          .describe('Pane target (pane id or session:window.pane). If omitted, uses default pane if set.')
+          .optional(),
+        name: z.string().describe('Macro to run.'),
+        intervalMs: z.number().describe('Poll interval for wait steps.').default(250).optional(),
+      },
+    },
+    async ({ host, target, name, intervalMs = 250 }) => {
+      const macro = macros.get(name);
+      if (!macro) throw new McpError(ErrorCode.InvalidParams, `Unknown macro '${name}'`);
+      const resolvedHost = resolveHost(host);
+      const resolvedTarget = requirePaneTarget(target, host);
+      const session = getSessionFromTarget(resolvedTarget);
+      const results = await runMacro(
+        macro.steps,
+        {
+          send: async (keys, enter) => {
+            await sendKeysQueued(resolvedTarget, keys, enter, resolvedHost);
+            await auditLog(resolvedHost, session, 'run_macro.send', {
+              macro: name,
+              target: resolvedTarget,
+              keys,
+              enter,
+            });
+          },
+          capture: (lines = 200) => capturePane(resolvedTarget, -lines, undefined, resolvedHost),
+        },
+        { intervalMs },
+      );
+      const ok = results.filter((r) => r.status === 'ok').length;
+      const text = [
+        ...results.flatMap((r) => [
+          `Step ${r.step} ${r.action}: ${r.status} (${r.elapsedMs}ms)${r.detail ? ` ${r.detail}` : ''}`,
+          ...(r.output !== undefined ? [r.output || '(empty)'] : []),
+        ]),
+        '',
+        `Summary: ${ok}/${results.length} steps succeeded`,
+      ].join('\n');
+      return { content: [{ type: 'text', text }], isError: ok < results.length };
+    },
+  );
+
+  server.registerTool(
+    'tmux_reset_pane',
     {
-      title: 'Send keys to pane',
-      description: 'Send keystrokes to a tmux target, optionally appending Enter.',
+      title: 'Reset a pane to a clean prompt',
+      description:
+        'Recover a pane stuck in copy-mode or a pager: cancels copy-mode if active, sends q then C-c, and optionally clears history.',
       inputSchema: {
         host: z.string().describe('SSH host alias (optional). Uses default host if set.').optional(),
         target: z
           .string()
           .describe('Pane target (pane id or session:window.pane). If omitted, uses default pane if set.')
           .optional(),
-        keys: z
-          .string()
-          .describe('The text/keys to send. Supports <SPACE>/<ENTER>/<TAB>/<ESC>. Empty + enter=true sends Enter.'),
-        enter: z.boolean().describe('Append Enter after the keys.').default(true).optional(),
+        clearHistory: z.boolean().describe('Also run clear-history on the pane.').default(false).optional(),
       },
     },
-    async ({ target, keys, enter = true, host }) => {
+    async ({ host, target, clearHistory = false }) => {
       const resolvedHost = resolveHost(host);
-      const resolvedTarget = requirePaneTarget(target);
-      await sendKeys(resolvedTarget, keys, enter, resolvedHost);
-      await log('debug', `send-keys to ${resolvedTarget}${resolvedHost ? ` on ${resolvedHost}` : ''}: "${keys}"`);
-      await auditLog(resolvedHost, getSessionFromTarget(resolvedTarget), 'send_keys', {
+      const resolvedTarget = requirePaneTarget(target, host);
+      const result = await resetPane(resolvedTarget, clearHistory, resolvedHost);
+      await log('info', `reset pane ${resolvedTarget}${resolvedHost ? ` on ${resolvedHost}` : ''}`);
+      await auditLog(resolvedHost, getSessionFromTarget(resolvedTarget), 'reset_pane', {
         target: resolvedTarget,
-        keys,
-        enter,
+        wasInMode: result.wasInMode,
+        clearHistory,
       });
-      await appendSessionLog(
-        resolvedHost,
-        getSessionFromTarget(resolvedTarget),
-        `send-keys "${keys}" enter=${enter}`,
-      );
-      return {
-        content: [{ type: 'text', text: `Sent keys to ${resolvedTarget}${enter ? ' (with Enter)' : ''}.` }],
-      };
+      const text = [
+        `Reset ${resolvedTarget}.`,
+        `Copy-mode: ${result.wasInMode ? 'cancelled' : 'not active'}`,
+        `History: ${clearHistory ? 'cleared' : 'kept'}`,
+      ].join('\n');
+      return { content: [{ type: 'text', text }] };
     },
   );
 
@@ -1890,43 +7306,104 @@ async function main() {
           .describe('Send Ctrl+C then Ctrl+U before first write to clear any stray input (bash/zsh friendly). Default true.')
           .default(true)
           .optional(),
+        stripEcho: z
+          .boolean()
+          .describe('Return only the output after the echoed command line (drops the prompt + command echo and older scrollback).')
+          .default(false)
+          .optional(),
+        skipIfAttached: z
+          .boolean()
+          .describe('Refuse to write if a client (e.g. a human) is attached to the target session.')
+          .default(false)
+          .optional(),
+        truncationMarker: z
+          .string()
+          .describe('Line placed above the captured output when older lines were cut off.')
+          .optional(),
+        waitForPrompt: z
+          .boolean()
+          .describe('Wait for the prompt sentinel (set with tmux_set_prompt_sentinel) before capturing.')
+          .default(false)
+          .optional(),
+        promptTimeoutMs: z
+          .number()
+          .int()
+          .min(100)
+          .describe('With waitForPrompt, give up waiting after this many milliseconds (default 30000).')
+          .optional(),
       },
     },
-    async ({ host, target, steps, failFast = true, joinWith, captureLines = 200, cleanPrompt = true }) => {
+    async ({
+      host,
+      target,
+      steps,
+      failFast = true,
+      joinWith,
+      captureLines = 200,
+      cleanPrompt = true,
+      stripEcho = false,
+      skipIfAttached = false,
+      truncationMarker,
+      waitForPrompt = false,
+      promptTimeoutMs = 30000,
+    }) => {
       const resolvedHost = resolveHost(host);
-      const resolvedTarget = requirePaneTarget(target);
+      const resolvedTarget = requirePaneTarget(target, host);
+      await guardAttached(resolvedTarget, resolvedHost, skipIfAttached);
+      const sentinel = waitForPrompt
+        ? await paneSentinel(resolvedTarget, (args) => runTmux(args, resolvedHost))
+        : undefined;
       const hasHeredoc = steps.some((s) => /<<\s*['"]?[\w-]+/.test(s.command));
       const chosenJoin = joinWith || (hasHeredoc ? 'newline' : failFast ? '&&' : ';');
       const separator = chosenJoin === 'newline' ? '\n' : ` ${chosenJoin} `;
       const hasMultiple = steps.length > 1;
 
-      // Clean prompt if requested (bash/zsh friendly: Ctrl+C then Ctrl+U)
-      if (cleanPrompt) {
-        await sendKeys(resolvedTarget, '', false, resolvedHost);
-        await sendKeys(resolvedTarget, '\u0003', false, resolvedHost); // Ctrl+C
-        await sendKeys(resolvedTarget, '\u0015', false, resolvedHost); // Ctrl+U (line clear)
-      }
-
+      let joined: string;
       if (chosenJoin !== 'newline' && failFast && hasMultiple) {
-        const joined = steps.map((s) => s.command).join(` ${separator} `);
-        await sendKeys(resolvedTarget, joined, true, resolvedHost);
+        joined = steps.map((s) => s.command).join(` ${separator} `);
       } else {
-        const joined = steps.map((s) => s.command).join(separator);
         // If newline-joined, treat as one send to keep heredoc terminators on their own line.
-        await sendKeys(resolvedTarget, joined, true, resolvedHost);
+        joined = steps.map((s) => s.command).join(separator);
       }
+      // Clean and send as one queued write so another client's keys cannot land between them.
+      let promptBaseline: string | undefined;
+      await paneWriteQueue(resolvedTarget, resolvedHost, async () => {
+        // Clean prompt if requested (bash/zsh friendly: Ctrl+C then Ctrl+U)
+        if (cleanPrompt) {
+          await sendKeys(resolvedTarget, '', false, resolvedHost);
+          await sendKeys(resolvedTarget, '\u0003', false, resolvedHost); // Ctrl+C
+          await sendKeys(resolvedTarget, '\u0015', false, resolvedHost); // Ctrl+U (line clear)
+        }
+        // The pane as the command is typed, after the cleanup keys redrew the prompt: the prompt wait must not
+        // match that redrawn prompt, and the echo can only start at the prompt this capture ends with.
+        if (sentinel || stripEcho) {
+          if (cleanPrompt) await new Promise((r) => setTimeout(r, 150)); // let the shell redraw its prompt
+          promptBaseline = await capturePane(resolvedTarget, -50, undefined, resolvedHost);
+        }
+        await sendKeys(resolvedTarget, joined, true, resolvedHost);
+      });
 
       // allow output to flush
-      await new Promise((r) => setTimeout(r, 300));
+      const prompt = sentinel
+        ? await waitForPattern(
+            () => capturePane(resolvedTarget, -50, undefined, resolvedHost),
+            promptSentinelPattern(sentinel),
+            { timeoutMs: promptTimeoutMs, intervalMs: 250, baseline: promptBaseline },
+          )
+        : await new Promise<undefined>((r) => setTimeout(r, 300));
       const capture = await capturePaged(resolvedTarget, resolvedHost, [20, 100, Math.max(captureLines, 400)]);
+      const echo = stripEcho ? stripEchoedCommand(capture.captured, joined, promptBaseline) : undefined;
 
       const text = [
         `Commands: ${steps.map((s) => s.command).join(' | ')}`,
         `Target: ${resolvedTarget}${resolvedHost ? ` on ${resolvedHost}` : ''}`,
         cleanPrompt ? 'Prompt cleanup: yes (C-c/C-u)' : 'Prompt cleanup: no',
+        ...(prompt ? [`Prompt: ${prompt.matched ? 'ready' : 'not back'} after ${prompt.elapsedMs}ms`] : []),
         `Capture: last ${capture.requested} of ${capture.historySize || '?'} lines${capture.moreAvailable ? ' (truncated, request more)' : ''}`,
+        ...(echo ? [`Echo stripped: ${echo.stripped ? 'yes' : 'no (command line not found)'}`] : []),
         '',
-        capture.captured || '(no output)',
+        ...(capture.moreAvailable && truncationMarker !== undefined && !echo?.stripped ? [truncationMarker] : []),
+        (echo ? echo.text : capture.captured) || '(no output)',
       ].join('\n');
 
       return {
@@ -1954,14 +7431,13 @@ async function main() {
     async ({ name, command, host }) => {
       const resolvedHost = resolveHost(host);
       await createSession(name, command, resolvedHost);
-      defaultHost = resolvedHost ?? defaultHost;
-      defaultSession = name;
-      defaultWindow = undefined;
-      defaultPane = undefined;
+      const applied = setDefaults(
+        { host: resolvedHost ?? defaultHost, session: name, window: undefined, pane: undefined },
+        { implicit: true },
+      );
       await log('info', `created session ${name}${resolvedHost ? ` on ${resolvedHost}` : ''}`);
-      return {
-        content: [{ type: 'text', text: `Created session ${name}${resolvedHost ? ` on ${resolvedHost}` : ''}.` }],
-      };
+      const text = `Created session ${name}${resolvedHost ? ` on ${resolvedHost}` : ''}.`;
+      return { content: [{ type: 'text', text: text + (applied ? '' : defaultsLockedNote) }] };
     },
   );
 
@@ -1980,13 +7456,18 @@ async function main() {
     async ({ target, name, command, host }) => {
       const resolvedHost = resolveHost(host);
       const finalName = await createWindow(target, name, command, resolvedHost);
-      defaultWindow = `${target}:${name ?? finalName}`;
+      const applied = setDefaults({ window: `${target}:${name ?? finalName}` }, { implicit: true });
       await log(
         'info',
         `created window ${target}:${name ?? finalName}${resolvedHost ? ` on ${resolvedHost}` : ''}`,
       );
       return {
-        content: [{ type: 'text', text: `Created window in ${target}${name ? ` named ${name}` : ` named ${finalName}`}.` }],
+        content: [
+          {
+            type: 'text',
+            text: `Created window in ${target} named ${name ?? finalName}.${applied ? '' : defaultsLockedNote}`,
+          },
+        ],
       };
     },
   );
@@ -2043,6 +7524,136 @@ async function main() {
     },
   );
 
+  server.registerTool(
+    'tmux_history_limit',
+    {
+      title: 'Check or raise history-limit',
+      description:
+        'Report the global history-limit (and the pane limit for a target) before a deep capture. With minLines and raise=true, raises the global limit; this only affects panes created afterwards.',
+      inputSchema: {
+        host: z.string().describe('SSH host alias (optional). Uses default host if set.').optional(),
+        target: z.string().describe('Pane whose own history limit to report (optional).').optional(),
+        minLines: z.number().int().min(1).describe('Scrollback lines the capture needs.').optional(),
+        raise: z
+          .boolean()
+          .describe('Raise the global history-limit to minLines if it is lower (set-option -g history-limit).')
+          .default(false)
+          .optional(),
+      },
+    },
+    async ({ host, target, minLines, raise = false }) => {
+      if (raise && minLines === undefined) {
+        throw new McpError(ErrorCode.InvalidParams, 'raise requires minLines');
+      }
+      const resolvedHost = resolveHost(host);
+      const result = await checkHistoryLimit((args) => runTmux(args, resolvedHost), { target, minLines, raise });
+      const lines = [`Global history-limit: ${result.globalLimit}`];
+      if (result.paneLimit !== undefined) lines.push(`Pane ${target} history limit: ${result.paneLimit}`);
+      if (result.raised) {
+        lines.push(`Raised global history-limit to ${minLines} (new panes only; existing scrollback is unchanged)`);
+        await log('info', `raised history-limit ${result.globalLimit} -> ${minLines}${host ? ` on ${host}` : ''}`);
+      }
+      if (result.short) {
+        const who = target ? 'the pane keeps' : 'new panes keep';
+        lines.push(`Warning: ${who} fewer than ${minLines} lines, so deeper captures come back short`);
+      }
+      return { content: [{ type: 'text', text: lines.join('\n') }], structuredContent: result };
+    },
+  );
+
+  server.registerTool(
+    'tmux_kill_idle_sessions',
+    {
+      title: 'Kill idle sessions',
+      description:
+        'Kill every session idle (no activity) for at least idleSeconds. Attached sessions are skipped unless includeAttached=true. Use dryRun=true to list them first; otherwise confirm=true is required.',
+      inputSchema: {
+        host: z.string().describe('SSH host alias (optional). Uses default host if set.').optional(),
+        idleSeconds: z.number().int().min(1).describe('Minimum idle time, from #{session_activity}, in seconds.'),
+        includeAttached: z
+          .boolean()
+          .describe('Also kill idle sessions that still have a client attached.')
+          .default(false)
+          .optional(),
+        dryRun: z.boolean().describe('Only list the sessions that would be killed.').default(false).optional(),
+        confirm: z
+          .boolean()
+          .describe('Must be true to proceed (not needed for dryRun).')
+          .default(false)
+          .optional(),
+      },
+    },
+    async ({ host, idleSeconds, includeAttached = false, dryRun = false, confirm = false }) => {
+      if (!dryRun && !confirm) {
+        throw new McpError(ErrorCode.InvalidParams, 'confirm=true is required to kill idle sessions (or pass dryRun)');
+      }
+      const resolvedHost = resolveHost(host);
+      const result = await killIdleSessions((args) => runTmux(args, resolvedHost), idleSeconds, {
+        includeAttached,
+        dryRun,
+        excludeClient: ownControlClient(resolvedHost),
+      });
+      const names = result.idle.map((s) => s.name);
+      const lines = [
+        dryRun
+          ? `Would kill ${names.length} idle session(s): ${names.join(', ') || 'none'}`
+          : `Killed ${result.killed.length} idle session(s): ${result.killed.join(', ') || 'none'}`,
+        ...result.failed.map((f) => `Failed to kill ${f.name}: ${f.error}`),
+      ];
+      if (result.skippedAttached.length) {
+        lines.push(`Skipped attached: ${result.skippedAttached.join(', ')}`);
+      }
+      if (result.killed.length) {
+        await log('warning', `killed idle sessions ${result.killed.join(', ')}${host ? ` on ${host}` : ''}`);
+      }
+      return {
+        content: [{ type: 'text', text: lines.join('\n') }],
+        structuredContent: {
+          idle: names,
+          killed: result.killed,
+          failed: result.failed,
+          skippedAttached: result.skippedAttached,
+          dryRun,
+        },
+      };
+    },
+  );
+
+  server.registerTool(
+    'tmux_kill_server',
+    {
+      title: 'Kill the tmux server',
+      description:
+        'Terminate the tmux server on a host, ending every session. Requires confirm=true and hostConfirmation equal to the host.',
+      inputSchema: {
+        host: z.string().describe('SSH host alias (optional). Uses default host if set.').optional(),
+        confirm: z
+          .boolean()
+          .describe('Must be true to proceed.')
+          .default(false)
+          .optional(),
+        hostConfirmation: z
+          .string()
+          .describe('Type the target host again ("local" for the local server) to confirm.')
+          .optional(),
+      },
+    },
+    async ({ host, confirm = false, hostConfirmation }) => {
+      const resolvedHost = resolveHost(host);
+      assertKillServerConfirmed(resolvedHost, confirm, hostConfirmation);
+      const sessions = await killServer(resolvedHost);
+      const label = resolvedHost ?? 'local';
+      await log('warning', `killed tmux server on ${label} (${sessions.length} sessions)`);
+      await auditLog(resolvedHost, undefined, 'kill_server', { sessions: sessions.map((s) => s.name) });
+      const running = sessions.length
+        ? sessions.map((s) => `- ${s.name} (${s.windows} windows${s.attached ? `, ${s.attached} attached` : ''})`)
+        : ['(no sessions)'];
+      return {
+        content: [{ type: 'text', text: [`Killed tmux server on ${label}. Was running:`, ...running].join('\n') }],
+      };
+    },
+  );
+
   server.registerTool(
     'tmux_kill_window',
     {
@@ -2145,9 +7756,29 @@ async function main() {
           .boolean()
           .describe('Set true if the command is destructive (kill*, attach -k, unlink-window, etc).')
           .optional(),
+        asShell: z
+          .boolean()
+          .describe('Join args into a single shell command and run it with run-shell (requires confirm=true).')
+          .default(false)
+          .optional(),
+        legacyEmptyText: z
+          .boolean()
+          .describe('Return "(no output)" instead of empty text when tmux prints nothing.')
+          .default(false)
+          .optional(),
+      },
+      outputSchema: {
+        output: z.string().describe('Raw tmux output (may be empty).'),
+        hadOutput: z.boolean().describe('Whether tmux printed anything.'),
       },
     },
-    async ({ args, host, confirm }) => {
+    async ({ args, host, confirm, asShell = false, legacyEmptyText = false }) => {
+      if (asShell && !confirm) {
+        throw new McpError(
+          ErrorCode.InvalidParams,
+          'confirm=true is required for asShell tmux_command calls (run-shell executes arbitrary commands)',
+        );
+      }
       const needsConfirm = isDestructiveTmuxArgs(args);
       if (needsConfirm && !confirm) {
         throw new McpError(
@@ -2156,14 +7787,251 @@ async function main() {
         );
       }
       const resolvedHost = resolveHost(host);
-      const output = await runTmux(args, resolvedHost);
-      await log('info', `command: tmux ${args.join(' ')}`);
+      const profile = getHostProfile(resolvedHost) as HostProfile | undefined;
+      const tmuxArgs = buildCommandArgs(args, asShell, profile?.commandWrapper);
+      const output = await runTmux(tmuxArgs, resolvedHost);
+      await log('info', `command: tmux ${tmuxArgs.join(' ')}`);
       await auditLog(resolvedHost, defaultSession, 'tmux_command', {
-        args,
+        args: tmuxArgs,
+        outputLength: output.length,
+      });
+      return commandOutputResult(output, legacyEmptyText);
+    },
+  );
+
+  server.registerTool(
+    'tmux_pane_stats',
+    {
+      title: 'Pane process resource usage',
+      description: "Report CPU %, memory %, RSS, and elapsed time of the pane's process (#{pane_pid}) via ps on the host.",
+      inputSchema: {
+        host: z.string().describe('SSH host alias (optional). Uses default host if set.').optional(),
+        target: z
+          .string()
+          .describe('Pane target (pane id or session:window.pane). If omitted, uses default pane if set.')
+          .optional(),
+      },
+    },
+    async ({ host, target }) => {
+      const resolvedTarget = requirePaneTarget(target, host);
+      const { pid, stats } = await paneStats(resolvedTarget, resolveHost(host));
+      if (!stats) {
+        return {
+          content: [{ type: 'text', text: `Pane ${resolvedTarget}: process${pid ? ` ${pid}` : ''} is gone.` }],
+          structuredContent: { pid, gone: true },
+        };
+      }
+      const text = [
+        `Pane ${resolvedTarget} pid ${stats.pid}`,
+        `CPU: ${stats.cpuPercent}%`,
+        `Memory: ${stats.memPercent}% (RSS ${stats.rssKb} KiB)`,
+        `Elapsed: ${stats.elapsed}`,
+      ].join('\n');
+      return {
+        content: [{ type: 'text', text }],
+        structuredContent: { ...stats, elapsedSeconds: parseElapsed(stats.elapsed), gone: false },
+      };
+    },
+  );
+
+  server.registerTool(
+    'tmux_refresh_client',
+    {
+      title: 'Refresh or resize a client',
+      description:
+        'Run refresh-client for an attached client, optionally setting its size (-C WxH) so captures match the expected dimensions.',
+      inputSchema: {
+        host: z.string().describe('SSH host alias (optional). Uses default host if set.').optional(),
+        client: z.string().min(1).describe('Client name (tty such as /dev/pts/3, from list-clients).'),
+        width: z.number().int().describe('Client width in columns (set together with height).').optional(),
+        height: z.number().int().describe('Client height in rows (set together with width).').optional(),
+      },
+    },
+    async ({ host, client, width, height }) => {
+      if ((width === undefined) !== (height === undefined)) {
+        throw new McpError(ErrorCode.InvalidParams, 'width and height must be given together');
+      }
+      const size = width !== undefined && height !== undefined ? { width, height } : undefined;
+      await runTmux(buildRefreshClientArgs(client, size), resolveHost(host));
+      return {
+        content: [{ type: 'text', text: `Refreshed ${client}${size ? ` at ${size.width}x${size.height}` : ''}.` }],
+      };
+    },
+  );
+
+  server.registerTool(
+    'tmux_list_buffers',
+    {
+      title: 'List paste buffers',
+      description: 'List tmux paste buffers (copy-mode yanks, set-buffer) with size, creation time and a short sample.',
+      inputSchema: {
+        host: z.string().describe('SSH host alias (optional). Uses default host if set.').optional(),
+      },
+    },
+    async ({ host }) => {
+      const buffers = parseBufferList(await runTmux(['list-buffers', '-F', bufferListFormat], resolveHost(host)));
+      const text = buffers.length
+        ? buffers
+            .map((b) => `${b.name}\t${b.size} bytes\t${new Date(b.created * 1000).toISOString()}\t${b.sample}`)
+            .join('\n')
+        : '(no buffers)';
+      return { content: [{ type: 'text', text }], structuredContent: { buffers } };
+    },
+  );
+
+  server.registerTool(
+    'tmux_show_buffer',
+    {
+      title: 'Read a paste buffer',
+      description: 'Return the contents of a tmux paste buffer (show-buffer), e.g. a copy-mode selection.',
+      inputSchema: {
+        host: z.string().describe('SSH host alias (optional). Uses default host if set.').optional(),
+        name: z.string().describe('Buffer name from tmux_list_buffers. Defaults to the most recent buffer.').optional(),
+      },
+    },
+    async ({ host, name }) => {
+      // Read the bytes untrimmed: leading/trailing whitespace is part of what was copied.
+      const { text } = decodeUtf8(await runTmuxBytes(buildShowBufferArgs(name), resolveHost(host)));
+      return { content: [{ type: 'text', text: text || '(empty buffer)' }] };
+    },
+  );
+
+  server.registerTool(
+    'tmux_display_message',
+    {
+      title: 'Render a tmux format string',
+      description:
+        'Run display-message -p with any tmux format (e.g. "#{client_width} #{session_activity}") against a target and return the rendered text.',
+      inputSchema: {
+        host: z.string().describe('SSH host alias (optional). Uses default host if set.').optional(),
+        target: z
+          .string()
+          .describe('Target to evaluate against (pane, window, or session). Defaults to the default pane if set.')
+          .optional(),
+        format: z.string().min(1).describe('tmux format string, passed through verbatim.'),
+        client: z
+          .string()
+          .describe('Client to evaluate against (e.g. /dev/pts/3, from list-clients) when several are attached.')
+          .optional(),
+      },
+    },
+    async ({ host, target, format, client }) => {
+      const resolvedHost = resolveHost(host);
+      const resolvedTarget = resolvePaneTarget(target, host);
+      const output = await runTmux(buildDisplayMessageArgs(format, resolvedTarget, client), resolvedHost);
+      return { content: [{ type: 'text', text: output }] };
+    },
+  );
+
+  server.registerTool(
+    'tmux_capture_status',
+    {
+      title: 'Capture the status line',
+      description:
+        'Render the status line a human sees (status-left, the window list, status-right) via display-message -p, as text and structured parts.',
+      inputSchema: {
+        host: z.string().describe('SSH host alias (optional). Uses default host if set.').optional(),
+        target: z
+          .string()
+          .describe('Session, window, or pane whose status line to render. Defaults to the default pane if set.')
+          .optional(),
+        client: z
+          .string()
+          .describe('Client to render for (e.g. /dev/pts/3, from list-clients) when several are attached.')
+          .optional(),
+        keepStyles: z.boolean().describe('Keep #[fg=...] style directives in the output.').default(false).optional(),
+      },
+    },
+    async ({ host, target, client, keepStyles = false }) => {
+      const resolvedTarget = resolvePaneTarget(target, host);
+      if (readOnlyMode) {
+        // Rendering runs any #(...) jobs in the human's status formats; read their raw values first.
+        const formats = await runTmux(
+          buildDisplayMessageArgs(statusFormatSources, resolvedTarget, client),
+          resolveHost(host),
+        );
+        if (formats.includes('#(')) {
+          throw new McpError(
+            ErrorCode.InvalidRequest,
+            'The status line runs #(...) shell jobs, blocked while the server is read-only (MCP_TMUX_READ_ONLY)',
+          );
+        }
+      }
+      const raw = await runTmux(buildDisplayMessageArgs(statusLineFormat, resolvedTarget, client), resolveHost(host));
+      const status = parseStatusLine(raw, keepStyles);
+      return { content: [{ type: 'text', text: status.text || '(empty status line)' }], structuredContent: status };
+    },
+  );
+
+  server.registerTool(
+    'tmux_run_shell',
+    {
+      title: 'Run a host shell command via tmux',
+      description:
+        'Run a shell command on the host through tmux run-shell (outside the pane, no keystrokes) and return its output.',
+      inputSchema: {
+        host: z.string().describe('SSH host alias (optional). Uses default host if set.').optional(),
+        command: z.string().min(1).describe('Shell command to run.'),
+        confirm: z.boolean().describe('Must be true: run-shell executes arbitrary commands on the host.').optional(),
+        target: z
+          .string()
+          .describe('Pane whose context to use (pane id or session:window.pane). Defaults to the default pane.')
+          .optional(),
+        usePaneCwd: z
+          .boolean()
+          .describe("Run from the pane's current directory (#{pane_current_path}) instead of tmux's default.")
+          .default(false)
+          .optional(),
+        separateStderr: z
+          .boolean()
+          .describe('Capture stderr separately (via a temp file) and report it with the exit status.')
+          .default(false)
+          .optional(),
+      },
+      outputSchema: {
+        output: z.string().describe('Command output (may be empty; stdout only with separateStderr).'),
+        hadOutput: z.boolean().describe('Whether the command printed anything.'),
+        stderr: z.string().describe('Command stderr (separateStderr only).').optional(),
+        exitCode: z.number().describe('Command exit status (separateStderr only).').optional(),
+      },
+    },
+    async ({ host, command, confirm, target, usePaneCwd = false, separateStderr = false }) => {
+      if (!confirm) {
+        throw new McpError(
+          ErrorCode.InvalidParams,
+          'confirm=true is required for tmux_run_shell (run-shell executes arbitrary commands)',
+        );
+      }
+      const resolvedHost = resolveHost(host);
+      const resolvedTarget = usePaneCwd ? requirePaneTarget(target, host) : resolvePaneTarget(target, host);
+      // runShell applies the host profile's commandWrapper, like every other run-shell host command.
+      const raw = await runShell(command, {
+        host: resolvedHost,
+        target: resolvedTarget,
+        usePaneCwd,
+        separateStderr,
+      });
+      const split = separateStderr ? splitStderrCapture(raw) : undefined;
+      const output = split ? split.stdout : raw;
+      await auditLog(resolvedHost, getSessionFromTarget(resolvedTarget), 'run_shell', {
+        command,
+        target: resolvedTarget,
+        usePaneCwd,
         outputLength: output.length,
+        ...(split ? { stderrLength: split.stderr.length, exitCode: split.exitCode } : {}),
       });
+      if (!split) return commandOutputResult(output);
+      const result = commandOutputResult(output);
+      const text = [
+        `Exit code: ${split.exitCode ?? 'unknown'}`,
+        '--- stdout ---',
+        output,
+        '--- stderr ---',
+        split.stderr,
+      ].join('\n');
       return {
-        content: [{ type: 'text', text: output || '(no output)' }],
+        content: [{ type: 'text' as const, text }],
+        structuredContent: { ...result.structuredContent, stderr: split.stderr, exitCode: split.exitCode },
       };
     },
   );
@@ -2186,8 +8054,15 @@ async function main() {
         const out = await runTmux(args, host);
         return { content: [{ type: 'text', text: out || '(empty output)' }] };
       } catch (error) {
-        const err = error as { message?: string; stderr?: string; stdout?: string };
-        const text = ['Error running tmux:', err.message || 'unknown', err.stderr || '', err.stdout || '']
+        const err = error as { message?: string; data?: TmuxErrorDetail };
+        const detail = err.data;
+        const text = [
+          'Error running tmux:',
+          err.message || 'unknown',
+          detail?.exitCode !== undefined ? `exit code: ${detail.exitCode}` : '',
+          detail?.stderr || '',
+          detail?.stdout || '',
+        ]
           .filter(Boolean)
           .join('\n');
         return { content: [{ type: 'text', text }] };
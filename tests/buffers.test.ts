@@ -0,0 +1,28 @@
+import { describe, expect, it } from 'vitest';
+import { buildShowBufferArgs, parseBufferList } from '../src/index.js';
+
+describe('parseBufferList', () => {
+  it('parses list-buffers output, newest first', () => {
+    // Real tmux 3.3a output for a set-buffer and a named multi-line buffer.
+    const raw = 'buffer0\t8\t1792001633\tauto one\nmine\t11\t1792001633\thello\\nworld\n';
+    expect(parseBufferList(raw)).toEqual([
+      { name: 'buffer0', size: 8, created: 1792001633, sample: 'auto one' },
+      { name: 'mine', size: 11, created: 1792001633, sample: 'hello\\nworld' },
+    ]);
+  });
+
+  it('keeps tabs inside the sample', () => {
+    expect(parseBufferList('b\t3\t1\ta\tb')[0].sample).toBe('a\tb');
+  });
+
+  it('returns nothing when there are no buffers', () => {
+    expect(parseBufferList('')).toEqual([]);
+  });
+});
+
+describe('buildShowBufferArgs', () => {
+  it('reads a named buffer or the most recent one', () => {
+    expect(buildShowBufferArgs('mine')).toEqual(['show-buffer', '-b', 'mine']);
+    expect(buildShowBufferArgs()).toEqual(['show-buffer']);
+  });
+});
@@ -0,0 +1,564 @@
+import { describe, expect, it } from 'vitest';
+import {
+  buildCaptureArgs,
+  captureLines,
+  captureMetaFields,
+  captureSize,
+  checkHistoryLimit,
+  collapseProgressLines,
+  decodeCapture,
+  decodeUtf8,
+  displayWidth,
+  expandTabs,
+  extractHyperlinks,
+  findMatches,
+  grepLines,
+  headTailLines,
+  historyFields,
+  keepLastBytes,
+  parsePaneFields,
+  progressKey,
+  resolveSourceEncoding,
+  resolveKeepColor,
+  retryWhileEmpty,
+  sliceColumnRange,
+  sliceColumns,
+  splitCaptureRanges,
+  stripEchoedCommand,
+  transformCapture,
+} from '../src/index.js';
+import { recordingRun } from './fakes.js';
+
+describe('parsePaneFields', () => {
+  it('maps tab-separated display-message output onto field names', () => {
+    expect(parsePaneFields(['title', 'width'], 'build logs\t120')).toEqual({ title: 'build logs', width: '120' });
+  });
+
+  it('fills missing values with empty strings', () => {
+    expect(parsePaneFields(['title', 'width'], '')).toEqual({ title: '', width: '' });
+  });
+
+  it('keeps tabs in the last field', () => {
+    expect(parsePaneFields(['width', 'title'], '120\tbuild\tlogs')).toEqual({ width: '120', title: 'build\tlogs' });
+  });
+});
+
+describe('stripEchoedCommand', () => {
+  it('removes the prompt line echoing the command', () => {
+    const capture = ['old output', 'user@box:~$ ls -1', 'a.txt', 'b.txt', 'user@box:~$'].join('\n');
+    expect(stripEchoedCommand(capture, 'ls -1')).toEqual({
+      text: ['a.txt', 'b.txt', 'user@box:~$'].join('\n'),
+      stripped: true,
+    });
+  });
+
+  it('removes continuation lines of multi-line commands', () => {
+    const capture = ['$ cat <<EOF', '> hi', '> EOF', 'hi', '$'].join('\n');
+    expect(stripEchoedCommand(capture, 'cat <<EOF\nhi\nEOF').text).toBe(['hi', '$'].join('\n'));
+  });
+
+  it('keeps output that repeats the command', () => {
+    const capture = ['user@box:~$ echo foo', 'foo', 'user@box:~$ echo echo foo', 'echo foo', 'user@box:~$'].join('\n');
+    expect(stripEchoedCommand(capture, 'echo echo foo').text).toBe(['echo foo', 'user@box:~$'].join('\n'));
+    const traced = ['user@box:~$ set -x; ls -1', '+ ls -1', 'a.txt', 'user@box:~$'].join('\n');
+    expect(stripEchoedCommand(traced, 'set -x; ls -1').text).toBe(['+ ls -1', 'a.txt', 'user@box:~$'].join('\n'));
+  });
+
+  it('anchors on the first echo after the baseline prompt', () => {
+    const baseline = ['user@box:~$ history | tail -1', ' 41  ls -1', '> ls -1', 'user@box:~$'].join('\n');
+    const typed = baseline.replace(/user@box:~\$$/, 'user@box:~$ ls -1');
+    const capture = [typed, 'a.txt', '> ls -1', 'user@box:~$'].join('\n');
+    expect(stripEchoedCommand(capture, 'ls -1', baseline).text).toBe(['a.txt', '> ls -1', 'user@box:~$'].join('\n'));
+  });
+
+  it('leaves the capture untouched when the echo is missing', () => {
+    expect(stripEchoedCommand('nothing here', 'ls')).toEqual({ text: 'nothing here', stripped: false });
+  });
+});
+
+describe('buildCaptureArgs', () => {
+  it('keeps the wrapped representation by default', () => {
+    expect(buildCaptureArgs('%1', -50)).toEqual(['capture-pane', '-p', '-t', '%1', '-S', '-50']);
+  });
+
+  it('adds -J when joining wrapped lines', () => {
+    expect(buildCaptureArgs('%1', -50, undefined, { joinWrapped: true })).toContain('-J');
+  });
+});
+
+describe('decodeUtf8', () => {
+  it('passes valid UTF-8 through', () => {
+    expect(decodeUtf8(Buffer.from('héllo ✓', 'utf8'))).toEqual({ text: 'héllo ✓', hadInvalidUtf8: false });
+  });
+
+  it('replaces invalid sequences and flags them', () => {
+    const result = decodeUtf8(new Uint8Array([0x6f, 0x6b, 0xff, 0xc3]));
+    expect(result.hadInvalidUtf8).toBe(true);
+    expect(result.text).toBe('ok\ufffd\ufffd');
+  });
+});
+
+describe('grepLines', () => {
+  const text = ['ok 1', 'ERROR a', 'ok 2', 'ok 3', 'ok 4', 'ERROR b', 'ok 5'].join('\n');
+
+  it('adds context windows and separates non-adjacent groups', () => {
+    expect(grepLines(text, /ERROR/, { context: 1 })).toEqual({
+      text: ['ok 1', 'ERROR a', 'ok 2', '--', 'ok 4', 'ERROR b', 'ok 5'].join('\n'),
+      total: 2,
+      shown: 2,
+    });
+  });
+
+  it('merges overlapping windows', () => {
+    expect(grepLines(text, /ERROR/, { context: 2 }).text).toBe(text);
+  });
+
+  it('keeps only the last N matches', () => {
+    expect(grepLines(text, /ERROR/, { context: 1, maxMatches: 1 })).toEqual({
+      text: ['ok 4', 'ERROR b', 'ok 5'].join('\n'),
+      total: 2,
+      shown: 1,
+    });
+  });
+
+  it('returns nothing when there are no matches', () => {
+    expect(grepLines(text, /panic/)).toEqual({ text: '', total: 0, shown: 0 });
+  });
+});
+
+describe('splitCaptureRanges', () => {
+  it('captures the viewport from line 0 and history above it', () => {
+    const { visible, scrollback } = splitCaptureRanges(-500);
+    expect(buildCaptureArgs('%1', visible.start, visible.end)).toEqual(['capture-pane', '-p', '-t', '%1', '-S', '0']);
+    expect(buildCaptureArgs('%1', scrollback.start, scrollback.end)).toEqual([
+      'capture-pane',
+      '-p',
+      '-t',
+      '%1',
+      '-S',
+      '-500',
+      '-E',
+      '-1',
+    ]);
+  });
+
+  it('defaults the scrollback to the last 200 history lines', () => {
+    expect(splitCaptureRanges().scrollback).toEqual({ start: -200, end: -1 });
+  });
+});
+
+describe('findMatches', () => {
+  it('reports line index, byte offset, and groups for every match', () => {
+    const text = ['ok', 'ERROR 42 at db.go', 'warn', 'ERROR 7 at é.go ERROR 8 at x.go'].join('\n');
+    expect(findMatches(text, /ERROR (\d+) at (\S+)/)).toEqual([
+      { line: 1, byteOffset: 0, text: 'ERROR 42 at db.go', groups: ['42', 'db.go'] },
+      { line: 3, byteOffset: 0, text: 'ERROR 7 at é.go', groups: ['7', 'é.go'] },
+      { line: 3, byteOffset: 17, text: 'ERROR 8 at x.go', groups: ['8', 'x.go'] },
+    ]);
+  });
+
+  it('reports unmatched optional groups as null', () => {
+    expect(findMatches('id=5', /id=(\d+)(x)?/)[0].groups).toEqual(['5', null]);
+  });
+
+  it('does not loop on empty matches', () => {
+    expect(findMatches('ab', /x*/)).toHaveLength(3);
+  });
+});
+
+describe('transformCapture', () => {
+  it('collapses runs of blank lines and counts the dropped lines', () => {
+    const text = ['a', '', '', '', 'b', '  ', '', 'c', ''].join('\n');
+    expect(transformCapture(text, { collapseBlankLines: true })).toEqual({
+      text: ['a', '', 'b', '  ', 'c', ''].join('\n'),
+      collapsedLines: 3,
+    });
+  });
+
+  it('leaves text alone by default', () => {
+    expect(transformCapture('a\n\n\nb')).toEqual({ text: 'a\n\n\nb', collapsedLines: 0 });
+  });
+
+  it('expands tabs and reports how many', () => {
+    expect(transformCapture('a\tb\n\tc', { expandTabs: 4 })).toEqual({
+      text: 'a   b\n    c',
+      collapsedLines: 0,
+      expandedTabs: 2,
+    });
+  });
+});
+
+describe('expandTabs', () => {
+  it('pads to the next tab stop for the configured width', () => {
+    expect(expandTabs('ab\tc', 8).text).toBe('ab      c');
+    expect(expandTabs('abcd\te', 4).text).toBe('abcd    e');
+    expect(expandTabs('x\t\ty', 2).text).toBe('x   y');
+  });
+
+  it('counts wide glyphs as two columns', () => {
+    expect(expandTabs('日本\t|', 8).text).toBe('日本    |');
+    expect(displayWidth(expandTabs('日本\t|', 8).text)).toBe(9);
+  });
+
+  it('leaves tab-free text unchanged', () => {
+    expect(expandTabs('no tabs', 4)).toEqual({ text: 'no tabs', expanded: 0 });
+  });
+
+  it('does not count colour escapes toward tab stops', () => {
+    expect(expandTabs('\x1b[31mab\x1b[0m\tc', 8).text).toBe('\x1b[31mab\x1b[0m      c');
+    expect(expandTabs('\x1b]8;;https://x.test\x07ab\x1b]8;;\x07\tc', 4).text).toBe(
+      '\x1b]8;;https://x.test\x07ab\x1b]8;;\x07  c',
+    );
+  });
+});
+
+describe('headTailLines', () => {
+  const text = Array.from({ length: 10 }, (_, i) => `line ${i + 1}`).join('\n');
+
+  it('keeps the head and tail and counts what was elided', () => {
+    expect(headTailLines(text, 2, 3)).toEqual({
+      text: ['line 1', 'line 2', '... 5 lines elided ...', 'line 8', 'line 9', 'line 10'].join('\n'),
+      elidedLines: 5,
+    });
+  });
+
+  it('supports head-only and tail-only', () => {
+    expect(headTailLines(text, 1).text).toBe('line 1\n... 9 lines elided ...');
+    expect(headTailLines(text, 0, 1).text).toBe('... 9 lines elided ...\nline 10');
+  });
+
+  it('returns short text untouched', () => {
+    expect(headTailLines(text, 6, 4)).toEqual({ text, elidedLines: 0 });
+  });
+
+  it('uses a custom truncation marker at the cut point', () => {
+    expect(headTailLines(text, 1, 1, '...[truncated]...').text).toBe('line 1\n...[truncated]...\nline 10');
+  });
+});
+
+describe('captureMetaFields', () => {
+  it('requests title and dimensions in one format', () => {
+    const fields = captureMetaFields({ title: true, dimensions: true });
+    expect(Object.keys(fields)).toEqual(['width', 'height', 'title']);
+    expect(fields).toEqual({ title: '#{pane_title}', width: '#{pane_width}', height: '#{pane_height}' });
+    expect(parsePaneFields(Object.keys(fields), '120\t40\tlogs\tv2')).toEqual({
+      title: 'logs\tv2',
+      width: '120',
+      height: '40',
+    });
+  });
+
+  it('adds the cursor position', () => {
+    const fields = captureMetaFields({ cursor: true });
+    expect(fields).toEqual({ cursorX: '#{cursor_x}', cursorY: '#{cursor_y}' });
+    expect(parsePaneFields(Object.keys(fields), '2\t23')).toEqual({ cursorX: '2', cursorY: '23' });
+  });
+
+  it('adds history size, limit, and scroll position', () => {
+    const fields = captureMetaFields({ history: true });
+    expect(Object.values(fields)).toEqual(['#{history_size}', '#{history_limit}', '#{scroll_position}']);
+    // Outside copy mode tmux renders scroll_position as empty.
+    const meta = parsePaneFields(Object.keys(fields), '1834\t2000\t');
+    expect(historyFields(meta)).toEqual({ historySize: 1834, historyLimit: 2000 });
+    expect(historyFields(parsePaneFields(Object.keys(fields), '1834\t2000\t40'))).toEqual({
+      historySize: 1834,
+      historyLimit: 2000,
+      scrollPosition: 40,
+    });
+  });
+
+  it('is empty when nothing is requested', () => {
+    expect(captureMetaFields({})).toEqual({});
+  });
+});
+
+describe('retryWhileEmpty', () => {
+  it('retries an empty capture until content appears', async () => {
+    const outputs = ['', '  \n', '$ '];
+    let calls = 0;
+    const result = await retryWhileEmpty(async () => outputs[calls++], (t) => !t.trim(), { retries: 5, delayMs: 1 });
+    expect(result).toEqual({ value: '$ ', retries: 2 });
+    expect(calls).toBe(3);
+  });
+
+  it('gives up after the bound and returns the empty result', async () => {
+    let calls = 0;
+    const result = await retryWhileEmpty(
+      async () => {
+        calls++;
+        return '';
+      },
+      (t) => !t,
+      { retries: 2, delayMs: 1 },
+    );
+    expect(result).toEqual({ value: '', retries: 2 });
+    expect(calls).toBe(3);
+  });
+
+  it('does not retry when disabled or already non-empty', async () => {
+    let calls = 0;
+    const fetch = async () => (calls++ ? 'late' : '');
+    expect(await retryWhileEmpty(fetch, (t) => !t, { retries: 0, delayMs: 1 })).toEqual({ value: '', retries: 0 });
+    expect(calls).toBe(1);
+  });
+});
+
+describe('resolveKeepColor', () => {
+  it('applies the server default when the call does not say', () => {
+    expect(resolveKeepColor(undefined, false, true)).toBe(false);
+    expect(resolveKeepColor(undefined, false, false)).toBe(true);
+  });
+
+  it('lets an explicit keepColor override the default', () => {
+    expect(resolveKeepColor(true, false, true)).toBe(true);
+    expect(resolveKeepColor(false, false, false)).toBe(false);
+  });
+
+  it('captures plain text for column slicing', () => {
+    expect(resolveKeepColor(undefined, true, false)).toBe(false);
+  });
+
+  it('maps to capture-pane -e', () => {
+    expect(buildCaptureArgs('%1', -10, undefined, { escapes: resolveKeepColor(true) })).toContain('-e');
+    expect(buildCaptureArgs('%1', -10, undefined, { escapes: resolveKeepColor(undefined) })).not.toContain('-e');
+  });
+});
+
+describe('captureLines', () => {
+  it('matches the blob split on newlines', () => {
+    const body = 'héllo\n\nwörld\n  日本';
+    expect(captureLines(body)).toEqual(body.split('\n'));
+    expect(captureLines(body).join('\n')).toBe(body);
+  });
+
+  it('ignores one trailing newline and agrees with lineCount', () => {
+    expect(captureLines('a\nb\n')).toEqual(['a', 'b']);
+    expect(captureLines('a\n\n')).toEqual(['a', '']);
+    expect(captureLines('a\nb\n').length).toBe(captureSize('a\nb\n').lineCount);
+    expect(captureLines('')).toEqual([]);
+  });
+});
+
+describe('captureSize', () => {
+  it('matches the returned body', () => {
+    const body = 'héllo\nwörld\n日本';
+    expect(captureSize(body)).toEqual({ byteLength: Buffer.byteLength(body), lineCount: 3 });
+    expect(captureSize(body).byteLength).toBe(20);
+  });
+
+  it('does not count a trailing newline as a line', () => {
+    expect(captureSize('a\nb\n')).toEqual({ byteLength: 4, lineCount: 2 });
+  });
+
+  it('reports an empty capture as zero lines', () => {
+    expect(captureSize('')).toEqual({ byteLength: 0, lineCount: 0 });
+  });
+});
+
+describe('keepLastBytes', () => {
+  it('keeps the newest bytes and puts the marker at the cut', () => {
+    expect(keepLastBytes('old line\nnew line', 8, '...[truncated]...')).toEqual({
+      text: '...[truncated]...\nnew line',
+      droppedBytes: 9,
+    });
+  });
+
+  it('never splits a multi-byte character', () => {
+    // 'é' is two bytes; cutting inside it moves the start to the next character.
+    expect(keepLastBytes('aé b', 3)).toEqual({ text: ' b', droppedBytes: 3 });
+  });
+
+  it('does not split an emoji sequence', () => {
+    // The family emoji is 25 bytes of code points joined by ZWJ; a cut inside it drops the whole glyph.
+    const family = '\u{1F468}\u200D\u{1F469}\u200D\u{1F467}\u200D\u{1F466}';
+    expect(keepLastBytes(`${family}ok`, 10)).toEqual({ text: 'ok', droppedBytes: 25 });
+  });
+
+  it('leaves text within the limit alone', () => {
+    expect(keepLastBytes('short', 10, '[cut]')).toEqual({ text: 'short', droppedBytes: 0 });
+  });
+});
+
+describe('display columns', () => {
+  it('counts wide CJK and emoji glyphs as two cells', () => {
+    expect(displayWidth('abc')).toBe(3);
+    expect(displayWidth('日本語')).toBe(6);
+    expect(displayWidth('ok 👍')).toBe(5);
+    expect(displayWidth('e\u0301')).toBe(1);
+    expect(displayWidth('\u2764\uFE0F')).toBe(2);
+  });
+
+  it('slices by display cells', () => {
+    expect(sliceColumns('日本語テキスト', 2, 6)).toBe('本語');
+    expect(sliceColumns('ab日本', 2)).toBe('日本');
+    expect(sliceColumns('👍 ok', 0, 2)).toBe('👍');
+  });
+
+  it('pads a wide glyph cut at either edge instead of splitting it', () => {
+    expect(sliceColumns('日本語', 1, 5)).toBe(' 本 ');
+    expect(displayWidth(sliceColumns('a日本語b', 0, 4))).toBe(4);
+  });
+
+  it('keeps columns aligned across mixed lines', () => {
+    const text = ['id  name', '1   日本', '2   🚀go'].join('\n');
+    expect(sliceColumnRange(text, 4, 8)).toBe(['name', '日本', '🚀go'].join('\n'));
+  });
+});
+
+describe('extractHyperlinks', () => {
+  it('returns plain text and the OSC 8 links in it', () => {
+    const raw =
+      '\x1b[1mbuild\x1b[0m ok\nsee \x1b]8;;https://example.com/a\x1b\\docs\x1b]8;;\x1b\\ and ' +
+      '\x1b]8;id=x;file:///tmp/log\x07\x1b[31mlog\x1b[0m\x1b]8;;\x07';
+    expect(extractHyperlinks(raw)).toEqual({
+      text: 'build ok\nsee docs and log',
+      links: [
+        { text: 'docs', url: 'https://example.com/a', line: 1 },
+        { text: 'log', url: 'file:///tmp/log', line: 1 },
+      ],
+    });
+  });
+
+  it('closes an unterminated link at the end and skips empty ones', () => {
+    const raw = '\x1b]8;;https://a\x07\x1b]8;;https://b\x07tail';
+    expect(extractHyperlinks(raw).links).toEqual([{ text: 'tail', url: 'https://b', line: 0 }]);
+  });
+});
+
+describe('collapseProgressLines', () => {
+  it('keeps only the latest line of each progress run', () => {
+    const text = [
+      'Downloading torch',
+      '  10% |██        | 1.2/12.0 MB',
+      '  55% |██████    | 6.6/12.0 MB',
+      ' 100% |██████████| 12.0/12.0 MB',
+      '⠋ installing',
+      '⠙ installing',
+      '⠹ installing',
+      'done',
+    ].join('\n');
+    expect(collapseProgressLines(text)).toEqual({
+      text: [
+        'Downloading torch',
+        ' 100% |██████████| 12.0/12.0 MB',
+        '⠹ installing',
+        'done',
+      ].join('\n'),
+      collapsed: 4,
+    });
+  });
+
+  it('leaves repeated lines without progress tokens alone', () => {
+    expect(collapseProgressLines('ok\nok\nstep 1\nstep 1')).toEqual({ text: 'ok\nok\nstep 1\nstep 1', collapsed: 0 });
+    expect(progressKey('plain text')).toBeUndefined();
+    expect(progressKey('layer 3f2a: 40%')).toBe('layer 3f2a: #');
+  });
+
+  it('keeps lines that differ in a leading or middle number', () => {
+    for (const text of [
+      'error at line 12: x\nerror at line 40: x',
+      'GET /a 200\nGET /a 500',
+      '3 files changed\n4 files changed',
+      '12:01:02 connected\n12:01:03 connected',
+      'worker 1 ready 50%\nworker 2 ready 50%',
+    ]) {
+      expect(collapseProgressLines(text)).toEqual({ text, collapsed: 0 });
+    }
+  });
+
+  it('collapses pip, tqdm, and docker style bars', () => {
+    const pip = [
+      '   ━━━━╸━━━━━━━ 2.1/12.0 MB 3.1 MB/s eta 0:00:04',
+      '   ━━━━━━━━━━━━ 12.0/12.0 MB 3.4 MB/s eta 0:00:00',
+    ];
+    const tqdm = [
+      'train:   5%|▌         | 5/100 [00:01<00:19, 5.0it/s]',
+      'train:  45%|████▌     | 45/100 [00:09<00:11, 4.9it/s]',
+    ];
+    const docker = ['a1b2: Downloading [==>        ]  1.2MB/45.6MB', 'a1b2: Downloading [=========> ]  40.1MB/45.6MB'];
+    for (const lines of [pip, tqdm, docker]) {
+      expect(collapseProgressLines(lines.join('\n'))).toEqual({ text: lines[1], collapsed: 1 });
+    }
+  });
+});
+
+describe('transformCapture collapseProgress', () => {
+  it('reports the collapsed progress count', () => {
+    expect(transformCapture('a\n1%\n2%\nb', { collapseProgress: true })).toEqual({
+      text: 'a\n2%\nb',
+      collapsedLines: 0,
+      collapsedProgress: 1,
+    });
+  });
+});
+
+describe('decodeCapture', () => {
+  const latin1 = Uint8Array.from([0x63, 0x61, 0x66, 0xe9, 0x20, 0xa9, 0x20, 0xfc, 0x62, 0x65, 0x72]);
+
+  it('transcodes latin1 bytes to UTF-8', () => {
+    expect(decodeCapture(latin1, 'latin1')).toEqual({ text: 'café © über', hadInvalidUtf8: false });
+    expect(resolveSourceEncoding('ISO-8859-1')).toBe('windows-1252');
+  });
+
+  it('passes UTF-8 through by default and flags latin1 bytes as invalid', () => {
+    expect(decodeCapture(latin1).hadInvalidUtf8).toBe(true);
+    expect(decodeCapture(new TextEncoder().encode('café'), 'utf8')).toEqual({ text: 'café', hadInvalidUtf8: false });
+  });
+
+  it('rejects unknown encodings', () => {
+    expect(() => resolveSourceEncoding('klingon')).toThrow('Unsupported sourceEncoding: klingon');
+  });
+});
+
+describe('checkHistoryLimit', () => {
+  const fake = (global: string, pane = '2000') =>
+    recordingRun((args) => {
+      if (args[0] === 'show-options') return global;
+      if (args[0] === 'display-message') return pane;
+      return '';
+    });
+
+  it('reads the global and pane limits without changing anything', async () => {
+    const { calls, run } = fake('2000', '1500');
+    expect(await checkHistoryLimit(run, { target: '%1', minLines: 1800 })).toEqual({
+      globalLimit: 2000,
+      paneLimit: 1500,
+      minLines: 1800,
+      short: true,
+      raised: false,
+    });
+    expect(calls).toEqual([
+      ['show-options', '-gv', 'history-limit'],
+      ['display-message', '-p', '-t', '%1', '#{history_limit}'],
+    ]);
+  });
+
+  it('raises the global limit only when asked and the request exceeds it', async () => {
+    const low = fake('2000');
+    const result = await checkHistoryLimit(low.run, { minLines: 50000, raise: true });
+    expect(result).toMatchObject({ globalLimit: 2000, short: false, raised: true });
+    expect(low.calls[1]).toEqual(['set-option', '-g', 'history-limit', '50000']);
+
+    const high = fake('100000');
+    expect(await checkHistoryLimit(high.run, { minLines: 50000, raise: true })).toMatchObject({ raised: false });
+    expect(high.calls).toHaveLength(1);
+  });
+
+  it('reports an existing pane as short even after raising', async () => {
+    const { run } = fake('2000', '2000');
+    expect(await checkHistoryLimit(run, { target: '%1', minLines: 10000, raise: true })).toMatchObject({
+      paneLimit: 2000,
+      short: true,
+      raised: true,
+    });
+  });
+
+  it('refuses to raise past the configured maximum', async () => {
+    const { calls, run } = fake('2000');
+    await expect(checkHistoryLimit(run, { minLines: 2 ** 31, raise: true, maxLines: 100000 })).rejects.toThrow(
+      'MCP_TMUX_MAX_HISTORY_LIMIT',
+    );
+    expect(calls).toEqual([]);
+    expect((await checkHistoryLimit(run, { minLines: 2 ** 31, maxLines: 100000 })).raised).toBe(false);
+  });
+});
@@ -0,0 +1,259 @@
+import { execFileSync } from 'node:child_process';
+import { describe, expect, it } from 'vitest';
+import {
+  assertKillServerConfirmed,
+  assertToolAllowed,
+  buildCommandArgs,
+  buildDisplayMessageArgs,
+  buildListArgs,
+  buildRefreshClientArgs,
+  buildRunShellArgs,
+  commandOutputResult,
+  parseStatusLine,
+  rawListResult,
+  splitStderrCapture,
+  statusLineFormat,
+  tmuxInvocation,
+  wrapHostCommand,
+  wrapStderrCapture,
+} from '../src/index.js';
+
+describe('commandOutputResult', () => {
+  it('reports empty output as empty text with hadOutput=false', () => {
+    expect(commandOutputResult('')).toEqual({
+      content: [{ type: 'text', text: '' }],
+      structuredContent: { output: '', hadOutput: false },
+    });
+  });
+
+  it('passes real output through', () => {
+    expect(commandOutputResult('3.4').structuredContent).toEqual({ output: '3.4', hadOutput: true });
+  });
+
+  it('keeps the old placeholder when asked', () => {
+    const result = commandOutputResult('', true);
+    expect(result.content[0].text).toBe('(no output)');
+    expect(result.structuredContent.hadOutput).toBe(false);
+  });
+});
+
+describe('buildRunShellArgs', () => {
+  it('prefixes a cd into the pane cwd when requested', () => {
+    expect(buildRunShellArgs('make test', { target: '%3', usePaneCwd: true, tmuxBin: 'tmux' })).toEqual([
+      'run-shell',
+      '-t',
+      '%3',
+      `cd "$(tmux display -p -t '%3' '#{pane_current_path}')" && make test`,
+    ]);
+  });
+
+  it('runs the command as-is by default', () => {
+    expect(buildRunShellArgs('uptime', { target: '%3' })).toEqual(['run-shell', '-t', '%3', 'uptime']);
+    expect(buildRunShellArgs('uptime')).toEqual(['run-shell', 'uptime']);
+  });
+});
+
+describe('assertKillServerConfirmed', () => {
+  it('requires confirm=true', () => {
+    expect(() => assertKillServerConfirmed('web-1', false, 'web-1')).toThrow('confirm=true is required');
+  });
+
+  it('requires the host to be typed back', () => {
+    expect(() => assertKillServerConfirmed('web-1', true)).toThrow('hostConfirmation must equal the target host "web-1"');
+    expect(() => assertKillServerConfirmed('web-1', true, 'web-2')).toThrow('hostConfirmation');
+  });
+
+  it('accepts both guards, using "local" for the local server', () => {
+    expect(() => assertKillServerConfirmed('web-1', true, 'web-1')).not.toThrow();
+    expect(() => assertKillServerConfirmed(undefined, true, 'local')).not.toThrow();
+  });
+});
+
+describe('buildDisplayMessageArgs', () => {
+  const format = `#{client_width}x#{client_height} $HOME "quoted" 'single' # not a comment`;
+
+  it('passes the format through as one argument', () => {
+    expect(buildDisplayMessageArgs(format, '%1')).toEqual(['display-message', '-p', '-t', '%1', format]);
+    expect(buildDisplayMessageArgs('#{pid}')).toEqual(['display-message', '-p', '#{pid}']);
+  });
+
+  it('addresses a specific client with -c', () => {
+    expect(buildDisplayMessageArgs('#{client_width}', '%1', '/dev/pts/3')).toEqual([
+      'display-message',
+      '-p',
+      '-c',
+      '/dev/pts/3',
+      '-t',
+      '%1',
+      '#{client_width}',
+    ]);
+  });
+
+  it('survives the remote base64 wrapping unmangled', () => {
+    const inv = tmuxInvocation(buildDisplayMessageArgs(format, '%1'), 'web-1');
+    const remote = inv.args[inv.args.length - 1];
+    const b64 = /printf %s '([^']+)'/.exec(remote)?.[1] ?? '';
+    const decoded = Buffer.from(b64, 'base64').toString('utf8');
+    expect(decoded.endsWith(` '${format.replace(/'/g, `'\\''`)}'`)).toBe(true);
+  });
+});
+
+describe('buildCommandArgs', () => {
+  it('passes raw args through by default', () => {
+    expect(buildCommandArgs(['list-sessions', '-F', '#{session_name}'])).toEqual([
+      'list-sessions',
+      '-F',
+      '#{session_name}',
+    ]);
+  });
+
+  it('joins args into one run-shell command line', () => {
+    expect(buildCommandArgs(['ps aux', '|', "grep 'node app'", '|', 'wc -l'], true)).toEqual([
+      'run-shell',
+      "ps aux | grep 'node app' | wc -l",
+    ]);
+  });
+
+  it("runs the joined command through the host's commandWrapper", () => {
+    expect(buildCommandArgs(['ps aux', '|', 'wc -l'], true, 'sudo -n')).toEqual([
+      'run-shell',
+      "sudo -n sh -c 'ps aux | wc -l'",
+    ]);
+    expect(buildCommandArgs(['list-sessions'], false, 'sudo -n')).toEqual(['list-sessions']);
+  });
+
+  it('keeps the pipeline intact through the remote base64 wrapping', () => {
+    const line = `echo "$HOME" | sed 's/a/b/' && printf '%s' done`;
+    const inv = tmuxInvocation(buildCommandArgs([line], true), 'web-1');
+    const remote = inv.args[inv.args.length - 1];
+    const b64 = /printf %s '([^']+)'/.exec(remote)?.[1] ?? '';
+    const decoded = Buffer.from(b64, 'base64').toString('utf8');
+    expect(decoded.endsWith(` 'run-shell' '${line.replace(/'/g, `'\\''`)}'`)).toBe(true);
+  });
+});
+
+describe('buildRefreshClientArgs', () => {
+  it('targets the client and formats the size', () => {
+    expect(buildRefreshClientArgs('/dev/pts/3')).toEqual(['refresh-client', '-t', '/dev/pts/3']);
+    expect(buildRefreshClientArgs('/dev/pts/3', { width: 120, height: 40 })).toEqual([
+      'refresh-client',
+      '-t',
+      '/dev/pts/3',
+      '-C',
+      '120x40',
+    ]);
+  });
+
+  it('rejects non-positive sizes', () => {
+    expect(() => buildRefreshClientArgs('c', { width: 0, height: 40 })).toThrow('positive integers');
+    expect(() => buildRefreshClientArgs('c', { width: 80.5, height: 24 })).toThrow('positive integers');
+  });
+});
+
+describe('separate stderr capture', () => {
+  it('splits stdout, stderr and the exit status of a real shell run', () => {
+    const raw = execFileSync('sh', ['-c', wrapStderrCapture('echo out; echo err >&2; exit 3')], { encoding: 'utf8' });
+    expect(splitStderrCapture(raw.replace(/\n$/, ''))).toEqual({ stdout: 'out\n', stderr: 'err', exitCode: 3 });
+  });
+
+  it('handles commands with no stdout', () => {
+    const raw = execFileSync('sh', ['-c', wrapStderrCapture('ls /nonexistent-mcp-tmux-dir')], { encoding: 'utf8' });
+    const split = splitStderrCapture(raw);
+    expect(split.stdout).toBe('');
+    expect(split.stderr).toMatch(/nonexistent-mcp-tmux-dir/);
+    expect(split.exitCode).not.toBe(0);
+  });
+
+  it('passes unmarked output through', () => {
+    expect(splitStderrCapture('plain')).toEqual({ stdout: 'plain', stderr: '', exitCode: undefined });
+  });
+});
+
+describe('buildListArgs', () => {
+  const format = `#{pane_id} #{?pane_active,*, } '#{pane_current_command}' $HOME # note`;
+
+  it('passes a custom format to list-panes', () => {
+    expect(buildListArgs('list-panes', format, 'collab:1')).toEqual(['list-panes', '-F', format, '-t', 'collab:1']);
+    expect(buildListArgs('list-panes', format, undefined, true)).toEqual(['list-panes', '-F', format, '-a']);
+    expect(buildListArgs('list-sessions', '#{session_name}')).toEqual(['list-sessions', '-F', '#{session_name}']);
+  });
+
+  it('survives the remote base64 wrapping unmangled', () => {
+    const inv = tmuxInvocation(buildListArgs('list-panes', format, 'collab:1'), 'web-1');
+    const b64 = /printf %s '([^']+)'/.exec(inv.args[inv.args.length - 1])?.[1] ?? '';
+    const decoded = Buffer.from(b64, 'base64').toString('utf8');
+    expect(decoded).toContain(` '-F' '${format.replace(/'/g, `'\\''`)}' '-t' 'collab:1'`);
+  });
+
+  it('rejects #() shell jobs in a format when read-only', () => {
+    for (const name of ['tmux_list_sessions', 'tmux_list_windows', 'tmux_list_panes']) {
+      expect(() => assertToolAllowed(name, { format: '#{pane_id} #(id)' }, true)).toThrow(/read-only/);
+      expect(() => assertToolAllowed(name, { format }, true)).not.toThrow();
+      expect(() => assertToolAllowed(name, { format: '#(id)' }, false)).not.toThrow();
+    }
+  });
+
+  it('returns the rendered lines as text and structured content', () => {
+    expect(rawListResult('%1 *\n%2  ')).toEqual({
+      content: [{ type: 'text', text: '%1 *\n%2  ' }],
+      structuredContent: { lines: ['%1 *', '%2  '] },
+    });
+    expect(rawListResult('').content[0].text).toBe('(none)');
+  });
+});
+
+describe('parseStatusLine', () => {
+  it('returns each rendered part and the joined status text', () => {
+    expect(parseStatusLine('[demo] \t0:bash- 1:vim* \t"vm" 18:30 14-Oct-26\n')).toEqual({
+      left: '[demo] ',
+      windows: '0:bash- 1:vim*',
+      right: '"vm" 18:30 14-Oct-26',
+      text: '[demo]  0:bash- 1:vim* "vm" 18:30 14-Oct-26',
+    });
+  });
+
+  it('strips style directives unless asked to keep them', () => {
+    const raw = '#[fg=green][demo]#[default]\t#[reverse]0:bash*#[noreverse] \t#[fg=red]load 0.1';
+    expect(parseStatusLine(raw)).toMatchObject({ left: '[demo]', windows: '0:bash*', right: 'load 0.1' });
+    expect(parseStatusLine(raw, true).left).toBe('#[fg=green][demo]#[default]');
+  });
+
+  it('skips empty parts in the text', () => {
+    expect(parseStatusLine('\t0:bash*\t').text).toBe('0:bash*');
+  });
+
+  it('renders the options through display-message in one call', () => {
+    expect(statusLineFormat.split('\t')).toHaveLength(3);
+    expect(statusLineFormat).toContain('#{T:status-left}');
+    expect(statusLineFormat).toContain('#{T:window-status-current-format}');
+  });
+});
+
+describe('wrapHostCommand', () => {
+  it('runs the host command through the wrapper', () => {
+    expect(wrapHostCommand("ps -p 42 || echo 'gone'", 'sudo -n')).toBe(`sudo -n sh -c 'ps -p 42 || echo '\\''gone'\\'''`);
+    expect(wrapHostCommand('uptime', 'sudo -n -u deploy')).toBe("sudo -n -u deploy sh -c 'uptime'");
+  });
+
+  it('leaves the command alone without a wrapper', () => {
+    expect(wrapHostCommand('uptime')).toBe('uptime');
+  });
+
+  it('rejects wrappers with shell syntax', () => {
+    expect(() => wrapHostCommand('uptime', 'sudo -n; rm -rf /')).toThrow(/plain words/);
+    expect(() => wrapHostCommand('uptime', '$(evil)')).toThrow(/plain words/);
+  });
+
+  it('wraps only the host command, not the tmux invocation', () => {
+    const args = buildRunShellArgs(wrapHostCommand('make test', 'sudo -n'), {
+      target: '%3',
+      usePaneCwd: true,
+      tmuxBin: 'tmux',
+    });
+    expect(args.slice(0, 3)).toEqual(['run-shell', '-t', '%3']);
+    expect(args[3].startsWith('cd "$(tmux display -p')).toBe(true);
+    expect(args[3].endsWith(" && sudo -n sh -c 'make test'")).toBe(true);
+    const invocation = tmuxInvocation(args);
+    expect(invocation.args[0]).toBe('run-shell');
+  });
+});
@@ -0,0 +1,168 @@
+import { describe, expect, it } from 'vitest';
+import {
+  controlCommandLine,
+  countAttachedClients,
+  createControlClient,
+  isControlEligible,
+  isControlUnsent,
+  type ControlBackend,
+} from '../src/index.js';
+
+function fakeBackend() {
+  const written: string[] = [];
+  let lineListener: (line: string) => void = () => undefined;
+  let closeListener: () => void = () => undefined;
+  let closed = false;
+  const backend: ControlBackend = {
+    write: (line) => {
+      written.push(line);
+    },
+    onLine: (listener) => {
+      lineListener = listener;
+    },
+    onClose: (listener) => {
+      closeListener = listener;
+    },
+    close: () => {
+      if (closed) return;
+      closed = true;
+      closeListener();
+    },
+  };
+  const emit = (...lines: string[]) => lines.forEach((line) => lineListener(line));
+  const reply = (n: number, lines: string[], kind: 'end' | 'error' = 'end') =>
+    emit(`%begin 1700000000 ${n} 1`, ...lines, `%${kind} 1700000000 ${n} 1`);
+  const attach = () => emit('%begin 1700000000 1 0', '%end 1700000000 1 0', '%session-changed $0 demo');
+  return { backend, written, emit, reply, attach };
+}
+
+describe('controlCommandLine', () => {
+  it('single-quotes every argument', () => {
+    expect(controlCommandLine(['display-message', '-p', '-t', '%1', "#{pane_id} it's ~ $HOME"])).toBe(
+      `'display-message' '-p' '-t' '%1' '#{pane_id} it'\\''s ~ $HOME'`,
+    );
+  });
+
+  it('refuses chained commands', () => {
+    const chain = ['set-option', '-t', '@1', 'a', 'b', ';', 'set-option', '-t', '@1', 'c', 'd'];
+    expect(controlCommandLine(chain)).toBeUndefined();
+    expect(controlCommandLine(['set-option', '-t', '@1', 'c', 'd;'])).toBe(`'set-option' '-t' '@1' 'c' 'd;'`);
+  });
+
+  it('refuses arguments with newlines', () => {
+    expect(controlCommandLine(['send-keys', '-t', '%1', 'a\nb'])).toBeUndefined();
+  });
+});
+
+describe('createControlClient', () => {
+  it('multiplexes several commands over one connection, in order', async () => {
+    const fake = fakeBackend();
+    const client = createControlClient(fake.backend, 1000);
+    const first = client.run(['capture-pane', '-p', '-t', '%1']);
+    const second = client.run(['display-message', '-p', '-t', '%2', '#{pane_width}']);
+    expect(fake.written).toEqual([]);
+    fake.attach();
+    expect(fake.written).toEqual([
+      `'capture-pane' '-p' '-t' '%1'\n`,
+      `'display-message' '-p' '-t' '%2' '#{pane_width}'\n`,
+    ]);
+    fake.emit('%output %1 noise', '%window-add @3');
+    fake.reply(2, ['line one', 'line two']);
+    fake.reply(3, ['120']);
+    expect(await first).toBe('line one\nline two');
+    expect(await second).toBe('120');
+    const third = client.run(['list-sessions']);
+    expect(fake.written).toHaveLength(3);
+    fake.reply(4, ['demo: 1 windows']);
+    expect(await third).toBe('demo: 1 windows');
+  });
+
+  it('rejects a command answered with %error without disturbing the next one', async () => {
+    const fake = fakeBackend();
+    const client = createControlClient(fake.backend, 1000);
+    fake.attach();
+    const bad = client.run(['capture-pane', '-p', '-t', '%9']);
+    const good = client.run(['list-sessions']);
+    fake.reply(2, ["can't find pane: %9"], 'error');
+    fake.reply(3, ['demo']);
+    await expect(bad).rejects.toThrow("can't find pane: %9");
+    expect(await good).toBe('demo');
+  });
+
+  it('skips blocks that did not come from this client', async () => {
+    const fake = fakeBackend();
+    const client = createControlClient(fake.backend, 1000);
+    fake.attach();
+    const pending = client.run(['list-sessions']);
+    fake.emit('%begin 1700000000 5 0', 'from a hook', '%end 1700000000 5 0');
+    fake.reply(6, ['demo']);
+    expect(await pending).toBe('demo');
+  });
+
+  it('reports unsent commands when the attach fails', async () => {
+    const fake = fakeBackend();
+    const client = createControlClient(fake.backend, 1000);
+    const pending = client.run(['list-sessions']);
+    fake.emit('%begin 1700000000 1 0', 'no sessions', '%error 1700000000 1 0');
+    expect(isControlUnsent(await pending.catch((e: unknown) => e))).toBe(true);
+    expect(fake.written).toEqual([]);
+    expect(client.closed).toBe(true);
+  });
+
+  it('reports sent commands when the client exits mid-command', async () => {
+    const fake = fakeBackend();
+    const client = createControlClient(fake.backend, 1000);
+    fake.attach();
+    const pending = client.run(['kill-session', '-t', 'demo']);
+    fake.emit('%exit');
+    const error = await pending.catch((e: unknown) => e);
+    expect(error).toBeInstanceOf(Error);
+    expect(isControlUnsent(error)).toBe(false);
+  });
+
+  it('keeps replies aligned when a chained command is followed by an unrelated one', async () => {
+    const fake = fakeBackend();
+    const client = createControlClient(fake.backend, 1000);
+    fake.attach();
+    const chained = client.run(['set-option', '-t', '@1', 'a', 'b', ';', 'set-window-option', '-t', '@1', 'c', 'd']);
+    const next = client.run(['display-message', '-p', '-t', '%2', '#{pane_width}']);
+    expect(isControlUnsent(await chained.catch((e: unknown) => e))).toBe(true);
+    expect(fake.written).toEqual([`'display-message' '-p' '-t' '%2' '#{pane_width}'\n`]);
+    fake.reply(2, ['120']);
+    expect(await next).toBe('120');
+  });
+
+  it('drops the connection when a reply times out', async () => {
+    const fake = fakeBackend();
+    const client = createControlClient(fake.backend, 5);
+    fake.attach();
+    await expect(client.run(['list-sessions'])).rejects.toThrow(/timed out/);
+    expect(client.closed).toBe(true);
+    expect(isControlUnsent(await client.run(['list-sessions']).catch((e: unknown) => e))).toBe(true);
+  });
+});
+
+describe('isControlEligible', () => {
+  it('only sends local, targeted commands', () => {
+    expect(isControlEligible(['capture-pane', '-p', '-t', '%1'])).toBe(true);
+    expect(isControlEligible(['list-sessions', '-F', '#{session_name}'])).toBe(true);
+    expect(isControlEligible(['display-message', '-p', '#{pid}'])).toBe(false);
+    expect(isControlEligible(['capture-pane', '-p', '-t', '%1'], 'web-1')).toBe(false);
+    expect(isControlEligible(['capture-pane', '-p', '-t', '%1'], undefined, '/tmp/sock')).toBe(false);
+    expect(isControlEligible(['set-option', '-t', '@1', 'a', ';', 'set-option', '-t', '@1', 'b'])).toBe(false);
+  });
+});
+
+describe('countAttachedClients', () => {
+  it('counts clients per session without our control client', () => {
+    const raw = ['client-101\tdev', 'client-102\tdev', '/dev/pts/3\tops', 'client-101\tops'].join('\n');
+    expect(countAttachedClients(raw, 'client-101')).toEqual(
+      new Map([
+        ['dev', 1],
+        ['ops', 1],
+      ]),
+    );
+    expect(countAttachedClients(raw).get('dev')).toBe(2);
+    expect(countAttachedClients('')).toEqual(new Map());
+  });
+});
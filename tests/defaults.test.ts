@@ -0,0 +1,128 @@
+import fs from 'node:fs/promises';
+import os from 'node:os';
+import path from 'node:path';
+import { describe, expect, it } from 'vitest';
+import {
+  assertDefaultWritable,
+  assertKnownDefaultsHost,
+  mergeHostDefaults,
+  nextDefaults,
+  pickDefault,
+  readHostDefaults,
+  writeHostDefaults,
+} from '../src/index.js';
+
+describe('assertDefaultWritable', () => {
+  it('rejects overwriting a locked default without force', () => {
+    expect(() => assertDefaultWritable(true, { session: 'collab', pane: undefined })).toThrow(
+      'Defaults are locked (session: collab)',
+    );
+  });
+
+  it('allows overwrite with force', () => {
+    expect(() => assertDefaultWritable(true, { session: 'collab' }, true)).not.toThrow();
+  });
+
+  it('allows the first default to be set while locked', () => {
+    expect(() => assertDefaultWritable(true, { host: undefined, session: undefined })).not.toThrow();
+  });
+
+  it('is a no-op when locking is disabled', () => {
+    expect(() => assertDefaultWritable(false, { session: 'collab' })).not.toThrow();
+  });
+});
+
+describe('per-host defaults', () => {
+  it('stores every entry of a batch', () => {
+    const saved = mergeHostDefaults({ db1: { session: 'ops', pane: '%2' } }, [
+      { host: 'db1', session: 'maint' },
+      { host: 'web1', session: 'deploy', window: 'deploy:1' },
+      { host: 'local', pane: '%0' },
+    ]);
+    expect(saved).toEqual({
+      db1: { session: 'maint', pane: '%2' },
+      web1: { session: 'deploy', window: 'deploy:1' },
+      local: { pane: '%0' },
+    });
+  });
+
+  it('clears fields set to an empty string and drops empty hosts', () => {
+    expect(mergeHostDefaults({ db1: { session: 'ops' }, web1: { pane: '%1' } }, [{ host: 'db1', session: '' }])).toEqual({
+      web1: { pane: '%1' },
+    });
+  });
+
+  it('rejects duplicate and empty hosts', () => {
+    expect(() => mergeHostDefaults({}, [{ host: 'a' }, { host: 'a' }])).toThrow(/more than once/);
+    expect(() => mergeHostDefaults({}, [{ host: ' ' }])).toThrow(/needs a host/);
+  });
+
+  it('persists the whole set together', async () => {
+    const dir = await fs.mkdtemp(path.join(os.tmpdir(), 'mcp-tmux-defaults-'));
+    const file = path.join(dir, 'nested', 'defaults.json');
+    const saved = mergeHostDefaults({}, [
+      { host: 'db1', session: 'ops' },
+      { host: 'web1', session: 'deploy' },
+    ]);
+    await writeHostDefaults(saved, file);
+    expect(await readHostDefaults(file)).toEqual(saved);
+    expect(await readHostDefaults(path.join(dir, 'missing.json'))).toEqual({});
+  });
+});
+
+describe('nextDefaults', () => {
+  const locked = { host: 'web-1', session: 'collab', window: undefined, pane: '%3' };
+
+  it('keeps a locked default through open_session and select_pane', () => {
+    const opened = nextDefaults(
+      true,
+      locked,
+      { host: 'db-1', session: 'other', window: undefined, pane: undefined },
+      { implicit: true },
+    );
+    expect(opened).toEqual(locked);
+    expect(nextDefaults(true, opened, { pane: '%9' }, { implicit: true })).toEqual(locked);
+  });
+
+  it('refuses explicit updates under the lock unless forced', () => {
+    expect(() => nextDefaults(true, locked, { session: 'other' })).toThrow(/Defaults are locked/);
+    expect(nextDefaults(true, locked, { session: 'other' }, { force: true })).toEqual({ ...locked, session: 'other' });
+  });
+
+  it('applies implicit updates when unlocked or nothing is set yet', () => {
+    expect(nextDefaults(false, locked, { pane: '%9' }, { implicit: true })).toEqual({ ...locked, pane: '%9' });
+    expect(nextDefaults(true, {}, { host: 'web-1', session: 's' }, { implicit: true })).toEqual({
+      host: 'web-1',
+      session: 's',
+    });
+  });
+});
+
+describe('pickDefault', () => {
+  const saved = { 'web-1': { session: 'collab', pane: '%4' }, local: { session: 'scratch' } };
+
+  it('falls back to the saved host defaults after a restart', () => {
+    expect(pickDefault(saved, 'session', undefined, 'web-1', 'web-1')).toBe('collab');
+    expect(pickDefault(saved, 'pane', undefined, 'web-1', 'web-1')).toBe('%4');
+    expect(pickDefault(saved, 'session', undefined, undefined, undefined)).toBe('scratch');
+  });
+
+  it('prefers the current default on the default host', () => {
+    expect(pickDefault(saved, 'session', 'live', 'web-1', 'web-1')).toBe('live');
+  });
+
+  it('uses the saved defaults of an explicitly passed host', () => {
+    expect(pickDefault(saved, 'session', 'live', 'web-1', undefined)).toBe('collab');
+    expect(pickDefault(saved, 'session', 'live', 'db-1', 'web-1')).toBe('live');
+  });
+});
+
+describe('assertKnownDefaultsHost', () => {
+  it('rejects activating a host without saved defaults', () => {
+    expect(() => assertKnownDefaultsHost({ 'web-1': {} }, 'web-2')).toThrow(
+      'No saved defaults for host web-2 (known: local, web-1)',
+    );
+    expect(() => assertKnownDefaultsHost({ 'web-1': {} }, 'web-1')).not.toThrow();
+    expect(() => assertKnownDefaultsHost({}, 'local')).not.toThrow();
+  });
+});
@@ -0,0 +1,35 @@
+import { describe, expect, it } from 'vitest';
+import { contentHash, diffLines } from '../src/index.js';
+
+describe('diffLines', () => {
+  it('reports lines that scrolled off and lines that arrived', () => {
+    const before = ['$ make', 'cc a.c', 'cc b.c'].join('\n');
+    const after = ['cc a.c', 'cc b.c', 'ld app', '$'].join('\n');
+    expect(diffLines(before, after)).toEqual({
+      removed: [{ line: 0, text: '$ make' }],
+      added: [
+        { line: 2, text: 'ld app' },
+        { line: 3, text: '$' },
+      ],
+    });
+  });
+
+  it('reports an in-place edit as a removal and an addition at the same position', () => {
+    expect(diffLines('a\nprogress 10%\nb', 'a\nprogress 90%\nb')).toEqual({
+      removed: [{ line: 1, text: 'progress 10%' }],
+      added: [{ line: 1, text: 'progress 90%' }],
+    });
+  });
+
+  it('returns nothing for identical captures', () => {
+    expect(diffLines('x\ny', 'x\ny')).toEqual({ added: [], removed: [] });
+  });
+});
+
+describe('contentHash', () => {
+  it('is stable and content-sensitive', () => {
+    expect(contentHash('abc')).toBe(contentHash('abc'));
+    expect(contentHash('abc')).not.toBe(contentHash('abd'));
+    expect(contentHash('abc')).toMatch(/^[0-9a-f]{16}$/);
+  });
+});
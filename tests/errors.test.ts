@@ -0,0 +1,26 @@
+import { describe, expect, it } from 'vitest';
+import { tmuxError } from '../src/index.js';
+
+describe('tmuxError', () => {
+  it('attaches structured detail for remote failures', () => {
+    const err = tmuxError(['capture-pane', '-p', '-t', '%1'], 'web-1', {
+      message: 'Command failed with exit code 1',
+      stderr: "can't find pane: %1",
+      exitCode: 1,
+    });
+    expect(err.message).toContain('ssh web-1 tmux capture-pane -p -t %1 failed');
+    expect(err.data).toEqual({
+      command: 'ssh web-1 tmux capture-pane -p -t %1',
+      args: ['capture-pane', '-p', '-t', '%1'],
+      host: 'web-1',
+      stderr: "can't find pane: %1",
+      exitCode: 1,
+    });
+  });
+
+  it('falls back to the error message when there is no output', () => {
+    const err = tmuxError(['-V'], undefined, { message: 'spawn tmux ENOENT' });
+    expect(err.message).toContain('tmux -V failed: spawn tmux ENOENT');
+    expect(err.data).toMatchObject({ command: 'tmux -V', exitCode: undefined, stderr: undefined });
+  });
+});
@@ -0,0 +1,99 @@
+import { describe, expect, it } from 'vitest';
+import { tmuxError, waitForCommand, watchPaneExit, type PaneProcessSample } from '../src/index.js';
+
+function sampler(samples: (PaneProcessSample | Error)[]) {
+  let i = 0;
+  return async () => {
+    const next = samples[Math.min(i++, samples.length - 1)];
+    if (next instanceof Error) throw next;
+    return next;
+  };
+}
+
+const opts = { intervalMs: 1, timeoutMs: 1000 };
+
+describe('watchPaneExit', () => {
+  it('reports the exit status of a dead pane', async () => {
+    const result = await watchPaneExit(
+      sampler([
+        { dead: false, command: 'make' },
+        { dead: true, deadStatus: 2, command: 'make' },
+      ]),
+      opts,
+    );
+    expect(result).toMatchObject({ status: 'exited', detail: 'Process exited with status 2.' });
+  });
+
+  it('treats a vanished pane as an exit', async () => {
+    const gone = tmuxError(['display-message', '-p', '-t', '%3'], undefined, { stderr: "can't find pane: %3" });
+    const result = await watchPaneExit(sampler([{ dead: false, command: 'sleep' }, gone]), opts);
+    expect(result.status).toBe('exited');
+    expect(result.detail).toContain('Pane closed');
+  });
+
+  it('detects the prompt returning', async () => {
+    const result = await watchPaneExit(
+      sampler([
+        { dead: false, command: 'npm' },
+        { dead: false, command: 'npm' },
+        { dead: false, command: 'zsh' },
+      ]),
+      opts,
+    );
+    expect(result).toMatchObject({ status: 'exited', detail: 'npm finished; prompt returned (exit status unknown).' });
+  });
+
+  it('returns immediately when nothing is running', async () => {
+    const result = await watchPaneExit(sampler([{ dead: false, command: 'bash' }]), opts);
+    expect(result.status).toBe('idle');
+  });
+
+  it('recognizes login shells reported with a leading dash', async () => {
+    expect((await watchPaneExit(sampler([{ dead: false, command: '-zsh' }]), opts)).status).toBe('idle');
+    const result = await watchPaneExit(
+      sampler([
+        { dead: false, command: 'npm' },
+        { dead: false, command: '-bash' },
+      ]),
+      opts,
+    );
+    expect(result.status).toBe('exited');
+  });
+
+  it('times out while the process keeps running', async () => {
+    const result = await watchPaneExit(sampler([{ dead: false, command: 'tail' }]), { intervalMs: 5, timeoutMs: 12 });
+    expect(result.status).toBe('timeout');
+  });
+
+  it('propagates other errors', async () => {
+    await expect(watchPaneExit(sampler([new Error('permission denied')]), opts)).rejects.toThrow('permission denied');
+  });
+});
+
+describe('waitForCommand', () => {
+  // display-message #{pane_current_command} output over successive polls.
+  const commands = (seen: string[]) => {
+    let i = 0;
+    return async () => seen[Math.min(i++, seen.length - 1)];
+  };
+
+  it('waits until the pane runs the command', async () => {
+    const result = await waitForCommand(commands(['bash', 'bash', 'node']), { command: 'node', ...opts });
+    expect(result).toMatchObject({ matched: true, command: 'node' });
+  });
+
+  it('waits until the pane leaves the command', async () => {
+    const result = await waitForCommand(commands(['vim\n', 'vim', 'zsh']), { command: 'vim', until: 'not', ...opts });
+    expect(result).toMatchObject({ matched: true, command: 'zsh' });
+  });
+
+  it('ignores the login-shell dash', async () => {
+    const result = await waitForCommand(commands(['node', '-bash']), { command: 'bash', ...opts });
+    expect(result).toMatchObject({ matched: true, command: 'bash' });
+  });
+
+  it('times out with the last command seen', async () => {
+    const result = await waitForCommand(commands(['make']), { command: 'bash', intervalMs: 1, timeoutMs: 5 });
+    expect(result).toMatchObject({ matched: false, command: 'make' });
+  });
+});
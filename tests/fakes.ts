@@ -0,0 +1,18 @@
+import type { TmuxPane } from '../src/index.js';
+
+// Shared fakes for driving the tmux-facing helpers without a tmux server.
+
+// A list-panes row; tests override only the fields they care about.
+export function fakePane(fields: Partial<TmuxPane> & { id: string }): TmuxPane {
+  return { session: 'dev', window: '0', index: 0, active: false, tty: '', command: 'bash', title: '', ...fields };
+}
+
+// A `run` that records every tmux argv and answers with respond (which may throw to simulate tmux errors).
+export function recordingRun(respond: (args: string[]) => string | Promise<string> = () => '') {
+  const calls: string[][] = [];
+  const run = async (args: string[]) => {
+    calls.push(args);
+    return respond(args);
+  };
+  return { calls, run };
+}
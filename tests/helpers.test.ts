@@ -1,5 +1,5 @@
 import { describe, expect, it } from 'vitest';
-import { buildPath } from '../src/index.js';
+import { buildPath, hostOverrideFromMeta, resolveHostProfile } from '../src/index.js';
 
 describe('buildPath', () => {
   it('appends fallbacks to an existing PATH', () => {
@@ -17,3 +17,54 @@ describe('buildPath', () => {
     expect(result).toBe('a:b:c');
   });
 });
+
+describe('host overrides', () => {
+  const profiles = { 'web-1': { tmuxBin: '/opt/tmux/bin/tmux', pathAdd: ['/opt/tmux/bin'], defaultSession: 'ops' } };
+
+  it('uses the profile map without an override', () => {
+    expect(resolveHostProfile('web-1', profiles, undefined)).toBe(profiles['web-1']);
+    expect(resolveHostProfile(undefined, profiles, undefined)).toBeUndefined();
+  });
+
+  it('bypasses the profile map when the request supplies settings', () => {
+    const override = hostOverrideFromMeta(
+      { 'x-tmux-host-override': { tmuxBin: '/opt/tmux/bin/tmux', pathAdd: ['/usr/local/bin'] } },
+      profiles,
+      false,
+    );
+    expect(resolveHostProfile('web-2', profiles, override)).toEqual({
+      tmuxBin: '/opt/tmux/bin/tmux',
+      pathAdd: ['/usr/local/bin'],
+    });
+    const ignored = hostOverrideFromMeta({ 'x-tmux-ignore-profile': true }, profiles, false);
+    expect(resolveHostProfile('web-1', profiles, ignored)).toEqual({});
+  });
+
+  it('rejects malformed overrides', () => {
+    expect(hostOverrideFromMeta({})).toBeUndefined();
+    expect(() => hostOverrideFromMeta({ 'x-tmux-host-override': { pathAdd: '/bin' } })).toThrow('pathAdd');
+    expect(() => hostOverrideFromMeta({ 'x-tmux-host-override': 'tmux' })).toThrow('x-tmux-host-override');
+  });
+
+  it('rejects pathAdd entries that would inject shell commands', () => {
+    for (const entry of ['/x; rm -rf ~', '/x$(id)', 'relative/bin', '/x`id`', '/a:/b']) {
+      expect(() => hostOverrideFromMeta({ 'x-tmux-host-override': { pathAdd: [entry] } }, profiles, false)).toThrow(
+        'absolute paths without shell metacharacters',
+      );
+    }
+  });
+
+  it('only accepts tmux binaries a profile declares', () => {
+    expect(() =>
+      hostOverrideFromMeta({ 'x-tmux-host-override': { tmuxBin: '/tmp/evil' } }, profiles, false),
+    ).toThrow('tmuxBin');
+  });
+
+  it('refuses overrides on a read-only server', () => {
+    expect(() => hostOverrideFromMeta({ 'x-tmux-ignore-profile': true }, profiles, true)).toThrow('read-only');
+    expect(() =>
+      hostOverrideFromMeta({ 'x-tmux-host-override': { tmuxBin: '/opt/tmux/bin/tmux' } }, profiles, true),
+    ).toThrow('read-only');
+    expect(hostOverrideFromMeta({}, profiles, true)).toBeUndefined();
+  });
+});
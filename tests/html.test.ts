@@ -0,0 +1,23 @@
+import { describe, expect, it } from 'vitest';
+import { ansiToHtml } from '../src/index.js';
+
+describe('ansiToHtml', () => {
+  it('converts a coloured line to styled spans', () => {
+    const line = '\x1b[1;31mERROR\x1b[0m: disk \x1b[38;5;46mok\x1b[39m <tmp>';
+    expect(ansiToHtml(line)).toBe(
+      '<pre class="tmux-pane"><span style="color:#cd0000;font-weight:bold">ERROR</span>: disk ' +
+        '<span style="color:#00ff00">ok</span> &lt;tmp&gt;</pre>',
+    );
+  });
+
+  it('handles truecolor backgrounds and inverse', () => {
+    expect(ansiToHtml('\x1b[48;2;16;32;48mx\x1b[7my')).toBe(
+      '<pre class="tmux-pane"><span style="background-color:#102030">x</span>' +
+        '<span style="color:#102030;background-color:#000000">y</span></pre>',
+    );
+  });
+
+  it('drops non-SGR escape sequences', () => {
+    expect(ansiToHtml('a\x1b[2Kb\x1b]8;;http://x\x07c')).toBe('<pre class="tmux-pane">abc</pre>');
+  });
+});
@@ -0,0 +1,89 @@
+import { describe, expect, it } from 'vitest';
+import { buildClearLineArgs, buildResetPaneCommands, exitPager, isPagerCommand, isTmuxKeyName } from '../src/index.js';
+
+describe('buildResetPaneCommands', () => {
+  it('cancels copy-mode only when the pane is in a mode', () => {
+    expect(buildResetPaneCommands('%1', true)[0]).toEqual(['send-keys', '-t', '%1', '-X', 'cancel']);
+    expect(buildResetPaneCommands('%1', false)).toEqual([
+      ['send-keys', '-t', '%1', 'q'],
+      ['send-keys', '-t', '%1', 'C-c'],
+    ]);
+  });
+
+  it('clears history last when requested', () => {
+    const commands = buildResetPaneCommands('%1', false, true);
+    expect(commands[commands.length - 1]).toEqual(['clear-history', '-t', '%1']);
+  });
+});
+
+describe('exitPager', () => {
+  const noSleep = async () => {};
+
+  it('sends q first when the pane is in a pager', async () => {
+    const events: string[] = [];
+    const commands = ['less', 'bash'];
+    const result = await exitPager({
+      command: async () => {
+        events.push('check');
+        return commands.shift() ?? 'bash';
+      },
+      quit: async () => {
+        events.push('q');
+      },
+      sleep: noSleep,
+    });
+    expect(events).toEqual(['check', 'q', 'check']);
+    expect(result).toEqual({ pager: 'less', exited: true });
+  });
+
+  it('leaves a shell alone', async () => {
+    let quits = 0;
+    const result = await exitPager({ command: async () => 'zsh', quit: async () => void quits++, sleep: noSleep });
+    expect(quits).toBe(0);
+    expect(result).toEqual({ pager: undefined, exited: false });
+  });
+
+  it('gives up after the allowed attempts', async () => {
+    let quits = 0;
+    const result = await exitPager(
+      { command: async () => 'man', quit: async () => void quits++, sleep: noSleep },
+      { attempts: 2 },
+    );
+    expect(quits).toBe(2);
+    expect(result).toEqual({ pager: 'man', exited: false });
+  });
+
+  it('recognises the common pagers', () => {
+    expect(['less', 'more', 'man'].every(isPagerCommand)).toBe(true);
+    expect(isPagerCommand('vim')).toBe(false);
+  });
+});
+
+describe('buildClearLineArgs', () => {
+  it('jumps to the end of the line, then kills to its start', () => {
+    expect(buildClearLineArgs('%3')).toEqual(['send-keys', '-t', '%3', 'C-e', 'C-u']);
+  });
+
+  it('sends a configured sequence', () => {
+    expect(buildClearLineArgs('%3', ['C-e', 'C-u', 'C-k'])).toEqual(['send-keys', '-t', '%3', 'C-e', 'C-u', 'C-k']);
+  });
+
+  it('rejects an empty sequence', () => {
+    expect(() => buildClearLineArgs('%3', [])).toThrow(/at least one key/);
+  });
+
+  it('rejects entries that are not tmux key names', () => {
+    expect(() => buildClearLineArgs('%3', ['C-u', 'rm -rf ~'])).toThrow('["rm -rf ~"]');
+  });
+});
+
+describe('isTmuxKeyName', () => {
+  it('accepts modified, named, function, and single-character keys', () => {
+    const keys = ['C-u', 'M-b', 'C-M-x', 'c-k', '^U', 'Escape', 'bspace', 'S-Up', 'F12', 'KP5', 'q', '-'];
+    expect(keys.every(isTmuxKeyName)).toBe(true);
+  });
+
+  it('rejects text and unknown names', () => {
+    expect(['', ' ', 'ls', 'C-', 'Ctrl-u', 'F13', 'C-ab'].some(isTmuxKeyName)).toBe(false);
+  });
+});
@@ -0,0 +1,141 @@
+import { describe, expect, it, vi } from 'vitest';
+import { applyLayouts, buildLayout, layoutChecksum, parseLayout, planLayouts, validateLayoutString } from '../src/index.js';
+
+const good = 'e0bb,204x50,0,0{102x50,0,0,0,101x50,103,0,1}';
+
+describe('validateLayoutString', () => {
+  it('accepts a captured layout', () => {
+    expect(validateLayoutString(good)).toBeUndefined();
+  });
+
+  it('rejects malformed layouts', () => {
+    expect(validateLayoutString('tiled')).toContain('checksum');
+    expect(validateLayoutString('b25d,204x50,0,0{102x50,0,0,0,101x50,103,0,1}')).toContain('checksum mismatch');
+    expect(validateLayoutString(`${layoutChecksum('204x50,0,0{102x50,0,0,0')},204x50,0,0{102x50,0,0,0`)).toContain(
+      'invalid layout',
+    );
+  });
+});
+
+describe('applyLayouts', () => {
+  it('reports invalid layouts instead of skipping them', async () => {
+    const apply = vi.fn(async () => {});
+    const results = await applyLayouts(
+      [
+        { target: 's:0', layout: good },
+        { target: 's:1', layout: 'nope' },
+      ],
+      {},
+      apply,
+    );
+    expect(apply).toHaveBeenCalledTimes(1);
+    expect(results[0]).toEqual({ target: 's:0', status: 'applied' });
+    expect(results[1]).toMatchObject({ target: 's:1', status: 'invalid' });
+  });
+
+  it('applies nothing in atomic mode when a layout is invalid', async () => {
+    const apply = vi.fn(async () => {});
+    const results = await applyLayouts(
+      [
+        { target: 's:0', layout: good },
+        { target: 's:1', layout: 'nope' },
+      ],
+      { atomic: true },
+      apply,
+    );
+    expect(apply).toHaveBeenCalledTimes(0);
+    expect(results.map((r) => r.status)).toEqual(['skipped', 'invalid']);
+  });
+
+  it('stops at the first apply failure in atomic mode', async () => {
+    const apply = vi.fn(async (target: string) => {
+      if (target === 's:0') throw new Error('select-layout failed');
+    });
+    const results = await applyLayouts(
+      [
+        { target: 's:0', layout: good },
+        { target: 's:1', layout: good },
+      ],
+      { atomic: true },
+      apply,
+    );
+    expect(results.map((r) => r.status)).toEqual(['failed', 'skipped']);
+    expect(results[0].error).toBe('select-layout failed');
+  });
+});
+
+describe('parseLayout / buildLayout', () => {
+  // Captured from tmux 3.3a: a left pane plus a right column split top/bottom, and a plain top/bottom window.
+  const nested = '21be,200x50,0,0{100x50,0,0,0,99x50,101,0[99x25,101,0,1,99x24,101,26,2]}';
+  const stacked = '655b,200x50,0,0[200x25,0,0,3,200x24,0,26,4]';
+
+  it('decomposes a layout into a typed tree', () => {
+    expect(parseLayout(nested)).toEqual({
+      checksum: '21be',
+      root: {
+        width: 200,
+        height: 50,
+        x: 0,
+        y: 0,
+        split: 'left-right',
+        children: [
+          { width: 100, height: 50, x: 0, y: 0, paneId: 0 },
+          {
+            width: 99,
+            height: 50,
+            x: 101,
+            y: 0,
+            split: 'top-bottom',
+            children: [
+              { width: 99, height: 25, x: 101, y: 0, paneId: 1 },
+              { width: 99, height: 24, x: 101, y: 26, paneId: 2 },
+            ],
+          },
+        ],
+      },
+    });
+  });
+
+  it('round-trips real layout strings', () => {
+    for (const layout of [nested, stacked]) {
+      expect(buildLayout(parseLayout(layout).root)).toBe(layout);
+    }
+  });
+
+  it('computes tmux checksums for constructed layouts', () => {
+    const layout = buildLayout({ width: 80, height: 24, x: 0, y: 0, paneId: 7 });
+    expect(layout).toBe(`${layoutChecksum('80x24,0,0,7')},80x24,0,0,7`);
+    expect(parseLayout(layout).root.paneId).toBe(7);
+  });
+
+  it('rejects bad checksums and malformed bodies', () => {
+    expect(() => parseLayout('0000,200x50,0,0[200x25,0,0,3,200x24,0,26,4]')).toThrow('checksum mismatch');
+    const body = '200x50,0,0[200x25,0,0,3';
+    expect(() => parseLayout(`${layoutChecksum(body)},${body}`)).toThrow('invalid layout');
+    expect(() => buildLayout({ width: 1, height: 1, x: 0, y: 0 })).toThrow('paneId or children');
+  });
+});
+
+describe('planLayouts', () => {
+  it('diffs requested layouts against the current ones without applying', async () => {
+    const current: Record<string, string> = { 's:0': good, 's:1': 'a1b2,204x50,0,0,3' };
+    const read = vi.fn(async (target: string) => {
+      if (!(target in current)) throw new Error(`can't find window: ${target}`);
+      return current[target];
+    });
+    const plan = await planLayouts(
+      [
+        { target: 's:0', layout: good },
+        { target: 's:1', layout: good },
+        { target: 's:2', layout: 'tiled' },
+        { target: 's:9', layout: good },
+      ],
+      undefined,
+      read,
+    );
+    expect(plan.map((r) => r.status)).toEqual(['no-op', 'will-change', 'invalid', 'failed']);
+    expect(plan[1].current).toBe('a1b2,204x50,0,0,3');
+    expect(plan[3].error).toContain("can't find window");
+    expect(read).toHaveBeenCalledTimes(3);
+  });
+});
@@ -0,0 +1,108 @@
+import { describe, expect, it } from 'vitest';
+import { createKeyedLimiter, createPaneWriteQueue } from '../src/index.js';
+
+const tick = () => new Promise((r) => setTimeout(r, 5));
+
+describe('createKeyedLimiter', () => {
+  it('caps concurrent calls per key while other keys proceed', async () => {
+    const run = createKeyedLimiter(2);
+    const inFlight: Record<string, number> = {};
+    const peak: Record<string, number> = {};
+    const job = (key: string) =>
+      run(key, async () => {
+        inFlight[key] = (inFlight[key] ?? 0) + 1;
+        peak[key] = Math.max(peak[key] ?? 0, inFlight[key]);
+        await tick();
+        inFlight[key]--;
+        return key;
+      });
+    const results = await Promise.all([
+      ...Array.from({ length: 6 }, () => job('web-1')),
+      ...Array.from({ length: 3 }, () => job('web-2')),
+    ]);
+    expect(results).toHaveLength(9);
+    expect(peak['web-1']).toBe(2);
+    expect(peak['web-2']).toBe(2);
+  });
+
+  it('runs queued calls in order and survives failures', async () => {
+    const run = createKeyedLimiter(1);
+    const order: number[] = [];
+    const failing = run('h', async () => {
+      await tick();
+      throw new Error('boom');
+    });
+    const rest = [1, 2, 3].map((n) =>
+      run('h', async () => {
+        order.push(n);
+      }),
+    );
+    await expect(failing).rejects.toThrow('boom');
+    await Promise.all(rest);
+    expect(order).toEqual([1, 2, 3]);
+  });
+
+  it('does not limit when the limit is 0', async () => {
+    const run = createKeyedLimiter(0);
+    let inFlight = 0;
+    let peak = 0;
+    await Promise.all(
+      Array.from({ length: 5 }, () =>
+        run('h', async () => {
+          peak = Math.max(peak, ++inFlight);
+          await tick();
+          inFlight--;
+        }),
+      ),
+    );
+    expect(peak).toBe(5);
+  });
+});
+
+describe('createPaneWriteQueue', () => {
+  it('keeps concurrent multi-key writes to one pane from interleaving', async () => {
+    const queue = createPaneWriteQueue();
+    const calls: string[] = [];
+    const write = (target: string, agent: string) =>
+      queue(target, 'web-1', async () => {
+        for (const key of ['C-u', `${agent}-cmd`, 'Enter']) {
+          calls.push(`${target} ${agent} ${key}`);
+          await tick();
+        }
+      });
+    await Promise.all([write('%1', 'a'), write('%1', 'b'), write('%2', 'c')]);
+    const pane1 = calls.filter((c) => c.startsWith('%1'));
+    expect(pane1).toEqual([
+      '%1 a C-u',
+      '%1 a a-cmd',
+      '%1 a Enter',
+      '%1 b C-u',
+      '%1 b b-cmd',
+      '%1 b Enter',
+    ]);
+    // The other pane was not held up behind pane %1.
+    expect(calls.indexOf('%2 c C-u')).toBeLessThan(calls.indexOf('%1 b C-u'));
+  });
+
+  it('queues a pane id and a session:window.pane naming the same pane together', async () => {
+    const resolved: string[] = [];
+    const queue = createPaneWriteQueue(async (target) => {
+      resolved.push(target);
+      return target === 'dev:0.1' ? '%3\n' : '';
+    });
+    let active = 0;
+    let overlapped = false;
+    const write = (target: string) =>
+      queue(target, undefined, async () => {
+        active++;
+        if (active > 1) overlapped = true;
+        await tick();
+        await tick();
+        active--;
+      });
+    await Promise.all([write('%3'), write('dev:0.1'), write('%3'), write('dev:0.1')]);
+    expect(overlapped).toBe(false);
+    // Pane ids are used as-is; only the other form is looked up.
+    expect(resolved).toEqual(['dev:0.1', 'dev:0.1']);
+  });
+});
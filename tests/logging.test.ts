@@ -0,0 +1,133 @@
+import fs from 'node:fs/promises';
+import os from 'node:os';
+import path from 'node:path';
+import { describe, expect, it } from 'vitest';
+import {
+  appendWithRotation,
+  formatAuditLine,
+  instrumentTool,
+  parseAuditSampling,
+  parseRedactPatterns,
+  redactSecrets,
+  redactValue,
+  requestIdFromMeta,
+  shouldAuditEvent,
+} from '../src/index.js';
+
+describe('appendWithRotation', () => {
+  it('rotates once the file would exceed the limit', async () => {
+    const dir = await fs.mkdtemp(path.join(os.tmpdir(), 'mcp-tmux-log-'));
+    const file = path.join(dir, 'audit.log');
+    await appendWithRotation(file, 'a'.repeat(8) + '\n', 16, 2);
+    await appendWithRotation(file, 'b'.repeat(8) + '\n', 16, 2);
+    await appendWithRotation(file, 'c'.repeat(8) + '\n', 16, 2);
+
+    expect(await fs.readFile(file, 'utf8')).toBe('cccccccc\n');
+    expect(await fs.readFile(`${file}.1`, 'utf8')).toBe('bbbbbbbb\n');
+    expect(await fs.readFile(`${file}.2`, 'utf8')).toBe('aaaaaaaa\n');
+  });
+
+  it('drops the oldest file beyond the keep count', async () => {
+    const dir = await fs.mkdtemp(path.join(os.tmpdir(), 'mcp-tmux-log-'));
+    const file = path.join(dir, 'audit.log');
+    for (const ch of ['a', 'b', 'c']) {
+      await appendWithRotation(file, ch.repeat(10) + '\n', 16, 1);
+    }
+    expect(await fs.readFile(`${file}.1`, 'utf8')).toBe('bbbbbbbbbb\n');
+    await expect(fs.stat(`${file}.2`)).rejects.toThrow();
+  });
+
+  it('keeps every line when appends race a rotation', async () => {
+    const dir = await fs.mkdtemp(path.join(os.tmpdir(), 'mcp-tmux-log-'));
+    const file = path.join(dir, 'audit.log');
+    const lines = ['a', 'b', 'c', 'd', 'e', 'f'].map((ch) => ch.repeat(8) + '\n');
+    await Promise.all(lines.map((line) => appendWithRotation(file, line, 16, 10)));
+    const files = [file, ...[1, 2, 3, 4, 5].map((i) => `${file}.${i}`)];
+    const contents = await Promise.all(files.map((f) => fs.readFile(f, 'utf8')));
+    expect(contents.reverse().join('')).toBe(lines.join(''));
+  });
+});
+
+describe('audit sampling', () => {
+  it('parses rates for read events only', () => {
+    expect(parseAuditSampling('capture_pane=100, context_history=0,send_keys=5,bogus')).toEqual({
+      capture_pane: 100,
+      context_history: 0,
+    });
+  });
+
+  it('suppresses sampled-out events but always logs errors', () => {
+    const rates = { capture_pane: 0 };
+    expect(shouldAuditEvent('capture_pane', rates, {})).toBe(false);
+    expect(shouldAuditEvent('capture_pane.error', rates, {})).toBe(true);
+    expect(shouldAuditEvent('send_keys', rates, {})).toBe(true);
+  });
+
+  it('logs one in N occurrences', () => {
+    const counters = {};
+    const logged = [1, 2, 3, 4, 5].map(() => shouldAuditEvent('capture_pane', { capture_pane: 2 }, counters));
+    expect(logged).toEqual([true, false, true, false, true]);
+  });
+});
+
+describe('redaction', () => {
+  it('masks secrets in plain log text', () => {
+    const text = redactSecrets('send-keys "GITHUB_TOKEN=ghp_abc123 deploy --password hunter2 --user bob"');
+    expect(text).toBe('send-keys "GITHUB_TOKEN=*** deploy --password *** --user bob"');
+  });
+
+  it('masks long token-like strings', () => {
+    expect(redactSecrets('curl -H X:dGhpcy1pcy1hLXZlcnktbG9uZy1zZWNyZXQtdG9rZW4=')).toBe('curl -H X:***');
+  });
+
+  it('keeps git SHAs and UUIDs readable', () => {
+    const text = [
+      'commit 34f57e9c1d2b3a4f5e6d7c8b9a0f1e2d3c4b5a69',
+      'digest 9b2f4e1c3a5d7f9e0b2c4d6f8a1b3c5e7d9f0a2b4c6e8f1a3b5c7d9e0f2a4b6c',
+      'container 123e4567-e89b-12d3-a456-426614174000',
+    ].join('\n');
+    expect(redactSecrets(text)).toBe(text);
+    expect(redactSecrets('key 34f57e9c1d2b3a4f5e6d7c8b9a0f1e2d3c4b5a69ffff')).toBe('key ***');
+  });
+
+  it('keeps long paths and words readable', () => {
+    const text = 'cd /usr/local/lib/node_modules/some-extremely-long-package-name-here';
+    expect(redactSecrets(text)).toBe(text);
+  });
+
+  it('masks strings inside JSON metadata without breaking its shape', () => {
+    const meta = { keys: 'mysql -u root --password=s3cret', args: ['AWS_SECRET=xyz'], enter: true };
+    expect(JSON.parse(JSON.stringify(redactValue(meta)))).toEqual({
+      keys: 'mysql -u root --password=***',
+      args: ['AWS_SECRET=***'],
+      enter: true,
+    });
+  });
+
+  it('applies extra configured patterns', () => {
+    const patterns = parseRedactPatterns('["corp-[0-9]+"]');
+    expect(redactSecrets('id corp-1234', patterns)).toBe('id ***');
+  });
+});
+
+describe('request ids', () => {
+  it('tags audit lines with the client-supplied x-request-id', async () => {
+    const handler = instrumentTool('tmux_send_keys', async () => formatAuditLine('send_keys', { keys: 'ls' }, 'T'));
+    const line = await handler({ keys: 'ls' }, { _meta: { 'x-request-id': 'agent-42' } });
+    expect(line).toBe('[T] send_keys req=agent-42 {"keys":"ls"}\n');
+  });
+
+  it('generates a request id when the client sends none', async () => {
+    const line = (await instrumentTool('tmux_health', async () => formatAuditLine('health', undefined, 'T'))({})) as string;
+    expect(line).toMatch(/^\[T\] health req=[0-9a-f]{16}\n$/);
+  });
+
+  it('omits the id outside a tool call', () => {
+    expect(formatAuditLine('startup', undefined, 'T')).toBe('[T] startup\n');
+  });
+
+  it('ignores blank ids', () => {
+    expect(requestIdFromMeta({ 'x-request-id': '  ' })).toMatch(/^[0-9a-f]{16}$/);
+    expect(requestIdFromMeta({ 'x-request-id': ' abc ' })).toBe('abc');
+  });
+});
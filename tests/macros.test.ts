@@ -0,0 +1,102 @@
+import { describe, expect, it } from 'vitest';
+import { compileMacroSteps, parseMacroFile, runMacro } from '../src/index.js';
+
+// A fake pane backing the macro runner: every send echoes the keys followed by the scripted response.
+function fakeRepl(responses: Record<string, string>) {
+  let screen = '>>> ';
+  const calls: string[] = [];
+  return {
+    calls,
+    io: {
+      send: async (keys: string, enter: boolean) => {
+        calls.push(`send ${keys}${enter ? ' <Enter>' : ''}`);
+        screen += `${keys}\n${responses[keys] ?? ''}>>> `;
+      },
+      capture: async () => screen,
+      sleep: async (ms: number) => {
+        calls.push(`sleep ${ms}`);
+      },
+    },
+  };
+}
+
+describe('runMacro', () => {
+  it('runs send, wait, sleep, and capture steps through the runner', async () => {
+    const repl = fakeRepl({ '1 + 1': '2\n', 'print("ok")': 'ok\n' });
+    const results = await runMacro(
+      [
+        { action: 'send', keys: '1 + 1' },
+        { action: 'wait', pattern: '^2$', flags: 'm' },
+        { action: 'sleep', ms: 50 },
+        { action: 'send', keys: 'print("ok")' },
+        { action: 'capture' },
+      ],
+      repl.io,
+      { intervalMs: 1 },
+    );
+    expect(results.map((r) => `${r.action}:${r.status}`)).toEqual([
+      'send:ok',
+      'wait:ok',
+      'sleep:ok',
+      'send:ok',
+      'capture:ok',
+    ]);
+    expect(repl.calls).toEqual(['send 1 + 1 <Enter>', 'sleep 50', 'send print("ok") <Enter>']);
+    expect(results[4].output).toBe('>>> 1 + 1\n2\n>>> print("ok")\nok\n>>> ');
+  });
+
+  it('only matches output produced after the preceding send', async () => {
+    const repl = fakeRepl({ a: 'done\n', b: '' });
+    const results = await runMacro(
+      [
+        { action: 'send', keys: 'a' },
+        { action: 'send', keys: 'b' },
+        { action: 'wait', pattern: 'done', timeoutMs: 5 },
+        { action: 'capture' },
+      ],
+      repl.io,
+      { intervalMs: 1 },
+    );
+    expect(results.map((r) => r.status)).toEqual(['ok', 'ok', 'timeout', 'skipped']);
+  });
+
+  it('rejects malformed steps before sending anything', async () => {
+    expect(() => compileMacroSteps([{ action: 'wait' }])).toThrow('pattern is required');
+    expect(() => compileMacroSteps([{ action: 'wait', pattern: '(' }])).toThrow('invalid pattern');
+    const repl = fakeRepl({});
+    await expect(runMacro([{ action: 'send', keys: 'x' }, { action: 'sleep' }], repl.io)).rejects.toThrow(
+      'ms is required',
+    );
+    expect(repl.calls).toEqual([]);
+  });
+});
+
+describe('parseMacroFile', () => {
+  it('keeps names that collide with Object.prototype as plain entries', () => {
+    const steps = [{ action: 'sleep', ms: 1 }];
+    const raw = JSON.stringify(steps);
+    const { macros } = parseMacroFile(`{"__proto__": {"steps": ${raw}}, "constructor": {"steps": ${raw}}}`);
+    expect(macros.get('toString')).toBeUndefined();
+    expect(macros.has('valueOf')).toBe(false);
+    expect(macros.get('constructor')?.steps).toEqual(steps);
+    expect(macros.get('__proto__')?.steps).toEqual(steps);
+    expect(({} as { steps?: unknown }).steps).toBeUndefined();
+  });
+
+  it('skips and reports malformed entries', () => {
+    const { macros, problems } = parseMacroFile(
+      JSON.stringify({
+        ok: { steps: [{ action: 'send', keys: 'ls' }] },
+        typo: { steps: [{ action: 'type', keys: 'ls' }] },
+        noPattern: { steps: [{ action: 'wait' }] },
+        empty: { steps: [] },
+      }),
+    );
+    expect([...macros.keys()]).toEqual(['ok']);
+    expect(problems).toHaveLength(3);
+    expect(problems[0]).toMatch(/^typo: steps\.0\.action:/);
+    expect(problems[1]).toContain('noPattern: ');
+    expect(problems[1]).toContain('pattern is required');
+    expect(problems[2]).toMatch(/^empty: steps:/);
+  });
+});
@@ -0,0 +1,143 @@
+import { describe, expect, it } from 'vitest';
+import {
+  buildPromptSentinelCommand,
+  configurePromptSentinel,
+  isPosixShell,
+  paneSentinel,
+  parsePromptPattern,
+  promptSentinelPattern,
+  segmentByPrompt,
+} from '../src/index.js';
+import { recordingRun } from './fakes.js';
+
+describe('segmentByPrompt', () => {
+  it('splits a transcript of two commands', () => {
+    const transcript = [
+      'dev@web-1:~/app$ ls',
+      'README.md  src',
+      'dev@web-1:~/app$ git status',
+      'On branch main',
+      'nothing to commit',
+      'dev@web-1:~/app$',
+    ].join('\n');
+    expect(segmentByPrompt(transcript)).toEqual([
+      { prompt: 'dev@web-1:~/app$', command: 'ls', output: 'README.md  src' },
+      { prompt: 'dev@web-1:~/app$', command: 'git status', output: 'On branch main\nnothing to commit' },
+      { prompt: 'dev@web-1:~/app$', command: '', output: '' },
+    ]);
+  });
+
+  it('joins PS2 continuation lines into multi-line commands', () => {
+    const transcript = ['~/app $ cat <<EOF', '> hello', '> EOF', 'hello', '~/app $ echo "a', '> b"', 'a', 'b'].join(
+      '\n',
+    );
+    expect(segmentByPrompt(transcript)).toEqual([
+      { prompt: '~/app $', command: 'cat <<EOF\nhello\nEOF', output: 'hello' },
+      { prompt: '~/app $', command: 'echo "a\nb"', output: 'a\nb' },
+    ]);
+  });
+
+  it('does not split on output lines that start with # or $', () => {
+    const transcript = ['dev@web-1:~/app$ cat NOTES.md', '# Heading', '$ not a prompt', 'text', '$'].join('\n');
+    expect(segmentByPrompt(transcript)).toEqual([
+      { prompt: 'dev@web-1:~/app$', command: 'cat NOTES.md', output: '# Heading\n$ not a prompt\ntext' },
+      { prompt: '$', command: '', output: '' },
+    ]);
+  });
+
+  it('keeps output before the first prompt and handles zsh/venv prompts', () => {
+    const transcript = ['...scrolled output', '(venv) dev@mac ~/app % pytest -q', '3 passed'].join('\n');
+    expect(segmentByPrompt(transcript)).toEqual([
+      { prompt: '', command: '', output: '...scrolled output' },
+      { prompt: '(venv) dev@mac ~/app %', command: 'pytest -q', output: '3 passed' },
+    ]);
+  });
+
+  it('returns a single prompt-less segment when no prompt is found', () => {
+    expect(segmentByPrompt('just\noutput')).toEqual([{ prompt: '', command: '', output: 'just\noutput' }]);
+  });
+
+  it('accepts a custom prompt pattern', () => {
+    const pattern = parsePromptPattern('^(\\[\\w+\\]>) (.*)$');
+    expect(segmentByPrompt('[db]> select 1;\n1', pattern)).toEqual([
+      { prompt: '[db]>', command: 'select 1;', output: '1' },
+    ]);
+  });
+});
+
+describe('prompt sentinel', () => {
+  it('appends the sentinel to PS1 without history or subscript surprises', () => {
+    expect(buildPromptSentinelCommand('[mcp-ready]')).toBe(` PS1="\${PS1}"'[mcp-ready] '`);
+    expect(() => buildPromptSentinelCommand("x'; rm -rf ~")).toThrow('sentinel must be');
+  });
+
+  it('matches only an idle prompt ending with the sentinel', () => {
+    const pattern = promptSentinelPattern('[mcp-ready]');
+    expect(pattern.test('output\ndev@web:~$ [mcp-ready]')).toBe(true);
+    expect(pattern.test('dev@web:~$ [mcp-ready] sleep 10')).toBe(false);
+    expect(pattern.test('dev@web:~$ mcp-ready')).toBe(false);
+  });
+
+  const fakePane = (option = '', shell = 'bash') => {
+    const { calls, run } = recordingRun((args) =>
+      args[0] === 'show-options' ? option : args[0] === 'display-message' ? shell : '',
+    );
+    let screen = 'dev@web:~$';
+    return {
+      calls,
+      io: {
+        run,
+        send: async (keys: string) => {
+          screen += `${keys}\ndev@web:~$ [mcp-ready]`;
+        },
+        capture: async () => screen,
+      },
+    };
+  };
+
+  it('injects once, waits for the new prompt, and records the sentinel on the pane', async () => {
+    const { calls, io } = fakePane();
+    const result = await configurePromptSentinel('%1', '[mcp-ready]', { intervalMs: 1 }, io);
+    expect(result).toMatchObject({ injected: true, ready: true });
+    expect(calls).toEqual([
+      ['show-options', '-pqv', '-t', '%1', '@mcp_prompt_sentinel'],
+      ['display-message', '-p', '-t', '%1', '#{pane_current_command}'],
+      ['set-option', '-p', '-t', '%1', '@mcp_prompt_sentinel', '[mcp-ready]'],
+    ]);
+  });
+
+  it('skips panes that already have the sentinel', async () => {
+    const { calls, io } = fakePane('[mcp-ready]\n');
+    expect(await configurePromptSentinel('%1', '[mcp-ready]', {}, io)).toEqual({
+      injected: false,
+      ready: true,
+      elapsedMs: 0,
+    });
+    expect(calls).toHaveLength(1);
+    expect(await paneSentinel('%1', io.run)).toBe('[mcp-ready]');
+  });
+
+  it('reports a shell that ignores PS1 and requires setup before waiting', async () => {
+    const { calls, io } = fakePane();
+    io.send = async () => undefined;
+    const result = await configurePromptSentinel('%1', '[mcp-ready]', { timeoutMs: 20, intervalMs: 5 }, io);
+    expect(result.ready).toBe(false);
+    expect(calls.map((c) => c[0])).toEqual(['show-options', 'display-message']);
+    await expect(paneSentinel('%1', io.run)).rejects.toThrow('run tmux_set_prompt_sentinel first');
+  });
+
+  it('refuses to type a PS1 assignment into a non-POSIX shell', async () => {
+    const { io } = fakePane('', 'fish');
+    let sent = false;
+    io.send = async () => {
+      sent = true;
+    };
+    await expect(configurePromptSentinel('%1', '[mcp-ready]', {}, io)).rejects.toThrow('not a POSIX shell');
+    expect(sent).toBe(false);
+  });
+
+  it('accepts login shells reported with a leading dash', () => {
+    expect(['-bash', '-zsh', 'sh\n'].every(isPosixShell)).toBe(true);
+    expect(['-fish', 'fish'].some(isPosixShell)).toBe(false);
+  });
+});
@@ -0,0 +1,75 @@
+import { describe, expect, it } from 'vitest';
+import { newOutputSince, runKeySequence } from '../src/index.js';
+
+// A fake pane that answers each line sent with the scripted response.
+function fakeInstaller(responses: Record<string, string>, prompt = 'Name? ') {
+  let screen = `$ ./install.sh\n${prompt}`;
+  const sent: string[] = [];
+  return {
+    sent,
+    io: {
+      send: async (keys: string) => {
+        sent.push(keys);
+        screen += `${keys}\n${responses[keys] ?? ''}`;
+      },
+      capture: async () => screen,
+    },
+  };
+}
+
+describe('runKeySequence', () => {
+  it('drives a multi-step prompt flow', async () => {
+    const pane = fakeInstaller({ bob: 'Hello bob\nProceed? [y/n] ', y: 'Installed.\n$ ' });
+    const results = await runKeySequence(
+      [
+        { keys: 'bob', waitFor: 'Proceed\\?' },
+        { keys: 'y', waitFor: '^Installed', flags: 'm' },
+      ],
+      pane.io,
+      { intervalMs: 1 },
+    );
+    expect(pane.sent).toEqual(['bob', 'y']);
+    expect(results.map((r) => r.status)).toEqual(['ok', 'ok']);
+    expect(results[0].detail).toBe('matched "Proceed?"');
+  });
+
+  it('does not match output that was already on screen', async () => {
+    const pane = fakeInstaller({ bob: 'still thinking\n' }, 'Proceed? ');
+    const results = await runKeySequence(
+      [{ keys: 'bob', waitFor: 'Proceed', timeoutMs: 5 }, { keys: 'y' }],
+      pane.io,
+      { intervalMs: 1 },
+    );
+    expect(results.map((r) => r.status)).toEqual(['timeout', 'skipped']);
+    expect(pane.sent).toEqual(['bob']);
+  });
+
+  it('reports send failures and stops', async () => {
+    const results = await runKeySequence([{ keys: 'a' }, { keys: 'b' }], {
+      send: async () => {
+        throw new Error("can't find pane");
+      },
+      capture: async () => '',
+    });
+    expect(results).toMatchObject([
+      { step: 1, status: 'failed', detail: "can't find pane" },
+      { step: 2, status: 'skipped' },
+    ]);
+  });
+
+  it('rejects invalid regexes before sending anything', async () => {
+    const pane = fakeInstaller({});
+    await expect(runKeySequence([{ keys: 'x', waitFor: '(' }], pane.io)).rejects.toThrow('step 1: invalid waitFor regex');
+    expect(pane.sent).toEqual([]);
+  });
+});
+
+describe('newOutputSince', () => {
+  it('keeps input typed on the cursor line but drops the prompt', () => {
+    expect(newOutputSince('a\nName? ', 'a\nName? bob\nHello')).toBe('bob\nHello');
+  });
+
+  it('returns everything when the screen was cleared', () => {
+    expect(newOutputSince('old\n$ ', 'fresh\n$ ')).toBe('fresh\n$ ');
+  });
+});
@@ -0,0 +1,156 @@
+import { describe, expect, it, vi } from 'vitest';
+import {
+  assertToolAllowed,
+  createSocketRouter,
+  createStats,
+  describeServer,
+  instrumentTool,
+  ping,
+  serverStats,
+  unsafeTmuxArg,
+} from '../src/index.js';
+
+describe('describeServer', () => {
+  it('aggregates package meta, tmux versions, defaults, and features', async () => {
+    const desc = await describeServer(async () => 'tmux 3.4\n');
+    expect(desc.package).toBe('@k8ika0s/mcp-tmux');
+    expect(desc.version).toMatch(/^\d+\.\d+\.\d+/);
+    expect(desc.auth).toBe('none (stdio)');
+    expect(desc.hosts).toEqual([{ host: 'local', profile: false, tmuxVersion: 'tmux 3.4' }]);
+    expect(Object.keys(desc.defaults)).toEqual(['host', 'session', 'window', 'pane']);
+    expect(desc.features.tracing).toBe(false);
+    expect(desc.features.lockDefault).toBe(false);
+    expect(desc.features.readOnly).toBe(false);
+  });
+
+  it('reports unreachable hosts without failing', async () => {
+    const desc = await describeServer(async () => {
+      throw new Error('tmux: not found');
+    });
+    expect(desc.hosts[0]).toEqual({ host: 'local', profile: false, error: 'tmux: not found' });
+  });
+});
+
+describe('ping', () => {
+  it('times a local tmux round trip', async () => {
+    const probe = vi.fn(async () => 'pong');
+    const result = await ping(undefined, true, probe);
+    expect(probe).toHaveBeenCalledWith(undefined);
+    expect(result.host).toBe('local');
+    expect(result.reply).toBe('pong');
+    expect(result.tmuxRoundTripMs).toBeGreaterThanOrEqual(0);
+    expect(Number.isNaN(Date.parse(result.serverTime))).toBe(false);
+  });
+
+  it('probes the requested host', async () => {
+    const probe = vi.fn(async () => 'pong');
+    const result = await ping('web-1', true, probe);
+    expect(probe).toHaveBeenCalledWith('web-1');
+    expect(result.host).toBe('web-1');
+  });
+
+  it('skips tmux when asked', async () => {
+    const probe = vi.fn(async () => 'pong');
+    const result = await ping('web-1', false, probe);
+    expect(probe).not.toHaveBeenCalled();
+    expect(result.tmuxRoundTripMs).toBeUndefined();
+  });
+});
+
+describe('read-only mode', () => {
+  it('blocks mutating tools', () => {
+    for (const name of ['tmux_send_keys', 'tmux_run_batch', 'tmux_new_session', 'tmux_kill_pane', 'tmux_set_default']) {
+      expect(() => assertToolAllowed(name, {}, true)).toThrow(/read-only/);
+    }
+    expect(() => assertToolAllowed('tmux_restore_layout', { target: 'dev:1' }, true)).toThrow(/read-only/);
+  });
+
+  it('lets reads through', () => {
+    for (const name of ['tmux_capture_pane', 'tmux_list_panes', 'tmux_state', 'tmux_get_default', 'tmux_health']) {
+      expect(() => assertToolAllowed(name, {}, true)).not.toThrow();
+    }
+    expect(() => assertToolAllowed('tmux_build_layout', { root: {} }, true)).not.toThrow();
+    expect(() => assertToolAllowed('tmux_build_layout', { root: {}, target: 'dev:1' }, true)).toThrow(/read-only/);
+    expect(() => assertToolAllowed('tmux_history_limit', { minLines: 5000 }, true)).not.toThrow();
+    expect(() => assertToolAllowed('tmux_history_limit', { minLines: 5000, raise: true }, true)).toThrow(/read-only/);
+  });
+
+  it('allows only read verbs through raw tmux commands', () => {
+    expect(() => assertToolAllowed('tmux_command', { args: ['list-sessions'] }, true)).not.toThrow();
+    expect(() => assertToolAllowed('tmux_command', { args: ['show-options', '-g'] }, true)).not.toThrow();
+    expect(() => assertToolAllowed('tmux_command', { args: ['display-message', '-p', '#{pid}'] }, true)).not.toThrow();
+    expect(() => assertToolAllowed('tmux_command', { args: ['display-message', 'hello'] }, true)).toThrow(/read-only/);
+    expect(() => assertToolAllowed('tmux_command', { args: ['send-keys', 'ls'] }, true)).toThrow(/read-only/);
+    expect(() => assertToolAllowed('tmux_command', { args: ['ls'], asShell: true }, true)).toThrow(/read-only/);
+    expect(() => assertToolAllowed('tmux_debug_raw', { args: ['kill-server'] }, true)).toThrow(/read-only/);
+  });
+
+  it('blocks chained commands and #() shell jobs', () => {
+    for (const args of [
+      ['list-sessions', ';', 'kill-server'],
+      ['list-sessions', '\\;', 'kill-server'],
+      ['list-sessions;', 'kill-server'],
+      ['display-message', '-p', '#(rm -rf ~)'],
+      ['list-panes', '-F', '#{pane_id} #(id)'],
+    ]) {
+      expect(() => assertToolAllowed('tmux_command', { args }, true)).toThrow(/blocked while the server is read-only/);
+      expect(() => assertToolAllowed('tmux_debug_raw', { args }, true)).toThrow(/read-only/);
+    }
+    expect(() => assertToolAllowed('tmux_display_message', { format: '#(whoami)' }, true)).toThrow(/read-only/);
+    expect(() => assertToolAllowed('tmux_display_message', { format: '#{pane_id}' }, true)).not.toThrow();
+    expect(() => assertToolAllowed('tmux_display_message', { format: '#(whoami)' }, false)).not.toThrow();
+    expect(unsafeTmuxArg(['list-sessions', '-F', '#{session_name};x'])).toBeUndefined();
+  });
+
+  it('allows everything when off', () => {
+    expect(() => assertToolAllowed('tmux_kill_server', { confirm: true }, false)).not.toThrow();
+  });
+
+  it('leaves handlers untouched by default', async () => {
+    const result = await instrumentTool('tmux_send_keys', async () => ({ content: [] }))({ keys: 'ls' }, {});
+    expect(result).toEqual({ content: [] });
+  });
+});
+
+describe('stats', () => {
+  it('counts and snapshots with uptime', () => {
+    let t = 1000;
+    const stats = createStats(() => t);
+    stats.bump('tmuxSpawns');
+    stats.bump('tmuxSpawns');
+    t = 1500;
+    expect(stats.snapshot(2)).toEqual({
+      toolCalls: 0,
+      toolErrors: 0,
+      tmuxSpawns: 2,
+      controlCommands: 0,
+      cacheHits: 0,
+      cacheMisses: 0,
+      activeTasks: 2,
+      uptimeMs: 500,
+    });
+  });
+
+  it('counts tool calls and errors through instrumentTool', async () => {
+    const before = serverStats.snapshot();
+    await instrumentTool('tmux_ping', async () => ({ content: [] }))({}, {});
+    await expect(
+      instrumentTool('tmux_ping', async () => {
+        throw new Error('boom');
+      })({}, {}),
+    ).rejects.toThrow('boom');
+    const after = serverStats.snapshot();
+    expect(after.toolCalls - before.toolCalls).toBe(2);
+    expect(after.toolErrors - before.toolErrors).toBe(1);
+  });
+
+  it('counts socket health cache hits and misses', async () => {
+    const router = createSocketRouter({ now: () => 0 });
+    const before = serverStats.snapshot();
+    await router.pick('local', ['a'], async () => 'ok');
+    await router.pick('local', ['a'], async () => 'ok');
+    const after = serverStats.snapshot();
+    expect(after.cacheMisses - before.cacheMisses).toBe(1);
+    expect(after.cacheHits - before.cacheHits).toBe(1);
+  });
+});
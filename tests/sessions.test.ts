@@ -0,0 +1,284 @@
+import { describe, expect, it } from 'vitest';
+import {
+  assertSessionDetached,
+  buildStateSnapshot,
+  capTotalBytes,
+  killIdleSessions,
+  mergeCaptures,
+  parseSessionActivity,
+  pickDefault,
+  selectIdleSessions,
+  setupSession,
+} from '../src/index.js';
+import { fakePane, recordingRun } from './fakes.js';
+
+describe('parseSessionActivity', () => {
+  it('parses activity and attach timestamps from list-sessions output', () => {
+    const raw = ['collab\t1760400000\t1760399000\t1', 'scratch\t1760300000\t\t0', 'bad line'].join('\n');
+    expect(parseSessionActivity(raw)).toEqual([
+      { name: 'collab', activity: 1760400000, lastAttached: 1760399000, attached: 1 },
+      { name: 'scratch', activity: 1760300000, lastAttached: undefined, attached: 0 },
+    ]);
+  });
+
+  it('handles an empty listing', () => {
+    expect(parseSessionActivity('')).toEqual([]);
+  });
+});
+
+describe('assertSessionDetached', () => {
+  it('rejects writes to a session with an attached client', () => {
+    expect(() => assertSessionDetached('1', 'collab:0.0')).toThrow(
+      'Session of collab:0.0 has 1 attached client; refusing to write',
+    );
+    expect(() => assertSessionDetached('2', '%3')).toThrow('has 2 attached clients');
+  });
+
+  it('allows writes to detached sessions', () => {
+    expect(() => assertSessionDetached('0', 'collab:0.0')).not.toThrow();
+  });
+});
+
+describe('buildStateSnapshot', () => {
+  const fakeIo = (captures: string[]) => ({
+    listSessions: async () => [{ id: '$0', name: 'dev', windows: 1, attached: 0, created: 0 }],
+    listWindows: async () => [
+      { session: 'dev', id: '@0', index: 0, name: 'shell', active: true, panes: 1, flags: '*' },
+    ],
+    listPanes: async () => [
+      { session: 'dev', window: '0', id: '%0', index: 0, active: true, tty: '/dev/pts/1', command: 'bash', title: '' },
+    ],
+    capture: async (target: string) => {
+      captures.push(target);
+      return '$ ';
+    },
+  });
+
+  it('captures the active pane by default', async () => {
+    const captures: string[] = [];
+    const snapshot = await buildStateSnapshot({ session: 'dev' }, fakeIo(captures));
+    expect(captures).toEqual(['%0']);
+    expect(snapshot.capture).toBe('$ ');
+  });
+
+  it('makes no capture calls with metadataOnly', async () => {
+    const captures: string[] = [];
+    const snapshot = await buildStateSnapshot({ session: 'dev', metadataOnly: true }, fakeIo(captures));
+    expect(captures).toEqual([]);
+    expect(snapshot.capture).toBeUndefined();
+    expect(snapshot.panes.map((p) => p.id)).toEqual(['%0']);
+  });
+
+  it("captures the named host's saved default pane", async () => {
+    const saved = { 'web-1': { session: 'dev', pane: '%4' }, 'web-2': { session: 'dev', pane: '%9' } };
+    const snapshotFor = async (host: string) => {
+      const captures: string[] = [];
+      const io = { ...fakeIo(captures), paneDefault: (h?: string) => pickDefault(saved, 'pane', '%0', h, 'web-1') };
+      const snapshot = await buildStateSnapshot({ host, session: 'dev' }, io);
+      return { captures, target: snapshot.captureTarget };
+    };
+    expect(await snapshotFor('web-1')).toEqual({ captures: ['%0'], target: '%0' });
+    expect(await snapshotFor('web-2')).toEqual({ captures: ['%9'], target: '%9' });
+  });
+});
+
+describe('state capture budget', () => {
+  it('caps the combined size of several captures', async () => {
+    const text: Record<string, string> = { '%0': 'a'.repeat(40), '%1': 'b'.repeat(40), '%2': 'c'.repeat(40) };
+    const io = {
+      listSessions: async () => [],
+      listWindows: async () => [],
+      listPanes: async () => [],
+      capture: async (target: string) => text[target],
+    };
+    const snapshot = await buildStateSnapshot(
+      { session: 'dev', captureTargets: ['%0', '%1', '%2'], maxTotalBytes: 60 },
+      io,
+    );
+    expect(snapshot.capture).toBeUndefined();
+    // The 18-byte marker line comes out of the 20 bytes left after %0.
+    expect(snapshot.captures).toEqual([
+      { target: '%0', text: 'a'.repeat(40), droppedBytes: 0, omitted: false },
+      { target: '%1', text: '...[truncated]...\nbb', droppedBytes: 38, omitted: false },
+      { target: '%2', text: '', droppedBytes: 40, omitted: true },
+    ]);
+    const total = snapshot.captures!.reduce((n, c) => n + Buffer.byteLength(c.text), 0);
+    expect(total).toBeLessThanOrEqual(60);
+  });
+
+  it('never exceeds the budget, omitting a capture the marker leaves no room for', () => {
+    const captures = [
+      { target: '%0', text: 'é'.repeat(30) },
+      { target: '%1', text: 'x'.repeat(50) },
+    ];
+    for (const max of [10, 18, 19, 45, 70, 75, 79]) {
+      const capped = capTotalBytes(captures, max);
+      expect(capped.reduce((n, c) => n + Buffer.byteLength(c.text), 0)).toBeLessThanOrEqual(max);
+    }
+    expect(capTotalBytes(captures, 18)[0]).toEqual({ target: '%0', text: '', droppedBytes: 60, omitted: true });
+  });
+
+  it('caps a single default-pane capture including the marker', async () => {
+    const io = {
+      listSessions: async () => [],
+      listWindows: async () => [],
+      listPanes: async () => [fakePane({ id: '%0', active: true })],
+      capture: async () => 'z'.repeat(100),
+    };
+    const snapshot = await buildStateSnapshot({ session: 'dev', maxTotalBytes: 30 }, io);
+    expect(snapshot.capture).toBe(`...[truncated]...\n${'z'.repeat(12)}`);
+    expect(Buffer.byteLength(snapshot.capture!)).toBeLessThanOrEqual(30);
+  });
+
+  it('keeps everything when it fits', () => {
+    const captures = [
+      { target: '%0', text: 'one' },
+      { target: '%1', text: 'two' },
+    ];
+    expect(capTotalBytes(captures, 6).every((c) => c.droppedBytes === 0 && !c.omitted)).toBe(true);
+  });
+});
+
+describe('merged captures', () => {
+  it('concatenates captures under pane headers, in order', () => {
+    expect(
+      mergeCaptures([
+        { target: '%0', text: '$ make', droppedBytes: 0, omitted: false },
+        { target: '%1', text: '', droppedBytes: 0, omitted: false },
+      ]),
+    ).toBe('=== pane %0 ===\n$ make\n\n=== pane %1 ===\n(empty)');
+  });
+
+  it('marks truncated and omitted panes in their headers', () => {
+    const merged = mergeCaptures([
+      { target: '%0', text: '...[truncated]...\nbb', droppedBytes: 20, omitted: false },
+      { target: '%1', text: '', droppedBytes: 40, omitted: true },
+    ]);
+    expect(merged.split('\n')).toEqual([
+      '=== pane %0 (truncated: dropped the first 20 bytes) ===',
+      '...[truncated]...',
+      'bb',
+      '',
+      '=== pane %1 (omitted: maxTotalBytes reached) ===',
+    ]);
+  });
+
+  it('captures every listed pane within the byte budget', async () => {
+    const pane = (id: string, index: number) => fakePane({ id, index, active: index === 0 });
+    const io = {
+      listSessions: async () => [],
+      listWindows: async () => [],
+      listPanes: async () => [pane('%4', 0), pane('%2', 1), pane('%7', 2)],
+      capture: async (target: string) => `out ${target}`,
+    };
+    const snapshot = await buildStateSnapshot({ session: 'dev', allPanes: true, maxTotalBytes: 12 }, io);
+    expect(snapshot.captures!.map((c) => c.target)).toEqual(['%4', '%2', '%7']);
+    expect(snapshot.merged).toBe(
+      '=== pane %4 ===\nout %4\n\n=== pane %2 ===\nout %2\n\n=== pane %7 (omitted: maxTotalBytes reached) ===',
+    );
+  });
+});
+
+describe('setupSession', () => {
+  it('creates the session with its first window, then adds the rest', async () => {
+    let ids = 0;
+    const { calls, run } = recordingRun((args) => {
+      if (args[0] === 'has-session') throw new Error("can't find session: dev");
+      return args.includes('-P') ? `@${ids++}\n` : '';
+    });
+    const result = await setupSession(
+      'dev',
+      [
+        { name: 'edit', cwd: '/src', command: 'vim' },
+        { name: 'logs', panes: 2, layout: 'even-horizontal' },
+      ],
+      { run },
+    );
+    expect(calls).toEqual([
+      ['has-session', '-t', '=dev'],
+      ['new-session', '-d', '-s', 'dev', '-n', 'edit', '-P', '-F', '#{window_id}', '-c', '/src', 'vim'],
+      ['new-window', '-d', '-t', '=dev:', '-n', 'logs', '-P', '-F', '#{window_id}'],
+      ['split-window', '-d', '-t', '@1', '-P', '-F', '#{pane_id}'],
+      ['select-layout', '-t', '@1', 'even-horizontal'],
+    ]);
+    expect(result).toEqual({
+      session: 'dev',
+      sessionCreated: true,
+      windows: [
+        { name: 'edit', windowId: '@0', created: true },
+        { name: 'logs', windowId: '@1', created: true },
+      ],
+    });
+  });
+
+  it('leaves existing windows alone in an existing session', async () => {
+    const { calls, run } = recordingRun((args) => {
+      if (args[0] === 'list-windows') return 'edit\t@3\n';
+      return args.includes('-P') ? '@4' : '';
+    });
+    const result = await setupSession('dev', [{ name: 'edit' }, { name: 'test' }], { run });
+    expect(calls.map((c) => c[0])).toEqual(['has-session', 'list-windows', 'new-window']);
+    expect(result.sessionCreated).toBe(false);
+    expect(result.windows).toEqual([
+      { name: 'edit', windowId: '@3', created: false },
+      { name: 'test', windowId: '@4', created: true },
+    ]);
+  });
+
+  it('rejects an empty window list', async () => {
+    await expect(setupSession('dev', [], { run: async () => '' })).rejects.toThrow(/at least one window/);
+  });
+});
+
+describe('killIdleSessions', () => {
+  const raw = ['build\t1000\t\t0', 'dev\t1900\t1800\t1', 'old-dev\t500\t400\t1', 'scratch\t100\t\t0'].join('\n');
+  const fake = (fail?: string) =>
+    recordingRun((args) => {
+      if (args[0] === 'list-sessions') return raw;
+      if (args[2] === fail) throw new Error("can't find session");
+      return '';
+    });
+
+  it('kills detached sessions idle past the threshold by exact name', async () => {
+    const { calls, run } = fake();
+    const result = await killIdleSessions(run, 600, { nowSec: 2000 });
+    expect(result.killed).toEqual(['build', 'scratch']);
+    expect(result.skippedAttached).toEqual(['old-dev']);
+    expect(calls.slice(1)).toEqual([
+      ['kill-session', '-t', '=build'],
+      ['kill-session', '-t', '=scratch'],
+    ]);
+  });
+
+  it('only lists targets on dryRun', async () => {
+    const { calls, run } = fake();
+    const result = await killIdleSessions(run, 600, { nowSec: 2000, dryRun: true, includeAttached: true });
+    expect(result.idle.map((s) => s.name)).toEqual(['build', 'old-dev', 'scratch']);
+    expect(result.killed).toEqual([]);
+    expect(calls).toHaveLength(1);
+  });
+
+  it('reports sessions that could not be killed', async () => {
+    const { run } = fake('=scratch');
+    const result = await killIdleSessions(run, 600, { nowSec: 2000 });
+    expect(result.killed).toEqual(['build']);
+    expect(result.failed).toEqual([{ name: 'scratch', error: "can't find session" }]);
+  });
+
+  it('does not count our control client as attached', async () => {
+    const { calls, run } = recordingRun((args) => {
+      if (args[0] === 'list-sessions') return raw;
+      if (args[0] === 'list-clients') return 'client-7\told-dev\n/dev/pts/2\tdev';
+      return '';
+    });
+    const result = await killIdleSessions(run, 600, { nowSec: 2000, dryRun: true, excludeClient: 'client-7' });
+    expect(result.idle.map((s) => s.name)).toEqual(['build', 'old-dev', 'scratch']);
+    expect(result.skippedAttached).toEqual([]);
+    expect(calls[1]).toEqual(['list-clients', '-F', '#{client_name}\t#{client_session}']);
+  });
+
+  it('keeps sessions active within the threshold', () => {
+    const sessions = parseSessionActivity(raw);
+    expect(selectIdleSessions(sessions, 2000, false, 2000)).toEqual({ idle: [], skippedAttached: [] });
+  });
+});
@@ -0,0 +1,78 @@
+import { describe, expect, it } from 'vitest';
+import { parseSessionSnapshot, restoreSession, validateSessionSnapshot } from '../src/index.js';
+import { recordingRun } from './fakes.js';
+
+// list-panes -s output for a two-window session: an editor window and a split build window.
+const listPanes = [
+  '1\tedit\tb1c2,200x50,0,0,0\t0\t/home/me/app\tvim',
+  '2\tbuild\t09d1,200x50,0,0{100x50,0,0,1,99x50,101,0,2}\t0\t/home/me/app\tbash',
+  '2\tbuild\t09d1,200x50,0,0{100x50,0,0,1,99x50,101,0,2}\t1\t/tmp/gone\tnode',
+].join('\n');
+
+describe('session snapshots', () => {
+  it('groups panes into windows', () => {
+    expect(parseSessionSnapshot('dev', listPanes)).toEqual({
+      version: 1,
+      session: 'dev',
+      windows: [
+        {
+          index: 1,
+          name: 'edit',
+          layout: 'b1c2,200x50,0,0,0',
+          panes: [{ index: 0, cwd: '/home/me/app', command: 'vim' }],
+        },
+        {
+          index: 2,
+          name: 'build',
+          layout: '09d1,200x50,0,0{100x50,0,0,1,99x50,101,0,2}',
+          panes: [
+            { index: 0, cwd: '/home/me/app', command: 'bash' },
+            { index: 1, cwd: '/tmp/gone', command: 'node' },
+          ],
+        },
+      ],
+    });
+  });
+
+  it('round-trips a two-window session through a fake tmux', async () => {
+    const snapshot = JSON.parse(JSON.stringify(parseSessionSnapshot('dev', listPanes)));
+    let ids = 0;
+    const { calls, run } = recordingRun((args) => {
+      if (args[0] === 'new-session' || args[0] === 'new-window') return `@${++ids}\t%${ids * 10}`;
+      if (args[0] === 'split-window') return `%${ids * 10 + 1}`;
+      return '';
+    });
+    const result = await restoreSession(
+      snapshot,
+      { session: 'dev2', restoreCommands: true },
+      { run, missingDirs: async (dirs) => dirs.filter((d) => d === '/tmp/gone') },
+    );
+    expect(calls).toEqual([
+      ['new-session', '-d', '-s', 'dev2', '-n', 'edit', '-P', '-F', '#{window_id}\t#{pane_id}', '-c', '/home/me/app'],
+      ['select-layout', '-t', '@1', 'b1c2,200x50,0,0,0'],
+      ['send-keys', '-t', '%10', '--', 'vim', 'Enter'],
+      ['new-window', '-d', '-t', 'dev2:', '-n', 'build', '-P', '-F', '#{window_id}\t#{pane_id}', '-c', '/home/me/app'],
+      ['split-window', '-d', '-t', '@2', '-P', '-F', '#{pane_id}'],
+      ['select-layout', '-t', '@2', '09d1,200x50,0,0{100x50,0,0,1,99x50,101,0,2}'],
+      ['send-keys', '-t', '%21', '--', 'node', 'Enter'],
+    ]);
+    expect(result).toEqual({
+      session: 'dev2',
+      windows: 2,
+      notes: ['dev2:build.1: cwd /tmp/gone is missing; started in the default directory'],
+    });
+  });
+
+  it('rejects snapshots without windows', async () => {
+    const io = { run: async () => '', missingDirs: async () => [] };
+    await expect(restoreSession({ version: 1, session: 's', windows: [] }, {}, io)).rejects.toThrow('version 1');
+  });
+
+  it('rejects malformed snapshots before running tmux', async () => {
+    const { calls, run } = recordingRun(() => '');
+    const snapshot = JSON.parse('{"version":1,"session":"s","windows":[{"index":0,"name":"w","panes":[{"cwd":7}]}]}');
+    expect(() => validateSessionSnapshot(snapshot)).toThrow('windows.0.layout');
+    await expect(restoreSession(snapshot, {}, { run, missingDirs: async () => [] })).rejects.toThrow('version 1');
+    expect(calls).toEqual([]);
+  });
+});
@@ -0,0 +1,237 @@
+import { describe, expect, it } from 'vitest';
+import {
+  buildSshArgs,
+  createSocketRouter,
+  isNoServerError,
+  isTransientError,
+  isTransportLost,
+  retryTransient,
+  retryWithServerStart,
+  socketArgs,
+  taskFailureNotice,
+  tmuxError,
+  withServerStartNote,
+} from '../src/index.js';
+
+describe('buildSshArgs', () => {
+  it('adds keepalive options before the host', () => {
+    expect(buildSshArgs('web-1', ['cmd'], 15, 3)).toEqual([
+      '-T',
+      '-o',
+      'ServerAliveInterval=15',
+      '-o',
+      'ServerAliveCountMax=3',
+      'web-1',
+      'cmd',
+    ]);
+  });
+
+  it('omits keepalives when disabled', () => {
+    expect(buildSshArgs('web-1', ['cmd'], 0, 3)).toEqual(['-T', 'web-1', 'cmd']);
+  });
+});
+
+describe('transport loss', () => {
+  it('detects ssh connection failures and reports transport-lost', () => {
+    const err = tmuxError(['capture-pane'], 'web-1', {
+      message: 'failed',
+      stderr: 'Connection to web-1 closed by remote host.',
+      exitCode: 255,
+    });
+    expect(isTransportLost(err)).toBe(true);
+    expect(taskFailureNotice(err)).toContain('Eof: transport-lost');
+    expect(taskFailureNotice(err, 5000)).toMatch(/ retryAfterMs=5000$/);
+  });
+
+  it('does not treat tmux failures as transport loss', () => {
+    const err = tmuxError(['capture-pane'], 'web-1', { message: 'failed', stderr: "can't find pane", exitCode: 1 });
+    expect(isTransportLost(err)).toBe(false);
+    expect(taskFailureNotice(err)).toContain("ssh web-1 tmux capture-pane failed: can't find pane");
+    expect(taskFailureNotice(err, 5000)).not.toContain('retryAfterMs');
+  });
+});
+
+describe('transient retries', () => {
+  const interrupted = () =>
+    tmuxError(['capture-pane'], 'web-1', { message: 'failed', stderr: 'read: Interrupted system call', exitCode: 1 });
+  const dropped = () => tmuxError(['capture-pane'], 'web-1', { message: 'failed', stderr: 'Broken pipe', exitCode: 255 });
+
+  it('classifies interrupted, timed-out and dropped calls as transient', () => {
+    expect(isTransientError(interrupted())).toBe(true);
+    expect(isTransientError(dropped())).toBe(true);
+    expect(isTransientError(new Error('Command timed out after 15000 milliseconds'))).toBe(true);
+    expect(isTransientError(tmuxError(['capture-pane'], undefined, { message: 'f', stderr: "can't find pane" }))).toBe(
+      false,
+    );
+  });
+
+  it('survives a transient error followed by data', async () => {
+    let calls = 0;
+    const read = async () => {
+      calls += 1;
+      if (calls === 1) throw interrupted();
+      return 'data';
+    };
+    expect(await retryTransient(read, { graceMs: 0, delayMs: 0 })).toBe('data');
+    expect(calls).toBe(2);
+  });
+
+  it('keeps retrying within the grace window', async () => {
+    let clock = 0;
+    let calls = 0;
+    const sleeps: number[] = [];
+    const read = async () => {
+      calls += 1;
+      if (calls < 4) throw dropped();
+      return 'back';
+    };
+    const result = await retryTransient(read, {
+      graceMs: 1000,
+      delayMs: 300,
+      now: () => clock,
+      sleep: async (ms) => {
+        sleeps.push(ms);
+        clock += ms;
+      },
+    });
+    expect(result).toBe('back');
+    expect(sleeps).toEqual([300, 300, 300]);
+  });
+
+  it('gives up once the grace window has passed', async () => {
+    let clock = 0;
+    let calls = 0;
+    const read = async () => {
+      calls += 1;
+      throw interrupted();
+    };
+    const sleep = async (ms: number) => {
+      clock += ms;
+    };
+    await expect(retryTransient(read, { graceMs: 500, delayMs: 200, now: () => clock, sleep })).rejects.toThrow(
+      /Interrupted system call/,
+    );
+    expect(calls).toBe(4);
+    calls = 0;
+    await expect(retryTransient(read, { graceMs: 0, delayMs: 0 })).rejects.toThrow(/Interrupted/);
+    expect(calls).toBe(2);
+  });
+
+  it('does not retry other errors', async () => {
+    let calls = 0;
+    const read = async () => {
+      calls += 1;
+      throw tmuxError(['capture-pane'], undefined, { message: 'f', stderr: "can't find pane" });
+    };
+    await expect(retryTransient(read, { graceMs: 1000, delayMs: 0 })).rejects.toThrow(/can't find pane/);
+    expect(calls).toBe(1);
+  });
+});
+
+describe('server auto-start', () => {
+  const noServer = () =>
+    tmuxError(['list-sessions'], 'web-1', {
+      message: 'failed',
+      stderr: 'no server running on /tmp/tmux-1000/default',
+      exitCode: 1,
+    });
+
+  it('starts the server and retries once after "no server running"', async () => {
+    const calls: string[] = [];
+    let attempts = 0;
+    const result = await retryWithServerStart(
+      async () => {
+        calls.push('run');
+        if (attempts++ === 0) throw noServer();
+        return 'ok';
+      },
+      async () => calls.push('start'),
+      true,
+    );
+    expect(result).toEqual({ value: 'ok', started: true });
+    expect(calls).toEqual(['run', 'start', 'run']);
+  });
+
+  it('leaves other failures and disabled auto-start alone', async () => {
+    const start = async () => {
+      throw new Error('should not start');
+    };
+    const other = tmuxError(['capture-pane'], 'web-1', { message: 'failed', stderr: "can't find pane", exitCode: 1 });
+    await expect(retryWithServerStart(async () => Promise.reject(other), start, true)).rejects.toThrow("can't find pane");
+    await expect(retryWithServerStart(async () => Promise.reject(noServer()), start, false)).rejects.toThrow(
+      'no server running',
+    );
+    expect(isNoServerError(noServer())).toBe(true);
+  });
+
+  it('notes the auto-start in the tool result', () => {
+    const result = withServerStartNote({ content: [{ type: 'text', text: 'ok' }] }, ['web-1', 'web-1']);
+    expect(result.content).toEqual([
+      { type: 'text', text: 'ok' },
+      { type: 'text', text: 'Note: tmux server was not running on web-1; started it (MCP_TMUX_AUTO_START_SERVER).' },
+    ]);
+    const untouched = { content: [{ type: 'text', text: 'ok' }] };
+    expect(withServerStartNote(untouched, [])).toBe(untouched);
+  });
+});
+
+describe('socket routing', () => {
+  const down = new Set(['main']);
+  const probes: string[] = [];
+  const probe = async (socket: string) => {
+    probes.push(socket);
+    if (down.has(socket)) throw new Error(`error connecting to /tmp/tmux-0/${socket} (No such file or directory)`);
+    return '4242';
+  };
+
+  it('fails over to a healthy socket when one is down', async () => {
+    const router = createSocketRouter();
+    expect(await router.pick('db1', ['main', 'standby'], probe)).toBe('standby');
+    // Health is cached, so the next call goes straight to the healthy one.
+    probes.length = 0;
+    expect(await router.pick('db1', ['main', 'standby'], probe)).toBe('standby');
+    expect(probes).toEqual([]);
+  });
+
+  it('re-probes once the cached result expires', async () => {
+    let clock = 0;
+    const router = createSocketRouter({ ttlMs: 100, now: () => clock });
+    expect(await router.pick('db1', ['main', 'standby'], probe)).toBe('standby');
+    down.delete('main');
+    clock = 150;
+    expect(await router.pick('db1', ['main', 'standby'], probe)).toBe('main');
+    down.add('main');
+  });
+
+  it('rotates the starting socket with round-robin', async () => {
+    const router = createSocketRouter();
+    const all = ['a', 'b', 'c'];
+    const picks: string[] = [];
+    for (let i = 0; i < 4; i++) picks.push(await router.pick('h', all, probe, 'round-robin'));
+    expect(picks).toEqual(['a', 'b', 'c', 'a']);
+  });
+
+  it('avoids a socket marked down by a failed call', async () => {
+    const router = createSocketRouter();
+    router.markDown('h', 'a', 'no server running');
+    expect(await router.pick('h', ['a', 'b'], probe)).toBe('b');
+  });
+
+  it('errors when every socket is down', async () => {
+    const router = createSocketRouter();
+    await expect(router.pick('db1', ['main'], probe)).rejects.toThrow(/No healthy tmux socket on db1: main/);
+  });
+
+  it('reports each socket from checkAll', async () => {
+    const health = await createSocketRouter().checkAll('db1', ['main', 'standby'], probe);
+    expect(health.map((h) => [h.socket, h.ok])).toEqual([
+      ['main', false],
+      ['standby', true],
+    ]);
+  });
+
+  it('uses -S for socket paths and -L for names', () => {
+    expect(socketArgs('/run/tmux/ha.sock')).toEqual(['-S', '/run/tmux/ha.sock']);
+    expect(socketArgs('standby')).toEqual(['-L', 'standby']);
+  });
+});
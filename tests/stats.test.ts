@@ -0,0 +1,31 @@
+import { describe, expect, it } from 'vitest';
+import { buildPsCommand, parseElapsed, parsePsStats } from '../src/index.js';
+
+describe('pane stats', () => {
+  it('parses ps output into typed fields', () => {
+    expect(parsePsStats(4242, ' 12.5  3.1 204800   01:02:03\n')).toEqual({
+      pid: 4242,
+      cpuPercent: 12.5,
+      memPercent: 3.1,
+      rssKb: 204800,
+      elapsed: '01:02:03',
+    });
+  });
+
+  it('reports a gone pid as undefined', () => {
+    expect(parsePsStats(4242, '__mcp_tmux_pid_gone__')).toBeUndefined();
+    expect(parsePsStats(4242, '')).toBeUndefined();
+  });
+
+  it('parses ps elapsed times', () => {
+    expect(parseElapsed('05:09')).toBe(309);
+    expect(parseElapsed('01:02:03')).toBe(3723);
+    expect(parseElapsed('2-00:00:01')).toBe(172801);
+    expect(parseElapsed('soon')).toBeUndefined();
+  });
+
+  it('builds a ps command for a numeric pid only', () => {
+    expect(buildPsCommand(4242)).toBe('ps -o %cpu=,%mem=,rss=,etime= -p 4242 || echo __mcp_tmux_pid_gone__');
+    expect(() => buildPsCommand(Number('1; rm -rf /'))).toThrow('invalid pane pid');
+  });
+});
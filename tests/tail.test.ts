@@ -0,0 +1,194 @@
+import { describe, expect, it } from 'vitest';
+import {
+  activityWindowLines,
+  appendedLines,
+  createActivityTracker,
+  createChangeDebouncer,
+  createResizeDetector,
+  followStep,
+  parseWatchHooks,
+  resizeNotice,
+  resumePoint,
+  withWatchHooks,
+} from '../src/index.js';
+
+describe('appendedLines', () => {
+  it('returns nothing when the pane did not change', () => {
+    expect(appendedLines('a\nb\nc', 'a\nb\nc')).toEqual([]);
+  });
+
+  it('returns only lines appended after the baseline', () => {
+    expect(appendedLines('a\nb\nc', 'b\nc\nd\ne')).toEqual(['d', 'e']);
+  });
+
+  it('treats a fully scrolled window as all new', () => {
+    expect(appendedLines('a\nb', 'x\ny')).toEqual(['x', 'y']);
+  });
+
+  it('emits the first capture when there is no baseline', () => {
+    expect(appendedLines('', 'x')).toEqual(['x']);
+  });
+});
+
+describe('createChangeDebouncer', () => {
+  it('coalesces rapid changes into one emission after the quiet window', () => {
+    const d = createChangeDebouncer({ debounceMs: 100 });
+    expect(d.offer('a', 0)).toBeUndefined();
+    expect(d.offer('ab', 20)).toBeUndefined();
+    expect(d.offer('abc', 40)).toBeUndefined();
+    expect(d.offer('abc', 90)).toBeUndefined();
+    expect(d.offer('abc', 140)).toBe('abc');
+    expect(d.offer('abc', 300)).toBeUndefined();
+  });
+
+  it('emits after maxLatencyMs even if the pane never goes quiet', () => {
+    const d = createChangeDebouncer({ debounceMs: 100, maxLatencyMs: 250 });
+    const emitted = [0, 50, 100, 150, 200, 250, 300].map((t) => d.offer(`v${t}`, t));
+    expect(emitted.filter((v) => v !== undefined)).toEqual(['v250']);
+  });
+});
+
+describe('followStep', () => {
+  it('never emits a line while it is still being written in line mode', () => {
+    let step = followStep('', 'build started\nCompil', true);
+    step = followStep(step.previous, 'build started\nCompiling', true);
+    expect(step.added).toEqual([]);
+    expect(step.partial).toBe('Compiling');
+    step = followStep(step.previous, 'build started\nCompiling... done\nLink', true);
+    expect(step.added).toEqual(['Compiling... done']);
+    expect(step.partial).toBe('Link');
+  });
+
+  it('emits raw appended lines without line mode', () => {
+    const step = followStep('a\nb', 'a\nb\nc', false);
+    expect(step.added).toEqual(['c']);
+    expect(step.partial).toBe('');
+  });
+});
+
+describe('activity-sized tail window', () => {
+  it('counts the lines written since the sample at the start of the window', () => {
+    const tracker = createActivityTracker();
+    tracker.record('p', 100, 0);
+    tracker.record('p', 140, 20_000);
+    tracker.record('p', 150, 50_000);
+    // 30s window at t=60s: the newest sample at or before t=30s is the one at t=20s.
+    expect(tracker.linesSince('p', 30_000, 175, 60_000)).toBe(35);
+    expect(activityWindowLines(35, 200)).toBe(36);
+  });
+
+  it('falls back to the oldest sample, then to the fixed budget', () => {
+    const tracker = createActivityTracker();
+    expect(tracker.linesSince('p', 10_000, 50, 1_000)).toBeUndefined();
+    expect(activityWindowLines(undefined, 200)).toBe(200);
+    tracker.record('p', 40, 500);
+    expect(tracker.linesSince('p', 10_000, 50, 1_000)).toBe(10);
+  });
+
+  it('clamps to the paging floor and the line limit', () => {
+    expect(activityWindowLines(0, 200)).toBe(20);
+    expect(activityWindowLines(5000, 200)).toBe(200);
+    expect(activityWindowLines(0, 10)).toBe(10);
+  });
+
+  it('forgets samples from before a history clear', () => {
+    const tracker = createActivityTracker();
+    tracker.record('p', 900, 0);
+    tracker.record('p', 3, 5_000);
+    expect(tracker.linesSince('p', 60_000, 12, 10_000)).toBe(9);
+  });
+});
+
+describe('createResizeDetector', () => {
+  it('emits the new size when the dimensions change', () => {
+    const resized = createResizeDetector();
+    // Successive #{pane_width}x#{pane_height} polls: the window is split halfway through.
+    const polls = [
+      { width: 200, height: 50 },
+      { width: 200, height: 50 },
+      { width: 100, height: 50 },
+      { width: 100, height: 50 },
+    ];
+    expect(polls.map(resized)).toEqual([undefined, undefined, { width: 100, height: 50 }, undefined]);
+  });
+
+  it('describes the resize for clients', () => {
+    expect(resizeNotice({ width: 100, height: 50 })).toBe(
+      'Resized: 100x50 (content reflowed; reset any buffered output)',
+    );
+  });
+});
+
+describe('watch hooks', () => {
+  it('parses start/end argv arrays and ignores invalid specs', () => {
+    expect(parseWatchHooks('{"start":["display-message","-t","{target}","agent watching"]}')).toEqual({
+      start: ['display-message', '-t', '{target}', 'agent watching'],
+    });
+    expect(parseWatchHooks(undefined)).toEqual({});
+    expect(parseWatchHooks('{"start":"display-message"}')).toEqual({});
+    expect(parseWatchHooks('not json')).toEqual({});
+  });
+
+  it('runs the start hook before the tail and the end hook after it', async () => {
+    const calls: string[][] = [];
+    const exec = async (args: string[]) => {
+      calls.push(args);
+    };
+    const hooks = { start: ['display-message', '-t', '{target}', 'agent watching'], end: ['display-message', 'bye'] };
+    const result = await withWatchHooks(
+      '%3',
+      undefined,
+      async () => {
+        calls.push(['tail']);
+        return 'out';
+      },
+      hooks,
+      exec,
+    );
+    expect(result).toBe('out');
+    expect(calls).toEqual([['display-message', '-t', '%3', 'agent watching'], ['tail'], ['display-message', 'bye']]);
+  });
+
+  it('does not let a failing hook break the tail', async () => {
+    const exec = async () => {
+      throw new Error('no client');
+    };
+    const hooks = { start: ['display-message', 'hi'], end: ['display-message', 'bye'] };
+    expect(await withWatchHooks('%1', undefined, async () => 'out', hooks, exec)).toBe('out');
+  });
+
+  it('still runs the end hook when the tail fails', async () => {
+    const calls: string[][] = [];
+    const exec = async (args: string[]) => {
+      calls.push(args);
+    };
+    const failing = withWatchHooks(
+      '%1',
+      undefined,
+      async () => {
+        throw new Error('pane gone');
+      },
+      { end: ['display-message', 'bye'] },
+      exec,
+    );
+    await expect(failing).rejects.toThrow('pane gone');
+    expect(calls).toEqual([['display-message', 'bye']]);
+  });
+});
+
+describe('resumePoint', () => {
+  it('starts the first capture at fromLine relative to the visible top', () => {
+    // 500 history lines, cursor on screen row 10: line 505 is screen row 5, line 480 is 20 lines up in history.
+    expect(resumePoint(505, 500, 10, 200)).toEqual({ start: 5, skipped: 0, reset: false });
+    expect(resumePoint(480, 500, 10, 200)).toEqual({ start: -20, skipped: 0, reset: false });
+    expect(resumePoint(510, 500, 10, 200)).toEqual({ start: 10, skipped: 0, reset: false });
+  });
+
+  it('keeps only the newest lines when the resume point is beyond the budget', () => {
+    expect(resumePoint(100, 500, 10, 200)).toEqual({ start: -189, skipped: 211, reset: false });
+  });
+
+  it('restarts at the cursor line when the history shrank below fromLine', () => {
+    expect(resumePoint(900, 10, 3, 200)).toEqual({ start: 3, skipped: 0, reset: true });
+  });
+});
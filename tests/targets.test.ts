@@ -0,0 +1,274 @@
+import { describe, expect, it, vi } from 'vitest';
+import {
+  applyPaneStrategy,
+  broadcastKeys,
+  buildPaneBorderArgs,
+  buildPaneBorderStatusArgs,
+  buildPaneTitleArgs,
+  buildSyncPanesArgs,
+  escapeWindowTarget,
+  findPaneByCommand,
+  namesPane,
+  parsePaneStrategy,
+  validateTarget,
+  windowPaneStrategy,
+} from '../src/index.js';
+import { fakePane, recordingRun } from './fakes.js';
+
+describe('windowPaneStrategy', () => {
+  it('targets the first pane by default', () => {
+    expect(windowPaneStrategy(false)).toBe('first');
+  });
+
+  it('uses the active pane when asked, else the configured strategy', () => {
+    expect(windowPaneStrategy(true, 'last')).toBe('active');
+    expect(windowPaneStrategy(false, 'last')).toBe('last');
+  });
+
+  it('resolves the first pane by index under pane-base-index 1', async () => {
+    const panes = [
+      { id: '%9', index: 2, active: true },
+      { id: '%8', index: 1, active: false },
+    ];
+    expect(await applyPaneStrategy('collab:api.v2', windowPaneStrategy(false), async () => panes)).toBe('%8');
+  });
+});
+
+describe('escapeWindowTarget', () => {
+  it('adds an empty pane part only when the window name has a dot', () => {
+    expect(escapeWindowTarget('collab:api.v2')).toBe('collab:api.v2.');
+    expect(escapeWindowTarget('collab:api.v2.')).toBe('collab:api.v2.');
+    expect(['collab:1', '@3', 'collab'].map(escapeWindowTarget)).toEqual(['collab:1', '@3', 'collab']);
+  });
+});
+
+describe('applyPaneStrategy', () => {
+  // pane-base-index 1, listed out of order, with the middle pane active.
+  const panes = [
+    { id: '%7', index: 3, active: false },
+    { id: '%5', index: 1, active: false },
+    { id: '%6', index: 2, active: true },
+  ];
+  let listed = 0;
+  const list = async () => {
+    listed++;
+    return panes;
+  };
+
+  it('resolves each strategy to a pane id', async () => {
+    expect(await applyPaneStrategy('collab', 'first', list)).toBe('%5');
+    expect(await applyPaneStrategy('collab:1', 'active', list)).toBe('%6');
+    expect(await applyPaneStrategy('@2', 'last', list)).toBe('%7');
+  });
+
+  it('leaves pane targets and an unset strategy alone', async () => {
+    listed = 0;
+    expect(await applyPaneStrategy('%3', 'last', list)).toBe('%3');
+    expect(await applyPaneStrategy('collab:1.2', 'first', list)).toBe('collab:1.2');
+    expect(await applyPaneStrategy('collab', undefined, list)).toBe('collab');
+    expect(listed).toBe(0);
+  });
+
+  it('tells pane targets from session and window targets', () => {
+    expect(['%1', 'dev:0.1', 'dev:.2', 'dev:1.{top}', 'dev:1.!', 'dev:1.+'].every(namesPane)).toBe(true);
+    expect(['dev', 'dev:1', '@4', 'dev:api.v2', 'dev:1.'].some(namesPane)).toBe(false);
+  });
+
+  it('parses the env setting', () => {
+    expect(parsePaneStrategy(' Last ')).toBe('last');
+    expect(parsePaneStrategy(undefined)).toBeUndefined();
+  });
+});
+
+describe('broadcastKeys', () => {
+  const pane = (id: string, index: number) =>
+    fakePane({ session: 'collab', window: '@1', id, index, active: index === 0, command: 'zsh' });
+
+  it('sends the keys to every pane in the window', async () => {
+    const list = vi.fn(async () => [pane('%1', 0), pane('%2', 1), pane('%3', 2)]);
+    const send = vi.fn(async () => {});
+    const results = await broadcastKeys('collab:1', 'clear', true, 'web-1', { list, send });
+    expect(list).toHaveBeenCalledWith('collab:1', 'web-1');
+    expect(send.mock.calls).toEqual([
+      ['%1', 'clear', true, 'web-1'],
+      ['%2', 'clear', true, 'web-1'],
+      ['%3', 'clear', true, 'web-1'],
+    ]);
+    expect(results.every((r) => r.ok)).toBe(true);
+  });
+
+  it('reports per-pane failures without aborting the others', async () => {
+    const send = vi.fn(async (target: string) => {
+      if (target === '%2') throw new Error('pane is dead');
+    });
+    const results = await broadcastKeys('collab:1', 'q', false, undefined, {
+      list: async () => [pane('%1', 0), pane('%2', 1)],
+      send,
+    });
+    expect(results).toEqual([
+      { pane: '%1', ok: true },
+      { pane: '%2', ok: false, error: 'pane is dead' },
+    ]);
+  });
+
+  it('rejects windows without panes', async () => {
+    await expect(
+      broadcastKeys('nope:9', 'x', true, undefined, { list: async () => [], send: async () => {} }),
+    ).rejects.toThrow('No panes found in window nope:9');
+  });
+});
+
+describe('pane titles', () => {
+  it('retitles with select-pane -T', () => {
+    expect(buildPaneTitleArgs('%3', 'agent: build')).toEqual(['select-pane', '-t', '%3', '-T', 'agent: build']);
+    expect(buildPaneTitleArgs(undefined, 'llm-pane')).toEqual(['select-pane', '-T', 'llm-pane']);
+  });
+
+  it('turns pane-border-status on only when it is off', () => {
+    expect(buildPaneBorderStatusArgs('%3', 'off')).toEqual(['set-window-option', '-t', '%3', 'pane-border-status', 'top']);
+    expect(buildPaneBorderStatusArgs('%3', 'bottom')).toBeUndefined();
+  });
+});
+
+describe('buildPaneBorderArgs', () => {
+  it('sets pane-border-status for a window', () => {
+    expect(buildPaneBorderArgs('collab:1', 'bottom')).toEqual([
+      'set-window-option',
+      '-t',
+      'collab:1',
+      'pane-border-status',
+      'bottom',
+    ]);
+  });
+
+  it('chains pane-border-format in the same call', () => {
+    expect(buildPaneBorderArgs('@2', 'top', '#{pane_index}: #{pane_title}')).toEqual([
+      'set-window-option',
+      '-t',
+      '@2',
+      'pane-border-status',
+      'top',
+      ';',
+      'set-window-option',
+      '-t',
+      '@2',
+      'pane-border-format',
+      '#{pane_index}: #{pane_title}',
+    ]);
+  });
+
+  it('validates the status and the window target', () => {
+    expect(() => buildPaneBorderArgs('collab:1', 'left' as 'top')).toThrow(/off, top, or bottom/);
+    expect(() => buildPaneBorderArgs('%3', 'top')).toThrow(/Expected a window target/);
+    expect(() => buildPaneBorderArgs('collab:1.0', 'off')).toThrow(/Expected a window target/);
+  });
+});
+
+describe('buildSyncPanesArgs', () => {
+  it('maps on/off onto set-window-option', () => {
+    expect(buildSyncPanesArgs('collab:1', true)).toEqual(['set-window-option', '-t', 'collab:1', 'synchronize-panes', 'on']);
+    expect(buildSyncPanesArgs('@3', false)).toEqual(['set-window-option', '-t', '@3', 'synchronize-panes', 'off']);
+  });
+
+  it('rejects pane targets', () => {
+    expect(() => buildSyncPanesArgs('collab:1.2', true)).toThrow('Expected a window target');
+    expect(() => buildSyncPanesArgs('%4', true)).toThrow('Expected a window target');
+  });
+
+  it('accepts window names containing dots', () => {
+    expect(buildSyncPanesArgs('collab:api.v2', true)).toEqual([
+      'set-window-option',
+      '-t',
+      'collab:api.v2.',
+      'synchronize-panes',
+      'on',
+    ]);
+  });
+});
+
+describe('findPaneByCommand', () => {
+  const pane = (id: string, command: string) =>
+    fakePane({ session: 'collab', window: '@1', id, index: Number(id.slice(1)), command });
+  const panes = [pane('%1', 'zsh'), pane('%2', 'node'), pane('%3', 'vim'), pane('%4', 'vim')];
+
+  it('returns the unique match', () => {
+    expect(findPaneByCommand(panes, 'node').id).toBe('%2');
+  });
+
+  it('lists what is running when nothing matches', () => {
+    expect(() => findPaneByCommand(panes, 'python')).toThrow('No pane is running "python" (running: zsh, node, vim)');
+  });
+
+  it('lists candidates when ambiguous', () => {
+    expect(() => findPaneByCommand(panes, 'vim')).toThrow(
+      'Several panes are running "vim": %3 (collab:@1.3), %4 (collab:@1.4)',
+    );
+  });
+});
+
+describe('validateTarget', () => {
+  const tmux = (sessions: Record<string, { id: string; index: number; active: boolean }[]>) => {
+    return recordingRun((args) => {
+      const target = args[args.indexOf('-t') + 1];
+      const session = target.replace(/^=/, '').split(':')[0];
+      const pane = Object.entries(sessions)
+        .flatMap(([name, panes]) => panes.map((p) => ({ ...p, session: name })))
+        .find((p) => p.id === target || (p.session === session && (target === session || p.active)));
+      if (args[0] === 'has-session') {
+        if (!sessions[session]) throw new Error(`can't find session: ${session}`);
+        return '';
+      }
+      if (args[0] === 'list-panes') {
+        return (sessions[session] ?? []).map((p) => `${p.id}\t${p.index}\t${p.active ? 1 : 0}`).join('\n');
+      }
+      if (!pane) throw new Error(`can't find pane: ${target}`);
+      return `${pane.session}\t@1\t${pane.id}`;
+    });
+  };
+
+  it('reports a resolvable, existing target with its concrete pane', async () => {
+    const { run, calls } = tmux({ collab: [{ id: '%1', index: 0, active: false }, { id: '%2', index: 1, active: true }] });
+    expect(await validateTarget('collab:0', undefined, run)).toEqual({
+      target: 'collab:0',
+      pane: '%2',
+      session: 'collab',
+      window: '@1',
+      sessionExists: true,
+      paneExists: true,
+    });
+    expect(calls.map((c) => c[0])).toEqual(['has-session', 'display-message']);
+    expect((await validateTarget('collab', 'first', run)).pane).toBe('%1');
+  });
+
+  it('reports a missing session without throwing', async () => {
+    const { run, calls } = tmux({ collab: [{ id: '%1', index: 0, active: true }] });
+    expect(await validateTarget('nope:1', undefined, run)).toEqual({
+      target: 'nope:1',
+      session: 'nope',
+      sessionExists: false,
+      paneExists: false,
+      error: "can't find session: nope",
+    });
+    expect(calls).toHaveLength(1);
+  });
+
+  it('matches the session name exactly', async () => {
+    const { run, calls } = tmux({ dev2: [{ id: '%1', index: 0, active: true }] });
+    expect(await validateTarget('dev:0', undefined, run)).toMatchObject({ sessionExists: false, paneExists: false });
+    expect(calls[0]).toEqual(['has-session', '-t', '=dev']);
+  });
+
+  it('reports a missing pane id', async () => {
+    const { run } = tmux({ collab: [{ id: '%1', index: 0, active: true }] });
+    const check = await validateTarget('%9', undefined, run);
+    expect(check).toMatchObject({ target: '%9', paneExists: false, error: "can't find pane: %9" });
+    expect(check.sessionExists).toBe(false);
+  });
+
+  it('only runs read commands', async () => {
+    const { run, calls } = tmux({ collab: [{ id: '%1', index: 0, active: true }] });
+    await validateTarget('collab', 'last', run);
+    await validateTarget('%1', undefined, run);
+    expect(calls.every((c) => ['has-session', 'list-panes', 'display-message'].includes(c[0]))).toBe(true);
+  });
+});
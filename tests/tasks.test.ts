@@ -0,0 +1,65 @@
+import { describe, expect, it } from 'vitest';
+import { createDeadline, createTaskRegistry, formatTaskList, maxDurationNotice } from '../src/index.js';
+
+describe('task registry', () => {
+  it('keeps client labels alongside the task', () => {
+    let t = 1000;
+    const registry = createTaskRegistry(50, () => t);
+    registry.start({ taskId: 'a', tool: 'tmux_tail_task', label: 'watching build output', target: 'dev:0.1' });
+    registry.start({ taskId: 'b', tool: 'tmux_wait_for_exit_task', target: '%4' });
+    t = 4000;
+    registry.finish('b', 'completed');
+    expect(registry.list()).toEqual([
+      {
+        taskId: 'a',
+        tool: 'tmux_tail_task',
+        label: 'watching build output',
+        target: 'dev:0.1',
+        startedAt: 1000,
+        status: 'working',
+      },
+      { taskId: 'b', tool: 'tmux_wait_for_exit_task', target: '%4', startedAt: 1000, status: 'completed', finishedAt: 4000 },
+    ]);
+    expect(formatTaskList(registry.list(), 6000)).toBe(
+      ['a working tmux_tail_task dev:0.1 5s "watching build output"', 'b completed tmux_wait_for_exit_task %4 3s'].join(
+        '\n',
+      ),
+    );
+  });
+
+  it('drops the oldest finished tasks past the limit', () => {
+    const registry = createTaskRegistry(1);
+    registry.start({ taskId: 'a', tool: 't' });
+    registry.start({ taskId: 'b', tool: 't' });
+    registry.start({ taskId: 'c', tool: 't' });
+    registry.finish('a', 'completed');
+    registry.finish('b', 'failed');
+    expect(registry.list().map((e) => e.taskId)).toEqual(['b', 'c']);
+  });
+});
+
+describe('max task duration', () => {
+  it('expires after the configured time and reports max-duration', () => {
+    let t = 0;
+    const expired = createDeadline(50, () => t);
+    expect(expired()).toBe(false);
+    t = 49;
+    expect(expired()).toBe(false);
+    t = 50;
+    expect(expired()).toBe(true);
+    expect(maxDurationNotice(50)).toMatch(/^Eof: max-duration/);
+  });
+
+  it('suggests a retry backoff on the Eof line', () => {
+    expect(maxDurationNotice(50, 2500)).toMatch(/^Eof: max-duration .* retryAfterMs=2500$/);
+    expect(maxDurationNotice(50)).toMatch(/retryAfterMs=1000$/);
+    expect(maxDurationNotice(50, 0)).not.toContain('retryAfterMs');
+  });
+
+  it('never expires when unbounded', () => {
+    let t = 0;
+    const expired = createDeadline(0, () => t);
+    t = 1e12;
+    expect(expired()).toBe(false);
+  });
+});
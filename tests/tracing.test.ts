@@ -0,0 +1,45 @@
+import { afterEach, describe, expect, it } from 'vitest';
+import { createInMemorySpanExporter, instrumentTool, setSpanExporter, withSpan } from '../src/index.js';
+
+describe('tracing', () => {
+  afterEach(() => setSpanExporter(undefined));
+
+  it('records a server span per tool call with the host attribute', async () => {
+    const exporter = createInMemorySpanExporter();
+    setSpanExporter(exporter);
+    await instrumentTool('tmux_x', async () => ({ content: [] }))({ host: 'web-1' }, { _meta: { 'x-request-id': 'req-1' } });
+    expect(exporter.spans).toHaveLength(1);
+    expect(exporter.spans[0].name).toBe('tool tmux_x');
+    expect(exporter.spans[0].kind).toBe('server');
+    expect(exporter.spans[0].attributes).toEqual({
+      'mcp.tool': 'tmux_x',
+      'mcp.request_id': 'req-1',
+      'tmux.host': 'web-1',
+    });
+    expect(exporter.spans[0].error).toBeUndefined();
+  });
+
+  it('nests child spans under the active tool span', async () => {
+    const exporter = createInMemorySpanExporter();
+    setSpanExporter(exporter);
+    await instrumentTool('tmux_x', () => withSpan('tmux list-panes', 'client', {}, async () => 'ok'))({});
+    const [child, parent] = exporter.spans;
+    expect(child.traceId).toBe(parent.traceId);
+    expect(child.parentSpanId).toBe(parent.spanId);
+    expect(parent.parentSpanId).toBeUndefined();
+  });
+
+  it('marks failed calls and rethrows', async () => {
+    const exporter = createInMemorySpanExporter();
+    setSpanExporter(exporter);
+    const failing = instrumentTool('tmux_x', async () => {
+      throw new Error('boom');
+    });
+    await expect(failing({})).rejects.toThrow('boom');
+    expect(exporter.spans[0].error).toBe('boom');
+  });
+
+  it('is a no-op without an exporter', async () => {
+    expect(await withSpan('noop', 'internal', {}, async () => 42)).toBe(42);
+  });
+});